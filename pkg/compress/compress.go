@@ -0,0 +1,54 @@
+// Package compress holds the block compressors the WAL can store values with.
+//
+// Snappy writes the Snappy block format, a quick LZ77 variant that only
+// finds repeats. Zstd writes standard zstd frames, which any zstd tool can
+// decompress, and reads frames from other zstd encoders too.
+package compress
+
+import (
+	"errors"
+)
+
+var (
+	// ErrCorrupt is returned for compressed data that does not decode
+	ErrCorrupt = errors.New("compress: corrupt input")
+
+	// ErrTooLarge is returned for compressed data that decodes to more than
+	// the caller allowed
+	ErrTooLarge = errors.New("compress: decoded size over limit")
+)
+
+// Codec compresses whole buffers at once
+type Codec interface {
+	// Encode appends the compressed form of src to dst
+	Encode(dst, src []byte) []byte
+
+	// Decode appends the decompressed form of src to dst. It fails with
+	// ErrTooLarge before producing more than max bytes.
+	Decode(dst, src []byte, max int) ([]byte, error)
+}
+
+var (
+	Snappy Codec = snappyCodec{}
+	Zstd Codec = zstdCodec{}
+)
+
+// hashLog is the size of the match finders' hash tables, 2^hashLog entries
+const hashLog = 14
+
+// hash4 maps the four bytes at the start of b to a hash table slot
+func hash4(b []byte) uint32 {
+	u := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	return (u * 0x1e35a7bd) >> (32 - hashLog)
+}
+
+// matchLen returns the length of the common prefix of a and b
+func matchLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := range n {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
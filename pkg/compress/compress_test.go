@@ -0,0 +1,244 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+var codecs = map[string]Codec{"snappy": Snappy, "zstd": Zstd}
+
+// testInputs are buffers that exercise the different ways the codecs store data
+func testInputs() map[string][]byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 300*1024)
+	for i := range random {
+		random[i] = byte(rng.Uint32())
+	}
+
+	// Text made of a small vocabulary, which has both repeats and skewed literals
+	words := []string{"put", "delete", "key", "value", "segment", "anchor", "checkpoint", "0", "1", "2", " ", "\n"}
+	var text []byte
+	for len(text) < 400*1024 {
+		text = append(text, words[rng.IntN(len(words))]...)
+	}
+
+	// Literals across the whole byte range with matches in between
+	var wide []byte
+	for i := 0; len(wide) < 50*1024; i++ {
+		wide = append(wide, byte(rng.Uint32()), byte(rng.Uint32()))
+		if i%4 == 0 && len(wide) > 40 {
+			wide = append(wide, wide[len(wide)/2:len(wide)/2+20]...)
+		}
+	}
+
+	return map[string][]byte{
+		"empty": nil,
+		"one": {42},
+		"short": []byte("hello, hello, hello"),
+		"zeros": make([]byte, 200*1024),
+		"random": random,
+		"text": text,
+		"small text": text[:700],
+		"mid text": text[:5000],
+		"wide": wide,
+		"repeat": bytes.Repeat([]byte("abcdefgh"), 70*1024),
+		"long offsets": append(append(bytes.Clone(random[:100*1024]), text[:1000]...), random[:100*1024]...),
+	}
+}
+
+// Tests that every codec decodes what it encodes, into an existing buffer too
+func TestCodec_RoundTrip(t *testing.T) {
+	for name, codec := range codecs {
+		for input, data := range testInputs() {
+			t.Run(name+"/"+input, func(t *testing.T) {
+				enc := codec.Encode(nil, data)
+				got, err := codec.Decode([]byte("prefix"), enc, len(data))
+				if err != nil {
+					t.Fatalf("Decode failed: %v", err)
+				}
+				if !bytes.Equal(got, append([]byte("prefix"), data...)) {
+					t.Fatalf("Decoded %d bytes that differ from the %d encoded", len(got)-6, len(data))
+				}
+			})
+		}
+	}
+}
+
+// Tests that compressible input comes out smaller and incompressible input barely grows
+func TestCodec_Ratio(t *testing.T) {
+	inputs := testInputs()
+	for name, codec := range codecs {
+		for _, input := range []string{"zeros", "text", "repeat"} {
+			if n := len(codec.Encode(nil, inputs[input])); n > len(inputs[input])/2 {
+				t.Errorf("%s: %s of %d bytes compressed to %d", name, input, len(inputs[input]), n)
+			}
+		}
+		random := inputs["random"]
+		if n := len(codec.Encode(nil, random)); n > len(random)+len(random)/100 {
+			t.Errorf("%s: random data of %d bytes grew to %d", name, len(random), n)
+		}
+	}
+
+	// Huffman coding alone has to beat storing skewed literals as they are
+	text := inputs["text"]
+	if s, z := len(Snappy.Encode(nil, text)), len(Zstd.Encode(nil, text)); z >= s {
+		t.Errorf("zstd compressed text to %d bytes, no better than snappy's %d", z, s)
+	}
+}
+
+// Tests that decoding stops at the limit instead of producing the whole output
+func TestCodec_Limit(t *testing.T) {
+	data := make([]byte, 10000)
+	for name, codec := range codecs {
+		enc := codec.Encode(nil, data)
+		if _, err := codec.Decode(nil, enc, len(data)-1); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s: expected ErrTooLarge, got %v", name, err)
+		}
+		if _, err := codec.Decode(nil, enc, len(data)); err != nil {
+			t.Errorf("%s: decoding at exactly the limit failed: %v", name, err)
+		}
+	}
+}
+
+// Tests that damaged and cut short input is reported as corrupt
+func TestCodec_Corrupt(t *testing.T) {
+	data := testInputs()["text"][:20000]
+	for name, codec := range codecs {
+		enc := codec.Encode(nil, data)
+		for _, n := range []int{0, 1, len(enc) / 2, len(enc) - 1} {
+			if _, err := codec.Decode(nil, enc[:n], len(data)); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("%s: cut to %d bytes, expected ErrCorrupt, got %v", name, n, err)
+			}
+		}
+
+		// Damage may still decode, but never to the original or past the limit
+		for i := 0; i < len(enc); i += 97 {
+			bad := bytes.Clone(enc)
+			bad[i] ^= 0x5A
+			got, err := codec.Decode(nil, bad, len(data))
+			if err == nil && bytes.Equal(got, data) {
+				t.Errorf("%s: damage at %d went unnoticed", name, i)
+			}
+			if err != nil && !errors.Is(err, ErrCorrupt) && !errors.Is(err, ErrTooLarge) {
+				t.Errorf("%s: damage at %d gave %v", name, i, err)
+			}
+		}
+	}
+}
+
+// Tests the snappy decoder against elements written out by hand
+func TestSnappy_Decode(t *testing.T) {
+	tests := []struct {
+		enc []byte
+		want string
+	}{
+		{[]byte{0}, ""},
+		{[]byte{3, 2 << 2, 'a', 'b', 'c'}, "abc"},
+		// A literal, then a copy with a one byte offset overlapping itself
+		{[]byte{10, 1 << 2, 'a', 'b', 4<<2 | 1, 2}, "ababababab"},
+		// A copy with a two byte offset
+		{[]byte{6, 2 << 2, 'x', 'y', 'z', 2<<2 | 2, 3, 0}, "xyzxyz"},
+		// A copy with a four byte offset
+		{[]byte{4, 1 << 2, 'p', 'q', 1<<2 | 3, 2, 0, 0, 0}, "pqpq"},
+		// A literal whose length follows in one byte
+		{append([]byte{64, 60 << 2, 63}, bytes.Repeat([]byte{'z'}, 64)...), string(bytes.Repeat([]byte{'z'}, 64))},
+	}
+
+	for _, tt := range tests {
+		got, err := Snappy.Decode(nil, tt.enc, 1000)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("Decode(%v) = %q (%v), want %q", tt.enc, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range [][]byte{
+		{},
+		{3, 3 << 2, 'a', 'b', 'c'}, // literal past the end of the input
+		{4, 1<<2 | 1, 1}, // copy from before the start
+		{2, 0, 'a'}, // shorter than declared
+		{1, 1 << 2, 'a', 'b'}, // longer than declared
+	} {
+		if _, err := Snappy.Decode(nil, bad, 1000); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Decode(%v): expected ErrCorrupt, got %v", bad, err)
+		}
+	}
+}
+
+// Tests that the zstd frame header declares the content size in the smallest field
+func TestZstd_FrameHeader(t *testing.T) {
+	for _, n := range []int{0, 255, 256, 65791, 65792, 1 << 23, 1<<23 + 1} {
+		data := make([]byte, n)
+		enc := Zstd.Encode(nil, data)
+		got, err := Zstd.Decode(nil, enc, n)
+		if err != nil || len(got) != n {
+			t.Errorf("%d bytes: decoded %d (%v)", n, len(got), err)
+		}
+	}
+}
+
+// Tests that a frame from the reference encoder, with compressed Huffman weights, repeated offsets and a checksum, decodes
+func TestZstd_ReferenceFrame(t *testing.T) {
+	// zstd -19 --check of want
+	frame := []byte{
+		0x28, 0xb5, 0x2f, 0xfd, 0x24, 0x95, 0xcd, 0x02, 0x00, 0x92, 0xc6, 0x12, 0x11, 0xa0, 0xed, 0xcc, 0x56, 0x2e, 0xf5, 0x7a,
+		0xb3, 0xda, 0xc8, 0xab, 0x6a, 0x3c, 0xa3, 0xdf, 0x33, 0x23, 0x60, 0xf4, 0x9e, 0x6e, 0x67, 0x7c, 0xc6, 0x9a, 0xf4, 0x87,
+		0xe9, 0x03, 0x6c, 0x85, 0xef, 0xac, 0xfd, 0xec, 0xd4, 0xe5, 0xb6, 0xff, 0xf8, 0xe3, 0x2c, 0x2f, 0xe7, 0xf4, 0x8f, 0x0f,
+		0xf9, 0xdb, 0x0d, 0x6d, 0xf9, 0x26, 0xa6, 0xca, 0x7c, 0xf6, 0xc6, 0xfd, 0x3b, 0x6c, 0x9d, 0xd3, 0xa7, 0xb6, 0x7e, 0x74,
+		0x95, 0x8a, 0x85, 0xdc, 0xf2, 0xab, 0x48, 0x03, 0x10, 0x06, 0x8a, 0x01, 0xa2, 0x8e, 0xf1, 0x02, 0xbd, 0x07, 0x67, 0x36,
+		0x76, 0xda,
+	}
+	want := "The write-ahead log appends every change before it is applied. The write-ahead log is replayed on start, and every change is applied again in order.\n"
+
+	got, err := Zstd.Decode(nil, frame, 1000)
+	if err != nil || string(got) != want {
+		t.Errorf("Decode = %q (%v), want %q", got, err, want)
+	}
+}
+
+// Fuzzes that every codec round trips any input, and that decoding arbitrary bytes never crashes or passes the limit
+func FuzzCodec(f *testing.F) {
+	f.Add([]byte("hello, hello, hello"))
+	f.Add(bytes.Repeat([]byte{0}, 1000))
+	f.Add(Snappy.Encode(nil, []byte("abcabcabcabc")))
+	f.Add(Zstd.Encode(nil, bytes.Repeat([]byte("abcd"), 100)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for name, codec := range codecs {
+			got, err := codec.Decode(nil, codec.Encode(nil, data), len(data))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s: round trip of %x gave %x (%v)", name, data, got, err)
+			}
+
+			if got, err := codec.Decode(nil, data, 1<<16); err == nil && len(got) > 1<<16 {
+				t.Fatalf("%s: decoded %d bytes, over the limit", name, len(got))
+			}
+		}
+	})
+}
+
+// Compares the speed and output size of the codecs
+func BenchmarkCodec(b *testing.B) {
+	inputs := testInputs()
+	for name, codec := range codecs {
+		for _, input := range []string{"text", "random"} {
+			data := inputs[input][:64*1024]
+			enc := codec.Encode(nil, data)
+			b.Run(fmt.Sprintf("%s/%s/encode", name, input), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for b.Loop() {
+					codec.Encode(nil, data)
+				}
+				b.ReportMetric(float64(len(enc))/float64(len(data)), "ratio")
+			})
+			b.Run(fmt.Sprintf("%s/%s/decode", name, input), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for b.Loop() {
+					codec.Decode(nil, enc, len(data))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package compress
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// The Snappy block format, see https://github.com/google/snappy/blob/main/format_description.txt
+//
+// A uvarint with the decoded length is followed by elements that either
+// carry literal bytes or copy earlier output. The low two bits of the first
+// byte of an element say which kind it is.
+const (
+	snappyLiteral = 0
+	snappyCopy1 = 1 // 3 bits of length, 11 bits of offset
+	snappyCopy2 = 2 // 6 bits of length, 16 bits of offset
+	snappyCopy4 = 3 // 6 bits of length, 32 bits of offset
+)
+
+type snappyCodec struct{}
+
+func (snappyCodec) Encode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+
+	// Positions plus one of earlier four byte sequences, by hash
+	table := make([]int, 1<<hashLog)
+	anchor := 0
+	for i := 0; i+4 <= len(src); {
+		h := hash4(src[i:])
+		cand := table[h] - 1
+		table[h] = i + 1
+		if cand < 0 || [4]byte(src[cand:]) != [4]byte(src[i:]) {
+			i++
+			continue
+		}
+
+		n := 4 + matchLen(src[cand+4:], src[i+4:])
+		dst = appendSnappyLiteral(dst, src[anchor:i])
+		dst = appendSnappyCopy(dst, i-cand, n)
+		i += n
+		anchor = i
+	}
+	return appendSnappyLiteral(dst, src[anchor:])
+}
+
+// appendSnappyLiteral appends an element carrying lit
+func appendSnappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// appendSnappyCopy appends elements copying n bytes from offset bytes back
+func appendSnappyCopy(dst []byte, offset, n int) []byte {
+	for n > 0 {
+		// A single element copies at most 64 bytes
+		l := min(n, 64)
+		switch {
+		case l >= 4 && l <= 11 && offset < 1<<11:
+			dst = append(dst, byte(offset>>8)<<5|byte(l-4)<<2|snappyCopy1, byte(offset))
+		case offset < 1<<16:
+			dst = append(dst, byte(l-1)<<2|snappyCopy2, byte(offset), byte(offset>>8))
+		default:
+			dst = append(dst, byte(l-1)<<2|snappyCopy4)
+			dst = binary.LittleEndian.AppendUint32(dst, uint32(offset))
+		}
+		n -= l
+	}
+	return dst
+}
+
+func (snappyCodec) Decode(dst, src []byte, max int) ([]byte, error) {
+	size, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, fmt.Errorf("%w: bad snappy length", ErrCorrupt)
+	}
+	if size > uint64(max) {
+		return nil, fmt.Errorf("%w: snappy data of %d bytes, at most %d allowed", ErrTooLarge, size, max)
+	}
+	n := int(size)
+
+	start := len(dst)
+	dst = slices.Grow(dst, n)
+	for s := src[k:]; len(s) > 0; {
+		var offset, l int
+		switch s[0] & 3 {
+		case snappyLiteral:
+			l = int(s[0] >> 2)
+			s = s[1:]
+			if l >= 60 {
+				// The length follows in 1 to 4 bytes
+				b := l - 59
+				if len(s) < b {
+					return nil, fmt.Errorf("%w: snappy literal length cut short", ErrCorrupt)
+				}
+				l = 0
+				for i := b - 1; i >= 0; i-- {
+					l = l<<8 | int(s[i])
+				}
+				s = s[b:]
+			}
+			l++
+			if l > len(s) || l > n-(len(dst)-start) {
+				return nil, fmt.Errorf("%w: snappy literal of %d bytes runs past the end", ErrCorrupt, l)
+			}
+			dst = append(dst, s[:l]...)
+			s = s[l:]
+			continue
+
+		case snappyCopy1:
+			if len(s) < 2 {
+				return nil, fmt.Errorf("%w: snappy copy cut short", ErrCorrupt)
+			}
+			l = 4 + int(s[0]>>2&7)
+			offset = int(s[0]>>5)<<8 | int(s[1])
+			s = s[2:]
+
+		case snappyCopy2:
+			if len(s) < 3 {
+				return nil, fmt.Errorf("%w: snappy copy cut short", ErrCorrupt)
+			}
+			l = 1 + int(s[0]>>2)
+			offset = int(binary.LittleEndian.Uint16(s[1:3]))
+			s = s[3:]
+
+		case snappyCopy4:
+			if len(s) < 5 {
+				return nil, fmt.Errorf("%w: snappy copy cut short", ErrCorrupt)
+			}
+			l = 1 + int(s[0]>>2)
+			offset = int(binary.LittleEndian.Uint32(s[1:5]))
+			s = s[5:]
+		}
+
+		written := len(dst) - start
+		if offset <= 0 || offset > written || l > n-written {
+			return nil, fmt.Errorf("%w: snappy copy of %d bytes from %d back at %d", ErrCorrupt, l, offset, written)
+		}
+		dst = appendCopy(dst, offset, l)
+	}
+
+	if len(dst)-start != n {
+		return nil, fmt.Errorf("%w: snappy data decoded to %d bytes, expected %d", ErrCorrupt, len(dst)-start, n)
+	}
+	return dst, nil
+}
+
+// appendCopy appends n bytes copied from offset bytes before the end of
+// dst. The copy may overlap what it appends, repeating the same bytes.
+func appendCopy(dst []byte, offset, n int) []byte {
+	from := len(dst) - offset
+	for n > 0 {
+		c := min(n, offset)
+		dst = append(dst, dst[from:from+c]...)
+		n -= c
+		from += c
+	}
+	return dst
+}
@@ -0,0 +1,202 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"com.github/mune-0/anchor/pkg/compress/internal/zstd"
+)
+
+// The zstd frame format, see RFC 8878. Frames are written with a known
+// content size, no checksum and no dictionary. Inputs up to the largest window
+// the decoder accepts go in a single segment, larger ones declare that window.
+// Blocks are compressed with greedy LZ77 matching, Huffman coded literals and
+// the predefined FSE tables for the sequences, and stored raw or as a run
+// when that comes out smaller.
+const (
+	zstdMagic = 0xFD2FB528
+
+	zstdWindowLog = 23 // 8MB
+	zstdMaxBlock = 128 * 1024 // 128KB
+)
+
+const (
+	blockRaw = 0
+	blockRLE = 1
+	blockCompressed = 2
+)
+
+type zstdCodec struct{}
+
+func (zstdCodec) Encode(dst, src []byte) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, zstdMagic)
+	dst = appendFrameHeader(dst, len(src))
+	if len(src) == 0 {
+		// A frame needs at least one block, an empty last raw block will do
+		return appendBlockHeader(dst, true, blockRaw, 0)
+	}
+
+	e := &zstdEncoder{table: make([]int, 1<<hashLog)}
+	for start := 0; start < len(src); start += zstdMaxBlock {
+		end := min(start+zstdMaxBlock, len(src))
+		dst = e.appendBlock(dst, src, start, end, end == len(src))
+	}
+	return dst
+}
+
+func (zstdCodec) Decode(dst, src []byte, max int) ([]byte, error) {
+	r := io.LimitReader(zstd.NewReader(bytes.NewReader(src)), int64(max)+1)
+	out := bytes.NewBuffer(dst)
+	n, err := out.ReadFrom(r)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: zstd frame cut short", ErrCorrupt)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if n > int64(max) {
+		return nil, fmt.Errorf("%w: zstd data of more than %d bytes", ErrTooLarge, max)
+	}
+	return out.Bytes(), nil
+}
+
+// appendFrameHeader appends the frame header for n bytes of content
+func appendFrameHeader(dst []byte, n int) []byte {
+	single := n <= 1<<zstdWindowLog
+
+	// Frame_Content_Size_Flag picks the size of the content size field. In a
+	// single segment frame 0 means one byte, the two byte field is offset by 256.
+	var flag byte
+	switch {
+	case n < 1<<8:
+		flag = 0
+	case n < 1<<16+256:
+		flag = 1
+	case uint64(n) < 1<<32:
+		flag = 2
+	default:
+		flag = 3
+	}
+
+	descriptor := flag << 6
+	if single {
+		descriptor |= 1 << 5
+	}
+	dst = append(dst, descriptor)
+	if !single {
+		// Window_Descriptor with an exponent of zstdWindowLog-10 and no mantissa
+		dst = append(dst, (zstdWindowLog-10)<<3)
+	}
+
+	switch flag {
+	case 0:
+		dst = append(dst, byte(n))
+	case 1:
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(n-256))
+	case 2:
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(n))
+	default:
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(n))
+	}
+	return dst
+}
+
+// appendBlockHeader appends the header of a block of the given type and size.
+// The size of a run is the number of bytes it repeats.
+func appendBlockHeader(dst []byte, last bool, typ byte, size int) []byte {
+	h := uint32(typ)<<1 | uint32(size)<<3
+	if last {
+		h |= 1
+	}
+	return append(dst, byte(h), byte(h>>8), byte(h>>16))
+}
+
+// sequence is a run of literals followed by a match
+type sequence struct {
+	litLen uint32
+	matchLen uint32
+	offset uint32
+}
+
+// zstdEncoder holds the state carried from one block of a frame to the next
+type zstdEncoder struct {
+	// Positions plus one of earlier four byte sequences, by hash
+	table []int
+
+	seqs []sequence
+	lits []byte
+	body []byte
+}
+
+// appendBlock appends the block holding src[start:end]. Matches may
+// reach back into earlier blocks, but never past end.
+func (e *zstdEncoder) appendBlock(dst, src []byte, start, end int, last bool) []byte {
+	e.seqs = e.seqs[:0]
+	e.lits = e.lits[:0]
+
+	anchor := start
+	for i := start; i+4 <= end; {
+		h := hash4(src[i:])
+		cand := e.table[h] - 1
+		e.table[h] = i + 1
+		if cand < 0 || i-cand > 1<<zstdWindowLog || [4]byte(src[cand:]) != [4]byte(src[i:]) {
+			i++
+			continue
+		}
+
+		n := 4 + matchLen(src[cand+4:end], src[i+4:end])
+		e.lits = append(e.lits, src[anchor:i]...)
+		e.seqs = append(e.seqs, sequence{litLen: uint32(i - anchor), matchLen: uint32(n), offset: uint32(i - cand)})
+		i += n
+		anchor = i
+	}
+	e.lits = append(e.lits, src[anchor:end]...)
+
+	raw := src[start:end]
+	if bytes.Count(raw, raw[:1]) == len(raw) {
+		dst = appendBlockHeader(dst, last, blockRLE, len(raw))
+		return append(dst, raw[0])
+	}
+
+	e.body = appendLiterals(e.body[:0], e.lits)
+	e.body = appendSequences(e.body, e.seqs)
+	if len(e.body) >= len(raw) {
+		dst = appendBlockHeader(dst, last, blockRaw, len(raw))
+		return append(dst, raw...)
+	}
+	dst = appendBlockHeader(dst, last, blockCompressed, len(e.body))
+	return append(dst, e.body...)
+}
+
+// bitWriter packs values into bytes from the least significant bit up, the
+// order zstd's backward bitstreams are written in
+type bitWriter struct {
+	out []byte
+	bits uint64
+	n uint
+}
+
+// add writes the low n bits of v
+func (w *bitWriter) add(v uint64, n uint) {
+	w.bits |= (v & (1<<n - 1)) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.n -= 8
+	}
+}
+
+// close writes the end mark, a single set bit the reader finds the end of
+// the stream by, and returns the bytes written
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits, w.n = 0, 0
+	}
+	return w.out
+}
@@ -0,0 +1,243 @@
+package compress
+
+import (
+	"slices"
+)
+
+const (
+	literalsRaw = 0
+	literalsRLE = 1
+	literalsCompressed = 2
+)
+
+// maxHuffmanBits is the longest Huffman code zstd allows
+const maxHuffmanBits = 11
+
+// maxDirectSymbol is the highest symbol the Huffman weights can be written
+// for without compressing them, four bits a weight
+const maxDirectSymbol = 128
+
+// appendLiterals appends the literals section for lits. They are Huffman
+// coded when that is smaller, as one stream if there are few enough and as
+// four otherwise.
+func appendLiterals(dst, lits []byte) []byte {
+	n := len(lits)
+	if n == 0 {
+		return appendRawLiteralsHeader(dst, literalsRaw, 0)
+	}
+
+	var freq [256]int
+	for _, c := range lits {
+		freq[c]++
+	}
+	maxSym := 255
+	for freq[maxSym] == 0 {
+		maxSym--
+	}
+	if freq[maxSym] == n {
+		dst = appendRawLiteralsHeader(dst, literalsRLE, n)
+		return append(dst, lits[0])
+	}
+
+	if maxSym <= maxDirectSymbol {
+		if out, ok := appendHuffmanLiterals(dst, lits, freq[:maxSym+1]); ok {
+			return out
+		}
+	}
+	dst = appendRawLiteralsHeader(dst, literalsRaw, n)
+	return append(dst, lits...)
+}
+
+// appendRawLiteralsHeader appends the header of a raw or run literals section
+func appendRawLiteralsHeader(dst []byte, typ byte, n int) []byte {
+	switch {
+	case n < 1<<5:
+		return append(dst, byte(n)<<3|typ)
+	case n < 1<<12:
+		return append(dst, byte(n)<<4|1<<2|typ, byte(n>>4))
+	default:
+		return append(dst, byte(n)<<4|3<<2|typ, byte(n>>4), byte(n>>12))
+	}
+}
+
+// appendHuffmanLiterals appends lits Huffman coded with a tree built from
+// freq, which ends at the highest symbol used. It reports false if that does
+// not come out smaller than lits, leaving dst as it was.
+func appendHuffmanLiterals(dst, lits []byte, freq []int) ([]byte, bool) {
+	n := len(lits)
+	lens, tableLog := huffmanLengths(freq)
+	codes := huffmanCodes(lens, tableLog)
+
+	start := len(dst)
+	headerLen := 3
+	switch {
+	case n <= 1023:
+	case n < 1<<14:
+		headerLen = 4
+	default:
+		headerLen = 5
+	}
+	dst = append(dst, make([]byte, headerLen)...)
+
+	// The tree goes first as the weights of all but the last symbol, whose
+	// weight the reader works out from the others
+	count := len(lens) - 1
+	dst = append(dst, byte(127+count))
+	for i := 0; i < count; i += 2 {
+		w := huffmanWeight(lens[i], tableLog) << 4
+		if i+1 < count {
+			w |= huffmanWeight(lens[i+1], tableLog)
+		}
+		dst = append(dst, w)
+	}
+
+	if n <= 1023 {
+		dst = appendHuffmanStream(dst, lits, lens, codes)
+	} else {
+		// Four streams of a quarter of the literals each, the last one
+		// taking what is left, after a table of the sizes of the first three
+		jump := len(dst)
+		dst = append(dst, make([]byte, 6)...)
+		quarter := (n + 3) / 4
+		for i := range 4 {
+			from := len(dst)
+			dst = appendHuffmanStream(dst, lits[min(i*quarter, n):min((i+1)*quarter, n)], lens, codes)
+			if i < 3 {
+				size := len(dst) - from
+				if size > 0xFFFF {
+					return dst[:start], false
+				}
+				dst[jump+2*i] = byte(size)
+				dst[jump+2*i+1] = byte(size >> 8)
+			}
+		}
+	}
+
+	size := len(dst) - start - headerLen
+	if size >= n || n <= 1023 && size > 1023 {
+		return dst[:start], false
+	}
+
+	header := dst[start : start+headerLen]
+	switch headerLen {
+	case 3:
+		h := uint32(literalsCompressed) | uint32(n)<<4 | uint32(size)<<14
+		header[0], header[1], header[2] = byte(h), byte(h>>8), byte(h>>16)
+	case 4:
+		h := uint32(literalsCompressed) | 2<<2 | uint32(n)<<4 | uint32(size)<<18
+		header[0], header[1], header[2], header[3] = byte(h), byte(h>>8), byte(h>>16), byte(h>>24)
+	default:
+		h := uint64(literalsCompressed) | 3<<2 | uint64(n)<<4 | uint64(size)<<22
+		header[0], header[1], header[2], header[3], header[4] = byte(h), byte(h>>8), byte(h>>16), byte(h>>24), byte(h>>32)
+	}
+	return dst, true
+}
+
+// appendHuffmanStream appends one Huffman coded stream of lits. It is read
+// back to front, so the literals are written from the last one to the first.
+func appendHuffmanStream(dst, lits []byte, lens []uint8, codes []uint16) []byte {
+	w := &bitWriter{out: dst}
+	for i := len(lits) - 1; i >= 0; i-- {
+		c := lits[i]
+		w.add(uint64(codes[c]), uint(lens[c]))
+	}
+	return w.close()
+}
+
+// huffmanWeight is the weight zstd describes a code of length l by
+func huffmanWeight(l, tableLog uint8) byte {
+	if l == 0 {
+		return 0
+	}
+	return tableLog + 1 - l
+}
+
+// huffmanLengths returns the Huffman code length of each symbol in freq, at
+// least two of which are used, and the longest of them. Codes longer than
+// maxHuffmanBits are avoided by flattening the frequencies until none are.
+func huffmanLengths(freq []int) ([]uint8, uint8) {
+	freq = slices.Clone(freq)
+	for {
+		lens, longest := huffmanTree(freq)
+		if longest <= maxHuffmanBits {
+			return lens, longest
+		}
+		for i, f := range freq {
+			freq[i] = (f + 1) / 2
+		}
+	}
+}
+
+// huffmanTree returns the code lengths of an unrestricted Huffman tree for freq
+func huffmanTree(freq []int) ([]uint8, uint8) {
+	var syms []int
+	for s, f := range freq {
+		if f > 0 {
+			syms = append(syms, s)
+		}
+	}
+	slices.SortStableFunc(syms, func(a, b int) int { return freq[a] - freq[b] })
+
+	// The leaves come first in order of frequency, then the inner nodes in
+	// the order they are made, which is also by frequency. Each step joins
+	// the two lightest nodes not yet joined, taken from the front of either.
+	n := len(syms)
+	weight := make([]int, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, s := range syms {
+		weight[i] = freq[s]
+	}
+	leaf, inner := 0, n
+	lightest := func(next int) int {
+		if leaf < n && (inner >= next || weight[leaf] <= weight[inner]) {
+			leaf++
+			return leaf - 1
+		}
+		inner++
+		return inner - 1
+	}
+	for k := n; k < 2*n-1; k++ {
+		a := lightest(k)
+		b := lightest(k)
+		weight[k] = weight[a] + weight[b]
+		parent[a], parent[b] = k, k
+	}
+
+	depth := make([]uint8, 2*n-1)
+	for k := 2*n - 3; k >= 0; k-- {
+		depth[k] = depth[parent[k]] + 1
+	}
+
+	lens := make([]uint8, len(freq))
+	var longest uint8
+	for i, s := range syms {
+		lens[s] = depth[i]
+		longest = max(longest, depth[i])
+	}
+	return lens, longest
+}
+
+// huffmanCodes assigns the codes zstd's reader expects for lens: the
+// symbols sorted by weight from the lightest, then by value, take the
+// table entries in turn
+func huffmanCodes(lens []uint8, tableLog uint8) []uint16 {
+	var rank [maxHuffmanBits + 2]uint32
+	var next uint32
+	for w := uint8(1); w <= tableLog; w++ {
+		rank[w] = next
+		for _, l := range lens {
+			if huffmanWeight(l, tableLog) == w {
+				next += 1 << (w - 1)
+			}
+		}
+	}
+
+	codes := make([]uint16, 256)
+	for s, l := range lens {
+		if w := huffmanWeight(l, tableLog); w > 0 {
+			codes[s] = uint16(rank[w] >> (w - 1))
+			rank[w] += 1 << (w - 1)
+		}
+	}
+	return codes
+}
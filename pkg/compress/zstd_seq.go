@@ -0,0 +1,395 @@
+package compress
+
+import (
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// The predefined distributions of the literal length, match length and
+// offset codes, RFC 8878 section 3.1.1.3.2.2. A -1 is a symbol with a
+// probability below 1 in the size of the table.
+var (
+	llNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	mlNorm = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	ofNorm = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	llTable = newFSETable(llNorm, 6)
+	mlTable = newFSETable(mlNorm, 6)
+	ofTable = newFSETable(ofNorm, 5)
+)
+
+// Literal lengths from 16 on and match lengths from 35 on are coded as a
+// baseline plus a number of extra bits, RFC 8878 section 3.1.1.3.2.1.1
+var (
+	llBase = []uint32{16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	llBits = []uint8{1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	mlBase = []uint32{35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	mlBits = []uint8{1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+// fseTable is an FSE encoding table, built the way the reference
+// implementation's FSE_buildCTable builds it
+type fseTable struct {
+	log uint
+	norm []int16
+	states []uint16
+
+	// Per symbol, the bias that gives the number of bits to write for a state
+	// and the offset of the symbol's states in states
+	deltaNbBits []uint32
+	deltaFindState []int32
+}
+
+func newFSETable(norm []int16, log uint) *fseTable {
+	size := 1 << log
+	t := &fseTable{
+		log: log,
+		norm: norm,
+		states: make([]uint16, size),
+		deltaNbBits: make([]uint32, len(norm)),
+		deltaFindState: make([]int32, len(norm)),
+	}
+
+	// Symbols below probability 1 take the last cells, the others are spread
+	// over the rest so that each shows up evenly through the table
+	symbols := make([]int, size)
+	cumul := make([]int, len(norm)+1)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			cumul[s+1] = cumul[s] + 1
+			symbols[high] = s
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + int(n)
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, n := range norm {
+		for range max(n, 0) {
+			symbols[pos] = s
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+
+	for u, s := range symbols {
+		t.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+
+	total := int32(0)
+	for s, n := range norm {
+		switch n {
+		case 0:
+		case -1, 1:
+			t.deltaNbBits[s] = uint32(log<<16) - uint32(size)
+			t.deltaFindState[s] = total - 1
+			total++
+		default:
+			maxBitsOut := uint32(log) - uint32(bits.Len16(uint16(n-1))-1)
+			minStatePlus := uint32(n) << maxBitsOut
+			t.deltaNbBits[s] = maxBitsOut<<16 - minStatePlus
+			t.deltaFindState[s] = total - int32(n)
+			total += int32(n)
+		}
+	}
+	return t
+}
+
+// fseState is the state of one FSE coded stream of symbols
+type fseState struct {
+	t *fseTable
+	state uint32
+}
+
+// init starts the stream on the last symbol to be coded, which takes no bits
+func (s *fseState) init(t *fseTable, sym uint8) {
+	s.t = t
+	nbBitsOut := (t.deltaNbBits[sym] + 1<<15) >> 16
+	value := nbBitsOut<<16 - t.deltaNbBits[sym]
+	s.state = uint32(t.states[int32(value>>nbBitsOut)+t.deltaFindState[sym]])
+}
+
+// encode writes the bits that lead from sym to the symbol coded before it
+func (s *fseState) encode(w *bitWriter, sym uint8) {
+	nbBitsOut := (s.state + s.t.deltaNbBits[sym]) >> 16
+	w.add(uint64(s.state), uint(nbBitsOut))
+	s.state = uint32(s.t.states[int32(s.state>>nbBitsOut)+s.t.deltaFindState[sym]])
+}
+
+// flush writes the state the reader starts from
+func (s *fseState) flush(w *bitWriter) {
+	w.add(uint64(s.state), s.t.log)
+}
+
+// codedSeq is a sequence split into its codes and extra bits
+type codedSeq struct {
+	llCode, mlCode, ofCode uint8
+	llExtra, mlExtra, ofExtra uint32
+	llBits, mlBits uint8
+}
+
+func codeSeq(seq sequence) codedSeq {
+	var c codedSeq
+
+	if seq.litLen < 16 {
+		c.llCode = uint8(seq.litLen)
+	} else {
+		i := baseIndex(llBase, seq.litLen)
+		c.llCode = uint8(16 + i)
+		c.llExtra = seq.litLen - llBase[i]
+		c.llBits = llBits[i]
+	}
+
+	if seq.matchLen < 35 {
+		c.mlCode = uint8(seq.matchLen - 3)
+	} else {
+		i := baseIndex(mlBase, seq.matchLen)
+		c.mlCode = uint8(32 + i)
+		c.mlExtra = seq.matchLen - mlBase[i]
+		c.mlBits = mlBits[i]
+	}
+
+	// Offsets 1 to 3 stand for repeated offsets, which are never used
+	offBase := seq.offset + 3
+	c.ofCode = uint8(bits.Len32(offBase) - 1)
+	c.ofExtra = offBase - 1<<c.ofCode
+	return c
+}
+
+// baseIndex returns the index of the last baseline in base at or below v
+func baseIndex(base []uint32, v uint32) int {
+	i := len(base) - 1
+	for base[i] > v {
+		i--
+	}
+	return i
+}
+
+// writeExtra writes the extra bits of c in the order the reader takes them back
+func (c codedSeq) writeExtra(w *bitWriter) {
+	w.add(uint64(c.llExtra), uint(c.llBits))
+	w.add(uint64(c.mlExtra), uint(c.mlBits))
+	w.add(uint64(c.ofExtra), uint(c.ofCode))
+}
+
+// appendSequences appends the sequences section for seqs. The bitstream is
+// read back to front, so the sequences are written from the last one to the
+// first.
+func appendSequences(dst []byte, seqs []sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7F00:
+		dst = append(dst, byte(n>>8)+128, byte(n))
+	default:
+		dst = append(dst, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	if n == 0 {
+		return dst
+	}
+
+	coded := make([]codedSeq, n)
+	var llCount, mlCount, ofCount [maxMLCode + 1]int
+	for i, seq := range seqs {
+		c := codeSeq(seq)
+		coded[i] = c
+		llCount[c.llCode]++
+		mlCount[c.mlCode]++
+		ofCount[c.ofCode]++
+	}
+
+	// The compression modes byte, then the tables it calls for in the same order
+	modes := len(dst)
+	dst = append(dst, 0)
+	var llT, ofT, mlT *fseTable
+	var mode byte
+	llT, mode, dst = chooseTable(dst, llCount[:maxLLCode+1], n, llTable, maxLLLog)
+	dst[modes] |= mode << 6
+	ofT, mode, dst = chooseTable(dst, ofCount[:maxOFCode+1], n, ofTable, maxOFLog)
+	dst[modes] |= mode << 4
+	mlT, mode, dst = chooseTable(dst, mlCount[:maxMLCode+1], n, mlTable, maxMLLog)
+	dst[modes] |= mode << 2
+
+	w := &bitWriter{out: dst}
+	var ll, ml, of fseState
+	last := coded[n-1]
+	ml.init(mlT, last.mlCode)
+	of.init(ofT, last.ofCode)
+	ll.init(llT, last.llCode)
+	last.writeExtra(w)
+
+	for i := n - 2; i >= 0; i-- {
+		c := coded[i]
+		of.encode(w, c.ofCode)
+		ml.encode(w, c.mlCode)
+		ll.encode(w, c.llCode)
+		c.writeExtra(w)
+	}
+
+	ml.flush(w)
+	of.flush(w)
+	ll.flush(w)
+	return w.close()
+}
+
+// The highest code and the largest table log the reader accepts for each
+// kind of code
+const (
+	maxLLCode = 35
+	maxMLCode = 52
+	maxOFCode = 31
+
+	maxLLLog = 9
+	maxMLLog = 9
+	maxOFLog = 8
+)
+
+const (
+	modePredefined = 0
+	modeRLE = 1
+	modeCompressed = 2
+)
+
+// chooseTable picks how to code symbols with the counts in count, out of n:
+// as a run if they are all the same, with the predefined table, or with a
+// table fitted to them, whichever comes out smaller. It appends what the
+// reader needs to build the table to dst.
+func chooseTable(dst []byte, count []int, n int, predefined *fseTable, maxLog uint) (*fseTable, byte, []byte) {
+	maxSym := len(count) - 1
+	for count[maxSym] == 0 {
+		maxSym--
+	}
+	if count[maxSym] == n {
+		return rleTable(maxSym), modeRLE, append(dst, byte(maxSym))
+	}
+
+	log := tableLog(n, maxSym, maxLog)
+	norm := normalize(count[:maxSym+1], n, log)
+	desc := appendNormCounts(nil, norm, log)
+	if maxSym < len(predefined.deltaNbBits) && tableCost(count, predefined.norm, predefined.log) <= tableCost(count, norm, log)+8*float64(len(desc)) {
+		return predefined, modePredefined, dst
+	}
+	return newFSETable(norm, log), modeCompressed, append(dst, desc...)
+}
+
+// rleTable is a table for a single symbol, which takes no bits at all
+func rleTable(sym int) *fseTable {
+	return &fseTable{
+		states: []uint16{0},
+		deltaNbBits: make([]uint32, sym+1),
+		deltaFindState: make([]int32, sym+1),
+	}
+}
+
+// tableLog picks the size of a table for n symbols up to maxSym, the way
+// the reference implementation's FSE_optimalTableLog does
+func tableLog(n, maxSym int, maxLog uint) uint {
+	log := int(maxLog)
+	if b := bits.Len(uint(n-1)) - 3; b < log {
+		log = b
+	}
+	if b := min(bits.Len(uint(n)), bits.Len(uint(maxSym))+1); b > log {
+		log = b
+	}
+	return uint(min(max(log, 5), int(maxLog)))
+}
+
+// normalize scales count, which sums to n, to a distribution over 1<<log
+// states that gives every symbol used at least one
+func normalize(count []int, n int, log uint) []int16 {
+	size := 1 << log
+	norm := make([]int16, len(count))
+	sum, largest := 0, 0
+	for s, c := range count {
+		if c == 0 {
+			continue
+		}
+		norm[s] = int16(max(1, c*size/n))
+		sum += int(norm[s])
+		if c > count[largest] {
+			largest = s
+		}
+	}
+
+	// Rounding the rare symbols up can overshoot, take that back from the
+	// most likely ones. Whatever is left over goes to the most likely.
+	for ; sum > size; sum-- {
+		norm[slices.Index(norm, slices.Max(norm))]--
+	}
+	norm[largest] += int16(size - sum)
+	return norm
+}
+
+// tableCost estimates the number of bits coding count with norm takes
+func tableCost(count []int, norm []int16, log uint) float64 {
+	var cost float64
+	for s, c := range count {
+		if c == 0 {
+			continue
+		}
+		if s >= len(norm) || norm[s] == 0 {
+			return math.Inf(1)
+		}
+		cost += float64(c) * (float64(log) - math.Log2(float64(max(norm[s], 1))))
+	}
+	return cost
+}
+
+// appendNormCounts appends the description of a distribution, RFC 8878
+// section 4.1.1, as the reference implementation's FSE_writeNCount writes it
+func appendNormCounts(dst []byte, norm []int16, log uint) []byte {
+	w := &bitWriter{out: dst}
+	w.add(uint64(log-5), 4)
+
+	size := 1 << log
+	remaining := size + 1
+	threshold := size
+	nbBits := uint(log + 1)
+	prev0 := false
+	for s := 0; s < len(norm) && remaining > 1; {
+		if prev0 {
+			// A run of unused symbols, counted in twos bits of up to 3
+			start := s
+			for norm[s] == 0 {
+				s++
+			}
+			for ; s >= start+3; start += 3 {
+				w.add(3, 2)
+			}
+			w.add(uint64(s-start), 2)
+		}
+
+		count := int(norm[s])
+		s++
+		limit := 2*threshold - 1 - remaining
+		remaining -= max(count, -count)
+		count++
+		if count >= threshold {
+			count += limit
+		}
+		if count < limit {
+			w.add(uint64(count), nbBits-1)
+		} else {
+			w.add(uint64(count), nbBits)
+		}
+		prev0 = count == 1
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.bits))
+	}
+	return w.out
+}
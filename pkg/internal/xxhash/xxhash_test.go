@@ -0,0 +1,50 @@
+package xxhash
+
+import (
+	"testing"
+)
+
+// Tests against values from the reference implementation
+func TestDigest_KnownValues(t *testing.T) {
+	tests := []struct {
+		input string
+		want uint64
+	}{
+		{"", 0xEF46DB3751D8E999},
+		{"a", 0xD24EC4F1A98C6E5B},
+		{"abc", 0x44BC2CF5AD770999},
+	}
+	for _, tt := range tests {
+		d := New()
+		d.Write([]byte(tt.input))
+		if got := d.Sum64(); got != tt.want {
+			t.Errorf("XXH64(%q) = %#x, want %#x", tt.input, got, tt.want)
+		}
+	}
+}
+
+// Tests that writing in pieces gives the hash of writing everything at once
+func TestDigest_Pieces(t *testing.T) {
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	whole := New()
+	whole.Write(data)
+
+	for size := 1; size <= 65; size++ {
+		d := New()
+		for b := data; len(b) > 0; b = b[min(size, len(b)):] {
+			d.Write(b[:min(size, len(b))])
+		}
+		if d.Sum64() != whole.Sum64() {
+			t.Errorf("Writes of %d bytes hash to %#x, want %#x", size, d.Sum64(), whole.Sum64())
+		}
+
+		d.Reset()
+		d.Write(data)
+		if d.Sum64() != whole.Sum64() {
+			t.Errorf("Hash after Reset is %#x, want %#x", d.Sum64(), whole.Sum64())
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// blockWriter builds one block with prefix-compressed keys and restart points
+type blockWriter struct {
+	restartInterval int
+
+	buf []byte
+	restarts []uint32
+	counter int
+	lastKey []byte
+	entries int
+}
+
+func newBlockWriter(restartInterval int) *blockWriter {
+	return &blockWriter{restartInterval: restartInterval}
+}
+
+// add appends an entry. Keys must arrive in increasing order.
+func (b *blockWriter) add(key, value []byte, kind Kind) {
+	shared := 0
+	if b.counter < b.restartInterval && b.entries > 0 {
+		n := min(len(key), len(b.lastKey))
+		for shared < n && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	} else {
+		// Restart point, the key is stored in full
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, byte(kind))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.counter++
+	b.entries++
+}
+
+// size returns the size the block would have if finished now
+func (b *blockWriter) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+func (b *blockWriter) empty() bool {
+	return b.entries == 0
+}
+
+// finish appends the restart array and returns the block. The slice is only
+// valid until the next call to reset.
+func (b *blockWriter) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, r)
+	}
+	return binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+}
+
+func (b *blockWriter) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:0]
+	b.counter = 0
+	b.lastKey = b.lastKey[:0]
+	b.entries = 0
+}
+
+// blockIter walks the entries of one block. Key is rebuilt from the shared
+// prefixes as the iterator moves, so it is only valid until the next move.
+type blockIter struct {
+	data []byte // entries, without the restart array
+	restarts []byte
+	numRestarts int
+
+	// offset is where the current entry starts, next where the one after it does
+	offset int
+	next int
+
+	key []byte
+	value []byte
+	kind Kind
+	valid bool
+	err error
+}
+
+// newBlockIter checks the restart array of block and returns an unpositioned iterator
+func newBlockIter(block []byte) (*blockIter, error) {
+	if len(block) < 4 {
+		return nil, fmt.Errorf("%w: block too short", ErrCorruption)
+	}
+
+	num := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	if num == 0 || num > (len(block)-4)/4 {
+		return nil, fmt.Errorf("%w: bad restart count %d", ErrCorruption, num)
+	}
+
+	end := len(block) - 4 - 4*num
+	b := &blockIter{
+		data: block[:end],
+		restarts: block[end : len(block)-4],
+		numRestarts: num,
+	}
+	for i := range num {
+		if b.restartOffset(i) >= end {
+			return nil, fmt.Errorf("%w: restart point %d out of range", ErrCorruption, i)
+		}
+	}
+	return b, nil
+}
+
+func (b *blockIter) restartOffset(i int) int {
+	return int(binary.LittleEndian.Uint32(b.restarts[4*i:]))
+}
+
+// seekRestart prepares the iterator to decode from restart point i
+func (b *blockIter) seekRestart(i int) {
+	b.key = b.key[:0]
+	b.next = b.restartOffset(i)
+	b.valid = false
+}
+
+// parseNext decodes the entry at b.next. Returns false at the end of the
+// block or if the entry is malformed, in which case b.err is set.
+func (b *blockIter) parseNext() bool {
+	b.offset = b.next
+	if b.offset >= len(b.data) {
+		b.valid = false
+		return false
+	}
+
+	p := b.data[b.offset:]
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(p)
+		if n <= 0 {
+			return b.corrupt()
+		}
+		fields[i] = v
+		p = p[n:]
+	}
+	shared, unshared, vLen := fields[0], fields[1], fields[2]
+
+	if len(p) < 1 || shared > uint64(len(b.key)) || unshared+vLen > uint64(len(p)-1) {
+		return b.corrupt()
+	}
+
+	b.kind = Kind(p[0])
+	p = p[1:]
+	b.key = append(b.key[:shared], p[:unshared]...)
+	b.value = p[unshared : unshared+vLen : unshared+vLen]
+	b.next = len(b.data) - len(p) + int(unshared+vLen)
+	b.valid = true
+	return true
+}
+
+func (b *blockIter) corrupt() bool {
+	b.err = fmt.Errorf("%w: bad entry at offset %d", ErrCorruption, b.offset)
+	b.valid = false
+	return false
+}
+
+func (b *blockIter) first() bool {
+	b.seekRestart(0)
+	return b.parseNext()
+}
+
+func (b *blockIter) last() bool {
+	b.seekRestart(b.numRestarts - 1)
+	for b.parseNext() && b.next < len(b.data) {
+	}
+	return b.valid
+}
+
+// seekGE moves to the first entry with a key >= target
+func (b *blockIter) seekGE(target []byte) bool {
+	// Find the last restart point whose key is < target, the entry we want
+	// is at or after it
+	i := sort.Search(b.numRestarts, func(i int) bool {
+		b.seekRestart(i)
+		if !b.parseNext() {
+			return true
+		}
+		return bytes.Compare(b.key, target) >= 0
+	})
+	if b.err != nil {
+		return false
+	}
+
+	b.seekRestart(max(i-1, 0))
+	for b.parseNext() {
+		if bytes.Compare(b.key, target) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blockIter) nextEntry() bool {
+	if !b.valid {
+		return false
+	}
+	return b.parseNext()
+}
+
+// prevEntry moves to the entry before the current one. Entries can only be
+// decoded forwards, so this restarts from the closest restart point before it.
+func (b *blockIter) prevEntry() bool {
+	if !b.valid {
+		return false
+	}
+
+	target := b.offset
+	i := sort.Search(b.numRestarts, func(i int) bool {
+		return b.restartOffset(i) >= target
+	}) - 1
+	if i < 0 {
+		b.valid = false
+		return false
+	}
+
+	b.seekRestart(i)
+	for b.parseNext() && b.next < target {
+	}
+	return b.valid
+}
@@ -0,0 +1,66 @@
+package sstable
+
+import "hash/fnv"
+
+// bloomFilter is a Bloom filter over every key in a table. The last byte is
+// the number of probes, the rest is the bit array.
+//
+// Probes use double hashing on the two halves of a 64 bit FNV-1a hash, so
+// each key is only hashed once however many probes there are.
+type bloomFilter []byte
+
+// bloomHash returns the hash a key is added to and looked up in a filter with
+func bloomHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// newBloomFilter builds a filter for keys with the given hashes, using about
+// bitsPerKey bits for each. Ten bits per key give about 1% false positives.
+func newBloomFilter(hashes []uint64, bitsPerKey int) bloomFilter {
+	// ln(2) times bits per key probes minimizes the false positive rate
+	probes := min(max(bitsPerKey*69/100, 1), 30)
+
+	// Tiny filters would see a very high false positive rate
+	nbits := max(len(hashes)*bitsPerKey, 64)
+	nbytes := (nbits + 7) / 8
+	nbits = nbytes * 8
+
+	f := make(bloomFilter, nbytes+1)
+	f[nbytes] = byte(probes)
+	for _, h := range hashes {
+		h1, h2 := uint32(h), uint32(h>>32)
+		for range probes {
+			bit := h1 % uint32(nbits)
+			f[bit/8] |= 1 << (bit % 8)
+			h1 += h2
+		}
+	}
+	return f
+}
+
+// mayContain reports whether key may have been added. False means it was not.
+func (f bloomFilter) mayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+
+	nbits := uint32(len(f)-1) * 8
+	probes := int(f[len(f)-1])
+	if probes > 30 {
+		// Reserved for other filter kinds, which are treated as a match
+		return true
+	}
+
+	h := bloomHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for range probes {
+		bit := h1 % nbits
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h1 += h2
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+// Package sstable implements immutable sorted table files.
+//
+// File layout:
+//
+//	[data block]... [filter block] [meta block] [index block] [footer]
+//
+// Every block is followed by a 4 byte CRC32 (IEEE) of its contents, like WAL records.
+//
+// Data blocks store each key as the prefix it shares with the previous key
+// plus the rest. Every RestartInterval entries a full key is stored instead,
+// and the offsets of those restart points close the block so lookups can
+// binary search them:
+//
+//	Entry: uvarint (Shared) + uvarint (Unshared) + uvarint (VLen) + 1 (Kind) + Key[Shared:] + Value
+//	Block: Entries + NumRestarts x 4 (Restart offset) + 4 (NumRestarts)
+//
+// The index block has the same layout, one entry per data block keyed by its
+// last key with the block's handle as value. The optional filter block is a
+// Bloom filter over every key in the table, found through the handle stored
+// in the meta block. The meta block maps property names to values. The
+// footer is fixed size:
+//
+//	8 (MetaOffset) + 8 (MetaSize) + 8 (IndexOffset) + 8 (IndexSize) + 4 (Version) + 4 (CRC) + 8 (Magic)
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	// Magic marks the end of every table file
+	Magic uint64 = 0x616e63686f727374 // "anchorst"
+
+	// Version is the format written by Writer and the only one Reader accepts
+	Version uint32 = 1
+
+	// FooterSize is the size of the fixed footer at the end of the file
+	FooterSize = 48
+
+	// blockTrailerSize is the CRC following every block
+	blockTrailerSize = 4
+
+	// DefaultBlockSize is the size at which a data block is cut
+	DefaultBlockSize = 4 * 1024
+
+	// DefaultRestartInterval is the number of entries between full keys
+	DefaultRestartInterval = 16
+)
+
+var (
+	// ErrCorruption is returned when a table does not decode or fails a checksum
+	ErrCorruption = errors.New("sstable: data corruption detected")
+
+	// ErrVersion is returned when opening a table written in an unknown format
+	ErrVersion = errors.New("sstable: unsupported format version")
+
+	// ErrNotFound is returned by Get when the table has no entry for the key
+	ErrNotFound = errors.New("sstable: key not found")
+
+	// ErrOutOfOrder is returned by Writer.Add when keys are not strictly increasing
+	ErrOutOfOrder = errors.New("sstable: keys must be added in strictly increasing order")
+)
+
+// Kind tells whether an entry holds a value or marks a deletion
+type Kind uint8
+
+const (
+	KindPut Kind = 0
+	KindDelete Kind = 1
+)
+
+// blockHandle locates a block inside the file. size excludes the trailer.
+type blockHandle struct {
+	offset uint64
+	size uint64
+}
+
+func (h blockHandle) encode() []byte {
+	buf := binary.AppendUvarint(nil, h.offset)
+	return binary.AppendUvarint(buf, h.size)
+}
+
+func decodeHandle(data []byte) (blockHandle, error) {
+	offset, n := binary.Uvarint(data)
+	if n <= 0 {
+		return blockHandle{}, fmt.Errorf("%w: bad block handle", ErrCorruption)
+	}
+	size, m := binary.Uvarint(data[n:])
+	if m <= 0 || n+m != len(data) {
+		return blockHandle{}, fmt.Errorf("%w: bad block handle", ErrCorruption)
+	}
+	return blockHandle{offset: offset, size: size}, nil
+}
+
+// footer is the fixed-size tail of a table pointing at its meta and index blocks
+type footer struct {
+	meta blockHandle
+	index blockHandle
+	version uint32
+}
+
+func (f footer) encode() []byte {
+	buf := make([]byte, FooterSize)
+	binary.LittleEndian.PutUint64(buf[0:8], f.meta.offset)
+	binary.LittleEndian.PutUint64(buf[8:16], f.meta.size)
+	binary.LittleEndian.PutUint64(buf[16:24], f.index.offset)
+	binary.LittleEndian.PutUint64(buf[24:32], f.index.size)
+	binary.LittleEndian.PutUint32(buf[32:36], f.version)
+	binary.LittleEndian.PutUint32(buf[36:40], crc32.ChecksumIEEE(buf[0:36]))
+	binary.LittleEndian.PutUint64(buf[40:48], Magic)
+	return buf
+}
+
+func decodeFooter(buf []byte) (footer, error) {
+	if len(buf) != FooterSize || binary.LittleEndian.Uint64(buf[40:48]) != Magic {
+		return footer{}, fmt.Errorf("%w: bad footer magic", ErrCorruption)
+	}
+
+	if crc32.ChecksumIEEE(buf[0:36]) != binary.LittleEndian.Uint32(buf[36:40]) {
+		return footer{}, fmt.Errorf("%w: footer checksum mismatch", ErrCorruption)
+	}
+
+	f := footer{
+		meta: blockHandle{
+			offset: binary.LittleEndian.Uint64(buf[0:8]),
+			size: binary.LittleEndian.Uint64(buf[8:16]),
+		},
+		index: blockHandle{
+			offset: binary.LittleEndian.Uint64(buf[16:24]),
+			size: binary.LittleEndian.Uint64(buf[24:32]),
+		},
+		version: binary.LittleEndian.Uint32(buf[32:36]),
+	}
+	if f.version != Version {
+		return footer{}, fmt.Errorf("%w: %d", ErrVersion, f.version)
+	}
+	return f, nil
+}
+
+// Options tune how a Writer lays out a table. The zero value uses the defaults.
+type Options struct {
+	// BlockSize is the approximate size of a data block before it is cut
+	BlockSize int
+
+	// RestartInterval is the number of entries between full keys in a block.
+	// Smaller values make lookups decode less at the cost of a larger block.
+	RestartInterval int
+
+	// FilterBitsPerKey is the size of the table's Bloom filter per key.
+	// Ten bits give about 1% false positives. Zero writes no filter.
+	FilterBitsPerKey int
+}
+
+func (o Options) withDefaults() Options {
+	if o.BlockSize <= 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	if o.RestartInterval <= 0 {
+		o.RestartInterval = DefaultRestartInterval
+	}
+	return o
+}
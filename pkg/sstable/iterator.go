@@ -0,0 +1,153 @@
+package sstable
+
+// Iterator walks the entries of a table in key order, in either direction.
+// Deletions are returned like any other entry, check Kind.
+//
+// A fresh iterator is unpositioned, call First, Last, SeekGE or SeekLT
+// before anything else. Each of those and Next and Prev report whether the
+// iterator landed on an entry. An Iterator is not safe for concurrent use,
+// but any number of them can share a Reader.
+type Iterator struct {
+	r *Reader
+
+	// block is the index of the data block data iterates over
+	block int
+	data *blockIter
+	err error
+}
+
+// NewIterator returns an iterator over every entry in the table
+func (r *Reader) NewIterator() *Iterator {
+	return &Iterator{r: r, block: -1}
+}
+
+// First moves to the smallest key
+func (it *Iterator) First() bool {
+	if !it.load(0) {
+		return false
+	}
+	return it.forward(it.data.first())
+}
+
+// Last moves to the largest key
+func (it *Iterator) Last() bool {
+	if !it.load(len(it.r.index) - 1) {
+		return false
+	}
+	return it.backward(it.data.last())
+}
+
+// SeekGE moves to the first key >= key
+func (it *Iterator) SeekGE(key []byte) bool {
+	if !it.load(it.r.findBlock(key)) {
+		return false
+	}
+	return it.forward(it.data.seekGE(key))
+}
+
+// SeekLT moves to the last key < key
+func (it *Iterator) SeekLT(key []byte) bool {
+	if it.SeekGE(key) {
+		return it.Prev()
+	}
+	if it.err != nil {
+		return false
+	}
+	return it.Last()
+}
+
+// Next moves to the following key
+func (it *Iterator) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	return it.forward(it.data.nextEntry())
+}
+
+// Prev moves to the preceding key
+func (it *Iterator) Prev() bool {
+	if !it.Valid() {
+		return false
+	}
+	return it.backward(it.data.prevEntry())
+}
+
+// forward moves on to the start of later blocks until it finds an entry
+func (it *Iterator) forward(ok bool) bool {
+	for !ok {
+		if !it.check() || !it.load(it.block+1) {
+			return false
+		}
+		ok = it.data.first()
+	}
+	return true
+}
+
+// backward moves back to the end of earlier blocks until it finds an entry
+func (it *Iterator) backward(ok bool) bool {
+	for !ok {
+		if !it.check() || !it.load(it.block-1) {
+			return false
+		}
+		ok = it.data.last()
+	}
+	return true
+}
+
+// check picks up a decoding error from the current block
+func (it *Iterator) check() bool {
+	if it.data.err != nil {
+		it.err = it.data.err
+		it.data = nil
+		return false
+	}
+	return true
+}
+
+// load makes block i current. Returns false, leaving the iterator invalid,
+// if there is no such block or it could not be read.
+func (it *Iterator) load(i int) bool {
+	if it.data != nil && i == it.block {
+		return true
+	}
+
+	it.block, it.data = i, nil
+	if i < 0 || i >= len(it.r.index) || it.err != nil {
+		return false
+	}
+
+	data, err := it.r.dataBlock(i)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.data = data
+	return true
+}
+
+// Valid reports whether the iterator is positioned on an entry
+func (it *Iterator) Valid() bool {
+	return it.data != nil && it.data.valid
+}
+
+// Key returns the key at the current position. The slice is only valid until
+// the iterator moves and must not be modified.
+func (it *Iterator) Key() []byte {
+	return it.data.key
+}
+
+// Value returns the value at the current position. The slice must not be modified.
+func (it *Iterator) Value() []byte {
+	return it.data.value
+}
+
+// Kind returns whether the current entry is a value or a deletion
+func (it *Iterator) Kind() Kind {
+	return it.data.kind
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,280 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Reader serves lookups and scans from a table file. The footer, index,
+// meta block and filter are loaded and verified by Open, data blocks are
+// read and verified on demand. A Reader is safe for concurrent use.
+type Reader struct {
+	file *os.File
+	path string
+	size int64
+
+	index []indexEntry
+	meta map[string]string
+	props Properties
+
+	// filter is nil if the table was written without one
+	filter bloomFilter
+	filterHits atomic.Uint64
+	filterMisses atomic.Uint64
+	falsePositives atomic.Uint64
+}
+
+// FilterStats counts how lookups used a table's Bloom filter
+type FilterStats struct {
+	// Hits are lookups the filter let through to a data block,
+	// FalsePositives those of them that found no entry after all
+	Hits uint64
+	FalsePositives uint64
+
+	// Misses are lookups the filter ruled out without reading a data block
+	Misses uint64
+}
+
+// FalsePositiveRate returns the share of lookups for absent keys the filter
+// failed to rule out, or 0 if there were none
+func (s FilterStats) FalsePositiveRate() float64 {
+	if s.FalsePositives+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.FalsePositives) / float64(s.FalsePositives+s.Misses)
+}
+
+// indexEntry points at a data block whose keys are all <= lastKey
+type indexEntry struct {
+	lastKey []byte
+	handle blockHandle
+}
+
+// Open opens the table at path and loads its index
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{file: f, path: path}
+	if err := r.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+func (r *Reader) load() error {
+	stat, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	r.size = stat.Size()
+
+	if r.size < FooterSize {
+		return fmt.Errorf("%w: file too short", ErrCorruption)
+	}
+
+	buf := make([]byte, FooterSize)
+	if _, err := r.file.ReadAt(buf, r.size-FooterSize); err != nil {
+		return err
+	}
+
+	f, err := decodeFooter(buf)
+	if err != nil {
+		return err
+	}
+
+	if err := r.loadIndex(f.index); err != nil {
+		return err
+	}
+	return r.loadMeta(f.meta)
+}
+
+// loadIndex decodes the whole index into memory so lookups can binary search it
+func (r *Reader) loadIndex(h blockHandle) error {
+	data, err := r.readBlock(h)
+	if err != nil || len(data) == 0 {
+		return err
+	}
+
+	it, err := newBlockIter(data)
+	if err != nil {
+		return err
+	}
+
+	for ok := it.first(); ok; ok = it.nextEntry() {
+		handle, err := decodeHandle(it.value)
+		if err != nil {
+			return err
+		}
+		r.index = append(r.index, indexEntry{lastKey: bytes.Clone(it.key), handle: handle})
+	}
+	return it.err
+}
+
+func (r *Reader) loadMeta(h blockHandle) error {
+	data, err := r.readBlock(h)
+	if err != nil {
+		return err
+	}
+
+	it, err := newBlockIter(data)
+	if err != nil {
+		return err
+	}
+
+	r.meta = make(map[string]string)
+	for ok := it.first(); ok; ok = it.nextEntry() {
+		r.meta[string(it.key)] = string(it.value)
+	}
+	if it.err != nil {
+		return it.err
+	}
+
+	for name, field := range map[string]*uint64{
+		propEntries: &r.props.Entries,
+		propDeletions: &r.props.Deletions,
+		propDataBlocks: &r.props.DataBlocks,
+	} {
+		if *field, err = strconv.ParseUint(r.meta[name], 10, 64); err != nil {
+			return fmt.Errorf("%w: bad property %s", ErrCorruption, name)
+		}
+	}
+	r.props.Smallest = []byte(r.meta[propSmallest])
+	r.props.Largest = []byte(r.meta[propLargest])
+
+	if r.props.DataBlocks != uint64(len(r.index)) {
+		return fmt.Errorf("%w: index has %d blocks, expected %d", ErrCorruption, len(r.index), r.props.DataBlocks)
+	}
+
+	if v, ok := r.meta[propFilter]; ok {
+		h, err := decodeHandle([]byte(v))
+		if err != nil {
+			return err
+		}
+		if r.filter, err = r.readBlock(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBlock reads the block at h and verifies its checksum
+func (r *Reader) readBlock(h blockHandle) ([]byte, error) {
+	end := uint64(r.size - FooterSize)
+	if h.offset > end || h.size+blockTrailerSize > end-h.offset {
+		return nil, fmt.Errorf("%w: block at %d overruns the file", ErrCorruption, h.offset)
+	}
+
+	buf := make([]byte, h.size+blockTrailerSize)
+	if _, err := r.file.ReadAt(buf, int64(h.offset)); err != nil {
+		return nil, err
+	}
+
+	data := buf[:h.size]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(buf[h.size:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch in block at %d", ErrCorruption, h.offset)
+	}
+	return data, nil
+}
+
+// dataBlock returns an iterator over data block i
+func (r *Reader) dataBlock(i int) (*blockIter, error) {
+	data, err := r.readBlock(r.index[i].handle)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockIter(data)
+}
+
+// findBlock returns the first block that may hold key, or len(r.index) if key
+// is past the end of the table
+func (r *Reader) findBlock(key []byte) int {
+	return sort.Search(len(r.index), func(i int) bool {
+		return bytes.Compare(r.index[i].lastKey, key) >= 0
+	})
+}
+
+// Get returns the value and kind of the entry for key.
+// Returns ErrNotFound if the table has no entry for it.
+func (r *Reader) Get(key []byte) ([]byte, Kind, error) {
+	i := r.findBlock(key)
+	if i == len(r.index) {
+		return nil, 0, ErrNotFound
+	}
+
+	if r.filter != nil {
+		if !r.filter.mayContain(key) {
+			r.filterMisses.Add(1)
+			return nil, 0, ErrNotFound
+		}
+		r.filterHits.Add(1)
+	}
+
+	value, kind, err := r.get(i, key)
+	if err == ErrNotFound && r.filter != nil {
+		r.falsePositives.Add(1)
+	}
+	return value, kind, err
+}
+
+// get looks key up in data block i
+func (r *Reader) get(i int, key []byte) ([]byte, Kind, error) {
+	it, err := r.dataBlock(i)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !it.seekGE(key) {
+		if it.err != nil {
+			return nil, 0, it.err
+		}
+		return nil, 0, ErrNotFound
+	}
+	if !bytes.Equal(it.key, key) {
+		return nil, 0, ErrNotFound
+	}
+	return it.value, it.kind, nil
+}
+
+// FilterStats returns how Get has used the table's filter so far
+func (r *Reader) FilterStats() FilterStats {
+	return FilterStats{
+		Hits: r.filterHits.Load(),
+		FalsePositives: r.falsePositives.Load(),
+		Misses: r.filterMisses.Load(),
+	}
+}
+
+// Meta returns a property recorded with Writer.SetMeta
+func (r *Reader) Meta(key string) (string, bool) {
+	v, ok := r.meta[key]
+	return v, ok
+}
+
+// Properties returns the statistics recorded when the table was written
+func (r *Reader) Properties() Properties {
+	return r.props
+}
+
+// Path returns the file the table was opened from
+func (r *Reader) Path() string {
+	return r.path
+}
+
+// Size returns the size of the table file in bytes
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,335 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Small blocks and restart intervals so tests cross plenty of boundaries
+var testOptions = Options{BlockSize: 256, RestartInterval: 4}
+
+// writeTable writes n sequential keys, every third one as a deletion
+func writeTable(t *testing.T, path string, n int) {
+	t.Helper()
+
+	w, err := NewWriter(path, testOptions)
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	for i := range n {
+		kind := KindPut
+		if i%3 == 0 {
+			kind = KindDelete
+		}
+		if err := w.Add([]byte(fmt.Sprintf("key-%05d", i)), []byte(fmt.Sprintf("value-%d", i)), kind); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	w.SetMeta("answer", "42")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+// Tests point lookups across many blocks, including misses and deletions
+func TestSSTable_Get(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sst")
+	writeTable(t, path, 2000)
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	for i := range 2000 {
+		value, kind, err := r.Get([]byte(fmt.Sprintf("key-%05d", i)))
+		if err != nil {
+			t.Fatalf("Get %d failed: %v", i, err)
+		}
+		if want := fmt.Sprintf("value-%d", i); string(value) != want {
+			t.Errorf("Get %d: expected %q, got %q", i, want, value)
+		}
+		if (kind == KindDelete) != (i%3 == 0) {
+			t.Errorf("Get %d: unexpected kind %d", i, kind)
+		}
+	}
+
+	for _, key := range []string{"a", "key-00000x", "zzz"} {
+		if _, _, err := r.Get([]byte(key)); err != ErrNotFound {
+			t.Errorf("Get %q: expected ErrNotFound, got %v", key, err)
+		}
+	}
+
+	if v, ok := r.Meta("answer"); !ok || v != "42" {
+		t.Errorf("Expected meta answer=42, got %q %v", v, ok)
+	}
+
+	props := r.Properties()
+	if props.Entries != 2000 || props.Deletions != 667 || props.DataBlocks < 10 {
+		t.Errorf("Unexpected properties: %+v", props)
+	}
+	if string(props.Smallest) != "key-00000" || string(props.Largest) != "key-01999" {
+		t.Errorf("Unexpected key range %s..%s", props.Smallest, props.Largest)
+	}
+}
+
+// Tests that shared key prefixes are not stored again
+func TestSSTable_PrefixCompression(t *testing.T) {
+	dir := t.TempDir()
+	prefix := string(make([]byte, 100))
+
+	size := func(interval int) int64 {
+		path := filepath.Join(dir, fmt.Sprintf("%d.sst", interval))
+		w, _ := NewWriter(path, Options{RestartInterval: interval})
+		for i := range 1000 {
+			w.Add([]byte(fmt.Sprintf("%s%05d", prefix, i)), nil, KindPut)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		stat, _ := os.Stat(path)
+		return stat.Size()
+	}
+
+	full, compressed := size(1), size(16)
+	if compressed*4 > full {
+		t.Errorf("Expected prefix compression to shrink the table, got %d vs %d bytes", compressed, full)
+	}
+}
+
+// Tests iteration in both directions and seeking between keys
+func TestSSTable_Iterator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sst")
+	writeTable(t, path, 1000)
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	it := r.NewIterator()
+	count := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if want := fmt.Sprintf("key-%05d", count); string(it.Key()) != want {
+			t.Fatalf("Expected %s, got %s", want, it.Key())
+		}
+		count++
+	}
+	if count != 1000 || it.Err() != nil {
+		t.Fatalf("Expected 1000 entries, got %d (%v)", count, it.Err())
+	}
+
+	for ok := it.Last(); ok; ok = it.Prev() {
+		count--
+		if want := fmt.Sprintf("key-%05d", count); string(it.Key()) != want {
+			t.Fatalf("Expected %s, got %s", want, it.Key())
+		}
+	}
+	if count != 0 {
+		t.Errorf("Reverse iteration stopped at %d", count)
+	}
+
+	if !it.SeekGE([]byte("key-00500x")) || string(it.Key()) != "key-00501" {
+		t.Errorf("SeekGE landed on %q", it.Key())
+	}
+	if !it.SeekLT([]byte("key-00500x")) || string(it.Key()) != "key-00500" {
+		t.Errorf("SeekLT landed on %q", it.Key())
+	}
+	if !it.SeekLT([]byte("zzz")) || string(it.Key()) != "key-00999" {
+		t.Errorf("SeekLT past the end landed on %q", it.Key())
+	}
+	if it.SeekGE([]byte("zzz")) || it.SeekLT([]byte("a")) {
+		t.Error("Expected seeks outside the table to be invalid")
+	}
+}
+
+// Tests seeks at random targets against a sorted list of random keys
+func TestSSTable_RandomSeek(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sst")
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	keys := make([]string, 0, 3000)
+	seen := make(map[string]bool)
+	for len(keys) < cap(keys) {
+		k := fmt.Sprintf("%x", rng.Uint64N(1<<(4*rng.IntN(8)+8)))
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	w, _ := NewWriter(path, testOptions)
+	for _, k := range keys {
+		w.Add([]byte(k), []byte("v"+k), KindPut)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	it := r.NewIterator()
+	for range 2000 {
+		target := fmt.Sprintf("%x", rng.Uint64N(1<<32))
+		i, _ := slices.BinarySearch(keys, target)
+
+		if ok := it.SeekGE([]byte(target)); ok != (i < len(keys)) || (ok && string(it.Key()) != keys[i]) {
+			t.Fatalf("SeekGE %s: expected index %d, got %q", target, i, it.Key())
+		}
+		ok := it.SeekLT([]byte(target))
+		if ok != (i > 0) || (ok && string(it.Key()) != keys[i-1]) {
+			t.Fatalf("SeekLT %s: expected index %d, got %q", target, i-1, it.Key())
+		}
+		if ok && string(it.Value()) != "v"+string(it.Key()) {
+			t.Fatalf("Wrong value %q for %q", it.Value(), it.Key())
+		}
+	}
+}
+
+// Tests that a table without entries can be written and read
+func TestSSTable_Empty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sst")
+
+	w, _ := NewWriter(path, Options{})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	if _, _, err := r.Get([]byte("a")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if it := r.NewIterator(); it.First() || it.Last() {
+		t.Error("Expected no entries")
+	}
+}
+
+// Tests that keys must be added in order
+func TestSSTable_OutOfOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sst")
+
+	w, _ := NewWriter(path, Options{})
+	w.Add([]byte("b"), nil, KindPut)
+	if err := w.Add([]byte("a"), nil, KindPut); err != ErrOutOfOrder {
+		t.Errorf("Expected ErrOutOfOrder, got %v", err)
+	}
+	if err := w.Add([]byte("b"), nil, KindPut); err != ErrOutOfOrder {
+		t.Errorf("Expected ErrOutOfOrder for a duplicate, got %v", err)
+	}
+	w.Abort()
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Expected Abort to remove the temporary file")
+	}
+}
+
+// Tests that damage anywhere in the file is reported as corruption
+func TestSSTable_Corruption(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+	writeTable(t, path, 500)
+	clean, _ := os.ReadFile(path)
+
+	damage := func(at int) error {
+		data := slices.Clone(clean)
+		data[at] ^= 0x01
+		os.WriteFile(path, data, 0644)
+
+		r, err := Open(path)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		it := r.NewIterator()
+		for ok := it.First(); ok; ok = it.Next() {
+		}
+		return it.Err()
+	}
+
+	// A data block, the footer's checksummed fields and its magic
+	for _, at := range []int{10, len(clean) - FooterSize + 3, len(clean) - 1} {
+		if err := damage(at); !errors.Is(err, ErrCorruption) {
+			t.Errorf("Byte %d: expected ErrCorruption, got %v", at, err)
+		}
+	}
+
+	// A well-formed footer announcing a format this reader does not know
+	data := slices.Clone(clean)
+	foot := data[len(data)-FooterSize:]
+	binary.LittleEndian.PutUint32(foot[32:36], Version+1)
+	binary.LittleEndian.PutUint32(foot[36:40], crc32.ChecksumIEEE(foot[0:36]))
+	os.WriteFile(path, data, 0644)
+
+	if _, err := Open(path); !errors.Is(err, ErrVersion) {
+		t.Errorf("Expected ErrVersion, got %v", err)
+	}
+}
+
+// Tests that the filter never hides a key and rules out most absent ones
+func TestSSTable_Filter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sst")
+
+	w, _ := NewWriter(path, Options{FilterBitsPerKey: 10})
+	for i := range 10000 {
+		w.Add([]byte(fmt.Sprintf("key-%05d", i*2)), nil, KindPut)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	for i := range 10000 {
+		if _, _, err := r.Get([]byte(fmt.Sprintf("key-%05d", i*2))); err != nil {
+			t.Fatalf("Get key-%05d failed: %v", i*2, err)
+		}
+	}
+	// Odd keys fall between the ones in the table, so only the filter can rule them out
+	for i := range 9999 {
+		if _, _, err := r.Get([]byte(fmt.Sprintf("key-%05d", i*2+1))); err != ErrNotFound {
+			t.Fatalf("Expected ErrNotFound for key-%05d, got %v", i*2+1, err)
+		}
+	}
+
+	stats := r.FilterStats()
+	if stats.Hits < 10000 || stats.Hits != 10000+stats.FalsePositives || stats.Misses+stats.FalsePositives != 9999 {
+		t.Errorf("Inconsistent filter stats %+v", stats)
+	}
+	if rate := stats.FalsePositiveRate(); rate > 0.02 {
+		t.Errorf("Expected about 1%% false positives, got %.2f%%", rate*100)
+	}
+
+	// Without a filter every lookup reads a block
+	path = filepath.Join(t.TempDir(), "plain.sst")
+	writeTable(t, path, 100)
+	plain, _ := Open(path)
+	defer plain.Close()
+	plain.Get([]byte("key-00001x"))
+	if stats := plain.FilterStats(); stats != (FilterStats{}) {
+		t.Errorf("Expected no filter stats, got %+v", stats)
+	}
+}
@@ -0,0 +1,220 @@
+package sstable
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// Property names reserved for Properties in the meta block
+const (
+	propEntries = "sstable.entries"
+	propDeletions = "sstable.deletions"
+	propDataBlocks = "sstable.data-blocks"
+	propSmallest = "sstable.smallest"
+	propLargest = "sstable.largest"
+
+	// propFilter holds the handle of the filter block, if there is one
+	propFilter = "sstable.filter"
+)
+
+// Properties describe a table as a whole. Writer records them in the meta block.
+type Properties struct {
+	// Entries is the number of entries, Deletions how many of those are tombstones
+	Entries uint64
+	Deletions uint64
+
+	DataBlocks uint64
+
+	// Smallest and Largest are the first and last keys in the table
+	Smallest []byte
+	Largest []byte
+}
+
+// Writer builds a table file from entries added in ascending key order.
+// Nothing is visible at path until Close returns, the table is written to
+// a temporary file first and renamed into place once it is on disk.
+type Writer struct {
+	path string
+	opts Options
+	file *os.File
+	writer *bufio.Writer
+	offset uint64
+
+	data *blockWriter
+	index *blockWriter
+	props Properties
+	meta map[string]string
+
+	// hashes of every key added, for the filter
+	hashes []uint64
+}
+
+// NewWriter creates a table that will be installed at path by Close
+func NewWriter(path string, opts Options) (*Writer, error) {
+	opts = opts.withDefaults()
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		path: path,
+		opts: opts,
+		file: f,
+		writer: bufio.NewWriterSize(f, 64*1024),
+		data: newBlockWriter(opts.RestartInterval),
+		// Index entries are binary searched directly, every one is a restart point
+		index: newBlockWriter(1),
+		meta: make(map[string]string),
+	}, nil
+}
+
+// Add appends an entry. Keys must be strictly increasing.
+func (w *Writer) Add(key, value []byte, kind Kind) error {
+	if w.props.Entries > 0 && bytes.Compare(key, w.props.Largest) <= 0 {
+		return ErrOutOfOrder
+	}
+
+	if w.props.Entries == 0 {
+		w.props.Smallest = bytes.Clone(key)
+	}
+	w.props.Largest = append(w.props.Largest[:0], key...)
+	w.props.Entries++
+	if w.opts.FilterBitsPerKey > 0 {
+		w.hashes = append(w.hashes, bloomHash(key))
+	}
+	if kind == KindDelete {
+		w.props.Deletions++
+	}
+
+	w.data.add(key, value, kind)
+	if w.data.size() >= w.opts.BlockSize {
+		return w.finishBlock()
+	}
+	return nil
+}
+
+// SetMeta records a property of the table, readable with Reader.Meta.
+// Names starting with "sstable." are reserved.
+func (w *Writer) SetMeta(key, value string) {
+	w.meta[key] = value
+}
+
+// Count returns the number of entries added so far
+func (w *Writer) Count() int {
+	return int(w.props.Entries)
+}
+
+// EstimatedSize returns roughly how large the file is so far
+func (w *Writer) EstimatedSize() uint64 {
+	return w.offset + uint64(w.data.size())
+}
+
+// finishBlock writes the pending data block and indexes it under its last key
+func (w *Writer) finishBlock() error {
+	if w.data.empty() {
+		return nil
+	}
+
+	handle, err := w.writeBlock(w.data.finish())
+	if err != nil {
+		return err
+	}
+
+	w.index.add(w.data.lastKey, handle.encode(), KindPut)
+	w.data.reset()
+	w.props.DataBlocks++
+	return nil
+}
+
+// writeBlock writes data followed by its checksum
+func (w *Writer) writeBlock(data []byte) (blockHandle, error) {
+	handle := blockHandle{offset: w.offset, size: uint64(len(data))}
+
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	n, err := w.writer.Write(data)
+	w.offset += uint64(n)
+	return handle, err
+}
+
+// Close writes the filter, meta block, index and footer, syncs the file and moves
+// it to its final path
+func (w *Writer) Close() error {
+	if err := w.finish(); err != nil {
+		w.Abort()
+		return err
+	}
+	return os.Rename(w.path+".tmp", w.path)
+}
+
+func (w *Writer) finish() error {
+	if err := w.finishBlock(); err != nil {
+		return err
+	}
+
+	w.meta[propEntries] = strconv.FormatUint(w.props.Entries, 10)
+	w.meta[propDeletions] = strconv.FormatUint(w.props.Deletions, 10)
+	w.meta[propDataBlocks] = strconv.FormatUint(w.props.DataBlocks, 10)
+	w.meta[propSmallest] = string(w.props.Smallest)
+	w.meta[propLargest] = string(w.props.Largest)
+
+	if len(w.hashes) > 0 {
+		handle, err := w.writeBlock(newBloomFilter(w.hashes, w.opts.FilterBitsPerKey))
+		if err != nil {
+			return err
+		}
+		w.meta[propFilter] = string(handle.encode())
+	}
+
+	keys := make([]string, 0, len(w.meta))
+	for k := range w.meta {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	meta := newBlockWriter(w.opts.RestartInterval)
+	for _, k := range keys {
+		meta.add([]byte(k), []byte(w.meta[k]), KindPut)
+	}
+
+	metaHandle, err := w.writeBlock(meta.finish())
+	if err != nil {
+		return err
+	}
+
+	// A table without entries still gets a valid, empty index
+	var indexHandle blockHandle
+	if w.index.empty() {
+		indexHandle, err = w.writeBlock(nil)
+	} else {
+		indexHandle, err = w.writeBlock(w.index.finish())
+	}
+	if err != nil {
+		return err
+	}
+
+	f := footer{meta: metaHandle, index: indexHandle, version: Version}
+	if _, err := w.writer.Write(f.encode()); err != nil {
+		return err
+	}
+
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// Abort discards the table being written
+func (w *Writer) Abort() {
+	w.file.Close()
+	os.Remove(w.path + ".tmp")
+}
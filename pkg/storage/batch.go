@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"strings"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// WriteBatch collects puts and deletes that Store.Apply commits atomically.
+// Operations are applied in the order they were added, so a later operation
+// on the same key wins. The zero value is an empty batch ready to use.
+type WriteBatch struct {
+	ops []*wal.LogEntry
+}
+
+// Put adds a put of key to the batch. The value is copied.
+func (b *WriteBatch) Put(key string, value []byte) {
+	// Defensive copy
+	snapshot := make([]byte, len(value))
+	copy(snapshot, value)
+
+	b.ops = append(b.ops, &wal.LogEntry{
+		Op: wal.OpPut,
+		Key: []byte(key),
+		Value: snapshot,
+	})
+}
+
+// Delete adds a delete of key to the batch
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, &wal.LogEntry{
+		Op: wal.OpDelete,
+		Key: []byte(key),
+	})
+}
+
+// Len returns the number of operations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.ops = nil
+}
+
+// validate checks every key in the batch the same way Put and Delete do
+func (b *WriteBatch) validate() error {
+	for _, op := range b.ops {
+		if strings.TrimSpace(string(op.Key)) == "" {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
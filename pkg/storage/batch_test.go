@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// Test that a batch applies all of its operations in order
+func TestMemStore_Apply(t *testing.T) {
+	mock := &MockWriter{}
+	store := NewMemStore(mock)
+	defer store.Close(context.Background())
+
+	ctx := context.Background()
+	store.Put(ctx, "old", []byte("value"))
+
+	var batch WriteBatch
+	batch.Put("a", []byte("1"))
+	batch.Put("b", []byte("2"))
+	batch.Delete("old")
+	batch.Put("a", []byte("3"))
+
+	if err := store.Apply(ctx, &batch); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	if got, _ := store.Get(ctx, "a"); !bytes.Equal(got, []byte("3")) {
+		t.Errorf("Later operation in the batch should win, got %q", got)
+	}
+	if got, _ := store.Get(ctx, "b"); !bytes.Equal(got, []byte("2")) {
+		t.Errorf("Got %q, want %q", got, "2")
+	}
+	if _, err := store.Get(ctx, "old"); err != ErrKeyNotFound {
+		t.Errorf("Deleted key should be gone, got %v", err)
+	}
+}
+
+// Test that a batch with an invalid key is rejected as a whole
+func TestMemStore_ApplyInvalidKey(t *testing.T) {
+	mock := &MockWriter{}
+	store := NewMemStore(mock)
+	defer store.Close(context.Background())
+
+	ctx := context.Background()
+
+	var batch WriteBatch
+	batch.Put("valid", []byte("value"))
+	batch.Put("", []byte("value"))
+
+	if err := store.Apply(ctx, &batch); err != ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+	if mock.WasCalled.Load() {
+		t.Error("Rejected batch should not reach the WAL")
+	}
+	if _, err := store.Get(ctx, "valid"); err != ErrKeyNotFound {
+		t.Errorf("No part of a rejected batch should be applied, got %v", err)
+	}
+}
+
+// Test that a batch torn by a crash is dropped entirely on recovery
+func TestMemStore_ApplyRecoverAtomic(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, _ := OpenMemStore(dir, Options{})
+	store.Put(ctx, "before", []byte("batch"))
+
+	var batch WriteBatch
+	for i := range 10 {
+		batch.Put(fmt.Sprintf("key-%d", i), []byte("value"))
+	}
+	store.Apply(ctx, &batch)
+	store.Close(ctx)
+
+	// Reopen intact first: the whole batch is there
+	store, _ = OpenMemStore(dir, Options{})
+	for i := range 10 {
+		if _, err := store.Get(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatalf("Batch operation %d lost: %v", i, err)
+		}
+	}
+	store.Close(ctx)
+
+	// Chop the tail of the batch record off
+	segments, _ := wal.Segments(dir)
+	path := segments[len(segments)-1]
+	stat, _ := os.Stat(path)
+	os.Truncate(path, stat.Size()-20)
+
+	store, _ = OpenMemStore(dir, Options{})
+	defer store.Close(ctx)
+
+	if _, err := store.Get(ctx, "before"); err != nil {
+		t.Errorf("Entry before the batch was lost: %v", err)
+	}
+	for i := range 10 {
+		if _, err := store.Get(ctx, fmt.Sprintf("key-%d", i)); err != ErrKeyNotFound {
+			t.Errorf("Operation %d of a torn batch was applied", i)
+		}
+	}
+}
+
+// Test that readers never see a batch half applied
+func TestMemStore_ApplyIsolation(t *testing.T) {
+	mock := &MockWriter{}
+	store := NewMemStore(mock)
+	defer store.Close(context.Background())
+
+	ctx := context.Background()
+
+	// Both keys always hold the same value when updated together
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 500 {
+			var batch WriteBatch
+			value := []byte(fmt.Sprintf("%d", i))
+			batch.Put("left", value)
+			batch.Put("right", value)
+			store.Apply(ctx, &batch)
+		}
+	}()
+
+	// An iterator reads both keys at the same snapshot
+	for range 500 {
+		it, _ := store.NewIterator(ctx, IterOptions{})
+		values := make(map[string][]byte)
+		for it.Next() {
+			values[it.Key()] = it.Value()
+		}
+		it.Close()
+
+		if !bytes.Equal(values["left"], values["right"]) {
+			t.Fatalf("Observed half applied batch: left=%q right=%q", values["left"], values["right"])
+		}
+	}
+	wg.Wait()
+}
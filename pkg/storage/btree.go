@@ -0,0 +1,485 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// btreeFileName is the page file of a BTreeStore
+const btreeFileName = "btree.db"
+
+// BTreeStore is a B-tree implementation of Store, kept in a file of
+// fixed-size pages next to its WAL.
+//
+// Writes are logged to the WAL and then applied to pages in the page cache.
+// Modified pages are written back by a checkpoint: their images are first
+// logged to the WAL as one record, then written in place, and finally the
+// meta page is pointed at that record. If a crash interrupts the in-place
+// writes, say halfway through a page split, replay restores every page from
+// the logged images before redoing the writes that came after.
+//
+// Reads run concurrently with each other. Writes and checkpoints take the
+// tree exclusively.
+type BTreeStore struct {
+	mut sync.RWMutex
+	closed atomic.Bool
+
+	file *os.File
+	tree btree
+
+	// meta is the meta page last written, see checkpoint
+	meta btreeMeta
+
+	walWriter wal.WALWriter
+	log *wal.Writer
+	sync wal.SyncPolicy
+
+	// checkpointPages is the number of dirty pages that triggers a checkpoint
+	checkpointPages int
+
+	recovery RecoveryInfo
+}
+
+// OpenBTreeStore opens the B-tree store in dir, creating it if needed.
+// Pages from a checkpoint that did not finish are restored and whatever the
+// WAL holds beyond the last checkpoint is redone before the store is returned.
+func OpenBTreeStore(dir string, opts Options) (*BTreeStore, error) {
+	opts = opts.withDefaults()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, btreeFileName)
+	if err := createBTreeFile(path); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BTreeStore{
+		file: file,
+		sync: opts.WAL.Sync,
+		checkpointPages: max(opts.PageCacheSize/2, 1),
+	}
+	b.tree.cache = newPageCache(file, opts.PageCacheSize)
+
+	info, err := b.recover(dir, opts.WAL)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w, err := wal.Open(dir, opts.WAL)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	b.walWriter, b.log = w, w
+	b.recovery = info
+
+	// Writes the repaired pages back and lets go of the replayed log
+	if err := b.checkpoint(); err != nil {
+		w.Close()
+		file.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// createBTreeFile writes an empty tree to path unless there is a file already.
+// The file is put together under a temporary name, so a crash never leaves a
+// half-initialized one behind.
+func createBTreeFile(path string) error {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	root := &btreePage{id: 2, kind: pageLeaf}
+	meta := &btreeMeta{root: root.id, pageCount: 3}
+	for _, page := range [][]byte{meta.encode(), meta.encode(), root.encode()} {
+		if _, err := f.Write(page); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// recover loads the current meta page and redoes the WAL on top of it.
+//
+// A checkpoint record in the log newer than the meta page belongs to a
+// checkpoint that may have written some of its pages but not all of them.
+// Replay starts at the newest such record, whose images hold every page
+// that changed since the meta page, so the tree is whole again before the
+// writes after it are redone.
+func (b *BTreeStore) recover(dir string, walOpts wal.Options) (RecoveryInfo, error) {
+	if err := b.loadMeta(); err != nil {
+		return RecoveryInfo{}, err
+	}
+
+	// The pages of the meta page's own checkpoint are all in place
+	from := b.meta.checkpoint + 1
+	_, err := replay(dir, walOpts, from, func(e *wal.LogEntry) error {
+		if e.Op == wal.OpCheckpoint {
+			from = e.LSN
+		}
+		return nil
+	})
+	if err != nil {
+		return RecoveryInfo{}, fmt.Errorf("WAL recovery failed: %w", err)
+	}
+
+	info, err := replay(dir, walOpts, from, func(e *wal.LogEntry) error {
+		if e.Op == wal.OpCheckpoint {
+			return b.restore(e.Value)
+		}
+
+		ops, err := entryOps(e)
+		if err != nil {
+			return err
+		}
+		return b.tree.apply(ops)
+	})
+	if err != nil {
+		return info, fmt.Errorf("WAL recovery failed: %w", err)
+	}
+	return info, nil
+}
+
+// loadMeta reads both meta pages and takes the newer one that is intact
+func (b *BTreeStore) loadMeta() error {
+	var current *btreeMeta
+	var lastErr error
+
+	buf := make([]byte, btreePageSize)
+	for slot := range 2 {
+		if _, err := b.file.ReadAt(buf, int64(slot)*btreePageSize); err != nil {
+			return err
+		}
+
+		m, err := decodeMeta(buf)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if current == nil || m.seq > current.seq {
+			current = m
+		}
+	}
+
+	if current == nil {
+		return lastErr
+	}
+
+	b.meta = *current
+	b.tree.root = current.root
+	b.tree.freeHead = current.freeHead
+	b.tree.pageCount = current.pageCount
+	return nil
+}
+
+// Get returns a value by key
+func (b *BTreeStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(key) == "" {
+		return nil, ErrInvalidKey
+	}
+
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	if b.closed.Load() {
+		return nil, ErrStoreClosed
+	}
+
+	value, found, err := b.tree.get([]byte(strings.TrimSpace(key)))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+
+	// Defensive copy
+	snapshot := make([]byte, len(value))
+	copy(snapshot, value)
+	return snapshot, nil
+}
+
+// Put stores a key-value pair.
+// Returns ErrEntryTooLarge if the key and value do not fit in a page.
+func (b *BTreeStore) Put(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(key) == "" {
+		return ErrInvalidKey
+	}
+
+	// Defensive copy
+	snapshot := make([]byte, len(value))
+	copy(snapshot, value)
+
+	entry := &wal.LogEntry{
+		Timestamp: time.Now().UnixNano(),
+		Op: wal.OpPut,
+		Key: []byte(key),
+		Value: snapshot,
+	}
+
+	return b.write(ctx, entry, []*wal.LogEntry{entry})
+}
+
+// Delete removes a key
+func (b *BTreeStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(key) == "" {
+		return ErrInvalidKey
+	}
+
+	entry := &wal.LogEntry{
+		Timestamp: time.Now().UnixNano(),
+		Op: wal.OpDelete,
+		Key: []byte(key),
+	}
+
+	return b.write(ctx, entry, []*wal.LogEntry{entry})
+}
+
+// Apply commits all operations in batch as a single WAL record
+func (b *BTreeStore) Apply(ctx context.Context, batch *WriteBatch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := batch.validate(); err != nil {
+		return err
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	record := wal.NewBatchEntry(time.Now().UnixNano(), batch.ops)
+	return b.write(ctx, record, batch.ops)
+}
+
+// write logs record to the WAL and then applies ops to the tree, checkpointing
+// once enough pages are dirty
+func (b *BTreeStore) write(ctx context.Context, record *wal.LogEntry, ops []*wal.LogEntry) error {
+	for _, op := range ops {
+		if op.Op == wal.OpPut && leafCellSize(op.Key, op.Value) > btreeMaxCell {
+			return fmt.Errorf("%w: %d bytes, at most %d fit in a page", ErrEntryTooLarge, leafCellSize(op.Key, op.Value), btreeMaxCell)
+		}
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if b.closed.Load() {
+		return ErrStoreClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := b.logEntry(ctx, record); err != nil {
+		return fmt.Errorf("WAL failure (data safe, update aborted): %w", err)
+	}
+
+	// From here on the record is in the log and will be redone on restart
+	if err := b.tree.apply(ops); err != nil {
+		return err
+	}
+
+	if b.tree.cache.dirtyCount() >= b.checkpointPages {
+		return b.checkpoint()
+	}
+	return nil
+}
+
+// logEntry appends entry to the WAL according to the store's sync policy
+func (b *BTreeStore) logEntry(ctx context.Context, entry *wal.LogEntry) error {
+	if b.sync == wal.SyncAlways {
+		_, err := b.walWriter.SyncWrite(ctx, entry)
+		return err
+	}
+
+	_, err := b.walWriter.Write(ctx, entry)
+	return err
+}
+
+// apply adds ops to the tree in order
+func (t *btree) apply(ops []*wal.LogEntry) error {
+	for _, op := range ops {
+		var err error
+		if op.Op == wal.OpDelete {
+			_, err = t.delete(op.Key)
+		} else {
+			err = t.put(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpoint writes the dirty pages back to the file. Caller must hold
+// b.mut exclusively.
+//
+// Checkpoint record: uvarint (Root) + uvarint (FreeHead) + uvarint (PageCount) + uvarint (Count) + Count x [4 (ID) + Page]
+func (b *BTreeStore) checkpoint() error {
+	pages := b.tree.cache.dirtyPages()
+	if len(pages) == 0 {
+		return nil
+	}
+
+	// Starts the record on a fresh segment, so everything before it can go
+	// once the pages are in place
+	if _, err := b.log.Rotate(); err != nil {
+		return err
+	}
+
+	record := binary.AppendUvarint(nil, uint64(b.tree.root))
+	record = binary.AppendUvarint(record, uint64(b.tree.freeHead))
+	record = binary.AppendUvarint(record, uint64(b.tree.pageCount))
+	record = binary.AppendUvarint(record, uint64(len(pages)))
+	images := make([][]byte, len(pages))
+	for i, p := range pages {
+		images[i] = p.encode()
+		record = binary.LittleEndian.AppendUint32(record, p.id)
+		record = append(record, images[i]...)
+	}
+
+	lsn, err := b.walWriter.SyncWrite(context.Background(), &wal.LogEntry{
+		Timestamp: time.Now().UnixNano(),
+		Op: wal.OpCheckpoint,
+		Value: record,
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, p := range pages {
+		if _, err := b.file.WriteAt(images[i], int64(p.id)*btreePageSize); err != nil {
+			return err
+		}
+	}
+	if err := b.file.Sync(); err != nil {
+		return err
+	}
+
+	meta := btreeMeta{
+		seq: b.meta.seq + 1,
+		root: b.tree.root,
+		freeHead: b.tree.freeHead,
+		pageCount: b.tree.pageCount,
+		checkpoint: lsn,
+	}
+	if _, err := b.file.WriteAt(meta.encode(), int64(meta.seq%2)*btreePageSize); err != nil {
+		return err
+	}
+	if err := b.file.Sync(); err != nil {
+		return err
+	}
+
+	b.meta = meta
+	b.tree.cache.clean()
+
+	_, err = b.log.RemoveBefore(lsn)
+	return err
+}
+
+// restore puts the pages of a checkpoint record back into the cache, dirty,
+// along with the shape of the tree they belong to
+func (b *BTreeStore) restore(record []byte) error {
+	d := &decoder{data: record}
+	root, freeHead, pageCount := d.uvarint(), d.uvarint(), d.uvarint()
+	count := d.uvarint()
+	if d.err != nil {
+		return fmt.Errorf("%w: checkpoint record truncated", errBadPage)
+	}
+
+	data := d.data
+	if uint64(len(data)) != count*(4+btreePageSize) {
+		return fmt.Errorf("%w: checkpoint record has %d bytes for %d pages", errBadPage, len(data), count)
+	}
+
+	for range count {
+		id := binary.LittleEndian.Uint32(data)
+		p, err := decodePage(id, data[4:4+btreePageSize])
+		if err != nil {
+			return err
+		}
+		b.tree.cache.put(p)
+		data = data[4+btreePageSize:]
+	}
+
+	b.tree.root = uint32(root)
+	b.tree.freeHead = uint32(freeHead)
+	b.tree.pageCount = uint32(pageCount)
+	return nil
+}
+
+// Recovery returns the outcome of the WAL replay done by OpenBTreeStore
+func (b *BTreeStore) Recovery() RecoveryInfo {
+	return b.recovery
+}
+
+// Close writes every dirty page back and closes the WAL and the page file
+func (b *BTreeStore) Close(ctx context.Context) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if b.closed.Load() {
+		return ErrStoreClosed
+	}
+	b.closed.Store(true)
+
+	err := b.checkpoint()
+	if cerr := b.log.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := b.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"cmp"
+	"container/list"
+	"os"
+	"slices"
+	"sync"
+)
+
+// pageCache keeps decoded pages of a B-tree file in memory.
+//
+// Clean pages are evicted least recently used first once there are more
+// than capacity of them. Dirty pages stay until a checkpoint has written
+// them out, see BTreeStore.checkpoint. Several readers may share the cache,
+// but pages are only modified while no reader is active.
+type pageCache struct {
+	file *os.File
+	capacity int
+
+	mut sync.Mutex
+	pages map[uint32]*list.Element
+	// lru holds *btreePage, most recently used first
+	lru *list.List
+	dirty map[uint32]*btreePage
+}
+
+func newPageCache(file *os.File, capacity int) *pageCache {
+	return &pageCache{
+		file: file,
+		capacity: capacity,
+		pages: make(map[uint32]*list.Element),
+		lru: list.New(),
+		dirty: make(map[uint32]*btreePage),
+	}
+}
+
+// get returns page id, reading it from the file if it is not cached
+func (c *pageCache) get(id uint32) (*btreePage, error) {
+	c.mut.Lock()
+	if e, ok := c.pages[id]; ok {
+		c.lru.MoveToFront(e)
+		c.mut.Unlock()
+		return e.Value.(*btreePage), nil
+	}
+	c.mut.Unlock()
+
+	buf := make([]byte, btreePageSize)
+	if _, err := c.file.ReadAt(buf, int64(id)*btreePageSize); err != nil {
+		return nil, err
+	}
+	p, err := decodePage(id, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	// Another reader may have loaded it in the meantime
+	if e, ok := c.pages[id]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*btreePage), nil
+	}
+	c.pages[id] = c.lru.PushFront(p)
+	c.evict()
+	return p, nil
+}
+
+// put adds p to the cache as a dirty page, replacing any page with its id
+func (c *pageCache) put(p *btreePage) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if e, ok := c.pages[p.id]; ok {
+		c.lru.Remove(e)
+	}
+	c.pages[p.id] = c.lru.PushFront(p)
+	p.dirty = true
+	c.dirty[p.id] = p
+}
+
+// markDirty records that p was modified and has to be written out. A page
+// still clean on the way down to a child may have been evicted while the
+// child was read, so p goes back in the cache in place of any copy since.
+func (c *pageCache) markDirty(p *btreePage) {
+	c.put(p)
+}
+
+// dirtyPages returns the modified pages in file order
+func (c *pageCache) dirtyPages() []*btreePage {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	pages := make([]*btreePage, 0, len(c.dirty))
+	for _, p := range c.dirty {
+		pages = append(pages, p)
+	}
+	slices.SortFunc(pages, func(a, b *btreePage) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	return pages
+}
+
+// dirtyCount returns the number of modified pages
+func (c *pageCache) dirtyCount() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return len(c.dirty)
+}
+
+// clean marks every page as written out, making them evictable again
+func (c *pageCache) clean() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for _, p := range c.dirty {
+		p.dirty = false
+	}
+	clear(c.dirty)
+	c.evict()
+}
+
+// evict drops clean pages until the cache is within capacity.
+// Caller must hold c.mut.
+func (c *pageCache) evict() {
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.capacity; {
+		prev := e.Prev()
+		if p := e.Value.(*btreePage); !p.dirty {
+			c.lru.Remove(e)
+			delete(c.pages, p.id)
+		}
+		e = prev
+	}
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+)
+
+// btreeIteratorBatch is the number of entries a btreeIterator copies out of
+// the tree at a time
+const btreeIteratorBatch = 128
+
+// btreeIterator iterates over a BTreeStore.
+//
+// It copies entries out of the tree in batches and holds no lock between
+// them, so unlike the other engines' iterators it does not read a snapshot:
+// writes made while iterating may or may not be seen, depending on whether
+// they land before or after the batch they fall in. Every key is still
+// visited at most once and in order.
+type btreeIterator struct {
+	store *BTreeStore
+	ctx context.Context
+	reverse bool
+
+	lower string
+	upper string
+	hasUpper bool
+
+	// seek is where the next call to Next starts from when started is false
+	seek *string
+	started bool
+
+	// batch holds the entries fetched after key, in iteration order
+	batch []btreeEntry
+	// more is false once the tree had nothing left past the last batch
+	more bool
+
+	key string
+	value []byte
+	err error
+	done bool
+	closed bool
+}
+
+type btreeEntry struct {
+	key string
+	value []byte
+}
+
+// NewIterator returns an iterator over the keys selected by opts
+func (b *BTreeStore) NewIterator(ctx context.Context, opts IterOptions) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if b.closed.Load() {
+		return nil, ErrStoreClosed
+	}
+
+	it := &btreeIterator{
+		store: b,
+		ctx: ctx,
+		reverse: opts.Reverse,
+	}
+	it.lower, it.upper, it.hasUpper = opts.bounds()
+	return it, nil
+}
+
+func (it *btreeIterator) Seek(key string) {
+	if it.closed {
+		return
+	}
+	it.seek = &key
+	it.started = false
+	it.done = false
+	it.batch = nil
+}
+
+func (it *btreeIterator) Next() bool {
+	if it.done || it.err != nil {
+		return false
+	}
+
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		return false
+	}
+
+	if it.store.closed.Load() {
+		it.err = ErrStoreClosed
+		return false
+	}
+
+	if len(it.batch) == 0 && (!it.started || it.more) {
+		if err := it.fill(); err != nil {
+			it.err = err
+			return false
+		}
+		it.started = true
+	}
+
+	if len(it.batch) == 0 {
+		it.done = true
+		it.value = nil
+		return false
+	}
+
+	// Entries are copies already, the batch is not shared
+	it.key, it.value = it.batch[0].key, it.batch[0].value
+	it.batch = it.batch[1:]
+	return true
+}
+
+// fill fetches the next batch of entries in range, starting after the
+// current key or, for the first batch, at the iterator's start
+func (it *btreeIterator) fill() error {
+	b := it.store
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	if b.closed.Load() {
+		return ErrStoreClosed
+	}
+
+	start, skip := it.start()
+	it.batch = it.batch[:0]
+	it.more = false
+
+	_, err := b.tree.scan(b.tree.root, start, it.reverse, func(key, value []byte) bool {
+		k := string(key)
+		if skip && k == it.key {
+			return true
+		}
+		if !it.inBounds(k) {
+			// Past the end in iteration order, or in reverse still above
+			// an exclusive upper bound
+			return it.reverse && it.hasUpper && k >= it.upper
+		}
+
+		if len(it.batch) == btreeIteratorBatch {
+			it.more = true
+			return false
+		}
+
+		// Defensive copy
+		v := make([]byte, len(value))
+		copy(v, value)
+		it.batch = append(it.batch, btreeEntry{key: k, value: v})
+		return true
+	})
+	return err
+}
+
+// start returns the key the next scan begins at and whether the entry at
+// that key was returned already. A nil key scans from the first or last key.
+func (it *btreeIterator) start() ([]byte, bool) {
+	if it.started {
+		return []byte(it.key), true
+	}
+
+	if !it.reverse {
+		start := it.lower
+		if it.seek != nil && *it.seek > start {
+			start = *it.seek
+		}
+		return []byte(start), false
+	}
+
+	switch {
+	case it.seek != nil && (!it.hasUpper || *it.seek < it.upper):
+		return []byte(*it.seek), false
+	case it.hasUpper:
+		return []byte(it.upper), false
+	default:
+		return nil, false
+	}
+}
+
+// inBounds reports whether key falls within [lower, upper)
+func (it *btreeIterator) inBounds(key string) bool {
+	if key < it.lower {
+		return false
+	}
+	return !it.hasUpper || key < it.upper
+}
+
+func (it *btreeIterator) Key() string {
+	return it.key
+}
+
+func (it *btreeIterator) Value() []byte {
+	return it.value
+}
+
+func (it *btreeIterator) Err() error {
+	return it.err
+}
+
+// Close drops the buffered entries. The iterator holds nothing else.
+func (it *btreeIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+
+	it.closed = true
+	it.done = true
+	it.value = nil
+	it.batch = nil
+	return nil
+}
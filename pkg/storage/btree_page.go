@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// The B-tree file is an array of fixed-size pages. Pages 0 and 1 are meta
+// pages, written alternately so that a torn write leaves the other intact.
+// Every other page is a leaf, an interior page or a free page.
+//
+// Node pages are slotted: a header, then an array of slots pointing at the
+// cells, which are packed from the end of the page towards the slots.
+//
+//	Header: 4 (CRC) + 1 (Kind) + 1 (Unused) + 2 (NumSlots) + 2 (CellStart) + 2 (Unused) + 4 (Link)
+//	Slots:  NumSlots x 2 (Cell offset), in key order
+//	Leaf cell:     uvarint (KLen) + uvarint (VLen) + Key + Value
+//	Interior cell: 4 (Child) + uvarint (KLen) + Key
+//
+// The child of an interior cell holds the keys below the cell's key and at or
+// above the previous cell's key. Link is the child holding the keys at or
+// above the last one. On a free page Link is the next free page.
+//
+// The CRC covers the rest of the page.
+//
+//	Meta: 4 (CRC) + 8 (Magic) + 4 (Version) + 4 (PageSize) + 8 (Seq) + 4 (Root) + 4 (FreeHead) + 4 (PageCount) + 8 (Checkpoint)
+const (
+	btreePageSize = 4096
+	btreeHeaderSize = 16
+
+	btreeMagic uint64 = 0x616e63686f726274 // "anchorbt"
+	btreeVersion uint32 = 1
+
+	// btreeMaxCell keeps every cell below a quarter of a page, so a split
+	// page always has room for what it is split around
+	btreeMaxCell = (btreePageSize - btreeHeaderSize) / 4
+)
+
+// Kinds of pages
+const (
+	pageLeaf byte = 1
+	pageInterior byte = 2
+	pageFree byte = 3
+)
+
+// errBadPage is wrapped by every page decoding failure
+var errBadPage = errors.New("corrupt page")
+
+// btreePage is a decoded page. Keys are sorted. A leaf holds a value for each
+// key, an interior page one more child than it has keys, the last child being
+// the page's link.
+type btreePage struct {
+	id uint32
+	kind byte
+	keys [][]byte
+	values [][]byte
+	children []uint32
+
+	// next is the following free page of a free page
+	next uint32
+
+	dirty bool
+}
+
+func (p *btreePage) leaf() bool {
+	return p.kind == pageLeaf
+}
+
+// search returns the position of key in a leaf and whether it is there
+func (p *btreePage) search(key []byte) (int, bool) {
+	i := sort.Search(len(p.keys), func(i int) bool {
+		return bytes.Compare(p.keys[i], key) >= 0
+	})
+	return i, i < len(p.keys) && bytes.Equal(p.keys[i], key)
+}
+
+// childIndex returns the position of the child of an interior page that holds key
+func (p *btreePage) childIndex(key []byte) int {
+	return sort.Search(len(p.keys), func(i int) bool {
+		return bytes.Compare(p.keys[i], key) > 0
+	})
+}
+
+// cellSize returns the encoded size of cell i, excluding its slot
+func (p *btreePage) cellSize(i int) int {
+	if p.leaf() {
+		return leafCellSize(p.keys[i], p.values[i])
+	}
+	return 4 + uvarintLen(uint64(len(p.keys[i]))) + len(p.keys[i])
+}
+
+func leafCellSize(key, value []byte) int {
+	return uvarintLen(uint64(len(key))) + uvarintLen(uint64(len(value))) + len(key) + len(value)
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// size returns the number of bytes the page takes encoded
+func (p *btreePage) size() int {
+	size := btreeHeaderSize
+	for i := range p.keys {
+		size += 2 + p.cellSize(i)
+	}
+	return size
+}
+
+// encode lays the page out in a fresh page-sized buffer. The page must fit.
+func (p *btreePage) encode() []byte {
+	buf := make([]byte, btreePageSize)
+	buf[4] = p.kind
+
+	link := p.next
+	if p.kind == pageInterior {
+		link = p.children[len(p.children)-1]
+	}
+	binary.LittleEndian.PutUint32(buf[12:16], link)
+
+	end := btreePageSize
+	for i, key := range p.keys {
+		end -= p.cellSize(i)
+		binary.LittleEndian.PutUint16(buf[btreeHeaderSize+2*i:], uint16(end))
+
+		cell := buf[end:end]
+		if p.leaf() {
+			cell = binary.AppendUvarint(cell, uint64(len(key)))
+			cell = binary.AppendUvarint(cell, uint64(len(p.values[i])))
+			cell = append(cell, key...)
+			cell = append(cell, p.values[i]...)
+		} else {
+			cell = binary.LittleEndian.AppendUint32(cell, p.children[i])
+			cell = binary.AppendUvarint(cell, uint64(len(key)))
+			cell = append(cell, key...)
+		}
+	}
+	binary.LittleEndian.PutUint16(buf[6:8], uint16(len(p.keys)))
+	binary.LittleEndian.PutUint16(buf[8:10], uint16(end))
+
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// decodePage parses page id from buf, which it may keep references into
+func decodePage(id uint32, buf []byte) (*btreePage, error) {
+	if len(buf) != btreePageSize {
+		return nil, fmt.Errorf("%w: page %d has %d bytes", errBadPage, id, len(buf))
+	}
+	if crc32.ChecksumIEEE(buf[4:]) != binary.LittleEndian.Uint32(buf[0:4]) {
+		return nil, fmt.Errorf("%w: page %d checksum mismatch", errBadPage, id)
+	}
+
+	p := &btreePage{id: id, kind: buf[4]}
+	link := binary.LittleEndian.Uint32(buf[12:16])
+	switch p.kind {
+	case pageFree:
+		p.next = link
+		return p, nil
+	case pageLeaf, pageInterior:
+	default:
+		return nil, fmt.Errorf("%w: page %d has kind %d", errBadPage, id, p.kind)
+	}
+
+	n := int(binary.LittleEndian.Uint16(buf[6:8]))
+	if btreeHeaderSize+2*n > btreePageSize {
+		return nil, fmt.Errorf("%w: page %d has %d slots", errBadPage, id, n)
+	}
+
+	for i := range n {
+		off := int(binary.LittleEndian.Uint16(buf[btreeHeaderSize+2*i:]))
+		if off < btreeHeaderSize+2*n || off >= btreePageSize {
+			return nil, fmt.Errorf("%w: page %d slot %d out of range", errBadPage, id, i)
+		}
+		cell := buf[off:]
+
+		var child uint32
+		if p.kind == pageInterior {
+			if len(cell) < 4 {
+				return nil, fmt.Errorf("%w: page %d cell %d truncated", errBadPage, id, i)
+			}
+			child = binary.LittleEndian.Uint32(cell)
+			cell = cell[4:]
+		}
+
+		kLen, n1 := binary.Uvarint(cell)
+		if n1 <= 0 {
+			return nil, fmt.Errorf("%w: page %d cell %d truncated", errBadPage, id, i)
+		}
+		cell = cell[n1:]
+
+		var vLen uint64
+		if p.kind == pageLeaf {
+			var n2 int
+			if vLen, n2 = binary.Uvarint(cell); n2 <= 0 {
+				return nil, fmt.Errorf("%w: page %d cell %d truncated", errBadPage, id, i)
+			}
+			cell = cell[n2:]
+		}
+
+		if kLen+vLen > uint64(len(cell)) {
+			return nil, fmt.Errorf("%w: page %d cell %d truncated", errBadPage, id, i)
+		}
+		p.keys = append(p.keys, cell[:kLen:kLen])
+		if p.kind == pageLeaf {
+			p.values = append(p.values, cell[kLen:kLen+vLen:kLen+vLen])
+		} else {
+			p.children = append(p.children, child)
+		}
+	}
+
+	if p.kind == pageInterior {
+		p.children = append(p.children, link)
+	}
+	return p, nil
+}
+
+// btreeMeta is the content of a meta page
+type btreeMeta struct {
+	// seq counts meta writes, the valid meta page with the higher one is current
+	seq uint64
+
+	root uint32
+	freeHead uint32
+	pageCount uint32
+
+	// checkpoint is the LSN of the WAL record holding the page images of
+	// the last checkpoint whose pages all reached the file
+	checkpoint uint64
+}
+
+func (m *btreeMeta) encode() []byte {
+	buf := make([]byte, btreePageSize)
+	binary.LittleEndian.PutUint64(buf[4:12], btreeMagic)
+	binary.LittleEndian.PutUint32(buf[12:16], btreeVersion)
+	binary.LittleEndian.PutUint32(buf[16:20], btreePageSize)
+	binary.LittleEndian.PutUint64(buf[20:28], m.seq)
+	binary.LittleEndian.PutUint32(buf[28:32], m.root)
+	binary.LittleEndian.PutUint32(buf[32:36], m.freeHead)
+	binary.LittleEndian.PutUint32(buf[36:40], m.pageCount)
+	binary.LittleEndian.PutUint64(buf[40:48], m.checkpoint)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func decodeMeta(buf []byte) (*btreeMeta, error) {
+	if crc32.ChecksumIEEE(buf[4:]) != binary.LittleEndian.Uint32(buf[0:4]) {
+		return nil, fmt.Errorf("%w: meta checksum mismatch", errBadPage)
+	}
+	if binary.LittleEndian.Uint64(buf[4:12]) != btreeMagic {
+		return nil, fmt.Errorf("%w: not a B-tree file", errBadPage)
+	}
+	if v := binary.LittleEndian.Uint32(buf[12:16]); v != btreeVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errBadPage, v)
+	}
+	if size := binary.LittleEndian.Uint32(buf[16:20]); size != btreePageSize {
+		return nil, fmt.Errorf("%w: page size %d", errBadPage, size)
+	}
+
+	return &btreeMeta{
+		seq: binary.LittleEndian.Uint64(buf[20:28]),
+		root: binary.LittleEndian.Uint32(buf[28:32]),
+		freeHead: binary.LittleEndian.Uint32(buf[32:36]),
+		pageCount: binary.LittleEndian.Uint32(buf[36:40]),
+		checkpoint: binary.LittleEndian.Uint64(buf[40:48]),
+	}, nil
+}
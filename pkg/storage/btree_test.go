@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+var _ Store = (*BTreeStore)(nil)
+
+// openBTree opens a B-tree store with a small page cache so tests checkpoint often
+func openBTree(t *testing.T, dir string, sync wal.SyncPolicy) *BTreeStore {
+	t.Helper()
+
+	store, err := OpenBTreeStore(dir, Options{
+		WAL: wal.Options{Sync: sync},
+		PageCacheSize: 64,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return store
+}
+
+// crash abandons store without writing its dirty pages back
+func crash(store *BTreeStore) {
+	store.closed.Store(true)
+	store.log.Close()
+	store.file.Close()
+}
+
+// checkKeys verifies that the store holds exactly the keys of want, in order
+func checkKeys(t *testing.T, store *BTreeStore, want map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+
+	it, err := store.NewIterator(ctx, IterOptions{})
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+
+	var keys []string
+	for it.Next() {
+		if v, ok := want[it.Key()]; !ok || string(it.Value()) != v {
+			t.Fatalf("Key %s: got %q, want %q", it.Key(), it.Value(), v)
+		}
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iteration failed: %v", err)
+	}
+
+	if !slices.IsSorted(keys) || len(keys) != len(want) {
+		t.Fatalf("Got %d keys (sorted %v), want %d", len(keys), slices.IsSorted(keys), len(want))
+	}
+	for k, v := range want {
+		if got, err := store.Get(ctx, k); err != nil || string(got) != v {
+			t.Fatalf("Get %s: got %q (%v), want %q", k, got, err, v)
+		}
+	}
+}
+
+// Test put, overwrite, get and delete on a single page
+func TestBTreeStore_Basic(t *testing.T) {
+	ctx := context.Background()
+	store := openBTree(t, t.TempDir(), wal.SyncNever)
+	defer store.Close(ctx)
+
+	store.Put(ctx, "a", []byte("1"))
+	store.Put(ctx, "b", []byte("2"))
+	store.Put(ctx, "a", []byte("3"))
+
+	if got, err := store.Get(ctx, "a"); err != nil || !bytes.Equal(got, []byte("3")) {
+		t.Errorf("Got %q (%v), want %q", got, err, "3")
+	}
+
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get(ctx, "a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := store.Put(ctx, " ", []byte("x")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+}
+
+// Test that enough inserts split pages into a deeper tree that survives a reopen
+func TestBTreeStore_Splits(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openBTree(t, dir, wal.SyncNever)
+	want := make(map[string]string)
+	for _, i := range rangePermutation(5000) {
+		key, value := fmt.Sprintf("key-%05d", i), fmt.Sprintf("value-%d-%s", i, bytes.Repeat([]byte("v"), 64))
+		if err := store.Put(ctx, key, []byte(value)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = value
+	}
+
+	root, err := store.tree.cache.get(store.tree.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.leaf() {
+		t.Errorf("Expected the root to have been split")
+	}
+	checkKeys(t, store, want)
+
+	if err := store.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	store = openBTree(t, dir, wal.SyncNever)
+	defer store.Close(ctx)
+
+	if info := store.Recovery(); info.Applied != 0 {
+		t.Errorf("Expected nothing to redo after a clean close, got %+v", info)
+	}
+	checkKeys(t, store, want)
+}
+
+// Test that deletes merge pages, shrink the tree and put pages on the free list for reuse
+func TestBTreeStore_Merges(t *testing.T) {
+	ctx := context.Background()
+	store := openBTree(t, t.TempDir(), wal.SyncNever)
+	defer store.Close(ctx)
+
+	fill := func() {
+		for i := range 3000 {
+			store.Put(ctx, fmt.Sprintf("key-%05d", i), bytes.Repeat([]byte("v"), 100))
+		}
+	}
+
+	fill()
+	pages := store.tree.pageCount
+
+	for i := range 3000 {
+		if err := store.Delete(ctx, fmt.Sprintf("key-%05d", i)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	root, err := store.tree.cache.get(store.tree.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.leaf() || len(root.keys) != 0 {
+		t.Errorf("Expected a single empty leaf, got kind %d with %d keys", root.kind, len(root.keys))
+	}
+	if store.tree.freeHead == 0 {
+		t.Errorf("Expected merged pages on the free list")
+	}
+
+	// Freed pages are reused before the file grows
+	fill()
+	if store.tree.pageCount > pages {
+		t.Errorf("File grew from %d to %d pages despite free pages", pages, store.tree.pageCount)
+	}
+	checkKeys(t, store, func() map[string]string {
+		want := make(map[string]string)
+		for i := range 3000 {
+			want[fmt.Sprintf("key-%05d", i)] = string(bytes.Repeat([]byte("v"), 100))
+		}
+		return want
+	}())
+}
+
+// Test ordered iteration across many pages with bounds, reverse order and Seek
+func TestBTreeStore_Iterator(t *testing.T) {
+	ctx := context.Background()
+	store := openBTree(t, t.TempDir(), wal.SyncNever)
+	defer store.Close(ctx)
+
+	var keys []string
+	for i := range 1000 {
+		key := fmt.Sprintf("key-%04d", i)
+		store.Put(ctx, key, []byte("v:"+key))
+		keys = append(keys, key)
+	}
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+
+	cases := []struct {
+		name string
+		opts IterOptions
+		want []string
+	}{
+		{"All", IterOptions{}, keys},
+		{"Range", IterOptions{Lower: "key-0100", Upper: "key-0400"}, keys[100:400]},
+		{"Prefix", IterOptions{Prefix: "key-05"}, keys[500:600]},
+		{"Reverse", IterOptions{Reverse: true}, reversed},
+		{"ReverseRange", IterOptions{Lower: "key-0100", Upper: "key-0400", Reverse: true}, reversed[600:900]},
+		{"Empty", IterOptions{Prefix: "nope"}, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			it, err := store.NewIterator(ctx, c.opts)
+			if err != nil {
+				t.Fatalf("NewIterator failed: %v", err)
+			}
+			if got := collect(t, it); !slices.Equal(got, c.want) {
+				t.Errorf("Got %d keys, want %d", len(got), len(c.want))
+			}
+		})
+	}
+
+	it, _ := store.NewIterator(ctx, IterOptions{Reverse: true})
+	defer it.Close()
+	it.Seek("key-0500x")
+	if !it.Next() || it.Key() != "key-0500" {
+		t.Errorf("Reverse Seek landed on %q, want key-0500", it.Key())
+	}
+}
+
+// Test that a key and value too large for a page are rejected
+func TestBTreeStore_EntryTooLarge(t *testing.T) {
+	ctx := context.Background()
+	store := openBTree(t, t.TempDir(), wal.SyncNever)
+	defer store.Close(ctx)
+
+	err := store.Put(ctx, "big", bytes.Repeat([]byte("v"), btreePageSize))
+	if !errors.Is(err, ErrEntryTooLarge) {
+		t.Errorf("Expected ErrEntryTooLarge, got %v", err)
+	}
+
+	batch := &WriteBatch{}
+	batch.Put("small", []byte("v"))
+	batch.Put("big", bytes.Repeat([]byte("v"), btreeMaxCell))
+	if err := store.Apply(ctx, batch); !errors.Is(err, ErrEntryTooLarge) {
+		t.Errorf("Expected ErrEntryTooLarge for the batch, got %v", err)
+	}
+	if _, err := store.Get(ctx, "small"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the rejected batch to be dropped whole, got %v", err)
+	}
+}
+
+// Test that writes not yet checkpointed are redone from the WAL after a crash
+func TestBTreeStore_RecoverAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openBTree(t, dir, wal.SyncAlways)
+	store.Put(ctx, "a", []byte("1"))
+	store.Put(ctx, "b", []byte("2"))
+	store.Delete(ctx, "a")
+	crash(store)
+
+	store = openBTree(t, dir, wal.SyncAlways)
+	defer store.Close(ctx)
+
+	if info := store.Recovery(); info.Applied != 3 {
+		t.Errorf("Expected 3 entries redone, got %+v", info)
+	}
+	checkKeys(t, store, map[string]string{"b": "2"})
+}
+
+// Test that a checkpoint cut short after writing some of its pages, here
+// the halves of split pages but not their parents, is repaired on restart
+func TestBTreeStore_InterruptedSplit(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	path := filepath.Join(dir, btreeFileName)
+
+	want := make(map[string]string)
+	put := func(store *BTreeStore, from, to int) {
+		for i := from; i < to; i++ {
+			key, value := fmt.Sprintf("key-%05d", i*7%1000), fmt.Sprintf("value-%d", i)
+			if err := store.Put(ctx, key, []byte(value+string(bytes.Repeat([]byte("v"), 200)))); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			want[key] = value + string(bytes.Repeat([]byte("v"), 200))
+		}
+	}
+
+	store := openBTree(t, dir, wal.SyncAlways)
+	put(store, 0, 300)
+	store.Close(ctx)
+
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Splits pages, then writes them back in a checkpoint that is allowed
+	// to finish so its page images can be picked from
+	store = openBTree(t, dir, wal.SyncAlways)
+	store.checkpointPages = math.MaxInt
+	oldPages := store.tree.pageCount
+	put(store, 300, 600)
+	store.mut.Lock()
+	dirty := store.tree.cache.dirtyPages()
+	if err := store.checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	store.mut.Unlock()
+	crash(store)
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the new pages reached the file. The meta page still points at
+	// the tree from before, whose pages were not updated.
+	torn := slices.Clone(before)
+	written := 0
+	for _, p := range dirty {
+		if p.id < oldPages {
+			continue
+		}
+		off := int(p.id) * btreePageSize
+		if len(torn) < off+btreePageSize {
+			torn = append(torn, make([]byte, off+btreePageSize-len(torn))...)
+		}
+		copy(torn[off:off+btreePageSize], after[off:off+btreePageSize])
+		written++
+	}
+	if written == 0 {
+		t.Fatalf("Expected the writes to have split pages")
+	}
+	if err := os.WriteFile(path, torn, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openBTree(t, dir, wal.SyncAlways)
+	checkKeys(t, store, want)
+	put(store, 600, 900)
+	store.Close(ctx)
+
+	store = openBTree(t, dir, wal.SyncAlways)
+	defer store.Close(ctx)
+	checkKeys(t, store, want)
+}
+
+// rangePermutation returns 0..n-1 in a fixed scrambled order
+func rangePermutation(n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i * 7919 % n
+	}
+	return order
+}
+
+// Test that a cache too small to hold the path from the root to a leaf does
+// not lose splits and merges of pages it evicted on the way down
+func TestBTreeStore_TinyCache(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	if got := (Options{PageCacheSize: 1}).withDefaults().PageCacheSize; got != MinPageCacheSize {
+		t.Errorf("Expected PageCacheSize to be raised to %d, got %d", MinPageCacheSize, got)
+	}
+
+	for _, capacity := range []int{1, 2} {
+		store := openBTree(t, dir, wal.SyncNever)
+		// Below what Options allows, which is the point. Checkpoints are rare,
+		// so pages changed after they were evicted stay dirty for a while.
+		store.tree.cache.capacity = capacity
+		store.checkpointPages = 10
+
+		want := make(map[string]string)
+		for _, i := range rangePermutation(3000) {
+			key, value := fmt.Sprintf("key-%05d", i), fmt.Sprintf("value-%d-%s", i, bytes.Repeat([]byte("v"), 64))
+			if err := store.Put(ctx, key, []byte(value)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			want[key] = value
+		}
+		for i := range 2000 {
+			key := fmt.Sprintf("key-%05d", i)
+			if err := store.Delete(ctx, key); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			delete(want, key)
+		}
+		checkKeys(t, store, want)
+
+		if err := store.Close(ctx); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		store = openBTree(t, dir, wal.SyncNever)
+		checkKeys(t, store, want)
+		store.Close(ctx)
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"slices"
+)
+
+// btree is the tree of pages in a B-tree file, see btree_page.go for the
+// layout. Lookups and scans may run concurrently with each other, changes
+// need exclusive access.
+type btree struct {
+	cache *pageCache
+
+	root uint32
+	freeHead uint32
+	pageCount uint32
+}
+
+// get returns the value of key. The slice must not be modified.
+func (t *btree) get(key []byte) ([]byte, bool, error) {
+	p, err := t.cache.get(t.root)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for !p.leaf() {
+		if p, err = t.cache.get(p.children[p.childIndex(key)]); err != nil {
+			return nil, false, err
+		}
+	}
+
+	i, found := p.search(key)
+	if !found {
+		return nil, false, nil
+	}
+	return p.values[i], true, nil
+}
+
+// put sets the value of key. Both slices are kept by the tree.
+func (t *btree) put(key, value []byte) error {
+	root, err := t.cache.get(t.root)
+	if err != nil {
+		return err
+	}
+
+	sep, right, err := t.insert(root, key, value)
+	if err != nil || right == nil {
+		return err
+	}
+
+	// The root was split, the tree grows by a level
+	newRoot, err := t.alloc(pageInterior)
+	if err != nil {
+		return err
+	}
+	newRoot.keys = [][]byte{sep}
+	newRoot.children = []uint32{root.id, right.id}
+	t.root = newRoot.id
+	return nil
+}
+
+// insert adds key to the subtree under p. If p had to be split, the new
+// right half is returned along with the key separating it from p.
+func (t *btree) insert(p *btreePage, key, value []byte) ([]byte, *btreePage, error) {
+	if p.leaf() {
+		i, found := p.search(key)
+		if found {
+			p.values[i] = value
+		} else {
+			p.keys = slices.Insert(p.keys, i, key)
+			p.values = slices.Insert(p.values, i, value)
+		}
+	} else {
+		i := p.childIndex(key)
+		child, err := t.cache.get(p.children[i])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sep, right, err := t.insert(child, key, value)
+		if err != nil || right == nil {
+			return nil, nil, err
+		}
+		p.keys = slices.Insert(p.keys, i, sep)
+		p.children = slices.Insert(p.children, i+1, right.id)
+	}
+	t.cache.markDirty(p)
+
+	if p.size() <= btreePageSize {
+		return nil, nil, nil
+	}
+	return t.split(p)
+}
+
+// split moves the upper half of p, by size, to a new page
+func (t *btree) split(p *btreePage) ([]byte, *btreePage, error) {
+	half := (p.size() - btreeHeaderSize) / 2
+	m, used := 0, 0
+	for m < len(p.keys)-1 && used < half {
+		used += 2 + p.cellSize(m)
+		m++
+	}
+
+	right, err := t.alloc(p.kind)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sep := p.keys[m]
+	if p.leaf() {
+		right.keys = slices.Clone(p.keys[m:])
+		right.values = slices.Clone(p.values[m:])
+		p.keys, p.values = p.keys[:m], p.values[:m]
+	} else {
+		// The separator moves up, it is not kept in either half
+		right.keys = slices.Clone(p.keys[m+1:])
+		right.children = slices.Clone(p.children[m+1:])
+		p.keys, p.children = p.keys[:m], p.children[:m+1]
+	}
+	return sep, right, nil
+}
+
+// delete removes key and reports whether it was there
+func (t *btree) delete(key []byte) (bool, error) {
+	root, err := t.cache.get(t.root)
+	if err != nil {
+		return false, err
+	}
+
+	found, err := t.remove(root, key)
+	if err != nil || !found {
+		return found, err
+	}
+
+	// The root's children were merged into one, the tree shrinks by a level
+	if !root.leaf() && len(root.keys) == 0 {
+		t.root = root.children[0]
+		t.free(root)
+	}
+	return true, nil
+}
+
+// remove deletes key from the subtree under p, merging pages that became
+// less than a quarter full into a neighbor where they fit
+func (t *btree) remove(p *btreePage, key []byte) (bool, error) {
+	if p.leaf() {
+		i, found := p.search(key)
+		if !found {
+			return false, nil
+		}
+		p.keys = slices.Delete(p.keys, i, i+1)
+		p.values = slices.Delete(p.values, i, i+1)
+		t.cache.markDirty(p)
+		return true, nil
+	}
+
+	i := p.childIndex(key)
+	child, err := t.cache.get(p.children[i])
+	if err != nil {
+		return false, err
+	}
+
+	found, err := t.remove(child, key)
+	if err != nil || !found {
+		return found, err
+	}
+
+	if child.size() < btreePageSize/4 {
+		return true, t.merge(p, i)
+	}
+	return true, nil
+}
+
+// merge folds child i of parent and its neighbor into one page if they fit
+func (t *btree) merge(parent *btreePage, i int) error {
+	if len(parent.children) < 2 {
+		return nil
+	}
+
+	l, r := i-1, i
+	if i == 0 {
+		l, r = 0, 1
+	}
+
+	left, err := t.cache.get(parent.children[l])
+	if err != nil {
+		return err
+	}
+	right, err := t.cache.get(parent.children[r])
+	if err != nil {
+		return err
+	}
+
+	size := left.size() + right.size() - btreeHeaderSize
+	if !left.leaf() {
+		// The separator comes down between the two halves
+		size += 2 + 4 + uvarintLen(uint64(len(parent.keys[l]))) + len(parent.keys[l])
+	}
+	if size > btreePageSize {
+		return nil
+	}
+
+	if left.leaf() {
+		left.keys = append(left.keys, right.keys...)
+		left.values = append(left.values, right.values...)
+	} else {
+		left.keys = append(append(left.keys, parent.keys[l]), right.keys...)
+		left.children = append(left.children, right.children...)
+	}
+	parent.keys = slices.Delete(parent.keys, l, l+1)
+	parent.children = slices.Delete(parent.children, r, r+1)
+
+	t.cache.markDirty(left)
+	t.cache.markDirty(parent)
+	t.free(right)
+	return nil
+}
+
+// alloc returns a new empty page, reusing a free one if there is any
+func (t *btree) alloc(kind byte) (*btreePage, error) {
+	id := t.pageCount
+	if t.freeHead != 0 {
+		free, err := t.cache.get(t.freeHead)
+		if err != nil {
+			return nil, err
+		}
+		id, t.freeHead = free.id, free.next
+	} else {
+		t.pageCount++
+	}
+
+	p := &btreePage{id: id, kind: kind}
+	t.cache.put(p)
+	return p, nil
+}
+
+// free puts p on the free list
+func (t *btree) free(p *btreePage) {
+	p.kind = pageFree
+	p.keys, p.values, p.children = nil, nil, nil
+	p.next = t.freeHead
+	t.freeHead = p.id
+	t.cache.markDirty(p)
+}
+
+// scan calls fn with the entries of the subtree under page id in key order,
+// starting at the first key >= start, until fn returns false. If reverse is
+// set it goes backwards from the last key <= start. A nil start begins at
+// the first or last key. Returns false if fn stopped the scan.
+func (t *btree) scan(id uint32, start []byte, reverse bool, fn func(key, value []byte) bool) (bool, error) {
+	p, err := t.cache.get(id)
+	if err != nil {
+		return false, err
+	}
+
+	if p.leaf() {
+		if !reverse {
+			i := 0
+			if start != nil {
+				i, _ = p.search(start)
+			}
+			for ; i < len(p.keys); i++ {
+				if !fn(p.keys[i], p.values[i]) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}
+
+		i := len(p.keys) - 1
+		if start != nil {
+			j, found := p.search(start)
+			if i = j; !found {
+				i = j - 1
+			}
+		}
+		for ; i >= 0; i-- {
+			if !fn(p.keys[i], p.values[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	if !reverse {
+		i := 0
+		if start != nil {
+			i = p.childIndex(start)
+		}
+		for ; i < len(p.children); i++ {
+			if more, err := t.scan(p.children[i], start, reverse, fn); !more || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	i := len(p.children) - 1
+	if start != nil {
+		i = p.childIndex(start)
+	}
+	for ; i >= 0; i-- {
+		if more, err := t.scan(p.children[i], start, reverse, fn); !more || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -11,4 +11,13 @@ var (
 
 	// ErrInvalidKey is returned when provided key is malformed or empty
 	ErrInvalidKey = errors.New("key is malformed or empty")
+
+	// ErrEntryTooLarge is returned when a key and value are too large for the store engine to hold
+	ErrEntryTooLarge = errors.New("entry too large")
+
+	// ErrUnknownEngine is returned by Open when no engine is registered under the requested name
+	ErrUnknownEngine = errors.New("unknown storage engine")
+
+	// ErrInvalidOptions is returned by Open when the options cannot describe a store
+	ErrInvalidOptions = errors.New("invalid options")
 )
@@ -0,0 +1,83 @@
+package storage
+
+// Iterator walks a range of keys in order.
+//
+// A fresh iterator is positioned before the first key in range, so the usual
+// loop is:
+//
+//	it, err := store.NewIterator(ctx, IterOptions{Prefix: "user:"})
+//	if err != nil { ... }
+//	defer it.Close()
+//	for it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator interface {
+	// Seek repositions the iterator so that the following Next lands on the
+	// first key >= key, or the last key <= key when iterating in reverse.
+	// Keys outside the iterator's bounds are clamped to the bounds.
+	Seek(key string)
+
+	// Next advances to the next key in range.
+	// Returns false when the range is exhausted or an error occurred.
+	Next() bool
+
+	// Key returns the key at the current position
+	Key() string
+
+	// Value returns the value at the current position.
+	// The slice is a copy and may be kept or modified by the caller.
+	Value() []byte
+
+	// Err returns the error that stopped the iteration, if any.
+	// Running past the end of the range is not an error.
+	Err() error
+
+	// Close releases the iterator. Further calls to Next return false.
+	Close() error
+}
+
+// IterOptions selects which keys an Iterator visits
+type IterOptions struct {
+	// Lower is the inclusive lower bound, empty means unbounded
+	Lower string
+
+	// Upper is the exclusive upper bound, empty means unbounded
+	Upper string
+
+	// Prefix restricts iteration to keys starting with Prefix.
+	// It is combined with Lower and Upper, the tighter bound wins.
+	Prefix string
+
+	// Reverse iterates from the largest key down to the smallest
+	Reverse bool
+}
+
+// bounds returns the effective [lower, upper) range of the options.
+// hasUpper is false when the range is unbounded above.
+func (o IterOptions) bounds() (lower, upper string, hasUpper bool) {
+	lower, upper, hasUpper = o.Lower, o.Upper, o.Upper != ""
+
+	if o.Prefix != "" {
+		if o.Prefix > lower {
+			lower = o.Prefix
+		}
+		if end, ok := prefixEnd(o.Prefix); ok && (!hasUpper || end < upper) {
+			upper, hasUpper = end, true
+		}
+	}
+	return lower, upper, hasUpper
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix.
+// ok is false if there is no such key (the prefix is all 0xff bytes).
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+// collect drains an iterator into a list of keys
+func collect(t *testing.T, it Iterator) []string {
+	t.Helper()
+	defer it.Close()
+
+	var keys []string
+	for it.Next() {
+		if want := "v:" + it.Key(); string(it.Value()) != want {
+			t.Errorf("Key %s: got value %q, want %q", it.Key(), it.Value(), want)
+		}
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iteration failed: %v", err)
+	}
+	return keys
+}
+
+// Test ordered iteration with bounds, prefixes and reverse order
+func TestMemStore_Iterator(t *testing.T) {
+	mock := &MockWriter{}
+	store := NewMemStore(mock)
+	defer store.Close(context.Background())
+
+	ctx := context.Background()
+	keys := []string{"a", "b", "user:1", "user:2", "user:3", "users", "z"}
+
+	// Insert out of order
+	for _, i := range []int{4, 0, 6, 2, 1, 5, 3} {
+		store.Put(ctx, keys[i], []byte("v:"+keys[i]))
+	}
+
+	cases := []struct {
+		name string
+		opts IterOptions
+		want []string
+	}{
+		{"All", IterOptions{}, keys},
+		{"Lower", IterOptions{Lower: "user:2"}, []string{"user:2", "user:3", "users", "z"}},
+		{"Upper", IterOptions{Upper: "user:2"}, []string{"a", "b", "user:1"}},
+		{"Range", IterOptions{Lower: "b", Upper: "users"}, []string{"b", "user:1", "user:2", "user:3"}},
+		{"Prefix", IterOptions{Prefix: "user:"}, []string{"user:1", "user:2", "user:3"}},
+		{"PrefixAndUpper", IterOptions{Prefix: "user:", Upper: "user:3"}, []string{"user:1", "user:2"}},
+		{"Empty", IterOptions{Prefix: "nope"}, nil},
+		{"Reverse", IterOptions{Reverse: true}, []string{"z", "users", "user:3", "user:2", "user:1", "b", "a"}},
+		{"ReversePrefix", IterOptions{Prefix: "user:", Reverse: true}, []string{"user:3", "user:2", "user:1"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			it, err := store.NewIterator(ctx, c.opts)
+			if err != nil {
+				t.Fatalf("NewIterator failed: %v", err)
+			}
+			if got := collect(t, it); !slices.Equal(got, c.want) {
+				t.Errorf("Got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// Test that Seek repositions forward and reverse iterators
+func TestMemStore_IteratorSeek(t *testing.T) {
+	mock := &MockWriter{}
+	store := NewMemStore(mock)
+	defer store.Close(context.Background())
+
+	ctx := context.Background()
+	for _, k := range []string{"b", "d", "f", "h"} {
+		store.Put(ctx, k, []byte("v:"+k))
+	}
+
+	it, _ := store.NewIterator(ctx, IterOptions{})
+	it.Seek("c")
+	if got := collect(t, it); !slices.Equal(got, []string{"d", "f", "h"}) {
+		t.Errorf("Forward seek: got %v", got)
+	}
+
+	it, _ = store.NewIterator(ctx, IterOptions{Reverse: true})
+	it.Seek("e")
+	if got := collect(t, it); !slices.Equal(got, []string{"d", "b"}) {
+		t.Errorf("Reverse seek: got %v", got)
+	}
+
+	// Seeking below the lower bound clamps to it
+	it, _ = store.NewIterator(ctx, IterOptions{Lower: "e"})
+	it.Seek("a")
+	if got := collect(t, it); !slices.Equal(got, []string{"f", "h"}) {
+		t.Errorf("Clamped seek: got %v", got)
+	}
+
+	// Seek works again after the iterator is exhausted
+	it, _ = store.NewIterator(ctx, IterOptions{})
+	for it.Next() {
+	}
+	it.Seek("f")
+	if got := collect(t, it); !slices.Equal(got, []string{"f", "h"}) {
+		t.Errorf("Seek after exhaustion: got %v", got)
+	}
+}
+
+// Test that iterators report a closed store and return defensive copies
+func TestMemStore_IteratorClosedAndCopies(t *testing.T) {
+	mock := &MockWriter{}
+	store := NewMemStore(mock)
+
+	ctx := context.Background()
+	store.Put(ctx, "key", []byte("value"))
+
+	it, _ := store.NewIterator(ctx, IterOptions{})
+	it.Next()
+	it.Value()[0] = 'X'
+
+	if got, _ := store.Get(ctx, "key"); string(got) != "value" {
+		t.Errorf("Iterator did not make a defensive copy, store has %q", got)
+	}
+
+	store.Close(ctx)
+
+	if it.Next() || it.Err() != ErrStoreClosed {
+		t.Errorf("Expected ErrStoreClosed from live iterator, got %v", it.Err())
+	}
+	if _, err := store.NewIterator(ctx, IterOptions{}); err != ErrStoreClosed {
+		t.Errorf("Expected ErrStoreClosed, got %v", err)
+	}
+}
+
+// Test that an iterator reads a snapshot taken when it was created
+func TestMemStore_IteratorSnapshot(t *testing.T) {
+	mock := &MockWriter{}
+	store := NewMemStore(mock)
+	defer store.Close(context.Background())
+
+	ctx := context.Background()
+	for _, k := range []string{"a", "b", "c"} {
+		store.Put(ctx, k, []byte("v:"+k))
+	}
+
+	it, _ := store.NewIterator(ctx, IterOptions{})
+
+	// None of these should be visible to the iterator
+	store.Put(ctx, "a", []byte("changed"))
+	store.Delete(ctx, "b")
+	store.Put(ctx, "bb", []byte("new"))
+
+	if got := collect(t, it); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("Got %v, want the keys as of iterator creation", got)
+	}
+
+	it, _ = store.NewIterator(ctx, IterOptions{})
+	defer it.Close()
+
+	var got []string
+	for it.Next() {
+		got = append(got, it.Key())
+	}
+	if !slices.Equal(got, []string{"a", "bb", "c"}) {
+		t.Errorf("New iterator should see the latest state, got %v", got)
+	}
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"hash/fnv"
+	"slices"
+	"sync"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// keyLockStripes is the number of locks that writes are spread over by key
+const keyLockStripes = 64
+
+// keyLocks serializes writes to the same key without serializing all writes.
+// Keys are hashed onto a fixed set of stripes, so unrelated keys only
+// contend when they happen to share one.
+type keyLocks [keyLockStripes]sync.Mutex
+
+// lock takes the stripe locks of every key in ops and returns a function
+// that releases them. Stripes are always taken in ascending order so two
+// batches touching the same keys cannot deadlock.
+func (k *keyLocks) lock(ops []*wal.LogEntry) func() {
+	stripes := make([]uint32, 0, len(ops))
+	for _, op := range ops {
+		h := fnv.New32a()
+		h.Write(op.Key)
+		stripes = append(stripes, h.Sum32()%keyLockStripes)
+	}
+
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	for _, i := range stripes {
+		k[i].Lock()
+	}
+
+	return func() {
+		for _, i := range stripes {
+			k[i].Unlock()
+		}
+	}
+}
@@ -22,6 +22,18 @@ type Store interface {
 	// Returns ErrStoreClosed if the store is no longer active.
 	Delete (ctx context.Context, key string) error
 
+	// Apply commits every operation in the batch atomically: after a crash
+	// either all of them are recovered or none are, and concurrent readers
+	// never observe a partially applied batch. An empty batch is a no-op.
+	// Returns ErrInvalidKey if any key in the batch is empty.
+	// Returns ErrStoreClosed if the store is no longer active.
+	Apply (ctx context.Context, batch *WriteBatch) error
+
+	// NewIterator returns an iterator over the keys selected by opts, in
+	// ascending order or descending if opts.Reverse is set.
+	// Returns ErrStoreClosed if the store is no longer active.
+	NewIterator (ctx context.Context, opts IterOptions) (Iterator, error)
+
 	// Close gracefully shuts down the store, flushing any pending writes.
 	// After Close is called, all other methods should return ErrStoreClosed.
 	Close(ctx context.Context) error
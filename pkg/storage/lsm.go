@@ -0,0 +1,402 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"com.github/mune-0/anchor/pkg/sstable"
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// maxFrozenMemtables is how many memtables may wait to be flushed before
+// writes are held back until the flusher catches up
+const maxFrozenMemtables = 2
+
+// l0StallFactor times Options.L0CompactionTrigger is how many level 0 files
+// there may be before writes are held back until compaction catches up
+const l0StallFactor = 3
+
+// LSMStore is a log-structured merge tree implementation of Store.
+//
+// Writes go to the WAL and then to an in-memory memtable. Once the memtable
+// grows past Options.MemtableSize it is frozen, a fresh one takes over, and a
+// background goroutine writes the frozen one out as an immutable sorted table
+// file in level 0. After that the WAL segments holding its entries are deleted.
+// A second goroutine compacts table files down the levels, see lsm_compaction.go.
+//
+// Reads check the memtable, then the frozen memtables, then the table files,
+// always newest first, and take the first entry found for the key. A delete
+// is stored as a tombstone entry so it hides older values further down.
+type LSMStore struct {
+	dir string
+	log *wal.Writer
+	opts Options
+	closed atomic.Bool
+
+	// version is what reads consult. It is replaced as a whole, always
+	// through setVersion, so iterators get a consistent set.
+	version atomic.Pointer[lsmVersion]
+
+	// installMut serializes changes to the table files and the manifest.
+	// checkpoint is the first LSN not covered by a table, manifestState is
+	// the tree the manifest describes.
+	installMut sync.Mutex
+	checkpoint uint64
+	manifest *manifestLog
+	manifestState *manifestState
+
+	// Same roles as in MemStore
+	writeMut sync.RWMutex
+	keyLocks keyLocks
+	applyMut sync.Mutex
+	lastSeq uint64
+	visible atomic.Uint64
+	snapshots snapshotSet
+	sync wal.SyncPolicy
+
+	// nextFile numbers table files and manifests, see tableName and manifestName
+	nextFile atomic.Uint64
+
+	// flushReq and compactReq wake the background goroutines, stop shuts them down
+	flushReq chan struct{}
+	compactReq chan struct{}
+	stop chan struct{}
+	background sync.WaitGroup
+
+	// bgDone is closed and replaced every time a flush or compaction
+	// finishes, bgErr is the failure that stopped them, if any
+	bgMut sync.Mutex
+	bgDone chan struct{}
+	bgErr error
+
+	// Only touched by the compactor, see lsm_compaction.go
+	compactPointer [numLevels][]byte
+
+	statsMut sync.Mutex
+	stats LSMStats
+
+	recovery RecoveryInfo
+}
+
+// OpenLSMStore opens the LSM store in dir, creating it if needed. The table
+// files listed in the manifest are loaded and whatever the WAL holds beyond
+// them is replayed into the memtable before the store is returned.
+func OpenLSMStore(dir string, opts Options) (*LSMStore, error) {
+	opts = opts.withDefaults()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &LSMStore{
+		dir: dir,
+		opts: opts,
+		sync: opts.WAL.Sync,
+		flushReq: make(chan struct{}, 1),
+		compactReq: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		bgDone: make(chan struct{}),
+	}
+
+	levels, err := l.loadTables()
+	if err != nil {
+		return nil, err
+	}
+	l.version.Store(newVersion(newMemtable(), nil, levels))
+
+	info, err := replay(dir, opts.WAL, l.checkpoint, func(e *wal.LogEntry) error {
+		ops, err := entryOps(e)
+		if err != nil {
+			return err
+		}
+		l.apply(ops)
+		return nil
+	})
+	if err != nil {
+		l.manifest.close()
+		l.version.Load().unref()
+		return nil, fmt.Errorf("WAL recovery failed: %w", err)
+	}
+
+	w, err := wal.Open(dir, opts.WAL)
+	if err != nil {
+		l.manifest.close()
+		l.version.Load().unref()
+		return nil, err
+	}
+
+	// A crash between installing a table and removing the log behind it
+	// leaves segments that replay skipped, get rid of them now
+	if _, err := w.RemoveBefore(l.checkpoint); err != nil {
+		w.Close()
+		l.manifest.close()
+		l.version.Load().unref()
+		return nil, err
+	}
+
+	l.log = w
+	l.recovery = info
+
+	l.background.Add(2)
+	go l.flushLoop()
+	go l.compactLoop()
+	l.requestCompaction()
+	return l, nil
+}
+
+// Recovery returns the outcome of the WAL replay done by OpenLSMStore
+func (l *LSMStore) Recovery() RecoveryInfo {
+	return l.recovery
+}
+
+// currentVersion returns the current version with a reference taken, or nil
+// once the store is closed. The caller must unref it when done.
+func (l *LSMStore) currentVersion() *lsmVersion {
+	for {
+		v := l.version.Load()
+		if v.tryRef() {
+			return v
+		}
+		// Only Close releases a version without replacing it
+		if l.closed.Load() && l.version.Load() == v {
+			return nil
+		}
+	}
+}
+
+// setVersion replaces the current version with the one next builds from it
+func (l *LSMStore) setVersion(next func(cur *lsmVersion) *lsmVersion) {
+	var old *lsmVersion
+	l.snapshots.swap(func() {
+		old = l.version.Load()
+		l.version.Store(next(old))
+	})
+	old.unref()
+}
+
+// Get returns a value by key
+func (l *LSMStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(key) == "" {
+		return nil, ErrInvalidKey
+	}
+
+	if l.closed.Load() {
+		return nil, ErrStoreClosed
+	}
+
+	value, found, err := l.lookup(strings.TrimSpace(key))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// lookup returns a copy of the newest visible value of key.
+// found is false if the key does not exist or was deleted.
+func (l *LSMStore) lookup(key string) (value []byte, found bool, err error) {
+retry:
+	for {
+		// Load visible before the version, see MemStore.lookup
+		seq := l.visible.Load()
+		v := l.currentVersion()
+		if v == nil {
+			return nil, false, ErrStoreClosed
+		}
+
+		for _, table := range v.memtables() {
+			n := table.find(key)
+			if n == nil {
+				continue
+			}
+
+			if ver := n.at(seq); ver != nil {
+				v.unref()
+				if ver.deleted {
+					return nil, false, nil
+				}
+
+				// Defensive copy
+				snapshot := make([]byte, len(ver.value))
+				copy(snapshot, ver.value)
+				return snapshot, true, nil
+			}
+
+			// Every version here is newer than seq. If seq is still current
+			// the key simply did not exist yet at seq, so look further down.
+			if l.visible.Load() != seq {
+				v.unref()
+				continue retry
+			}
+		}
+
+		defer v.unref()
+		for _, f := range v.filesFor([]byte(key)) {
+			value, kind, err := f.reader.Get([]byte(key))
+			if err == sstable.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			// Blocks are read into fresh buffers, the value is ours to hand out
+			return value, kind == sstable.KindPut, nil
+		}
+		return nil, false, nil
+	}
+}
+
+// Put stores a key-value pair
+func (l *LSMStore) Put(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(key) == "" {
+		return ErrInvalidKey
+	}
+
+	// Defensive copy
+	snapshot := make([]byte, len(value))
+	copy(snapshot, value)
+
+	entry := &wal.LogEntry{
+		Timestamp: time.Now().UnixNano(),
+		Op: wal.OpPut,
+		Key: []byte(key),
+		Value: snapshot,
+	}
+
+	return l.write(ctx, entry, []*wal.LogEntry{entry})
+}
+
+// Delete removes a key by writing a tombstone for it
+func (l *LSMStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(key) == "" {
+		return ErrInvalidKey
+	}
+
+	entry := &wal.LogEntry{
+		Timestamp: time.Now().UnixNano(),
+		Op: wal.OpDelete,
+		Key: []byte(key),
+	}
+
+	return l.write(ctx, entry, []*wal.LogEntry{entry})
+}
+
+// Apply commits all operations in batch as a single WAL record
+func (l *LSMStore) Apply(ctx context.Context, batch *WriteBatch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := batch.validate(); err != nil {
+		return err
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	record := wal.NewBatchEntry(time.Now().UnixNano(), batch.ops)
+	return l.write(ctx, record, batch.ops)
+}
+
+// write logs record to the WAL and then applies ops to the memtable,
+// the same way MemStore.write does
+func (l *LSMStore) write(ctx context.Context, record *wal.LogEntry, ops []*wal.LogEntry) error {
+	if err := l.makeRoom(ctx); err != nil {
+		return err
+	}
+
+	l.writeMut.RLock()
+	defer l.writeMut.RUnlock()
+
+	if l.closed.Load() {
+		return ErrStoreClosed
+	}
+
+	unlock := l.keyLocks.lock(ops)
+	defer unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := l.logEntry(ctx, record); err != nil {
+		return fmt.Errorf("WAL failure (data safe, update aborted): %w", err)
+	}
+
+	l.apply(ops)
+	return nil
+}
+
+// apply adds ops to the active memtable under one new sequence number and
+// then makes them visible together
+func (l *LSMStore) apply(ops []*wal.LogEntry) {
+	l.applyMut.Lock()
+	defer l.applyMut.Unlock()
+
+	table := l.version.Load().mem
+	seq := l.lastSeq + 1
+	keep := l.snapshots.oldest(l.visible.Load())
+
+	for _, op := range ops {
+		table.add(string(op.Key), seq, op.Value, op.Op == wal.OpDelete, keep)
+	}
+
+	l.lastSeq = seq
+	l.visible.Store(seq)
+}
+
+// logEntry appends entry to the WAL according to the store's sync policy
+func (l *LSMStore) logEntry(ctx context.Context, entry *wal.LogEntry) error {
+	if l.sync == wal.SyncAlways {
+		_, err := l.log.SyncWrite(ctx, entry)
+		return err
+	}
+
+	_, err := l.log.Write(ctx, entry)
+	return err
+}
+
+// Close stops the background flusher and compactor and closes the WAL.
+// Table files are closed once the last open iterator is done with them.
+// Whatever is still in memory stays in the WAL and is replayed on the next open.
+func (l *LSMStore) Close(ctx context.Context) error {
+	// Wait for in-flight writes to finish with the WAL
+	l.writeMut.Lock()
+	if l.closed.Load() {
+		l.writeMut.Unlock()
+		return ErrStoreClosed
+	}
+	l.closed.Store(true)
+	l.writeMut.Unlock()
+
+	// Lets a flush or compaction in progress finish first
+	close(l.stop)
+	l.background.Wait()
+
+	err := l.log.Close()
+	if merr := l.manifest.close(); err == nil {
+		err = merr
+	}
+	l.version.Load().unref()
+	return err
+}
@@ -0,0 +1,367 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"com.github/mune-0/anchor/pkg/sstable"
+)
+
+// LSMStats describes the shape of an LSM tree and the work spent building it
+type LSMStats struct {
+	// Levels holds one entry per level, level 0 first
+	Levels []LevelStats
+
+	Flushes int64
+	BytesFlushed int64
+
+	// Compactions includes files moved down a level without being
+	// rewritten, which add nothing to the byte counts
+	Compactions int64
+	CompactionBytesIn int64
+	CompactionBytesOut int64
+
+	// Filter sums up how lookups used the Bloom filters of the table files
+	// currently in the tree
+	Filter sstable.FilterStats
+}
+
+// LevelStats describes the table files in one level
+type LevelStats struct {
+	Files int
+	Bytes int64
+}
+
+// WriteAmplification returns how many bytes were written to table files for
+// each byte flushed from memory, or 0 before the first flush
+func (s LSMStats) WriteAmplification() float64 {
+	if s.BytesFlushed == 0 {
+		return 0
+	}
+	return float64(s.BytesFlushed+s.CompactionBytesOut) / float64(s.BytesFlushed)
+}
+
+// Stats returns the current level sizes and the flush and compaction totals
+func (l *LSMStore) Stats() LSMStats {
+	l.statsMut.Lock()
+	stats := l.stats
+	l.statsMut.Unlock()
+
+	v := l.version.Load()
+	stats.Levels = make([]LevelStats, numLevels)
+	for i, level := range v.levels {
+		stats.Levels[i] = LevelStats{Files: len(level), Bytes: v.levelSize(i)}
+		for _, f := range level {
+			fs := f.reader.FilterStats()
+			stats.Filter.Hits += fs.Hits
+			stats.Filter.FalsePositives += fs.FalsePositives
+			stats.Filter.Misses += fs.Misses
+		}
+	}
+	return stats
+}
+
+// compaction merges inputs[0] from level with the files of the next level
+// they overlap, inputs[1], into new files in the next level
+type compaction struct {
+	version *lsmVersion
+	level int
+	inputs [2][]*tableFile
+}
+
+// requestCompaction wakes the compactor to check whether any level is too big
+func (l *LSMStore) requestCompaction() {
+	select {
+	case l.compactReq <- struct{}{}:
+	default:
+	}
+}
+
+// compactLoop runs compactions until no level needs one, each time it is
+// woken up, until Close
+func (l *LSMStore) compactLoop() {
+	defer l.background.Done()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.compactReq:
+		}
+
+		for {
+			c := l.pickCompaction()
+			if c == nil {
+				break
+			}
+
+			err := l.compact(c)
+			c.version.unref()
+			if err != nil {
+				err = fmt.Errorf("compaction failure: %w", err)
+			}
+			l.finishJob(err)
+
+			if err != nil {
+				// Reads still work, the files involved are left as they were
+				return
+			}
+
+			select {
+			case <-l.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// pickCompaction returns the compaction for the level furthest over its
+// limit, or nil if every level is within bounds
+func (l *LSMStore) pickCompaction() *compaction {
+	v := l.currentVersion()
+	if v == nil {
+		return nil
+	}
+
+	level := l.compactionLevel(v)
+	if level < 0 {
+		v.unref()
+		return nil
+	}
+
+	c := &compaction{version: v, level: level}
+	if level == 0 {
+		// Level 0 files overlap, so all of them go down together
+		c.inputs[0] = v.levels[0]
+	} else {
+		c.inputs[0] = []*tableFile{l.nextInput(v, level)}
+	}
+
+	smallest, largest := keyRange(c.inputs[0])
+	c.inputs[1] = v.overlapping(level+1, smallest, largest)
+	return c
+}
+
+// compactionLevel returns the level of v furthest over its limit, or -1 if
+// every level is within bounds.
+//
+// Level 0 is scored by its file count against Options.L0CompactionTrigger,
+// since every one of its files is checked by reads. Deeper levels are scored
+// by their size against BaseLevelSize times LevelSizeRatio for every level
+// below 1. The last level has no limit.
+func (l *LSMStore) compactionLevel(v *lsmVersion) int {
+	best, bestScore := -1, 1.0
+	if score := float64(len(v.levels[0])) / float64(l.opts.L0CompactionTrigger); score >= bestScore {
+		best, bestScore = 0, score
+	}
+
+	limit := float64(l.opts.BaseLevelSize)
+	for level := 1; level < numLevels-1; level++ {
+		if score := float64(v.levelSize(level)) / limit; score >= bestScore {
+			best, bestScore = level, score
+		}
+		limit *= float64(l.opts.LevelSizeRatio)
+	}
+	return best
+}
+
+// nextInput picks the file of level that follows the one its last
+// compaction took, so that compactions move through the key space in turn
+func (l *LSMStore) nextInput(v *lsmVersion, level int) *tableFile {
+	files := v.levels[level]
+	pointer := l.compactPointer[level]
+
+	pick := files[0]
+	if pointer != nil {
+		for _, f := range files {
+			if string(f.smallest) > string(pointer) {
+				pick = f
+				break
+			}
+		}
+	}
+	l.compactPointer[level] = pick.largest
+	return pick
+}
+
+// keyRange returns the smallest and largest key held by files
+func keyRange(files []*tableFile) (smallest, largest []byte) {
+	for i, f := range files {
+		if i == 0 || string(f.smallest) < string(smallest) {
+			smallest = f.smallest
+		}
+		if i == 0 || string(f.largest) > string(largest) {
+			largest = f.largest
+		}
+	}
+	return smallest, largest
+}
+
+// compact runs c and installs its result
+func (l *LSMStore) compact(c *compaction) error {
+	edit := &versionEdit{deleted: make(map[uint64]bool)}
+	var bytesIn int64
+	for _, files := range c.inputs {
+		for _, f := range files {
+			edit.deleted[f.num] = true
+			bytesIn += f.size
+		}
+	}
+
+	// A single file with nothing to merge with just changes levels
+	if len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 {
+		edit.added[c.level+1] = c.inputs[0]
+		if err := l.install(edit); err != nil {
+			return err
+		}
+
+		l.statsMut.Lock()
+		l.stats.Compactions++
+		l.statsMut.Unlock()
+		return nil
+	}
+
+	outputs, err := l.writeCompaction(c)
+	if err != nil {
+		return err
+	}
+
+	edit.added[c.level+1] = outputs
+	if err := l.install(edit); err != nil {
+		discardFiles(outputs)
+		return err
+	}
+
+	var bytesOut int64
+	for _, f := range outputs {
+		bytesOut += f.size
+	}
+
+	l.statsMut.Lock()
+	l.stats.Compactions++
+	l.stats.CompactionBytesIn += bytesIn
+	l.stats.CompactionBytesOut += bytesOut
+	l.statsMut.Unlock()
+	return nil
+}
+
+// writeCompaction merges the inputs of c into new table files of about
+// Options.TargetFileSize each. Only the newest entry of each key is kept,
+// and tombstones are dropped once no deeper level can hold an older value.
+func (l *LSMStore) writeCompaction(c *compaction) ([]*tableFile, error) {
+	// Newest first, which is how level 0 is already ordered
+	var sources []lsmSource
+	if c.level == 0 {
+		for _, f := range c.inputs[0] {
+			sources = append(sources, &levelSource{files: []*tableFile{f}})
+		}
+	} else {
+		sources = append(sources, &levelSource{files: c.inputs[0]})
+	}
+	sources = append(sources, &levelSource{files: c.inputs[1]})
+
+	var outputs []*tableFile
+	var w *sstable.Writer
+	var num uint64
+
+	// finish closes the current output and opens it for reading
+	finish := func() error {
+		defer func() { w = nil }()
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		r, err := sstable.Open(filepath.Join(l.dir, tableName(num)))
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, newTableFile(num, r))
+		return nil
+	}
+
+	fail := func(err error) ([]*tableFile, error) {
+		if w != nil {
+			w.Abort()
+		}
+		discardFiles(outputs)
+		return nil, err
+	}
+
+	for _, src := range sources {
+		src.seekGE("")
+	}
+
+	for src := pickSource(sources, false); src != nil; src = pickSource(sources, false) {
+		key := src.key()
+		if !src.deleted() || l.olderValues(c, []byte(key)) {
+			if w == nil {
+				num = l.nextFile.Add(1)
+				var err error
+				if w, err = sstable.NewWriter(filepath.Join(l.dir, tableName(num)), l.tableOptions()); err != nil {
+					return fail(err)
+				}
+			}
+
+			kind := sstable.KindPut
+			if src.deleted() {
+				kind = sstable.KindDelete
+			}
+			if err := w.Add([]byte(key), src.value(), kind); err != nil {
+				return fail(err)
+			}
+
+			if w.EstimatedSize() >= uint64(l.opts.TargetFileSize) {
+				if err := finish(); err != nil {
+					return fail(err)
+				}
+			}
+		}
+
+		// Older entries for the key are shadowed
+		for _, s := range sources {
+			if s.valid() && s.key() == key {
+				s.next()
+			}
+		}
+	}
+
+	for _, src := range sources {
+		if err := src.err(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if w != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := syncDir(l.dir); err != nil {
+		return fail(err)
+	}
+	return outputs, nil
+}
+
+// olderValues reports whether a level below the output of c may still hold
+// a value for key, which a tombstone has to keep hiding
+func (l *LSMStore) olderValues(c *compaction, key []byte) bool {
+	for _, level := range c.version.levels[c.level+2:] {
+		for _, f := range level {
+			if f.contains(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// discardFiles closes and deletes table files that never made it into a version
+func discardFiles(files []*tableFile) {
+	for _, f := range files {
+		path := f.reader.Path()
+		f.reader.Close()
+		os.Remove(path)
+	}
+}
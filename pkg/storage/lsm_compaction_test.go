@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// openCompacting opens an LSM store with levels small enough that a few
+// thousand writes reach level 2
+func openCompacting(t *testing.T, dir string) *LSMStore {
+	t.Helper()
+
+	store, err := OpenLSMStore(dir, Options{
+		WAL: wal.Options{Sync: wal.SyncNever, SegmentSize: 4096},
+		MemtableSize: 8 * 1024,
+		L0CompactionTrigger: 2,
+		BaseLevelSize: 32 * 1024,
+		LevelSizeRatio: 2,
+		TargetFileSize: 8 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return store
+}
+
+// waitForCompaction flushes the store and waits until no level needs compacting
+func waitForCompaction(t *testing.T, store *LSMStore) {
+	t.Helper()
+
+	if err := store.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for store.compactionLevel(store.version.Load()) >= 0 {
+		if _, err := store.backgroundState(); err != nil {
+			t.Fatalf("Background failure: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Compaction did not finish: %+v", store.Stats().Levels)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// checkLevels fails if a level below 0 is out of order or has overlapping files
+func checkLevels(t *testing.T, store *LSMStore) {
+	t.Helper()
+
+	v := store.version.Load()
+	for i, level := range v.levels[1:] {
+		for j := 1; j < len(level); j++ {
+			if bytes.Compare(level[j-1].largest, level[j].smallest) >= 0 {
+				t.Errorf("Level %d: files %d and %d overlap", i+1, level[j-1].num, level[j].num)
+			}
+		}
+	}
+}
+
+// Test that overwrites and deletes survive compaction into deeper levels
+func TestLSMCompaction_Levels(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openCompacting(t, dir)
+	defer store.Close(ctx)
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	model := make(map[string]string)
+	for i := range 20000 {
+		key := fmt.Sprintf("key-%04d", rng.IntN(2000))
+		if rng.IntN(5) == 0 {
+			store.Delete(ctx, key)
+			delete(model, key)
+			continue
+		}
+		value := fmt.Sprintf("v:%s:%d", key, i)
+		if err := store.Put(ctx, key, []byte(value)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		model[key] = value
+	}
+	waitForCompaction(t, store)
+	checkLevels(t, store)
+
+	stats := store.Stats()
+	if stats.Levels[0].Files >= 2 || stats.Levels[2].Files == 0 {
+		t.Errorf("Expected data to move down to level 2, got %+v", stats.Levels)
+	}
+
+	for i := range 2000 {
+		key := fmt.Sprintf("key-%04d", i)
+		got, err := store.Get(ctx, key)
+		want, ok := model[key]
+		if !ok {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expected %s to be deleted, got %v", key, err)
+			}
+			continue
+		}
+		if err != nil || string(got) != want {
+			t.Fatalf("Get %s: expected %s, got %s (%v)", key, want, got, err)
+		}
+	}
+
+	it, _ := store.NewIterator(ctx, IterOptions{})
+	count := 0
+	for it.Next() {
+		if model[it.Key()] != string(it.Value()) {
+			t.Fatalf("Iterator: unexpected %s=%s", it.Key(), it.Value())
+		}
+		count++
+	}
+	it.Close()
+	if count != len(model) || it.Err() != nil {
+		t.Errorf("Expected %d keys, got %d (%v)", len(model), count, it.Err())
+	}
+}
+
+// compactLevel runs the compaction of every file in level into the next one,
+// whether or not the level is over its limit
+func compactLevel(t *testing.T, store *LSMStore, level int) {
+	t.Helper()
+
+	v := store.currentVersion()
+	defer v.unref()
+
+	c := &compaction{version: v, level: level, inputs: [2][]*tableFile{v.levels[level]}}
+	smallest, largest := keyRange(c.inputs[0])
+	c.inputs[1] = v.overlapping(level+1, smallest, largest)
+	if err := store.compact(c); err != nil {
+		t.Fatalf("Compaction of level %d failed: %v", level, err)
+	}
+}
+
+// Test that tombstones and the values they hide are gone once nothing deeper is left
+func TestLSMCompaction_DropsTombstones(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// Flushes and compactions only happen when the test asks for them
+	store, err := OpenLSMStore(dir, Options{
+		WAL: wal.Options{Sync: wal.SyncNever},
+		MemtableSize: 1 << 20,
+		L0CompactionTrigger: 100,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close(ctx)
+
+	for i := range 100 {
+		store.Put(ctx, fmt.Sprintf("key-%04d", i), []byte("value"))
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	for i := range 100 {
+		store.Delete(ctx, fmt.Sprintf("key-%04d", i))
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if files := store.Stats().Levels[0].Files; files != 2 {
+		t.Fatalf("Expected the puts and the deletes in 2 level 0 files, got %d", files)
+	}
+	compactLevel(t, store, 0)
+
+	for i, level := range store.Stats().Levels {
+		if level.Files != 0 {
+			t.Errorf("Expected level %d to be empty, got %+v", i, level)
+		}
+	}
+	if files := tableFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected replaced table files to be deleted, got %v", files)
+	}
+}
+
+// Test that the levels are recovered from the manifest and stray table files removed
+func TestLSMCompaction_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openCompacting(t, dir)
+	for i := range 5000 {
+		store.Put(ctx, fmt.Sprintf("key-%04d", i%1500), []byte(fmt.Sprint(i)))
+	}
+	waitForCompaction(t, store)
+	before := store.Stats().Levels
+	store.Close(ctx)
+
+	// A table written by a compaction that never got installed
+	stray := filepath.Join(dir, tableName(999999))
+	os.WriteFile(stray, []byte("partial"), 0644)
+
+	store = openCompacting(t, dir)
+	defer store.Close(ctx)
+
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Error("Expected the stray table file to be removed")
+	}
+	if after := store.Stats().Levels; fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("Expected levels %v, got %v", before, after)
+	}
+	checkLevels(t, store)
+
+	for i := 3500; i < 5000; i++ {
+		got, err := store.Get(ctx, fmt.Sprintf("key-%04d", i%1500))
+		if err != nil || string(got) != fmt.Sprint(i) {
+			t.Fatalf("Get key-%04d: got %s (%v)", i%1500, got, err)
+		}
+	}
+}
+
+// Test that flush and compaction work is counted
+func TestLSMCompaction_Stats(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openCompacting(t, dir)
+	defer store.Close(ctx)
+
+	if amp := store.Stats().WriteAmplification(); amp != 0 {
+		t.Errorf("Expected no write amplification before the first flush, got %f", amp)
+	}
+
+	for i := range 5000 {
+		store.Put(ctx, fmt.Sprintf("key-%04d", i%1000), bytes.Repeat([]byte("v"), 32))
+	}
+	waitForCompaction(t, store)
+
+	stats := store.Stats()
+	if stats.Flushes == 0 || stats.BytesFlushed == 0 {
+		t.Errorf("Expected flushes to be counted, got %+v", stats)
+	}
+	if stats.Compactions == 0 || stats.CompactionBytesIn == 0 || stats.CompactionBytesOut == 0 {
+		t.Errorf("Expected compactions to be counted, got %+v", stats)
+	}
+	if amp := stats.WriteAmplification(); amp <= 1 {
+		t.Errorf("Expected write amplification above 1, got %f", amp)
+	}
+}
@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"com.github/mune-0/anchor/pkg/sstable"
+)
+
+// tableExt is the extension of LSM table files
+const tableExt = ".sst"
+
+// tableName returns the file name of table number num
+func tableName(num uint64) string {
+	return fmt.Sprintf("%06d%s", num, tableExt)
+}
+
+// loadTables opens the table files the manifest lists and sets the file
+// counter and WAL checkpoint from it, then starts a fresh manifest. Table
+// files it does not list and leftovers from writes that did not finish are
+// removed.
+//
+// A directory without a manifest but with table files was written before
+// there were levels. Its tables are taken into level 0. The WAL only holds
+// entries newer than every table, so all of it is replayed.
+func (l *LSMStore) loadTables() ([numLevels][]*tableFile, error) {
+	var levels [numLevels][]*tableFile
+
+	state, ok, err := readManifest(l.dir)
+	if err != nil {
+		return levels, err
+	}
+
+	nums, err := listTables(l.dir)
+	if err != nil {
+		return levels, err
+	}
+
+	if !ok {
+		state = newManifestState()
+		for _, num := range nums {
+			state.files[num] = manifestFile{level: 0, num: num}
+		}
+	}
+
+	for _, mf := range state.files {
+		r, err := sstable.Open(filepath.Join(l.dir, tableName(mf.num)))
+		if err != nil {
+			closeLevels(levels)
+			return levels, err
+		}
+		levels[mf.level] = append(levels[mf.level], newTableFile(mf.num, r))
+	}
+
+	// Puts every level in order
+	levels = (&versionEdit{added: levels}).apply(&lsmVersion{})
+
+	next := state.nextFile
+	for _, num := range nums {
+		next = max(next, num)
+		if _, ok := state.files[num]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.dir, tableName(num))); err != nil {
+			closeLevels(levels)
+			return levels, err
+		}
+	}
+
+	// Starting over also leaves a torn edit at the end of the old manifest behind
+	num := next + 1
+	l.nextFile.Store(num)
+	l.checkpoint = state.checkpoint
+
+	state.nextFile = num
+	clear(state.files)
+	for i, level := range levels {
+		for _, f := range level {
+			state.files[f.num] = describeFile(i, f)
+		}
+	}
+
+	m, err := createManifest(l.dir, num, state)
+	if err != nil {
+		closeLevels(levels)
+		return levels, err
+	}
+	l.manifest, l.manifestState = m, state
+	return levels, nil
+}
+
+// listTables returns the numbers of the table files in dir, removing
+// temporary files left behind by a crash
+func listTables(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var nums []uint64
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, tableExt+".tmp") || name == currentName+".tmp" {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, tableExt) {
+			continue
+		}
+
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, tableExt), 10, 64)
+		if err != nil {
+			continue // Not one of ours
+		}
+		nums = append(nums, num)
+	}
+	return nums, nil
+}
+
+// closeLevels closes table files that no version holds yet
+func closeLevels(levels [numLevels][]*tableFile) {
+	for _, level := range levels {
+		for _, f := range level {
+			f.reader.Close()
+		}
+	}
+}
+
+// makeRoom is called before a write. It holds the write back while too many
+// memtables are waiting to be flushed, and freezes the active memtable once
+// it has grown past the threshold.
+func (l *LSMStore) makeRoom(ctx context.Context) error {
+	for {
+		done, err := l.backgroundState()
+		if err != nil {
+			return err
+		}
+
+		// Level 0 files all have to be checked by reads, so they are not
+		// allowed to pile up faster than compaction can merge them
+		v := l.version.Load()
+		if len(v.frozen) < maxFrozenMemtables && len(v.levels[0]) < l0StallFactor*l.opts.L0CompactionTrigger {
+			break
+		}
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.stop:
+			return ErrStoreClosed
+		}
+	}
+
+	if l.version.Load().mem.Size() < l.opts.MemtableSize {
+		return nil
+	}
+	return l.freeze(false)
+}
+
+// freeze swaps in a fresh memtable and hands the old one to the flusher.
+// Unless force is set, nothing happens if another write froze it first.
+func (l *LSMStore) freeze(force bool) error {
+	// No write may be between logging and applying while the WAL and the
+	// memtable are switched over, or its entry would end up on the wrong side
+	l.writeMut.Lock()
+	defer l.writeMut.Unlock()
+
+	if l.closed.Load() {
+		return ErrStoreClosed
+	}
+
+	size := l.version.Load().mem.Size()
+	if size == 0 || (!force && size < l.opts.MemtableSize) {
+		return nil
+	}
+
+	// The frozen memtable holds exactly the entries below next, so once it
+	// is flushed every segment before the new one can go
+	next, err := l.log.Rotate()
+	if err != nil {
+		return err
+	}
+
+	l.setVersion(func(cur *lsmVersion) *lsmVersion {
+		frozen := &frozenMemtable{table: cur.mem, next: next}
+		return newVersion(newMemtable(), append([]*frozenMemtable{frozen}, cur.frozen...), cur.levels)
+	})
+
+	select {
+	case l.flushReq <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush freezes the active memtable and waits until every frozen memtable
+// has been written to a table file
+func (l *LSMStore) Flush(ctx context.Context) error {
+	if err := l.freeze(true); err != nil {
+		return err
+	}
+
+	for {
+		done, err := l.backgroundState()
+		if err != nil {
+			return err
+		}
+
+		if len(l.version.Load().frozen) == 0 {
+			return nil
+		}
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.stop:
+			return ErrStoreClosed
+		}
+	}
+}
+
+// backgroundState returns a channel that is closed when the flusher or the
+// compactor next finishes a job, and the error that stopped one of them if
+// there was one
+func (l *LSMStore) backgroundState() (<-chan struct{}, error) {
+	l.bgMut.Lock()
+	defer l.bgMut.Unlock()
+	return l.bgDone, l.bgErr
+}
+
+// finishJob wakes everyone waiting in backgroundState
+func (l *LSMStore) finishJob(err error) {
+	l.bgMut.Lock()
+	defer l.bgMut.Unlock()
+
+	if l.bgErr == nil {
+		l.bgErr = err
+	}
+	close(l.bgDone)
+	l.bgDone = make(chan struct{})
+}
+
+// flushLoop writes frozen memtables to table files, oldest first, until Close
+func (l *LSMStore) flushLoop() {
+	defer l.background.Done()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.flushReq:
+		}
+
+		for {
+			v := l.version.Load()
+			if len(v.frozen) == 0 {
+				break
+			}
+
+			err := l.flush(v.frozen[len(v.frozen)-1])
+			if err != nil {
+				err = fmt.Errorf("flush failure: %w", err)
+			}
+			l.finishJob(err)
+
+			if err != nil {
+				// Writes fail from now on, the data is still safe in the WAL
+				return
+			}
+
+			select {
+			case <-l.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// flush writes f to a new level 0 table file, installs it in place of f and
+// removes the WAL segments it made redundant
+func (l *LSMStore) flush(f *frozenMemtable) error {
+	num := l.nextFile.Add(1)
+	path := filepath.Join(l.dir, tableName(num))
+
+	w, err := sstable.NewWriter(path, l.tableOptions())
+	if err != nil {
+		return err
+	}
+
+	// The table is frozen, so the newest version of each key is final.
+	// Tombstones are kept, they hide older values in older tables.
+	for n := f.table.seekGE(""); n != nil; n = n.next[0].Load() {
+		v := n.versions.Load()
+		kind := sstable.KindPut
+		if v.deleted {
+			kind = sstable.KindDelete
+		}
+		if err := w.Add([]byte(n.key), v.value, kind); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := syncDir(l.dir); err != nil {
+		return err
+	}
+
+	r, err := sstable.Open(path)
+	if err != nil {
+		return err
+	}
+
+	file := newTableFile(num, r)
+	edit := &versionEdit{flushed: f}
+	edit.added[0] = []*tableFile{file}
+	if err := l.install(edit); err != nil {
+		// The file is removed as an orphan on the next open
+		r.Close()
+		return err
+	}
+
+	l.statsMut.Lock()
+	l.stats.Flushes++
+	l.stats.BytesFlushed += file.size
+	l.statsMut.Unlock()
+
+	if _, err := l.log.RemoveBefore(f.next); err != nil {
+		return err
+	}
+
+	l.requestCompaction()
+	return nil
+}
+
+// install applies edit to the current version, first recording it in the
+// manifest. Files the edit deletes are removed from disk once the last
+// version using them is released.
+func (l *LSMStore) install(edit *versionEdit) error {
+	l.installMut.Lock()
+	defer l.installMut.Unlock()
+
+	cur := l.version.Load()
+	levels := edit.apply(cur)
+
+	me := &manifestEdit{
+		nextFile: l.nextFile.Load(),
+		lastLSN: l.log.LastLSN(),
+	}
+	if edit.flushed != nil {
+		me.checkpoint = edit.flushed.next
+	}
+	for i, level := range cur.levels {
+		for _, f := range level {
+			if edit.deleted[f.num] {
+				me.deleted = append(me.deleted, manifestFile{level: i, num: f.num})
+			}
+		}
+	}
+	for i, files := range edit.added {
+		for _, f := range files {
+			me.added = append(me.added, describeFile(i, f))
+		}
+	}
+
+	if err := l.manifest.append(me); err != nil {
+		return err
+	}
+	if err := l.manifestState.apply(me); err != nil {
+		return err
+	}
+	l.checkpoint = l.manifestState.checkpoint
+
+	// A file moved to another level is deleted and added again
+	live := make(map[uint64]bool)
+	for _, level := range levels {
+		for _, f := range level {
+			live[f.num] = true
+		}
+	}
+	for _, level := range cur.levels {
+		for _, f := range level {
+			if edit.deleted[f.num] && !live[f.num] {
+				f.obsolete.Store(true)
+			}
+		}
+	}
+
+	l.setVersion(func(cur *lsmVersion) *lsmVersion {
+		frozen := cur.frozen
+		if edit.flushed != nil {
+			frozen = slices.DeleteFunc(slices.Clone(frozen), func(x *frozenMemtable) bool { return x == edit.flushed })
+		}
+		return newVersion(cur.mem, frozen, levels)
+	})
+
+	if l.manifest.size > manifestRollSize {
+		return l.rollManifest()
+	}
+	return nil
+}
+
+// rollManifest moves on to a new manifest holding just the current state.
+// Caller must hold installMut.
+func (l *LSMStore) rollManifest() error {
+	num := l.nextFile.Add(1)
+	l.manifestState.nextFile = num
+
+	m, err := createManifest(l.dir, num, l.manifestState)
+	if err != nil {
+		return err
+	}
+
+	old := l.manifest
+	l.manifest = m
+	return old.close()
+}
+
+// tableOptions returns how table files of the store are laid out
+func (l *LSMStore) tableOptions() sstable.Options {
+	return sstable.Options{FilterBitsPerKey: max(l.opts.BloomBitsPerKey, 0)}
+}
+
+// syncDir fsyncs a directory so that files created or renamed in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
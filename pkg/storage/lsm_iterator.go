@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"com.github/mune-0/anchor/pkg/sstable"
+)
+
+// lsmSource is one sorted input of an lsmIterator or a compaction: a
+// memtable read at a snapshot or the table files of a level. Deletions are returned like any other entry.
+// The positioning methods report whether the source landed on an entry.
+type lsmSource interface {
+	seekGE(key string) bool
+	seekLT(key string) bool
+	last() bool
+	next() bool
+	prev() bool
+	valid() bool
+	key() string
+	value() []byte
+	deleted() bool
+	err() error
+}
+
+// lsmIterator merges the memtables and table files of one version.
+// Where several sources hold the same key the newest one wins, and keys
+// whose winning entry is a tombstone are skipped.
+//
+// Like memIterator it reads at a pinned snapshot, and the version it
+// merges is the one that was current when the snapshot was taken.
+type lsmIterator struct {
+	store *LSMStore
+	ctx context.Context
+	reverse bool
+	seq uint64
+	version *lsmVersion
+
+	// sources are ordered newest first
+	sources []lsmSource
+
+	lower string
+	upper string
+	hasUpper bool
+
+	// seek is where the next call to Next starts from when started is false
+	seek *string
+	started bool
+
+	key string
+	value []byte
+	err error
+	done bool
+	closed bool
+}
+
+// NewIterator returns an iterator over the keys selected by opts
+func (l *LSMStore) NewIterator(ctx context.Context, opts IterOptions) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if l.closed.Load() {
+		return nil, ErrStoreClosed
+	}
+
+	var v *lsmVersion
+	ok := false
+	seq := l.snapshots.acquire(&l.visible, func() {
+		v = l.version.Load()
+		ok = v.tryRef()
+	})
+	if !ok {
+		l.snapshots.release(seq)
+		return nil, ErrStoreClosed
+	}
+
+	it := &lsmIterator{
+		store: l,
+		ctx: ctx,
+		reverse: opts.Reverse,
+		seq: seq,
+		version: v,
+	}
+	for _, table := range v.memtables() {
+		it.sources = append(it.sources, &memSource{table: table, seq: seq})
+	}
+	it.sources = append(it.sources, levelSources(v)...)
+	it.lower, it.upper, it.hasUpper = opts.bounds()
+	return it, nil
+}
+
+func (it *lsmIterator) Seek(key string) {
+	if it.closed {
+		return
+	}
+	it.seek = &key
+	it.started = false
+	it.done = false
+}
+
+func (it *lsmIterator) Next() bool {
+	if it.done || it.err != nil {
+		return false
+	}
+
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		return false
+	}
+
+	if it.store.closed.Load() {
+		it.err = ErrStoreClosed
+		return false
+	}
+
+	if !it.started {
+		it.position()
+		it.started = true
+	} else {
+		it.step()
+	}
+
+	for {
+		src := it.pick()
+		if err := it.sourceErr(); err != nil {
+			it.err = err
+			return false
+		}
+
+		if src == nil || !it.inBounds(src.key()) {
+			it.done = true
+			it.value = nil
+			return false
+		}
+
+		it.key = src.key()
+		if src.deleted() {
+			it.step()
+			continue
+		}
+
+		// Defensive copy
+		it.value = make([]byte, len(src.value()))
+		copy(it.value, src.value())
+		return true
+	}
+}
+
+// position puts every source on its first candidate for the first Next
+func (it *lsmIterator) position() {
+	for _, src := range it.sources {
+		switch {
+		case !it.reverse:
+			start := it.lower
+			if it.seek != nil && *it.seek > start {
+				start = *it.seek
+			}
+			src.seekGE(start)
+		case it.seek != nil && (!it.hasUpper || *it.seek < it.upper):
+			// Largest key <= seek
+			src.seekLT(*it.seek + "\x00")
+		case it.hasUpper:
+			src.seekLT(it.upper)
+		default:
+			src.last()
+		}
+	}
+}
+
+// step moves every source sitting on the current key past it
+func (it *lsmIterator) step() {
+	for _, src := range it.sources {
+		if !src.valid() || src.key() != it.key {
+			continue
+		}
+		if it.reverse {
+			src.prev()
+		} else {
+			src.next()
+		}
+	}
+}
+
+// pick returns the source holding the next key in iteration order. On a tie
+// the newest source wins, older entries for the key are stale.
+func (it *lsmIterator) pick() lsmSource {
+	return pickSource(it.sources, it.reverse)
+}
+
+// pickSource returns the first of sources, which are ordered newest first,
+// holding the smallest key, or the largest one if reverse is set
+func pickSource(sources []lsmSource, reverse bool) lsmSource {
+	var best lsmSource
+	for _, src := range sources {
+		if !src.valid() {
+			continue
+		}
+		if best == nil ||
+			(!reverse && src.key() < best.key()) ||
+			(reverse && src.key() > best.key()) {
+			best = src
+		}
+	}
+	return best
+}
+
+func (it *lsmIterator) sourceErr() error {
+	for _, src := range it.sources {
+		if err := src.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inBounds reports whether key falls within [lower, upper)
+func (it *lsmIterator) inBounds(key string) bool {
+	if key < it.lower {
+		return false
+	}
+	return !it.hasUpper || key < it.upper
+}
+
+func (it *lsmIterator) Key() string {
+	return it.key
+}
+
+func (it *lsmIterator) Value() []byte {
+	return it.value
+}
+
+func (it *lsmIterator) Err() error {
+	return it.err
+}
+
+// Close releases the snapshot and the version held by the iterator
+func (it *lsmIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+
+	it.closed = true
+	it.done = true
+	it.value = nil
+	it.store.snapshots.release(it.seq)
+	it.version.unref()
+	return nil
+}
+
+// memSource reads a memtable at a sequence number, skipping keys that had
+// no version yet at that point
+type memSource struct {
+	table *memtable
+	seq uint64
+	node *memNode
+	ver *memVersion
+}
+
+func (s *memSource) seekGE(key string) bool {
+	return s.forward(s.table.seekGE(key))
+}
+
+func (s *memSource) seekLT(key string) bool {
+	return s.backward(s.table.seekLT(key))
+}
+
+func (s *memSource) last() bool {
+	return s.backward(s.table.last())
+}
+
+func (s *memSource) next() bool {
+	return s.forward(s.node.next[0].Load())
+}
+
+func (s *memSource) prev() bool {
+	return s.backward(s.table.seekLT(s.node.key))
+}
+
+// forward settles on n or the first node after it with a version at s.seq
+func (s *memSource) forward(n *memNode) bool {
+	for ; n != nil; n = n.next[0].Load() {
+		if v := n.at(s.seq); v != nil {
+			s.node, s.ver = n, v
+			return true
+		}
+	}
+	s.node, s.ver = nil, nil
+	return false
+}
+
+// backward settles on n or the first node before it with a version at s.seq
+func (s *memSource) backward(n *memNode) bool {
+	for ; n != nil; n = s.table.seekLT(n.key) {
+		if v := n.at(s.seq); v != nil {
+			s.node, s.ver = n, v
+			return true
+		}
+	}
+	s.node, s.ver = nil, nil
+	return false
+}
+
+func (s *memSource) valid() bool {
+	return s.node != nil
+}
+
+func (s *memSource) key() string {
+	return s.node.key
+}
+
+func (s *memSource) value() []byte {
+	return s.ver.value
+}
+
+func (s *memSource) deleted() bool {
+	return s.ver.deleted
+}
+
+func (s *memSource) err() error {
+	return nil
+}
+
+// levelSources returns a source for each level 0 file of v, newest first,
+// followed by one for each deeper level
+func levelSources(v *lsmVersion) []lsmSource {
+	var sources []lsmSource
+	for _, f := range v.levels[0] {
+		sources = append(sources, &levelSource{files: []*tableFile{f}})
+	}
+	for _, level := range v.levels[1:] {
+		if len(level) > 0 {
+			sources = append(sources, &levelSource{files: level})
+		}
+	}
+	return sources
+}
+
+// levelSource reads table files that are sorted and do not overlap as if
+// they were one. The current key is converted once per move, since merging
+// compares it over and over.
+type levelSource struct {
+	files []*tableFile
+
+	// it iterates over files[file], it is nil when the source is exhausted
+	file int
+	it *sstable.Iterator
+	cur string
+	fail error
+}
+
+func (s *levelSource) seekGE(key string) bool {
+	// First file that may hold keys >= key
+	i, _ := slices.BinarySearchFunc(s.files, key, func(f *tableFile, key string) int {
+		return cmp.Compare(string(f.largest), key)
+	})
+	if !s.load(i) {
+		return false
+	}
+	return s.forward(s.it.SeekGE([]byte(key)))
+}
+
+func (s *levelSource) seekLT(key string) bool {
+	// Last file that may hold keys < key
+	i, _ := slices.BinarySearchFunc(s.files, key, func(f *tableFile, key string) int {
+		return cmp.Compare(string(f.smallest), key)
+	})
+	if !s.load(i - 1) {
+		return false
+	}
+	return s.backward(s.it.SeekLT([]byte(key)))
+}
+
+func (s *levelSource) last() bool {
+	if !s.load(len(s.files) - 1) {
+		return false
+	}
+	return s.backward(s.it.Last())
+}
+
+func (s *levelSource) next() bool {
+	return s.forward(s.it.Next())
+}
+
+func (s *levelSource) prev() bool {
+	return s.backward(s.it.Prev())
+}
+
+// load switches to file i, or leaves the source exhausted if there is none
+func (s *levelSource) load(i int) bool {
+	s.file, s.it = i, nil
+	if i < 0 || i >= len(s.files) || s.fail != nil {
+		return false
+	}
+	s.it = s.files[i].reader.NewIterator()
+	return true
+}
+
+// forward moves on to the start of later files until it finds an entry
+func (s *levelSource) forward(ok bool) bool {
+	for !ok {
+		if !s.check() || !s.load(s.file+1) {
+			return false
+		}
+		ok = s.it.First()
+	}
+	s.cur = string(s.it.Key())
+	return true
+}
+
+// backward moves back to the end of earlier files until it finds an entry
+func (s *levelSource) backward(ok bool) bool {
+	for !ok {
+		if !s.check() || !s.load(s.file-1) {
+			return false
+		}
+		ok = s.it.Last()
+	}
+	s.cur = string(s.it.Key())
+	return true
+}
+
+// check picks up a read error from the current file
+func (s *levelSource) check() bool {
+	if err := s.it.Err(); err != nil {
+		s.fail = err
+		s.it = nil
+		return false
+	}
+	return true
+}
+
+func (s *levelSource) valid() bool {
+	return s.it != nil && s.it.Valid()
+}
+
+func (s *levelSource) key() string {
+	return s.cur
+}
+
+func (s *levelSource) value() []byte {
+	return s.it.Value()
+}
+
+func (s *levelSource) deleted() bool {
+	return s.it.Kind() == sstable.KindDelete
+}
+
+func (s *levelSource) err() error {
+	return s.fail
+}
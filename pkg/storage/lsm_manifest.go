@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// The manifest records which table files make up the tree, so that after a
+// crash the store knows which files are live and how much of the WAL they
+// already cover.
+//
+// It is a log of version edits. Each edit is the value of a wal.LogEntry, so
+// it gets the same checksummed framing as the WAL, and is synced before the
+// version it describes is installed. Every manifest file starts with an edit
+// describing the whole tree. A new file is started on every open and once
+// the current one grows past manifestRollSize.
+//
+// The CURRENT file names the manifest in use. It is replaced with a rename
+// once the new manifest is on disk, so it always names a complete one.
+// Table files the manifest does not list are leftovers of a flush or
+// compaction that did not finish, and are deleted on open.
+const (
+	currentName = "CURRENT"
+	manifestPrefix = "MANIFEST-"
+
+	// manifestRollSize is the size past which edits go to a fresh manifest
+	manifestRollSize = 1024 * 1024 // 1MB
+)
+
+// manifestName returns the file name of manifest number num. Manifests and
+// table files are numbered from the same counter.
+func manifestName(num uint64) string {
+	return fmt.Sprintf("%s%06d", manifestPrefix, num)
+}
+
+// Field tags of an encoded manifestEdit
+const (
+	tagNextFile = 1
+	tagLastLSN = 2
+	tagCheckpoint = 3
+	tagDeleted = 4
+	tagAdded = 5
+)
+
+// manifestEdit is one record of the manifest. Counters left at zero are
+// not changed by the edit.
+//
+// Layout: a sequence of fields, each a uvarint tag followed by its value
+// NextFile, LastLSN, Checkpoint: uvarint
+// Deleted: uvarint (Level) + uvarint (Num)
+// Added:   uvarint (Level) + uvarint (Num) + uvarint (Size) + uvarint (Len) + Smallest + uvarint (Len) + Largest
+type manifestEdit struct {
+	// nextFile is the highest file number handed out so far
+	nextFile uint64
+
+	// lastLSN is the last LSN in the WAL when the edit was made
+	lastLSN uint64
+
+	// checkpoint is the first LSN that is not in any table
+	checkpoint uint64
+
+	// deleted only has level and num set
+	deleted []manifestFile
+	added []manifestFile
+}
+
+type manifestFile struct {
+	level int
+	num uint64
+	size int64
+	smallest []byte
+	largest []byte
+}
+
+func (e *manifestEdit) encode() []byte {
+	var buf []byte
+	counter := func(tag, v uint64) {
+		if v != 0 {
+			buf = binary.AppendUvarint(buf, tag)
+			buf = binary.AppendUvarint(buf, v)
+		}
+	}
+	counter(tagNextFile, e.nextFile)
+	counter(tagLastLSN, e.lastLSN)
+	counter(tagCheckpoint, e.checkpoint)
+
+	for _, f := range e.deleted {
+		buf = binary.AppendUvarint(buf, tagDeleted)
+		buf = binary.AppendUvarint(buf, uint64(f.level))
+		buf = binary.AppendUvarint(buf, f.num)
+	}
+	for _, f := range e.added {
+		buf = binary.AppendUvarint(buf, tagAdded)
+		buf = binary.AppendUvarint(buf, uint64(f.level))
+		buf = binary.AppendUvarint(buf, f.num)
+		buf = binary.AppendUvarint(buf, uint64(f.size))
+		buf = binary.AppendUvarint(buf, uint64(len(f.smallest)))
+		buf = append(buf, f.smallest...)
+		buf = binary.AppendUvarint(buf, uint64(len(f.largest)))
+		buf = append(buf, f.largest...)
+	}
+	return buf
+}
+
+// errBadManifest is wrapped by every manifest decoding failure
+var errBadManifest = errors.New("corrupt manifest")
+
+func decodeManifestEdit(data []byte) (*manifestEdit, error) {
+	d := &decoder{data: data}
+	e := &manifestEdit{}
+
+	for len(d.data) > 0 && d.err == nil {
+		switch tag := d.uvarint(); tag {
+		case tagNextFile:
+			e.nextFile = d.uvarint()
+		case tagLastLSN:
+			e.lastLSN = d.uvarint()
+		case tagCheckpoint:
+			e.checkpoint = d.uvarint()
+		case tagDeleted:
+			e.deleted = append(e.deleted, manifestFile{
+				level: d.level(),
+				num: d.uvarint(),
+			})
+		case tagAdded:
+			e.added = append(e.added, manifestFile{
+				level: d.level(),
+				num: d.uvarint(),
+				size: int64(d.uvarint()),
+				smallest: d.bytes(),
+				largest: d.bytes(),
+			})
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("%w: unknown field %d", errBadManifest, tag)
+			}
+		}
+	}
+	return e, d.err
+}
+
+// decoder reads uvarint-framed fields, remembering the first failure
+type decoder struct {
+	data []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: truncated", errBadManifest)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) level() int {
+	level := d.uvarint()
+	if d.err == nil && level >= numLevels {
+		d.err = fmt.Errorf("%w: level %d out of range", errBadManifest, level)
+	}
+	return int(level)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.data)) {
+		d.err = fmt.Errorf("%w: truncated", errBadManifest)
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+// manifestState is the tree described by the edits of a manifest so far
+type manifestState struct {
+	nextFile uint64
+	lastLSN uint64
+	checkpoint uint64
+	files map[uint64]manifestFile
+}
+
+func newManifestState() *manifestState {
+	return &manifestState{files: make(map[uint64]manifestFile)}
+}
+
+// apply adds e to the state. Deleting a file that is not where e says it is
+// means the manifest does not match the tree it was written for.
+func (s *manifestState) apply(e *manifestEdit) error {
+	s.nextFile = max(s.nextFile, e.nextFile)
+	s.lastLSN = max(s.lastLSN, e.lastLSN)
+	s.checkpoint = max(s.checkpoint, e.checkpoint)
+
+	for _, f := range e.deleted {
+		if cur, ok := s.files[f.num]; !ok || cur.level != f.level {
+			return fmt.Errorf("%w: file %d is not in level %d", errBadManifest, f.num, f.level)
+		}
+		delete(s.files, f.num)
+	}
+	for _, f := range e.added {
+		s.files[f.num] = f
+	}
+	return nil
+}
+
+// snapshot returns an edit that builds the whole state from nothing
+func (s *manifestState) snapshot() *manifestEdit {
+	e := &manifestEdit{
+		nextFile: s.nextFile,
+		lastLSN: s.lastLSN,
+		checkpoint: s.checkpoint,
+	}
+	for _, f := range s.files {
+		e.added = append(e.added, f)
+	}
+	slices.SortFunc(e.added, func(a, b manifestFile) int {
+		return cmp.Or(cmp.Compare(a.level, b.level), cmp.Compare(a.num, b.num))
+	})
+	return e
+}
+
+// readManifest replays the manifest CURRENT names. ok is false if there is none yet.
+func readManifest(dir string) (state *manifestState, ok bool, err error) {
+	current, err := os.ReadFile(filepath.Join(dir, currentName))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	name := strings.TrimSuffix(string(current), "\n")
+	if !strings.HasPrefix(name, manifestPrefix) || strings.ContainsRune(name, os.PathSeparator) {
+		return nil, false, fmt.Errorf("%w: CURRENT names %q", errBadManifest, name)
+	}
+
+	r, err := wal.NewReader(filepath.Join(dir, name))
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+
+	state = newManifestState()
+	edits := 0
+	for {
+		entry, err := r.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A torn edit at the end was never synced, so the version it
+			// describes was never installed
+			break
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %s: %w", errBadManifest, name, err)
+		}
+
+		e, err := decodeManifestEdit(entry.Value)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := state.apply(e); err != nil {
+			return nil, false, err
+		}
+		edits++
+	}
+
+	// CURRENT only moves to a manifest once its first edit is on disk
+	if edits == 0 {
+		return nil, false, fmt.Errorf("%w: %s is empty", errBadManifest, name)
+	}
+	return state, true, nil
+}
+
+// manifestLog appends edits to the manifest in use
+type manifestLog struct {
+	log *wal.Writer
+	size int64
+}
+
+// createManifest writes state to a new manifest file num, points CURRENT
+// at it and removes the manifests it replaces
+func createManifest(dir string, num uint64, state *manifestState) (*manifestLog, error) {
+	name := manifestName(num)
+	path := filepath.Join(dir, name)
+
+	w, err := wal.NewWriter(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifestLog{log: w}
+	if err := m.append(state.snapshot()); err != nil {
+		w.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	if err := setCurrent(dir, name); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), manifestPrefix) && f.Name() != name {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				w.Close()
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// append writes e to the manifest and waits until it is on disk
+func (m *manifestLog) append(e *manifestEdit) error {
+	data := e.encode()
+	entry := &wal.LogEntry{
+		Timestamp: time.Now().UnixNano(),
+		Op: wal.OpPut,
+		Value: data,
+	}
+
+	if _, err := m.log.SyncWrite(context.Background(), entry); err != nil {
+		return err
+	}
+	m.size += int64(wal.ChunkHeaderSize + wal.HeaderSize + wal.HeaderChecksumSize + len(data))
+	return nil
+}
+
+func (m *manifestLog) close() error {
+	return m.log.Close()
+}
+
+// setCurrent durably points CURRENT at the manifest called name
+func setCurrent(dir, name string) error {
+	path := filepath.Join(dir, currentName)
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(name + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// describeFile returns the manifest entry for f in level
+func describeFile(level int, f *tableFile) manifestFile {
+	return manifestFile{
+		level: level,
+		num: f.num,
+		size: f.size,
+		smallest: f.smallest,
+		largest: f.largest,
+	}
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// manifestFiles returns the manifest files in dir and the one CURRENT names
+func manifestFiles(t *testing.T, dir string) (files []string, current string) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, manifestPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, currentName))
+	if err != nil {
+		t.Fatalf("Reading CURRENT failed: %v", err)
+	}
+	return files, filepath.Join(dir, strings.TrimSpace(string(data)))
+}
+
+// Test that edits survive encoding and replay into the same state
+func TestManifest_Edits(t *testing.T) {
+	s := newManifestState()
+	edits := []*manifestEdit{
+		{nextFile: 3, added: []manifestFile{
+			{level: 0, num: 2, size: 100, smallest: []byte("a"), largest: []byte("m")},
+			{level: 0, num: 3, size: 200, smallest: []byte("c"), largest: []byte("z")},
+		}},
+		{nextFile: 5, lastLSN: 42, checkpoint: 40,
+			deleted: []manifestFile{{level: 0, num: 2}, {level: 0, num: 3}},
+			added: []manifestFile{{level: 1, num: 5, size: 250, smallest: []byte("a"), largest: []byte("z")}},
+		},
+	}
+
+	for _, e := range edits {
+		decoded, err := decodeManifestEdit(e.encode())
+		if err != nil {
+			t.Fatalf("Decoding failed: %v", err)
+		}
+		if err := s.apply(decoded); err != nil {
+			t.Fatalf("Applying failed: %v", err)
+		}
+	}
+
+	if s.nextFile != 5 || s.lastLSN != 42 || s.checkpoint != 40 || len(s.files) != 1 {
+		t.Fatalf("Unexpected state %+v", s)
+	}
+	if f := s.files[5]; f.level != 1 || f.size != 250 || string(f.smallest) != "a" || string(f.largest) != "z" {
+		t.Errorf("Unexpected file %+v", f)
+	}
+
+	// Deleting a file that is not there means the log does not fit together
+	if err := s.apply(&manifestEdit{deleted: []manifestFile{{level: 0, num: 5}}}); !errors.Is(err, errBadManifest) {
+		t.Errorf("Expected errBadManifest, got %v", err)
+	}
+	if _, err := decodeManifestEdit([]byte{99, 1}); !errors.Is(err, errBadManifest) {
+		t.Errorf("Expected errBadManifest for an unknown field, got %v", err)
+	}
+}
+
+// Test that each open starts a fresh manifest and removes the old one
+func TestManifest_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openCompacting(t, dir)
+	for i := range 3000 {
+		store.Put(ctx, fmt.Sprintf("key-%04d", i%1000), []byte(fmt.Sprint(i)))
+	}
+	waitForCompaction(t, store)
+	before := store.Stats().Levels
+	store.Close(ctx)
+
+	_, old := manifestFiles(t, dir)
+
+	store = openCompacting(t, dir)
+	defer store.Close(ctx)
+
+	files, current := manifestFiles(t, dir)
+	if len(files) != 1 || files[0] != current || current == old {
+		t.Errorf("Expected a single new manifest, got %v with CURRENT at %s", files, current)
+	}
+	if after := store.Stats().Levels; fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("Expected levels %v, got %v", before, after)
+	}
+
+	// Moving on to another manifest keeps describing the same tree
+	store.installMut.Lock()
+	err := store.rollManifest()
+	store.installMut.Unlock()
+	if err != nil {
+		t.Fatalf("Roll failed: %v", err)
+	}
+	state, ok, err := readManifest(dir)
+	if !ok || err != nil || len(state.files) != len(store.manifestState.files) {
+		t.Errorf("Expected the rolled manifest to list every file, got %v %v", ok, err)
+	}
+}
+
+// Test that a torn edit at the end is ignored while damage before it is reported
+func TestManifest_Damage(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openCompacting(t, dir)
+	for i := range 2000 {
+		store.Put(ctx, fmt.Sprintf("key-%04d", i), []byte("value"))
+	}
+	store.Flush(ctx)
+	store.Close(ctx)
+
+	_, current := manifestFiles(t, dir)
+	clean, _ := os.ReadFile(current)
+
+	// Half of a record, as left by a crash while appending
+	torn := append(clean, clean[:10]...)
+	os.WriteFile(current, torn, 0644)
+
+	store = openCompacting(t, dir)
+	for i := range 2000 {
+		if _, err := store.Get(ctx, fmt.Sprintf("key-%04d", i)); err != nil {
+			t.Fatalf("Get key-%04d failed: %v", i, err)
+		}
+	}
+	store.Close(ctx)
+
+	_, current = manifestFiles(t, dir)
+	data, _ := os.ReadFile(current)
+	data[len(data)/2] ^= 0x01
+	os.WriteFile(current, data, 0644)
+
+	if _, err := OpenLSMStore(dir, Options{}); !errors.Is(err, errBadManifest) {
+		t.Errorf("Expected errBadManifest, got %v", err)
+	}
+}
+
+// Test that a manifest replays once its edits run over several blocks of
+// the log, including edits that start in the last few bytes of one
+func TestManifest_SpansBlocks(t *testing.T) {
+	dir := t.TempDir()
+	state := newManifestState()
+	m, err := createManifest(dir, 1, state)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// An edit adding the next file, whose smallest key is keyLen bytes long
+	// and whose largest is pad bytes longer than the shortest
+	edit := func(keyLen, pad int) *manifestEdit {
+		num := state.nextFile + 1
+		smallest := []byte(strings.Repeat("a", keyLen))
+		largest := []byte(strings.Repeat("z", 1+pad))
+		return &manifestEdit{nextFile: num, added: []manifestFile{{level: 0, num: num, size: 100, smallest: smallest, largest: largest}}}
+	}
+	write := func(e *manifestEdit) {
+		t.Helper()
+		if err := m.append(e); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		if err := state.apply(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	overhead := wal.ChunkHeaderSize + wal.HeaderSize + wal.HeaderChecksumSize
+	path := filepath.Join(dir, manifestName(1))
+	for tail := range wal.ChunkHeaderSize + 2 {
+		// Size an edit to end tail bytes before the end of a block
+		stat, _ := os.Stat(path)
+		left := wal.BlockSize - int(stat.Size()%wal.BlockSize)
+		if left < wal.ChunkHeaderSize {
+			left += wal.BlockSize
+		}
+		want := left - tail - overhead
+		if want < len(edit(0, 0).encode()) {
+			want += wal.BlockSize - wal.ChunkHeaderSize
+		}
+		keyLen := want - len(edit(0, 0).encode())
+		for len(edit(keyLen, 0).encode()) > want {
+			keyLen--
+		}
+		write(edit(keyLen, want-len(edit(keyLen, 0).encode())))
+
+		stat, _ = os.Stat(path)
+		if got := wal.BlockSize - int(stat.Size()%wal.BlockSize); got%wal.BlockSize != tail {
+			t.Fatalf("Edit left %d bytes in its block, want %d", got, tail)
+		}
+		write(edit(10, 0))
+	}
+	m.close()
+
+	got, ok, err := readManifest(dir)
+	if !ok || err != nil {
+		t.Fatalf("Replay failed: %v %v", ok, err)
+	}
+	if len(got.files) != len(state.files) || got.nextFile != state.nextFile {
+		t.Errorf("Expected %d files up to %d, got %d up to %d", len(state.files), state.nextFile, len(got.files), got.nextFile)
+	}
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+var _ Store = (*LSMStore)(nil)
+
+// openLSM opens an LSM store with a tiny memtable so tests flush often
+func openLSM(t *testing.T, dir string) *LSMStore {
+	t.Helper()
+
+	store, err := OpenLSMStore(dir, Options{
+		WAL: wal.Options{Sync: wal.SyncNever, SegmentSize: 4096},
+		MemtableSize: 8 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return store
+}
+
+func tableFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+tableExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// Test that a full memtable is flushed to a table file and the WAL behind it is released
+func TestLSMStore_Flush(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openLSM(t, dir)
+	defer store.Close(ctx)
+
+	for i := range 2000 {
+		if err := store.Put(ctx, fmt.Sprintf("key-%04d", i), bytes.Repeat([]byte("v"), 32)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if n := len(tableFiles(t, dir)); n < 2 {
+		t.Errorf("Expected several table files, got %d", n)
+	}
+
+	// Only the segment the empty memtable writes to is left
+	if segments, _ := wal.Segments(dir); len(segments) != 1 {
+		t.Errorf("Expected flushed segments to be removed, %d left", len(segments))
+	}
+
+	for i := range 2000 {
+		if _, err := store.Get(ctx, fmt.Sprintf("key-%04d", i)); err != nil {
+			t.Fatalf("Get key-%04d failed: %v", i, err)
+		}
+	}
+}
+
+// Test that newer values and deletes shadow older ones in earlier tables
+func TestLSMStore_Shadowing(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openLSM(t, dir)
+	defer store.Close(ctx)
+
+	store.Put(ctx, "a", []byte("1"))
+	store.Put(ctx, "b", []byte("1"))
+	store.Put(ctx, "c", []byte("1"))
+	store.Flush(ctx)
+
+	store.Put(ctx, "a", []byte("2"))
+	store.Delete(ctx, "b")
+	store.Flush(ctx)
+
+	// Still in the memtable
+	store.Put(ctx, "c", []byte("3"))
+
+	want := map[string]string{"a": "2", "c": "3"}
+	for key, value := range want {
+		got, err := store.Get(ctx, key)
+		if err != nil || string(got) != value {
+			t.Errorf("Get %s: expected %s, got %s (%v)", key, value, got, err)
+		}
+	}
+	if _, err := store.Get(ctx, "b"); err != ErrKeyNotFound {
+		t.Errorf("Expected deleted key to stay deleted, got %v", err)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		it, _ := store.NewIterator(ctx, IterOptions{Reverse: reverse})
+
+		var got []string
+		for it.Next() {
+			got = append(got, it.Key()+"="+string(it.Value()))
+		}
+		it.Close()
+
+		want := "[a=2 c=3]"
+		if reverse {
+			want = "[c=3 a=2]"
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("Reverse %v: expected %s, got %v", reverse, want, got)
+		}
+	}
+}
+
+// Test that tables and the unflushed tail of the WAL are both recovered
+func TestLSMStore_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openLSM(t, dir)
+	for i := range 1000 {
+		store.Put(ctx, fmt.Sprintf("key-%04d", i), []byte(fmt.Sprint(i)))
+	}
+	store.Flush(ctx)
+	for i := range 100 {
+		store.Delete(ctx, fmt.Sprintf("key-%04d", i))
+	}
+	store.Close(ctx)
+
+	store = openLSM(t, dir)
+	defer store.Close(ctx)
+
+	// At most the deletes were still in the WAL, the puts come from tables
+	if info := store.Recovery(); info.Applied == 0 || info.Applied > 100 {
+		t.Errorf("Expected only the deletes to be replayed, got %d", info.Applied)
+	}
+
+	for i := range 1000 {
+		got, err := store.Get(ctx, fmt.Sprintf("key-%04d", i))
+		if i < 100 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expected key-%04d to be deleted, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil || string(got) != fmt.Sprint(i) {
+			t.Fatalf("Get key-%04d: got %s (%v)", i, got, err)
+		}
+	}
+}
+
+// Test that an iterator keeps its snapshot while the memtable is flushed underneath it
+func TestLSMStore_IteratorAcrossFlush(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openLSM(t, dir)
+	defer store.Close(ctx)
+
+	for i := range 10 {
+		store.Put(ctx, fmt.Sprintf("key-%d", i), []byte("old"))
+	}
+
+	it, _ := store.NewIterator(ctx, IterOptions{})
+	defer it.Close()
+
+	for i := range 10 {
+		store.Put(ctx, fmt.Sprintf("key-%d", i), []byte("new"))
+	}
+	store.Delete(ctx, "key-5")
+	store.Flush(ctx)
+
+	count := 0
+	for it.Next() {
+		if string(it.Value()) != "old" {
+			t.Errorf("%s: expected old, got %s", it.Key(), it.Value())
+		}
+		count++
+	}
+	if count != 10 || it.Err() != nil {
+		t.Errorf("Expected 10 keys from the snapshot, got %d (%v)", count, it.Err())
+	}
+}
+
+// Test concurrent writers and readers while memtables are being flushed
+func TestLSMStore_ConcurrentFlush(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store := openLSM(t, dir)
+	defer store.Close(ctx)
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				key := fmt.Sprintf("w%d-%04d", w, i)
+				if err := store.Put(ctx, key, []byte("v:"+key)); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				// Every key written so far stays readable through flushes
+				if got, err := store.Get(ctx, key); err != nil || string(got) != "v:"+key {
+					t.Errorf("Get %s: got %s (%v)", key, got, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	it, _ := store.NewIterator(ctx, IterOptions{})
+	if got := collect(t, it); len(got) != 2000 {
+		t.Errorf("Expected 2000 keys, got %d", len(got))
+	}
+}
+
+// Test that lookups of absent keys are answered by the table filters
+func TestLSMStore_BloomFilters(t *testing.T) {
+	ctx := context.Background()
+
+	for _, bits := range []int{0, -1} {
+		dir := t.TempDir()
+		store, err := OpenLSMStore(dir, Options{
+			WAL: wal.Options{Sync: wal.SyncNever},
+			BloomBitsPerKey: bits,
+		})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+
+		for i := range 1000 {
+			store.Put(ctx, fmt.Sprintf("key-%04d", i*2), []byte("value"))
+		}
+		store.Flush(ctx)
+
+		for i := range 999 {
+			if _, err := store.Get(ctx, fmt.Sprintf("key-%04d", i*2+1)); err != ErrKeyNotFound {
+				t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+			}
+		}
+
+		filter := store.Stats().Filter
+		if bits < 0 && filter.Misses != 0 {
+			t.Errorf("Expected no filters to be written, got %+v", filter)
+		}
+		if bits == 0 && (filter.Misses == 0 || filter.FalsePositiveRate() > 0.05) {
+			t.Errorf("Expected the default filters to rule out absent keys, got %+v", filter)
+		}
+		store.Close(ctx)
+	}
+}
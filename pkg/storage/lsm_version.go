@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"os"
+	"slices"
+	"sync/atomic"
+
+	"com.github/mune-0/anchor/pkg/sstable"
+)
+
+// numLevels is the number of levels table files are organized in
+const numLevels = 7
+
+// tableFile is a table file that is part of the LSM tree.
+//
+// Every version listing the file holds a reference to it. When the last one
+// goes away the file is closed, and deleted if a compaction replaced it.
+type tableFile struct {
+	num uint64
+	size int64
+	smallest []byte
+	largest []byte
+	reader *sstable.Reader
+
+	refs atomic.Int32
+	obsolete atomic.Bool
+}
+
+// newTableFile wraps an open table. It is closed once it has been part of a
+// version and the last version holding it is released.
+func newTableFile(num uint64, r *sstable.Reader) *tableFile {
+	props := r.Properties()
+	return &tableFile{
+		num: num,
+		size: r.Size(),
+		smallest: props.Smallest,
+		largest: props.Largest,
+		reader: r,
+	}
+}
+
+func (f *tableFile) ref() {
+	f.refs.Add(1)
+}
+
+func (f *tableFile) unref() {
+	if f.refs.Add(-1) > 0 {
+		return
+	}
+
+	path := f.reader.Path()
+	f.reader.Close()
+	if f.obsolete.Load() {
+		os.Remove(path)
+	}
+}
+
+// overlaps reports whether the file may hold keys in [smallest, largest]
+func (f *tableFile) overlaps(smallest, largest []byte) bool {
+	return bytes.Compare(f.largest, smallest) >= 0 && bytes.Compare(f.smallest, largest) <= 0
+}
+
+// contains reports whether key falls within the file's key range
+func (f *tableFile) contains(key []byte) bool {
+	return f.overlaps(key, key)
+}
+
+// lsmVersion is the set of places a read looks in, newest first.
+// It is never modified once installed.
+//
+// Level 0 holds flushed memtables, newest first, and their key ranges may
+// overlap. Every other level is sorted by key and its files do not overlap,
+// so at most one file per level can hold a given key.
+//
+// Readers take a reference for as long as they use a version, see
+// LSMStore.currentVersion. The store holds one on the current version.
+type lsmVersion struct {
+	mem *memtable
+	frozen []*frozenMemtable
+	levels [numLevels][]*tableFile
+
+	refs atomic.Int32
+}
+
+// frozenMemtable is a memtable waiting to be written to a table file
+type frozenMemtable struct {
+	table *memtable
+
+	// next is the first LSN that is not in table. Once the table file is
+	// written, the WAL below it is no longer needed.
+	next uint64
+}
+
+// newVersion returns a version with a single reference, holding one on each of its files
+func newVersion(mem *memtable, frozen []*frozenMemtable, levels [numLevels][]*tableFile) *lsmVersion {
+	v := &lsmVersion{mem: mem, frozen: frozen, levels: levels}
+	v.refs.Store(1)
+	for _, level := range levels {
+		for _, f := range level {
+			f.ref()
+		}
+	}
+	return v
+}
+
+// tryRef takes a reference unless the version has already been released
+func (v *lsmVersion) tryRef() bool {
+	for {
+		n := v.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if v.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (v *lsmVersion) unref() {
+	if v.refs.Add(-1) > 0 {
+		return
+	}
+	for _, level := range v.levels {
+		for _, f := range level {
+			f.unref()
+		}
+	}
+}
+
+// memtables returns the active memtable followed by the frozen ones, newest first
+func (v *lsmVersion) memtables() []*memtable {
+	tables := make([]*memtable, 0, 1+len(v.frozen))
+	tables = append(tables, v.mem)
+	for _, f := range v.frozen {
+		tables = append(tables, f.table)
+	}
+	return tables
+}
+
+// filesFor returns the files that may hold key, newest first
+func (v *lsmVersion) filesFor(key []byte) []*tableFile {
+	var files []*tableFile
+	for _, f := range v.levels[0] {
+		if f.contains(key) {
+			files = append(files, f)
+		}
+	}
+	for _, level := range v.levels[1:] {
+		i, _ := slices.BinarySearchFunc(level, key, func(f *tableFile, key []byte) int {
+			return bytes.Compare(f.largest, key)
+		})
+		if i < len(level) && level[i].contains(key) {
+			files = append(files, level[i])
+		}
+	}
+	return files
+}
+
+// overlapping returns the files in level whose key range meets [smallest, largest]
+func (v *lsmVersion) overlapping(level int, smallest, largest []byte) []*tableFile {
+	var files []*tableFile
+	for _, f := range v.levels[level] {
+		if f.overlaps(smallest, largest) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// levelSize returns the total size of the files in level
+func (v *lsmVersion) levelSize(level int) int64 {
+	var size int64
+	for _, f := range v.levels[level] {
+		size += f.size
+	}
+	return size
+}
+
+// versionEdit describes how one version of the tree turns into the next
+type versionEdit struct {
+	added [numLevels][]*tableFile
+	deleted map[uint64]bool
+
+	// flushed is the frozen memtable the added level 0 file was written from
+	flushed *frozenMemtable
+}
+
+// apply returns the levels of v with the edit applied
+func (e *versionEdit) apply(v *lsmVersion) [numLevels][]*tableFile {
+	var levels [numLevels][]*tableFile
+	for i := range levels {
+		for _, f := range v.levels[i] {
+			if !e.deleted[f.num] {
+				levels[i] = append(levels[i], f)
+			}
+		}
+		levels[i] = append(levels[i], e.added[i]...)
+
+		if i == 0 {
+			// Newer flushes have higher numbers and go first
+			slices.SortFunc(levels[i], func(a, b *tableFile) int {
+				return cmp.Compare(b.num, a.num)
+			})
+		} else {
+			slices.SortFunc(levels[i], func(a, b *tableFile) int {
+				return bytes.Compare(a.smallest, b.smallest)
+			})
+		}
+	}
+	return levels
+}
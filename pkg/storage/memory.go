@@ -2,27 +2,67 @@ package storage
 
 import (
 	"sync"
+	"sync/atomic"
 	"context"
 	"strings"
 	"time"
 	"fmt"
+	"io"
 	"com.github/mune-0/anchor/pkg/wal"
 )
 
-// MemStore is an in-memory implementation of Store
+// rebuildMinDead is how many deleted keys the memtable must hold before
+// it is worth copying the live ones into a fresh table
+const rebuildMinDead = 1024
+
+// MemStore is an in-memory implementation of Store.
+// Keys are kept sorted so they can be scanned in order with NewIterator.
+// Reads never take a lock, see memtable.
 type MemStore struct {
-	data map[string][]byte
-	mut sync.RWMutex
-	closed bool
+	// table is replaced by a compacted copy once deleted keys pile up, see rebuild.
+	// It is nil once the store is closed.
+	table atomic.Pointer[memtable]
+	closed atomic.Bool
 	walWriter wal.WALWriter
+
+	// Writes hold writeMut shared for as long as they touch the WAL,
+	// so Close can wait for them before shutting the log
+	writeMut sync.RWMutex
+
+	// Writes to the same key hold the same stripe from logging through applying,
+	// so the table always ends up in the order the entries appear in the WAL
+	keyLocks keyLocks
+
+	// applyMut serializes the short step of adding logged writes to the table,
+	// so sequence numbers are handed out and made visible strictly in order
+	applyMut sync.Mutex
+	lastSeq uint64
+
+	// visible is the sequence number readers read at. Everything at or below
+	// it is fully applied, which is what makes batches atomic to readers.
+	visible atomic.Uint64
+
+	// Sequence numbers that open iterators read at
+	snapshots snapshotSet
+
+	// sync is the durability policy for writes. Only SyncAlways waits for
+	// the WAL to reach disk, anything else leaves it to the WAL writer.
+	sync wal.SyncPolicy
+
+	// closer is set when the store owns its WAL (see OpenMemStore)
+	closer io.Closer
+	recovery RecoveryInfo
 }
 
-// NewMemStore creates an new in-memory store
+// NewMemStore creates an new in-memory store.
+// Every write is synced to w before it is acknowledged.
 func NewMemStore (w wal.WALWriter) *MemStore {
-	return &MemStore{
-		data: make(map[string][]byte),
+	mem := &MemStore{
 		walWriter : w,
+		sync: wal.SyncAlways,
 	}
+	mem.table.Store(newMemtable())
+	return mem
 }
 
 // Get returns a value by key
@@ -36,28 +76,54 @@ func  (mem *MemStore) Get (ctx context.Context, key string) ([]byte, error) {
 		return nil, ErrInvalidKey
 	}
 
-	mem.mut.RLock()
-	defer mem.mut.RUnlock()
-
-	if err := ctx.Err(); err != nil {
-		return nil, err
-	}
-
 	// Checking if memory store is already closed
-	if mem.closed {
+	if mem.closed.Load() {
 		return nil, ErrStoreClosed 
 	}
 
-	if val, ok := mem.data[strings.TrimSpace(key)]; ok {
+	v, err := mem.lookup(strings.TrimSpace(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if v != nil && !v.deleted {
 		// Defensive copy
-		snapshot := make([]byte, len(val))
-		copy(snapshot, val)
+		snapshot := make([]byte, len(v.value))
+		copy(snapshot, v.value)
 		return snapshot, nil
 	} else {
 		return nil, ErrKeyNotFound
 	}
 }
 
+// lookup returns the newest visible version of key, or nil if it has none
+func (mem *MemStore) lookup(key string) (*memVersion, error) {
+	for {
+		// Load visible before the table: a table swapped in by rebuild
+		// always holds everything up to the visible sequence number
+		seq := mem.visible.Load()
+		table := mem.table.Load()
+		if table == nil {
+			return nil, ErrStoreClosed
+		}
+
+		n := table.find(key)
+		if n == nil {
+			return nil, nil
+		}
+		if v := n.at(seq); v != nil {
+			return v, nil
+		}
+
+		// Every version is newer than seq. Either the key is still being
+		// written, or a writer moved past seq and trimmed the version we were
+		// after while we were reading. Only the latter needs another look.
+		if mem.visible.Load() == seq {
+			return nil, nil
+		}
+	}
+}
+
 // Put stores a key-value pair
 func (mem *MemStore) Put (ctx context.Context, key string, value []byte) error {
 	// Check context before acquiring lock
@@ -80,28 +146,143 @@ func (mem *MemStore) Put (ctx context.Context, key string, value []byte) error {
 		Value: snapshot,
 	}
 
-	// Write to WAL (Durability)
-	if err := mem.walWriter.SyncWrite(ctx, entry); err != nil {
-		return fmt.Errorf("WAL failure (data safe, update aborted): %w", err)
+	return mem.write(ctx, entry, []*wal.LogEntry{entry})
+}
+
+// Apply commits all operations in batch as a single WAL record
+func (mem *MemStore) Apply(ctx context.Context, batch *WriteBatch) error {
+	// Check context before acquiring lock
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := batch.validate(); err != nil {
+		return err
 	}
 
-	mem.mut.Lock()
-	defer mem.mut.Unlock()
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	record := wal.NewBatchEntry(time.Now().UnixNano(), batch.ops)
+	return mem.write(ctx, record, batch.ops)
+}
+
+// write logs record to the WAL and then applies ops, the puts and deletes
+// the record stands for, to the table in one step
+func (mem *MemStore) write(ctx context.Context, record *wal.LogEntry, ops []*wal.LogEntry) error {
+	mem.writeMut.RLock()
+	defer mem.writeMut.RUnlock()
+
+	// Close flips this while holding writeMut exclusively
+	if mem.closed.Load() {
+		return ErrStoreClosed
+	}
+
+	unlock := mem.keyLocks.lock(ops)
+	defer unlock()
 
 	// Check context again after acquiring lock
 	if err := ctx.Err(); err != nil {
 		return err
 	}
-	
-	if mem.closed {
-		return ErrStoreClosed
+
+	// Write to WAL (Durability)
+	if err := mem.logEntry(ctx, record); err != nil {
+		return fmt.Errorf("WAL failure (data safe, update aborted): %w", err)
 	}
-	
-	mem.data[key] = snapshot
 
+	// From here on the record is in the log and will be replayed on restart,
+	// so it has to be applied even if ctx has been cancelled in the meantime
+	mem.apply(ops)
 	return nil
 }
 
+// apply adds ops to the table under one new sequence number and then makes
+// them visible together
+func (mem *MemStore) apply(ops []*wal.LogEntry) {
+	mem.applyMut.Lock()
+	defer mem.applyMut.Unlock()
+
+	table := mem.table.Load()
+	seq := mem.lastSeq + 1
+	keep := mem.oldestSnapshot()
+
+	for _, op := range ops {
+		table.add(string(op.Key), seq, op.Value, op.Op == wal.OpDelete, keep)
+	}
+
+	mem.lastSeq = seq
+	mem.visible.Store(seq)
+
+	if dead := table.dead(); dead > rebuildMinDead && dead > table.Len() {
+		mem.rebuild(table)
+	}
+}
+
+// rebuild replaces old with a table holding only the live keys. Nodes are
+// never unlinked from a memtable, so without this a store that keeps
+// deleting keys would grow forever. Caller must hold mem.applyMut.
+//
+// Readers already inside old keep using it, it no longer changes.
+func (mem *MemStore) rebuild(old *memtable) {
+	seq := mem.lastSeq
+	fresh := newMemtable()
+
+	for n := old.seekGE(""); n != nil; n = n.next[0].Load() {
+		if v := n.at(seq); v != nil && !v.deleted {
+			fresh.add(n.key, v.seq, v.value, false, seq)
+		}
+	}
+
+	// Iterators pick up a snapshot and a table together
+	mem.snapshots.swap(func() {
+		mem.table.Store(fresh)
+	})
+}
+
+// acquireSnapshot pins the current visible sequence number so versions at
+// it are not trimmed away, and returns it with the table it applies to
+func (mem *MemStore) acquireSnapshot() (uint64, *memtable) {
+	var table *memtable
+	seq := mem.snapshots.acquire(&mem.visible, func() {
+		table = mem.table.Load()
+	})
+	return seq, table
+}
+
+// releaseSnapshot unpins a sequence number taken with acquireSnapshot
+func (mem *MemStore) releaseSnapshot(seq uint64) {
+	mem.snapshots.release(seq)
+}
+
+// oldestSnapshot returns the lowest sequence number any reader may still ask
+// for. Caller must hold mem.applyMut so visible does not move underneath.
+func (mem *MemStore) oldestSnapshot() uint64 {
+	return mem.snapshots.oldest(mem.visible.Load())
+}
+
+// MemtableSize returns the approximate number of bytes held in memory by
+// keys, values and their bookkeeping
+func (mem *MemStore) MemtableSize() int64 {
+	table := mem.table.Load()
+	if table == nil {
+		return 0
+	}
+	return table.Size()
+}
+
+// logEntry appends entry to the WAL according to the store's sync policy
+func (mem *MemStore) logEntry(ctx context.Context, entry *wal.LogEntry) error {
+	if mem.sync == wal.SyncAlways {
+		_, err := mem.walWriter.SyncWrite(ctx, entry)
+		return err
+	}
+
+	_, err := mem.walWriter.Write(ctx, entry)
+	return err
+}
+
 // Delete removes a key
 func (mem *MemStore) Delete(ctx context.Context, key string) error {
 	// Check context before acquiring lock
@@ -113,29 +294,31 @@ func (mem *MemStore) Delete(ctx context.Context, key string) error {
 		return ErrInvalidKey
 	}
 
-	mem.mut.Lock()
-	defer mem.mut.Unlock()
-
-
-	// Check context again after acquiring lock
-	if err := ctx.Err(); err != nil {
-		return err
+	// Deletes are logged like puts, otherwise replay would bring the key back
+	entry := &wal.LogEntry{
+		Timestamp: time.Now().UnixNano(),
+		Op: wal.OpDelete,
+		Key: []byte(key),
 	}
 
-	delete(mem.data, key)
-	return nil
+	return mem.write(ctx, entry, []*wal.LogEntry{entry})
 }
 
-// Close closes the store
-func (mem *MemStore) Close () error {
-	mem.mut.Lock()
-	defer mem.mut.Unlock()
+// Close closes the store and the WAL it owns
+func (mem *MemStore) Close (ctx context.Context) error {
+	// Wait for in-flight writes to finish with the WAL
+	mem.writeMut.Lock()
+	defer mem.writeMut.Unlock()
 
-	if mem.closed {
+	if mem.closed.Load() {
 		return ErrStoreClosed
 	}
 
-	mem.closed = true
-	mem.data = nil
+	mem.closed.Store(true)
+	mem.table.Store(nil)
+
+	if mem.closer != nil {
+		return mem.closer.Close()
+	}
 	return nil
 }
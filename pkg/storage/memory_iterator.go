@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+)
+
+// memIterator iterates over a MemStore.
+//
+// It reads at the sequence number that was visible when it was created, so
+// it sees a consistent snapshot of the store: writes made while iterating,
+// including batches, are either entirely invisible to it or were entirely
+// applied before it started. The snapshot is pinned until Close.
+type memIterator struct {
+	mem *MemStore
+	ctx context.Context
+	reverse bool
+
+	table *memtable
+	seq uint64
+
+	lower string
+	upper string
+	hasUpper bool
+
+	// seek is where the next call to Next starts from when started is false
+	seek *string
+	started bool
+
+	node *memNode
+	key string
+	value []byte
+	err error
+	done bool
+	closed bool
+}
+
+// NewIterator returns an iterator over the keys selected by opts
+func (mem *MemStore) NewIterator(ctx context.Context, opts IterOptions) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if mem.closed.Load() {
+		return nil, ErrStoreClosed
+	}
+
+	seq, table := mem.acquireSnapshot()
+	if table == nil {
+		mem.releaseSnapshot(seq)
+		return nil, ErrStoreClosed
+	}
+
+	it := &memIterator{
+		mem: mem,
+		ctx: ctx,
+		reverse: opts.Reverse,
+		table: table,
+		seq: seq,
+	}
+	it.lower, it.upper, it.hasUpper = opts.bounds()
+	return it, nil
+}
+
+func (it *memIterator) Seek(key string) {
+	if it.closed {
+		return
+	}
+	it.seek = &key
+	it.started = false
+	it.done = false
+}
+
+func (it *memIterator) Next() bool {
+	if it.done || it.err != nil {
+		return false
+	}
+
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		return false
+	}
+
+	if it.mem.closed.Load() {
+		it.err = ErrStoreClosed
+		return false
+	}
+
+	for {
+		if it.reverse {
+			it.node = it.prev()
+		} else {
+			it.node = it.next()
+		}
+		it.started = true
+
+		if it.node == nil || !it.inBounds(it.node.key) {
+			it.done = true
+			it.value = nil
+			return false
+		}
+
+		// Skip keys that did not exist or were deleted as of the snapshot
+		v := it.node.at(it.seq)
+		if v == nil || v.deleted {
+			continue
+		}
+
+		// Defensive copy
+		it.key = it.node.key
+		it.value = make([]byte, len(v.value))
+		copy(it.value, v.value)
+		return true
+	}
+}
+
+// next finds the following node when iterating forward
+func (it *memIterator) next() *memNode {
+	if it.started {
+		// Nodes are never unlinked, so the successor is always valid
+		return it.node.next[0].Load()
+	}
+
+	start := it.lower
+	if it.seek != nil && *it.seek > start {
+		start = *it.seek
+	}
+	return it.table.seekGE(start)
+}
+
+// prev finds the following node when iterating in reverse
+func (it *memIterator) prev() *memNode {
+	if it.started {
+		return it.table.seekLT(it.node.key)
+	}
+
+	if it.seek != nil && (!it.hasUpper || *it.seek < it.upper) {
+		// Largest key <= seek
+		return it.table.seekLT(*it.seek + "\x00")
+	}
+	if it.hasUpper {
+		return it.table.seekLT(it.upper)
+	}
+	return it.table.last()
+}
+
+// inBounds reports whether key falls within [lower, upper)
+func (it *memIterator) inBounds(key string) bool {
+	if key < it.lower {
+		return false
+	}
+	return !it.hasUpper || key < it.upper
+}
+
+func (it *memIterator) Key() string {
+	return it.key
+}
+
+func (it *memIterator) Value() []byte {
+	return it.value
+}
+
+func (it *memIterator) Err() error {
+	return it.err
+}
+
+// Close releases the snapshot held by the iterator
+func (it *memIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+
+	it.closed = true
+	it.done = true
+	it.value = nil
+	it.mem.releaseSnapshot(it.seq)
+	return nil
+}
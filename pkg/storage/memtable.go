@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+const (
+	// memtableMaxHeight bounds the tower height, enough for ~2^24 keys at p=1/4
+	memtableMaxHeight = 12
+
+	// memtableBranching is the inverse of the probability of growing a tower by one level
+	memtableBranching = 4
+
+	// Rough per-entry bookkeeping costs used for size accounting
+	memNodeOverhead = 48
+	memVersionOverhead = 48
+)
+
+// memtable is a concurrent ordered map from keys to versioned values.
+//
+// It is a skiplist where nodes are only ever added, never unlinked, so
+// readers walk it with atomic loads and no locks at all. Inserts link new
+// nodes in with compare-and-swap. Every write pushes a new version onto the
+// key's node tagged with a sequence number, and readers pick the newest
+// version at or below the sequence number they are reading at. That is what
+// lets a batch become visible all at once: its versions are in place before
+// the store advances the visible sequence number past them.
+//
+// Writes to the same key must not race each other, the caller orders them.
+type memtable struct {
+	head *memNode
+	height atomic.Int32
+
+	// Approximate memory held by keys, values and bookkeeping, in bytes
+	size atomic.Int64
+
+	// Number of keys in the table and how many of those are not deleted
+	keys atomic.Int64
+	live atomic.Int64
+}
+
+type memNode struct {
+	key string
+	versions atomic.Pointer[memVersion]
+	next []atomic.Pointer[memNode]
+}
+
+// memVersion is one value of a key, newest first
+type memVersion struct {
+	seq uint64
+	value []byte
+	deleted bool
+	prev atomic.Pointer[memVersion]
+}
+
+func newMemtable() *memtable {
+	m := &memtable{
+		head: &memNode{next: make([]atomic.Pointer[memNode], memtableMaxHeight)},
+	}
+	m.height.Store(1)
+	return m
+}
+
+// randomHeight picks the height of a new tower
+func randomHeight() int {
+	h := 1
+	for h < memtableMaxHeight && rand.IntN(memtableBranching) == 0 {
+		h++
+	}
+	return h
+}
+
+// findSplice returns the nodes around key on every level: prev[i] is the last
+// node before key and next[i] the first node at or after it. It returns the
+// node holding key if there is one.
+func (m *memtable) findSplice(key string, prev, next *[memtableMaxHeight]*memNode) *memNode {
+	height := int(m.height.Load())
+
+	// Levels above the current height are empty as far as this search knows.
+	// If they fill up in the meantime, the CAS in node notices.
+	for i := height; i < memtableMaxHeight; i++ {
+		prev[i], next[i] = m.head, nil
+	}
+
+	x := m.head
+	for i := height - 1; i >= 0; i-- {
+		x, next[i] = m.spliceAt(key, i, x)
+		prev[i] = x
+	}
+	if n := next[0]; n != nil && n.key == key {
+		return n
+	}
+	return nil
+}
+
+// spliceAt walks level i from start, which must sort before key, and
+// returns the pair of nodes key would go between
+func (m *memtable) spliceAt(key string, i int, start *memNode) (*memNode, *memNode) {
+	prev := start
+	for {
+		next := prev.next[i].Load()
+		if next == nil || next.key >= key {
+			return prev, next
+		}
+		prev = next
+	}
+}
+
+// node returns the node for key, linking in a new one if it does not exist yet
+func (m *memtable) node(key string) *memNode {
+	var prev, next [memtableMaxHeight]*memNode
+
+	for {
+		if n := m.findSplice(key, &prev, &next); n != nil {
+			return n
+		}
+
+		height := randomHeight()
+
+		// Losing this race only means another insert raised it first
+		for cur := m.height.Load(); int(cur) < height; cur = m.height.Load() {
+			if m.height.CompareAndSwap(cur, int32(height)) {
+				break
+			}
+		}
+
+		n := &memNode{key: key, next: make([]atomic.Pointer[memNode], height)}
+		for i := range height {
+			n.next[i].Store(next[i])
+		}
+
+		// Level 0 decides membership, if someone got in first start over
+		if !prev[0].next[0].CompareAndSwap(next[0], n) {
+			continue
+		}
+
+		// Higher levels are only shortcuts, keep retrying until linked
+		for i := 1; i < height; i++ {
+			for !prev[i].next[i].CompareAndSwap(next[i], n) {
+				prev[i], next[i] = m.spliceAt(key, i, prev[i])
+				n.next[i].Store(next[i])
+			}
+		}
+
+		m.keys.Add(1)
+		m.size.Add(int64(len(key) + memNodeOverhead + height*8))
+		return n
+	}
+}
+
+// add records a new version of key at seq. Versions older than the newest
+// one at or below keep are dropped, since no reader can ask for them anymore.
+func (m *memtable) add(key string, seq uint64, value []byte, deleted bool, keep uint64) {
+	n := m.node(key)
+
+	v := &memVersion{seq: seq, value: value, deleted: deleted}
+	top := n.versions.Load()
+	v.prev.Store(top)
+	n.versions.Store(v)
+
+	m.size.Add(int64(len(value) + memVersionOverhead))
+
+	wasLive := top != nil && !top.deleted
+	switch {
+	case wasLive && deleted:
+		m.live.Add(-1)
+	case !wasLive && !deleted:
+		m.live.Add(1)
+	}
+
+	// Find the newest version every reader can still see and cut below it
+	for ; v != nil; v = v.prev.Load() {
+		if v.seq <= keep {
+			for old := v.prev.Load(); old != nil; old = old.prev.Load() {
+				m.size.Add(-int64(len(old.value) + memVersionOverhead))
+			}
+			v.prev.Store(nil)
+			return
+		}
+	}
+}
+
+// find returns the node for key, or nil if the key was never written
+func (m *memtable) find(key string) *memNode {
+	n := m.seekGE(key)
+	if n == nil || n.key != key {
+		return nil
+	}
+	return n
+}
+
+// at returns the newest version of the node at or below seq, or nil
+func (n *memNode) at(seq uint64) *memVersion {
+	for v := n.versions.Load(); v != nil; v = v.prev.Load() {
+		if v.seq <= seq {
+			return v
+		}
+	}
+	return nil
+}
+
+// seekGE returns the first node with a key >= key, or nil
+func (m *memtable) seekGE(key string) *memNode {
+	x := m.head
+	for i := int(m.height.Load()) - 1; i >= 0; i-- {
+		x, _ = m.spliceAt(key, i, x)
+	}
+	return x.next[0].Load()
+}
+
+// seekLT returns the last node with a key < key, or nil
+func (m *memtable) seekLT(key string) *memNode {
+	x := m.head
+	for i := int(m.height.Load()) - 1; i >= 0; i-- {
+		x, _ = m.spliceAt(key, i, x)
+	}
+	if x == m.head {
+		return nil
+	}
+	return x
+}
+
+// last returns the node with the largest key, or nil if the table is empty
+func (m *memtable) last() *memNode {
+	x := m.head
+	for i := int(m.height.Load()) - 1; i >= 0; i-- {
+		for next := x.next[i].Load(); next != nil; next = x.next[i].Load() {
+			x = next
+		}
+	}
+	if x == m.head {
+		return nil
+	}
+	return x
+}
+
+// Size returns the approximate number of bytes held by the table
+func (m *memtable) Size() int64 {
+	return m.size.Load()
+}
+
+// Len returns the number of keys in the table that are not deleted
+func (m *memtable) Len() int64 {
+	return m.live.Load()
+}
+
+// dead returns the number of keys whose newest version is a tombstone
+func (m *memtable) dead() int64 {
+	return m.keys.Load() - m.live.Load()
+}
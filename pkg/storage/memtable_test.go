@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// Test the memtable against a sorted reference under random puts and deletes
+func TestMemtable_RandomOps(t *testing.T) {
+	table := newMemtable()
+	ref := make(map[string]string)
+
+	for i := range 5000 {
+		seq := uint64(i + 1)
+		key := fmt.Sprintf("key-%03d", rand.IntN(300))
+
+		if rand.IntN(3) == 0 {
+			table.add(key, seq, nil, true, seq)
+			delete(ref, key)
+		} else {
+			value := fmt.Sprintf("value-%d", i)
+			table.add(key, seq, []byte(value), false, seq)
+			ref[key] = value
+		}
+	}
+
+	if table.Len() != int64(len(ref)) {
+		t.Fatalf("Len is %d, reference has %d", table.Len(), len(ref))
+	}
+
+	var want []string
+	for k := range ref {
+		want = append(want, k)
+	}
+	slices.Sort(want)
+
+	var got []string
+	for n := table.seekGE(""); n != nil; n = n.next[0].Load() {
+		v := n.at(^uint64(0))
+		if v.deleted {
+			continue
+		}
+		if string(v.value) != ref[n.key] {
+			t.Errorf("Key %s: got %s, want %s", n.key, v.value, ref[n.key])
+		}
+		got = append(got, n.key)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Memtable order does not match reference")
+	}
+}
+
+// Test that concurrent inserts of overlapping keys all end up linked exactly once and in order
+func TestMemtable_ConcurrentInsert(t *testing.T) {
+	table := newMemtable()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := range 1000 {
+				// Every goroutine writes half of its keys over another goroutine's range
+				key := fmt.Sprintf("key-%05d", (id/2)*1000+i)
+				table.node(key)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	count := 0
+	prev := ""
+	for n := table.seekGE(""); n != nil; n = n.next[0].Load() {
+		if n.key <= prev {
+			t.Fatalf("Key %s follows %s", n.key, prev)
+		}
+		prev = n.key
+		count++
+	}
+	if count != 4000 {
+		t.Errorf("Expected 4000 distinct keys, got %d", count)
+	}
+	if table.keys.Load() != 4000 {
+		t.Errorf("Key count says %d, want 4000", table.keys.Load())
+	}
+}
+
+// Test that readers pick the version for their sequence number and that old versions are trimmed
+func TestMemtable_Versions(t *testing.T) {
+	table := newMemtable()
+
+	table.add("key", 1, []byte("one"), false, 0)
+	table.add("key", 2, []byte("two"), false, 0)
+	table.add("key", 3, nil, true, 0)
+
+	n := table.find("key")
+	if v := n.at(2); string(v.value) != "two" {
+		t.Errorf("At 2: got %q", v.value)
+	}
+	if v := n.at(3); !v.deleted {
+		t.Errorf("At 3: expected a tombstone")
+	}
+	if v := n.at(0); v != nil {
+		t.Errorf("At 0: expected nothing, got %q", v.value)
+	}
+
+	sizeBefore := table.Size()
+
+	// Nobody reads below 3 anymore, so only versions 4 and 3 need to stay
+	table.add("key", 4, []byte("four"), false, 3)
+	if v := n.at(2); v != nil {
+		t.Errorf("Version 2 should have been trimmed, got %q", v.value)
+	}
+	if v := n.at(3); v == nil || !v.deleted {
+		t.Errorf("Version 3 should survive trimming")
+	}
+	if table.Size() >= sizeBefore+int64(len("four")+memVersionOverhead) {
+		t.Errorf("Trimmed versions were not subtracted from the size")
+	}
+}
+
+// Test that a store which keeps deleting keys does not keep them around forever
+func TestMemStore_RebuildAfterDeletes(t *testing.T) {
+	mock := &MockWriter{}
+	store := NewMemStore(mock)
+	defer store.Close(context.Background())
+
+	ctx := context.Background()
+	store.Put(ctx, "keep", []byte("value"))
+
+	for i := range 3 * rebuildMinDead {
+		key := fmt.Sprintf("temp-%d", i)
+		store.Put(ctx, key, []byte("value"))
+		store.Delete(ctx, key)
+	}
+
+	table := store.table.Load()
+	if table.keys.Load() > 2*rebuildMinDead {
+		t.Errorf("Table still holds %d keys for 1 live one", table.keys.Load())
+	}
+	if got, err := store.Get(ctx, "keep"); err != nil || string(got) != "value" {
+		t.Errorf("Live key lost in rebuild: %q, %v", got, err)
+	}
+	if store.MemtableSize() <= 0 {
+		t.Errorf("Expected a positive memtable size, got %d", store.MemtableSize())
+	}
+}
+
+// lockedMap is the map and RWMutex MemStore used before the memtable, kept as a benchmark baseline
+type lockedMap struct {
+	data map[string][]byte
+	mut sync.RWMutex
+}
+
+func (m *lockedMap) get(key string) []byte {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return m.data[key]
+}
+
+func (m *lockedMap) put(key string, value []byte) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.data[key] = value
+}
+
+// Compares the memtable against a locked map for read-heavy and mixed workloads
+func BenchmarkMemtable(b *testing.B) {
+	const keys = 10000
+
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = fmt.Sprintf("key-%06d", i)
+	}
+	value := make([]byte, 100)
+
+	for _, readPct := range []int{100, 90, 50} {
+		b.Run(fmt.Sprintf("map/reads=%d%%", readPct), func(b *testing.B) {
+			m := &lockedMap{data: make(map[string][]byte)}
+			for _, k := range names {
+				m.put(k, value)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					key := names[rand.IntN(keys)]
+					if rand.IntN(100) < readPct {
+						m.get(key)
+					} else {
+						m.put(key, value)
+					}
+				}
+			})
+		})
+
+		b.Run(fmt.Sprintf("memtable/reads=%d%%", readPct), func(b *testing.B) {
+			store := NewMemStore(&MockWriter{})
+			defer store.Close(context.Background())
+
+			ctx := context.Background()
+			for _, k := range names {
+				store.Put(ctx, k, value)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					key := names[rand.IntN(keys)]
+					if rand.IntN(100) < readPct {
+						store.lookup(key)
+					} else {
+						store.apply([]*wal.LogEntry{{Op: wal.OpPut, Key: []byte(key), Value: value}})
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+const (
+	// DefaultMemtableSize is the flush threshold used when Options.MemtableSize is unset
+	DefaultMemtableSize = 4 * 1024 * 1024 // 4MB
+
+	// DefaultL0CompactionTrigger is used when Options.L0CompactionTrigger is unset
+	DefaultL0CompactionTrigger = 4
+
+	// DefaultBaseLevelSize is used when Options.BaseLevelSize is unset
+	DefaultBaseLevelSize = 10 * 1024 * 1024 // 10MB
+
+	// DefaultLevelSizeRatio is used when Options.LevelSizeRatio is unset
+	DefaultLevelSizeRatio = 10
+
+	// DefaultTargetFileSize is used when Options.TargetFileSize is unset
+	DefaultTargetFileSize = 2 * 1024 * 1024 // 2MB
+
+	// DefaultBloomBitsPerKey is used when Options.BloomBitsPerKey is unset
+	DefaultBloomBitsPerKey = 10
+
+	// DefaultPageCacheSize is used when Options.PageCacheSize is unset
+	DefaultPageCacheSize = 1024 // 4MB of pages
+
+	// MinPageCacheSize is the smallest Options.PageCacheSize. A put may split
+	// every page from the root down to a leaf, which touches twice as many
+	// pages as the tree is high plus a new root: 15 for a tree of 7 levels,
+	// deeper than a tree of 4KB pages gets.
+	MinPageCacheSize = 16
+)
+
+// Options configures a store kept in a directory on disk
+type Options struct {
+	// Engine names the storage engine Open uses, one of EngineMemory,
+	// EngineLSM, EngineBTree or an engine added with Register
+	Engine string
+
+	// Dir is the directory holding the store's WAL and data files. It is
+	// created if needed.
+	Dir string
+
+	// WAL configures the write-ahead log. WAL.Sync decides whether a write
+	// is on disk before it is acknowledged, the zero value syncs every write.
+	// WAL.FS only moves the log, the LSM and B-tree engines keep their other
+	// files on the OS filesystem (see package vfs). WAL.Recovery decides
+	// whether a damaged log fails opening the store or is salvaged, see
+	// RecoveryInfo.
+	WAL wal.Options
+
+	// MemtableSize is the approximate number of bytes the LSM engine buffers
+	// in memory before it freezes the memtable and flushes it to a table file
+	MemtableSize int64
+
+	// L0CompactionTrigger is the number of level 0 files at which they are
+	// compacted into level 1. Writes are held back at three times as many.
+	L0CompactionTrigger int
+
+	// BaseLevelSize is the size in bytes level 1 may grow to before it is
+	// compacted into level 2. Each deeper level may be LevelSizeRatio times
+	// larger than the one above it.
+	BaseLevelSize int64
+	LevelSizeRatio int
+
+	// TargetFileSize is the size at which compaction starts a new output file
+	TargetFileSize int64
+
+	// BloomBitsPerKey sizes the Bloom filter written with every table file,
+	// which lets lookups skip tables that cannot hold the key. A negative
+	// value writes no filters.
+	BloomBitsPerKey int
+
+	// PageCacheSize is the number of pages the B-tree engine keeps in memory.
+	// Half as many modified pages trigger a checkpoint writing them back.
+	// A checkpoint logs its pages in a single record, which has to fit in
+	// WAL.Limits.MaxValueSize. Values below MinPageCacheSize are raised to it.
+	PageCacheSize int
+}
+
+// withDefaults fills in the engine settings left at zero
+func (o Options) withDefaults() Options {
+	if o.MemtableSize <= 0 {
+		o.MemtableSize = DefaultMemtableSize
+	}
+	if o.L0CompactionTrigger <= 0 {
+		o.L0CompactionTrigger = DefaultL0CompactionTrigger
+	}
+	if o.BaseLevelSize <= 0 {
+		o.BaseLevelSize = DefaultBaseLevelSize
+	}
+	if o.LevelSizeRatio <= 1 {
+		o.LevelSizeRatio = DefaultLevelSizeRatio
+	}
+	if o.TargetFileSize <= 0 {
+		o.TargetFileSize = DefaultTargetFileSize
+	}
+	if o.BloomBitsPerKey == 0 {
+		o.BloomBitsPerKey = DefaultBloomBitsPerKey
+	}
+	if o.PageCacheSize <= 0 {
+		o.PageCacheSize = DefaultPageCacheSize
+	}
+	o.PageCacheSize = max(o.PageCacheSize, MinPageCacheSize)
+	return o
+}
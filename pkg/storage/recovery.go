@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// RecoveryInfo describes what happened while replaying the WAL on startup
+type RecoveryInfo struct {
+	// Applied is the number of log entries replayed into the store
+	Applied int
+
+	// Segment is the WAL segment replay stopped in
+	Segment string
+
+	// Offset is the position in Segment right after the last valid record.
+	// New appends start here.
+	Offset int64
+
+	// Truncated is the number of bytes dropped from a torn final record,
+	// or from a corrupt one in wal.RecoverTruncateTail mode
+	Truncated int64
+
+	// Skipped lists the damaged ranges of the log passed over in
+	// wal.RecoverSkipCorrupted mode. The records in them are lost.
+	Skipped []wal.Damage
+}
+
+// legacyWALName is the single log file a MemStore kept its WAL in before
+// the WAL was split into segments
+const legacyWALName = "anchor.wal"
+
+// importLegacyWAL makes the single log file of a store from before the WAL
+// was split into segments the first segment of its WAL
+func importLegacyWAL(fs vfs.FS, dir string) error {
+	path := filepath.Join(dir, legacyWALName)
+	if _, err := fs.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return wal.ImportFile(fs, path, dir)
+}
+
+// OpenMemStore creates an in-memory store backed by the WAL in dir.
+// Any entries already in the log are replayed before the store is returned,
+// so data written before a crash or restart is visible again.
+func OpenMemStore(dir string, opts Options) (*MemStore, error) {
+	fs := vfs.Default(opts.WAL.FS)
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := importLegacyWAL(fs, dir); err != nil {
+		return nil, err
+	}
+
+	mem := &MemStore{
+		sync: opts.WAL.Sync,
+	}
+	mem.table.Store(newMemtable())
+
+	info, err := replay(dir, opts.WAL, 0, func(e *wal.LogEntry) error {
+		ops, err := entryOps(e)
+		if err != nil {
+			return err
+		}
+		mem.apply(ops)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("WAL recovery failed: %w", err)
+	}
+
+	w, err := wal.Open(dir, opts.WAL)
+	if err != nil {
+		return nil, err
+	}
+
+	mem.walWriter = w
+	mem.closer = w
+	mem.recovery = info
+	return mem, nil
+}
+
+// Recovery returns the outcome of the WAL replay done by OpenMemStore
+func (mem *MemStore) Recovery() RecoveryInfo {
+	return mem.recovery
+}
+
+// entryOps returns the puts and deletes a log entry stands for
+func entryOps(e *wal.LogEntry) ([]*wal.LogEntry, error) {
+	if e.Op != wal.OpBatch {
+		return []*wal.LogEntry{e}, nil
+	}
+	return e.BatchEntries()
+}
+
+// replay reads every entry in the WAL in dir with an LSN of at least from
+// and hands it to apply in order. A torn final record (crash in the middle
+// of a write) is cut off so the next append lands on a clean record boundary.
+// Damaged records are dealt with as opts.Recovery says.
+func replay(dir string, opts wal.Options, from uint64, apply func(*wal.LogEntry) error) (RecoveryInfo, error) {
+	var info RecoveryInfo
+
+	r, err := wal.OpenReader(dir, opts)
+	if err != nil {
+		return info, err
+	}
+	defer r.Close()
+
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			info.Segment = r.CurrentFile()
+			info.Offset = r.CurrentOffset()
+			info.Skipped = r.Skipped()
+			return info, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			info.Segment = r.CurrentFile()
+			info.Offset = r.RecordOffset()
+			info.Skipped = r.Skipped()
+			info.Truncated, err = truncateTail(vfs.Default(opts.FS), info.Segment, info.Offset)
+			return info, err
+		}
+		if err != nil {
+			return info, err
+		}
+
+		// Already checkpointed elsewhere, the segment just has not been removed yet
+		if entry.LSN < from {
+			continue
+		}
+
+		if err := apply(entry); err != nil {
+			return info, fmt.Errorf("entry %d: %w", entry.LSN, err)
+		}
+		info.Applied++
+	}
+}
+
+// truncateTail cuts the file at path down to size and returns the number of bytes removed
+func truncateTail(fs vfs.FS, path string, size int64) (int64, error) {
+	f, err := fs.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return 0, err
+	}
+	return stat.Size() - size, f.Sync()
+}
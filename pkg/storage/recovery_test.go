@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// Test that data written through the WAL is visible again after reopening the store
+func TestMemStore_RecoverAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := OpenMemStore(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	store.Put(ctx, "a", []byte("1"))
+	store.Put(ctx, "b", []byte("2"))
+	store.Put(ctx, "a", []byte("3"))
+	store.Close(ctx)
+
+	store, err = OpenMemStore(dir, Options{})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer store.Close(ctx)
+
+	if info := store.Recovery(); info.Applied != 3 || info.Truncated != 0 {
+		t.Errorf("Unexpected recovery info: %+v", info)
+	}
+
+	got, err := store.Get(ctx, "a")
+	if err != nil || !bytes.Equal(got, []byte("3")) {
+		t.Errorf("Got %q (%v), want %q", got, err, "3")
+	}
+
+	got, err = store.Get(ctx, "b")
+	if err != nil || !bytes.Equal(got, []byte("2")) {
+		t.Errorf("Got %q (%v), want %q", got, err, "2")
+	}
+}
+
+// Test that a torn final record is dropped and later appends land on a clean boundary
+func TestMemStore_RecoverTornTail(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, _ := OpenMemStore(dir, Options{})
+	store.Put(ctx, "kept", []byte("value"))
+	store.Put(ctx, "torn", []byte("value"))
+	store.Close(ctx)
+
+	segments, _ := wal.Segments(dir)
+	path := segments[len(segments)-1]
+
+	// Cut the last record in half to simulate a crash mid-write
+	stat, _ := os.Stat(path)
+	os.Truncate(path, stat.Size()-7)
+
+	store, err := OpenMemStore(dir, Options{})
+	if err != nil {
+		t.Fatalf("Recovery should tolerate a torn tail, got %v", err)
+	}
+
+	info := store.Recovery()
+	if info.Applied != 1 {
+		t.Errorf("Expected 1 applied entry, got %d", info.Applied)
+	}
+	if info.Truncated == 0 {
+		t.Errorf("Expected torn bytes to be truncated")
+	}
+
+	stat, _ = os.Stat(path)
+	if stat.Size() != info.Offset {
+		t.Errorf("File size %d does not match recovery offset %d", stat.Size(), info.Offset)
+	}
+
+	if _, err := store.Get(ctx, "torn"); err != ErrKeyNotFound {
+		t.Errorf("Torn entry should not be applied, got %v", err)
+	}
+
+	// Appends after recovery must be readable on the next restart
+	store.Put(ctx, "after", []byte("crash"))
+	store.Close(ctx)
+
+	store, err = OpenMemStore(dir, Options{})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer store.Close(ctx)
+
+	if info := store.Recovery(); info.Applied != 2 || info.Truncated != 0 {
+		t.Errorf("Unexpected recovery info: %+v", info)
+	}
+	if _, err := store.Get(ctx, "after"); err != nil {
+		t.Errorf("Entry written after recovery was lost: %v", err)
+	}
+}
+
+// Test that a corrupt record in the middle of the log fails recovery unless the store is told to skip it
+func TestMemStore_RecoverSkipCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, _ := OpenMemStore(dir, Options{})
+	store.Put(ctx, "a", []byte("1"))
+	store.Put(ctx, "b", []byte("2"))
+	store.Put(ctx, "c", []byte("3"))
+	store.Close(ctx)
+
+	// Flip the last byte of the value of "b"
+	segments, _ := wal.Segments(dir)
+	path := segments[len(segments)-1]
+	data, _ := os.ReadFile(path)
+	recordSize := (len(data) - wal.FileHeaderSize) / 3
+	data[wal.FileHeaderSize+2*recordSize-1] ^= 0xFF
+	os.WriteFile(path, data, 0644)
+
+	for _, mode := range []wal.RecoveryMode{wal.RecoverStrict, wal.RecoverTruncateTail} {
+		if _, err := OpenMemStore(dir, Options{WAL: wal.Options{Recovery: mode}}); !errors.Is(err, wal.ErrCorruption) {
+			t.Errorf("Expected %s recovery to fail with ErrCorruption, got %v", mode, err)
+		}
+	}
+
+	store, err := OpenMemStore(dir, Options{WAL: wal.Options{Recovery: wal.RecoverSkipCorrupted}})
+	if err != nil {
+		t.Fatalf("Recovery should skip the corrupt record, got %v", err)
+	}
+	defer store.Close(ctx)
+
+	info := store.Recovery()
+	if info.Applied != 2 || len(info.Skipped) != 1 {
+		t.Fatalf("Unexpected recovery info: %+v", info)
+	}
+	if skipped := info.Skipped[0]; skipped.Offset != int64(wal.FileHeaderSize+recordSize) || skipped.Length != int64(recordSize) {
+		t.Errorf("Expected the record of %q to be skipped, got %+v", "b", skipped)
+	}
+
+	if _, err := store.Get(ctx, "b"); err != ErrKeyNotFound {
+		t.Errorf("Corrupt entry should not be applied, got %v", err)
+	}
+	if _, err := store.Get(ctx, "c"); err != nil {
+		t.Errorf("Entry after the corrupt one was lost: %v", err)
+	}
+}
+
+// Test that relaxed sync policies still persist everything on a clean shutdown
+func TestMemStore_SyncPolicy(t *testing.T) {
+	for _, policy := range []wal.SyncPolicy{wal.SyncAlways, wal.SyncEveryN, wal.SyncInterval, wal.SyncNever} {
+		t.Run(policy.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			ctx := context.Background()
+			opts := Options{WAL: wal.Options{Sync: policy}}
+
+			store, err := OpenMemStore(dir, opts)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			store.Put(ctx, "key", []byte("value"))
+			store.Close(ctx)
+
+			store, _ = OpenMemStore(dir, opts)
+			defer store.Close(ctx)
+
+			if _, err := store.Get(ctx, "key"); err != nil {
+				t.Errorf("Entry lost with policy %s: %v", policy, err)
+			}
+		})
+	}
+}
+
+// Test that deleted keys stay deleted after a restart
+func TestMemStore_RecoverDelete(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, _ := OpenMemStore(dir, Options{})
+	store.Put(ctx, "gone", []byte("value"))
+	store.Put(ctx, "back", []byte("value"))
+	store.Delete(ctx, "gone")
+	store.Delete(ctx, "back")
+	store.Put(ctx, "back", []byte("again"))
+	store.Close(ctx)
+
+	store, _ = OpenMemStore(dir, Options{})
+	defer store.Close(ctx)
+
+	if _, err := store.Get(ctx, "gone"); err != ErrKeyNotFound {
+		t.Errorf("Deleted key was resurrected, got %v", err)
+	}
+
+	got, err := store.Get(ctx, "back")
+	if err != nil || !bytes.Equal(got, []byte("again")) {
+		t.Errorf("Got %q (%v), want %q", got, err, "again")
+	}
+}
+
+// Test that racing puts and deletes on the same keys replay to the state the store had before the restart
+func TestMemStore_RecoverConcurrentOrder(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, _ := OpenMemStore(dir, Options{WAL: wal.Options{GroupCommit: true}})
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := range 100 {
+				key := fmt.Sprintf("key-%d", i%4)
+				if (id+i)%3 == 0 {
+					store.Delete(ctx, key)
+				} else {
+					store.Put(ctx, key, []byte(fmt.Sprintf("value-%d-%d", id, i)))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	before := make(map[string][]byte)
+	for i := range 4 {
+		key := fmt.Sprintf("key-%d", i)
+		if val, err := store.Get(ctx, key); err == nil {
+			before[key] = val
+		}
+	}
+	store.Close(ctx)
+
+	store, _ = OpenMemStore(dir, Options{})
+	defer store.Close(ctx)
+
+	for i := range 4 {
+		key := fmt.Sprintf("key-%d", i)
+		got, err := store.Get(ctx, key)
+
+		want, ok := before[key]
+		if !ok {
+			if err != ErrKeyNotFound {
+				t.Errorf("Key %s: expected it to be deleted, got %q", key, got)
+			}
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Key %s: replayed %q, store had %q", key, got, want)
+		}
+	}
+}
+
+// Test that the single WAL file of a store from before the WAL had segments
+// is carried over instead of being ignored. testdata/anchor.wal was written
+// by such a store: puts of alpha, beta and gamma.
+func TestMemStore_ImportLegacyWAL(t *testing.T) {
+	ctx := context.Background()
+	legacy, err := os.ReadFile(filepath.Join("testdata", legacyWALName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, legacyWALName), legacy, 0644)
+	store, err := OpenMemStore(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.Put(ctx, "delta", []byte("4"))
+	store.Close(ctx)
+
+	if _, err := os.Stat(filepath.Join(dir, legacyWALName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected %s to become a segment, got %v", legacyWALName, err)
+	}
+
+	store, err = OpenMemStore(dir, Options{})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer store.Close(ctx)
+	for key, want := range map[string]string{"alpha": "1", "beta": "2", "gamma": "3", "delta": "4"} {
+		if got, err := store.Get(ctx, key); err != nil || string(got) != want {
+			t.Errorf("Get %s: got %q (%v), want %q", key, got, err, want)
+		}
+	}
+
+	// Alongside segments there is no telling where the old records belong
+	os.WriteFile(filepath.Join(dir, legacyWALName), legacy, 0644)
+	if _, err := OpenMemStore(dir, Options{}); err == nil || !strings.Contains(err.Error(), legacyWALName) {
+		t.Errorf("Expected Open to refuse %s next to segments, got %v", legacyWALName, err)
+	}
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Names of the built-in engines
+const (
+	EngineMemory = "memory"
+	EngineLSM = "lsm"
+	EngineBTree = "btree"
+)
+
+// OpenFunc opens a store of one engine as configured by opts
+type OpenFunc func(ctx context.Context, opts Options) (Store, error)
+
+var (
+	enginesMut sync.RWMutex
+	engines = make(map[string]OpenFunc)
+)
+
+func init() {
+	Register(EngineMemory, func(ctx context.Context, opts Options) (Store, error) {
+		return OpenMemStore(opts.Dir, opts)
+	})
+	Register(EngineLSM, func(ctx context.Context, opts Options) (Store, error) {
+		return OpenLSMStore(opts.Dir, opts)
+	})
+	Register(EngineBTree, func(ctx context.Context, opts Options) (Store, error) {
+		return OpenBTreeStore(opts.Dir, opts)
+	})
+}
+
+// Register makes an engine available to Open under name.
+// It panics if name is empty or already taken, or if open is nil.
+func Register(name string, open OpenFunc) {
+	enginesMut.Lock()
+	defer enginesMut.Unlock()
+
+	if strings.TrimSpace(name) == "" || open == nil {
+		panic("storage: Register needs a name and an open function")
+	}
+	if _, ok := engines[name]; ok {
+		panic("storage: engine " + name + " registered twice")
+	}
+	engines[name] = open
+}
+
+// Engines returns the names of the registered engines, sorted
+func Engines() []string {
+	enginesMut.RLock()
+	defer enginesMut.RUnlock()
+
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Open opens the store in opts.Dir with the engine named by opts.Engine.
+// Returns ErrUnknownEngine if no engine of that name was registered.
+func Open(ctx context.Context, opts Options) (Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	enginesMut.RLock()
+	open, ok := engines[opts.Engine]
+	enginesMut.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q, have %s", ErrUnknownEngine, opts.Engine, strings.Join(Engines(), ", "))
+	}
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("%w: no directory for the %s engine", ErrInvalidOptions, opts.Engine)
+	}
+	return open(ctx, opts)
+}
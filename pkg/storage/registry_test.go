@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// Test that Open rejects unknown engines and finds ones added with Register
+func TestStore_Registry(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := Open(ctx, Options{Engine: "nope", Dir: t.TempDir()})
+	if !errors.Is(err, ErrUnknownEngine) {
+		t.Errorf("Expected ErrUnknownEngine, got %v", err)
+	}
+
+	_, err = Open(ctx, Options{Engine: EngineLSM})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("Expected ErrInvalidOptions without a directory, got %v", err)
+	}
+
+	opened := false
+	Register("registry-test", func(ctx context.Context, opts Options) (Store, error) {
+		opened = true
+		return OpenMemStore(opts.Dir, opts)
+	})
+	if !slices.Contains(Engines(), "registry-test") {
+		t.Errorf("Registered engine missing from %v", Engines())
+	}
+
+	store, err := Open(ctx, Options{Engine: "registry-test", Dir: t.TempDir()})
+	if err != nil || !opened {
+		t.Fatalf("Open of a registered engine failed: %v", err)
+	}
+	store.Close(ctx)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering a name twice to panic")
+		}
+	}()
+	Register(EngineMemory, func(ctx context.Context, opts Options) (Store, error) { return nil, nil })
+}
+
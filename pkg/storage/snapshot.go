@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// snapshotSet tracks the sequence numbers that open iterators read at, with
+// reference counts. Versions they still need are kept when newer ones are
+// added. The zero value is an empty set ready to use.
+type snapshotSet struct {
+	mut sync.Mutex
+	refs map[uint64]int
+}
+
+// acquire pins the sequence number currently in visible and returns it.
+// load runs under the set's lock, so whatever it picks up (a table, a list
+// of files) is the one the number refers to as long as every replacement
+// of those goes through swap.
+func (s *snapshotSet) acquire(visible *atomic.Uint64, load func()) uint64 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.refs == nil {
+		s.refs = make(map[uint64]int)
+	}
+
+	seq := visible.Load()
+	s.refs[seq]++
+	load()
+	return seq
+}
+
+// release unpins a sequence number taken with acquire
+func (s *snapshotSet) release(seq uint64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.refs[seq]--; s.refs[seq] <= 0 {
+		delete(s.refs, seq)
+	}
+}
+
+// oldest returns the lowest sequence number any reader may still ask for,
+// given the one currently visible
+func (s *snapshotSet) oldest(visible uint64) uint64 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for seq := range s.refs {
+		visible = min(visible, seq)
+	}
+	return visible
+}
+
+// swap runs fn under the set's lock, see acquire
+func (s *snapshotSet) swap(fn func()) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	fn()
+}
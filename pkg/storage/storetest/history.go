@@ -0,0 +1,167 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"com.github/mune-0/anchor/pkg/storage"
+)
+
+// Kind is what an Operation did
+type Kind uint8
+
+const (
+	KindGet Kind = iota
+	KindPut
+	KindDelete
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindGet:
+		return "get"
+	case KindPut:
+		return "put"
+	case KindDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("Kind(%d)", k)
+	}
+}
+
+// Operation is one call made against a store while recording a history
+type Operation struct {
+	Client int
+	Kind Kind
+	Key string
+
+	// Value is the value written by a put
+	Value string
+
+	// Output is the value returned by a get, if Found is set
+	Output string
+	Found bool
+
+	// Call and Return are taken from a clock shared by all clients, so an
+	// operation that returned before another was called has the smaller
+	// Return. The operation took effect somewhere in between.
+	// A write that failed has a Return of math.MaxInt64, it may have taken
+	// effect at any point after its call or not at all.
+	Call int64
+	Return int64
+}
+
+func (op Operation) String() string {
+	switch op.Kind {
+	case KindGet:
+		if !op.Found {
+			return fmt.Sprintf("client %d: get %s -> not found", op.Client, op.Key)
+		}
+		return fmt.Sprintf("client %d: get %s -> %s", op.Client, op.Key, op.Output)
+	case KindPut:
+		return fmt.Sprintf("client %d: put %s = %s", op.Client, op.Key, op.Value)
+	default:
+		return fmt.Sprintf("client %d: %s %s", op.Client, op.Kind, op.Key)
+	}
+}
+
+// HistoryOptions configures RecordHistory. Fields left at zero take the
+// defaults below.
+type HistoryOptions struct {
+	// Clients is the number of goroutines calling the store, default 4
+	Clients int
+
+	// Operations is the number of calls each client makes, default 200
+	Operations int
+
+	// Keys is the number of distinct keys used, default 4. Few keys make
+	// clients collide more often.
+	Keys int
+
+	// Seed makes the choice of operations reproducible
+	Seed uint64
+}
+
+func (o HistoryOptions) withDefaults() HistoryOptions {
+	if o.Clients <= 0 {
+		o.Clients = 4
+	}
+	if o.Operations <= 0 {
+		o.Operations = 200
+	}
+	if o.Keys <= 0 {
+		o.Keys = 4
+	}
+	return o
+}
+
+// RecordHistory runs random puts, gets and deletes against store from
+// several goroutines at once and returns every operation with what it saw.
+// Every put writes a value no other put writes.
+//
+// A get failing with anything but storage.ErrKeyNotFound stops the recording
+// and its error is returned, failed writes are kept in the history as
+// operations that may or may not have happened.
+func RecordHistory(ctx context.Context, store storage.Store, opts HistoryOptions) ([]Operation, error) {
+	opts = opts.withDefaults()
+
+	var clock atomic.Int64
+	histories := make([][]Operation, opts.Clients)
+	errs := make([]error, opts.Clients)
+
+	var wg sync.WaitGroup
+	for client := range opts.Clients {
+		wg.Go(func() {
+			rng := rand.New(rand.NewPCG(opts.Seed, uint64(client)))
+			for i := range opts.Operations {
+				op := Operation{
+					Client: client,
+					Kind: Kind(rng.IntN(3)),
+					Key: fmt.Sprintf("key-%d", rng.IntN(opts.Keys)),
+				}
+
+				var err error
+				op.Call = clock.Add(1)
+				switch op.Kind {
+				case KindGet:
+					var value []byte
+					value, err = store.Get(ctx, op.Key)
+					op.Output, op.Found = string(value), err == nil
+					if errors.Is(err, storage.ErrKeyNotFound) {
+						err = nil
+					}
+				case KindPut:
+					op.Value = fmt.Sprintf("%d-%d", client, i)
+					err = store.Put(ctx, op.Key, []byte(op.Value))
+				case KindDelete:
+					err = store.Delete(ctx, op.Key)
+				}
+				op.Return = clock.Add(1)
+
+				if err != nil {
+					if op.Kind == KindGet {
+						errs[client] = fmt.Errorf("%s: %w", op, err)
+						return
+					}
+					op.Return = math.MaxInt64
+				}
+				histories[client] = append(histories[client], op)
+			}
+		})
+	}
+	wg.Wait()
+
+	var history []Operation
+	for client := range opts.Clients {
+		if errs[client] != nil {
+			return nil, errs[client]
+		}
+		history = append(history, histories[client]...)
+	}
+	return history, nil
+}
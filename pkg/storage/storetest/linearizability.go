@@ -0,0 +1,184 @@
+package storetest
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ErrNotLinearizable is returned by CheckLinearizable when a history cannot
+// be explained by running its operations one at a time
+var ErrNotLinearizable = errors.New("history is not linearizable")
+
+// CheckLinearizable verifies that history is linearizable against a map
+// from keys to values: that every operation can be given a point between
+// its Call and its Return at which it took effect, such that running them
+// one at a time in that order returns what each of them saw.
+//
+// Keys are independent of each other, so each is checked on its own. The
+// search is the one of Wing and Gong with the state caching added by Lowe,
+// as used by Porcupine. It is exponential in the worst case but quick for
+// histories of a few clients.
+func CheckLinearizable(history []Operation) error {
+	byKey := make(map[string][]Operation)
+	for _, op := range history {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		if !linearizable(byKey[key]) {
+			return fmt.Errorf("%w: %d operations on %s cannot be ordered", ErrNotLinearizable, len(byKey[key]), key)
+		}
+	}
+	return nil
+}
+
+// kvState is the model of a single key
+type kvState struct {
+	value string
+	exists bool
+}
+
+// step applies op to s and reports whether op could have returned what it
+// did in state s
+func step(s kvState, op Operation) (kvState, bool) {
+	switch op.Kind {
+	case KindPut:
+		return kvState{value: op.Value, exists: true}, true
+	case KindDelete:
+		return kvState{}, true
+	default:
+		return s, op.Found == s.exists && (!op.Found || op.Output == s.value)
+	}
+}
+
+// event is a call or a return in the list the search walks. The call of
+// an operation that was linearized is lifted out of the list together with
+// its return.
+type event struct {
+	op int
+	call bool
+	match *event
+	prev *event
+	next *event
+}
+
+// events returns the calls and returns of ops as a list in time order,
+// headed by a sentinel
+func events(ops []Operation) *event {
+	type stamped struct {
+		e *event
+		time int64
+	}
+
+	var all []stamped
+	for i, op := range ops {
+		call := &event{op: i, call: true}
+		ret := &event{op: i, match: call}
+		call.match = ret
+		all = append(all, stamped{call, op.Call}, stamped{ret, op.Return})
+	}
+	slices.SortStableFunc(all, func(a, b stamped) int {
+		return cmp.Compare(a.time, b.time)
+	})
+
+	head := &event{}
+	prev := head
+	for _, s := range all {
+		prev.next, s.e.prev = s.e, prev
+		prev = s.e
+	}
+	return head
+}
+
+// lift takes the call e and its return out of the list
+func lift(e *event) {
+	e.prev.next, e.next.prev = e.next, e.prev
+	ret := e.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// unlift puts back what lift took out
+func unlift(e *event) {
+	ret := e.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	e.prev.next, e.next.prev = e, e
+}
+
+// linearizable searches for an order of ops, all on one key
+func linearizable(ops []Operation) bool {
+	type frame struct {
+		call *event
+		state kvState
+	}
+
+	head := events(ops)
+	done := make([]uint64, (len(ops)+63)/64)
+	// seen holds the combinations of linearized operations and resulting
+	// state already explored, they cannot lead anywhere new
+	seen := make(map[string]bool)
+
+	var stack []frame
+	var state kvState
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			if next, ok := step(state, ops[e.op]); ok {
+				done[e.op/64] |= 1 << (e.op % 64)
+				key := cacheKey(done, next)
+				if !seen[key] {
+					seen[key] = true
+					stack = append(stack, frame{call: e, state: state})
+					state = next
+					lift(e)
+					e = head.next
+					continue
+				}
+				done[e.op/64] &^= 1 << (e.op % 64)
+			}
+			e = e.next
+			continue
+		}
+
+		// An operation returned without having taken effect, so the last
+		// choice was wrong. Undo it and try the next call after it.
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		done[top.call.op/64] &^= 1 << (top.call.op % 64)
+		unlift(top.call)
+		e = top.call.next
+	}
+	return true
+}
+
+func cacheKey(done []uint64, s kvState) string {
+	buf := make([]byte, 0, 8*len(done)+1+len(s.value))
+	for _, word := range done {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	if s.exists {
+		buf = append(buf, 1)
+		buf = append(buf, s.value...)
+	} else {
+		buf = append(buf, 0)
+	}
+	return string(buf)
+}
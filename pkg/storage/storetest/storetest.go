@@ -0,0 +1,355 @@
+// Package storetest checks implementations of storage.Store against the
+// contract in kv.go. Run covers the documented behavior case by case, and
+// RecordHistory with CheckLinearizable verifies that concurrent Puts, Gets
+// and Deletes behave as if they ran one at a time.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"com.github/mune-0/anchor/pkg/storage"
+)
+
+// Run checks that stores made by newStore keep the contract of
+// storage.Store, see kv.go. Every case gets a fresh store, which Run closes.
+// newStore is given the test of the case, for its TempDir and Fatal.
+func Run(t *testing.T, newStore func(t *testing.T) storage.Store) {
+	cases := []struct {
+		name string
+		run func(t *testing.T, store storage.Store)
+	}{
+		{"PutGet", testPutGet},
+		{"GetNotFound", testGetNotFound},
+		{"InvalidKey", testInvalidKey},
+		{"Delete", testDelete},
+		{"Update", testUpdate},
+		{"DefensiveCopy", testDefensiveCopy},
+		{"ContextCancellation", testContextCancellation},
+		{"ContextTimeout", testContextTimeout},
+		{"Batch", testBatch},
+		{"Iterator", testIterator},
+		{"ConcurrentReads", testConcurrentReads},
+		{"ConcurrentWrites", testConcurrentWrites},
+		{"Linearizable", testLinearizable},
+		{"Close", testClose},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := newStore(t)
+			// Most cases leave the store open, the Close case has closed it already
+			defer store.Close(context.Background())
+			c.run(t, store)
+		})
+	}
+}
+
+// collect drains an iterator into a list of keys, checking that every value
+// is "v:" followed by its key
+func collect(t *testing.T, it storage.Iterator) []string {
+	t.Helper()
+	defer it.Close()
+
+	var keys []string
+	for it.Next() {
+		if want := "v:" + it.Key(); string(it.Value()) != want {
+			t.Errorf("Key %s: got value %q, want %q", it.Key(), it.Value(), want)
+		}
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iteration failed: %v", err)
+	}
+	return keys
+}
+
+func testPutGet(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "test-key", []byte("test-value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	got, err := store.Get(ctx, "test-key")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !bytes.Equal(got, []byte("test-value")) {
+		t.Errorf("Got %q, want %q", got, "test-value")
+	}
+}
+
+func testGetNotFound(t *testing.T, store storage.Store) {
+	if _, err := store.Get(context.Background(), "non-existent"); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Expected storage.ErrKeyNotFound, got %v", err)
+	}
+}
+
+func testInvalidKey(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	for _, key := range []string{"", "  "} {
+		if err := store.Put(ctx, key, []byte("value")); !errors.Is(err, storage.ErrInvalidKey) {
+			t.Errorf("Put %q: expected storage.ErrInvalidKey, got %v", key, err)
+		}
+		if _, err := store.Get(ctx, key); !errors.Is(err, storage.ErrInvalidKey) {
+			t.Errorf("Get %q: expected storage.ErrInvalidKey, got %v", key, err)
+		}
+		if err := store.Delete(ctx, key); !errors.Is(err, storage.ErrInvalidKey) {
+			t.Errorf("Delete %q: expected storage.ErrInvalidKey, got %v", key, err)
+		}
+	}
+
+	batch := &storage.WriteBatch{}
+	batch.Put("ok", []byte("value"))
+	batch.Delete("")
+	if err := store.Apply(ctx, batch); !errors.Is(err, storage.ErrInvalidKey) {
+		t.Errorf("Apply: expected storage.ErrInvalidKey, got %v", err)
+	}
+}
+
+func testDelete(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	store.Put(ctx, "test-key", []byte("test-value"))
+	if err := store.Delete(ctx, "test-key"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get(ctx, "test-key"); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Key should not exist after delete, got %v", err)
+	}
+
+	// Deleting what is not there is not an error
+	if err := store.Delete(ctx, "test-key"); err != nil {
+		t.Errorf("Second delete failed: %v", err)
+	}
+	if err := store.Delete(ctx, "never-written"); err != nil {
+		t.Errorf("Delete of a missing key failed: %v", err)
+	}
+}
+
+func testUpdate(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	store.Put(ctx, "test-key", []byte("first-value"))
+	store.Put(ctx, "test-key", []byte("second-value"))
+
+	if got, _ := store.Get(ctx, "test-key"); !bytes.Equal(got, []byte("second-value")) {
+		t.Errorf("Got %q, want %q", got, "second-value")
+	}
+}
+
+func testDefensiveCopy(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	value := []byte("original")
+	store.Put(ctx, "test-key", value)
+
+	// Modifying the slice passed to Put must not reach the store
+	value[0] = 'X'
+	got, _ := store.Get(ctx, "test-key")
+	if !bytes.Equal(got, []byte("original")) {
+		t.Errorf("storage.Store did not make defensive copy on Put, got %q", got)
+	}
+
+	// Nor may modifying the slice Get returned
+	got[0] = 'Y'
+	if got, _ := store.Get(ctx, "test-key"); !bytes.Equal(got, []byte("original")) {
+		t.Errorf("storage.Store did not make defensive copy on Get, got %q", got)
+	}
+}
+
+func testContextCancellation(t *testing.T, store storage.Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := store.Put(ctx, "key", []byte("value")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Put: expected context.Canceled, got %v", err)
+	}
+	if _, err := store.Get(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get: expected context.Canceled, got %v", err)
+	}
+	if err := store.Delete(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Delete: expected context.Canceled, got %v", err)
+	}
+	if _, err := store.NewIterator(ctx, storage.IterOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("NewIterator: expected context.Canceled, got %v", err)
+	}
+
+	// Nothing was written
+	if _, err := store.Get(context.Background(), "key"); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Expected the cancelled Put to be dropped, got %v", err)
+	}
+}
+
+func testContextTimeout(t *testing.T, store storage.Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	if err := store.Put(ctx, "key", []byte("value")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func testBatch(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	store.Put(ctx, "old", []byte("value"))
+
+	batch := &storage.WriteBatch{}
+	batch.Put("a", []byte("1"))
+	batch.Put("b", []byte("2"))
+	batch.Delete("old")
+	if err := store.Apply(ctx, batch); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if got, err := store.Get(ctx, key); err != nil || string(got) != want {
+			t.Errorf("Get %s: got %q (%v), want %q", key, got, err, want)
+		}
+	}
+	if _, err := store.Get(ctx, "old"); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Errorf("Expected old to be deleted by the batch, got %v", err)
+	}
+
+	if err := store.Apply(ctx, &storage.WriteBatch{}); err != nil {
+		t.Errorf("Empty batch failed: %v", err)
+	}
+}
+
+func testIterator(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	keys := []string{"a", "b", "user:1", "user:2", "user:3", "users", "z"}
+
+	for _, i := range []int{4, 0, 6, 2, 1, 5, 3} {
+		store.Put(ctx, keys[i], []byte("v:"+keys[i]))
+	}
+	store.Put(ctx, "gone", []byte("v:gone"))
+	store.Delete(ctx, "gone")
+
+	it, err := store.NewIterator(ctx, storage.IterOptions{})
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	if got := collect(t, it); !slices.Equal(got, keys) {
+		t.Errorf("Got %v, want %v", got, keys)
+	}
+
+	it, err = store.NewIterator(ctx, storage.IterOptions{Prefix: "user:", Reverse: true})
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	if got, want := collect(t, it), []string{"user:3", "user:2", "user:1"}; !slices.Equal(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+func testConcurrentReads(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	for i := range 10 {
+		store.Put(ctx, fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i)))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Go(func() {
+			for j := range 10 {
+				if _, err := store.Get(ctx, fmt.Sprintf("key-%d", j)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Concurrent read failed: %v", err)
+	}
+}
+
+func testConcurrentWrites(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+	numGoroutines, writesPerGoroutine := 10, 100
+
+	var wg sync.WaitGroup
+	for i := range numGoroutines {
+		wg.Go(func() {
+			for j := range writesPerGoroutine {
+				key := fmt.Sprintf("key-%d-%d", i, j)
+				if err := store.Put(ctx, key, []byte(fmt.Sprintf("value-%d-%d", i, j))); err != nil {
+					t.Errorf("Put failed: %v", err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	for i := range numGoroutines {
+		for j := range writesPerGoroutine {
+			key := fmt.Sprintf("key-%d-%d", i, j)
+			want := fmt.Sprintf("value-%d-%d", i, j)
+			if got, err := store.Get(ctx, key); err != nil || string(got) != want {
+				t.Errorf("Key %s: got %q (%v), want %q", key, got, err, want)
+			}
+		}
+	}
+}
+
+// linearizableSeed picks the operations of the Linearizable case. The
+// default keeps runs repeatable, other seeds explore other histories.
+var linearizableSeed = flag.Uint64("storetest.seed", 1, "seed for the operations of the Linearizable case")
+
+func testLinearizable(t *testing.T, store storage.Store) {
+	seed := *linearizableSeed
+	t.Logf("Seed %d, change with -storetest.seed", seed)
+
+	history, err := RecordHistory(context.Background(), store, HistoryOptions{Seed: seed})
+	if err != nil {
+		t.Fatalf("Recording failed: %v", err)
+	}
+	if err := CheckLinearizable(history); err != nil {
+		t.Error(err)
+	}
+}
+
+func testClose(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	store.Put(ctx, "key", []byte("value"))
+	if err := store.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if err := store.Put(ctx, "key2", []byte("value2")); !errors.Is(err, storage.ErrStoreClosed) {
+		t.Errorf("Put after close should return storage.ErrStoreClosed, got %v", err)
+	}
+	if _, err := store.Get(ctx, "key"); !errors.Is(err, storage.ErrStoreClosed) {
+		t.Errorf("Get after close should return storage.ErrStoreClosed, got %v", err)
+	}
+	if err := store.Delete(ctx, "key"); !errors.Is(err, storage.ErrStoreClosed) {
+		t.Errorf("Delete after close should return storage.ErrStoreClosed, got %v", err)
+	}
+
+	batch := &storage.WriteBatch{}
+	batch.Put("key3", []byte("value3"))
+	if err := store.Apply(ctx, batch); !errors.Is(err, storage.ErrStoreClosed) {
+		t.Errorf("Apply after close should return storage.ErrStoreClosed, got %v", err)
+	}
+	if _, err := store.NewIterator(ctx, storage.IterOptions{}); !errors.Is(err, storage.ErrStoreClosed) {
+		t.Errorf("NewIterator after close should return storage.ErrStoreClosed, got %v", err)
+	}
+}
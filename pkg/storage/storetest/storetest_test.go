@@ -0,0 +1,119 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/storage"
+	"com.github/mune-0/anchor/pkg/wal"
+)
+
+// Test that every registered engine keeps the Store contract when opened by name
+func TestRun_Engines(t *testing.T) {
+	for _, engine := range storage.Engines() {
+		t.Run(engine, func(t *testing.T) {
+			Run(t, func(t *testing.T) storage.Store {
+				store, err := storage.Open(context.Background(), storage.Options{
+					Engine: engine,
+					Dir: t.TempDir(),
+					WAL: wal.Options{Sync: wal.SyncNever},
+				})
+				if err != nil {
+					t.Fatalf("Open failed: %v", err)
+				}
+				return store
+			})
+		})
+	}
+}
+
+// Test that MemStore keeps the contract over a WAL writer it does not own
+func TestRun_MemStoreOverWriter(t *testing.T) {
+	Run(t, func(t *testing.T) storage.Store {
+		w, err := wal.NewWriter(filepath.Join(t.TempDir(), "wal.log"))
+		if err != nil {
+			t.Fatalf("NewWriter failed: %v", err)
+		}
+		t.Cleanup(func() { w.Close() })
+		return storage.NewMemStore(w)
+	})
+}
+
+// Test the checker on small histories whose verdict is known
+func TestCheckLinearizable(t *testing.T) {
+	put := func(value string, call, ret int64) Operation {
+		return Operation{Kind: KindPut, Key: "k", Value: value, Call: call, Return: ret}
+	}
+	get := func(output string, call, ret int64) Operation {
+		return Operation{Kind: KindGet, Key: "k", Output: output, Found: output != "", Call: call, Return: ret}
+	}
+	del := func(call, ret int64) Operation {
+		return Operation{Kind: KindDelete, Key: "k", Call: call, Return: ret}
+	}
+
+	cases := []struct {
+		name string
+		history []Operation
+		ok bool
+	}{
+		{"Empty", nil, true},
+		{"Sequential", []Operation{put("a", 1, 2), get("a", 3, 4), del(5, 6), get("", 7, 8)}, true},
+		{"StaleRead", []Operation{put("a", 1, 2), put("b", 3, 4), get("a", 5, 6)}, false},
+		{"ReadBeforeWrite", []Operation{get("a", 1, 2), put("a", 3, 4)}, false},
+		{"UnwrittenValue", []Operation{put("a", 1, 2), get("x", 3, 4)}, false},
+		{"OverlappingRead", []Operation{put("a", 1, 2), put("b", 3, 6), get("a", 4, 5)}, true},
+		{"OverlappingReadNew", []Operation{put("a", 1, 2), put("b", 3, 6), get("b", 4, 5)}, true},
+		// Once one read saw the new value, a later one may not see the old
+		{"FlipFlop", []Operation{put("a", 1, 2), put("b", 3, 10), get("b", 4, 5), get("a", 6, 7)}, false},
+		{"DeleteHides", []Operation{put("a", 1, 2), del(3, 4), get("a", 5, 6)}, false},
+		{"PendingWriteSeen", []Operation{put("a", 1, math.MaxInt64), get("a", 2, 3)}, true},
+		{"PendingWriteUnseen", []Operation{put("a", 1, math.MaxInt64), get("", 2, 3)}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := CheckLinearizable(c.history)
+			if c.ok && err != nil {
+				t.Errorf("Expected linearizable, got %v", err)
+			}
+			if !c.ok && !errors.Is(err, ErrNotLinearizable) {
+				t.Errorf("Expected ErrNotLinearizable, got %v", err)
+			}
+		})
+	}
+}
+
+// lossyStore forgets every other put
+type lossyStore struct {
+	storage.Store
+	puts int
+}
+
+func (s *lossyStore) Put(ctx context.Context, key string, value []byte) error {
+	s.puts++
+	if s.puts%2 == 0 {
+		return nil
+	}
+	return s.Store.Put(ctx, key, value)
+}
+
+// Test that a recorded history of a store that loses writes is caught
+func TestCheckLinearizable_LossyStore(t *testing.T) {
+	ctx := context.Background()
+	inner, err := storage.Open(ctx, storage.Options{Engine: storage.EngineMemory, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer inner.Close(ctx)
+
+	history, err := RecordHistory(ctx, &lossyStore{Store: inner}, HistoryOptions{Clients: 1, Seed: 1})
+	if err != nil {
+		t.Fatalf("Recording failed: %v", err)
+	}
+	if err := CheckLinearizable(history); !errors.Is(err, ErrNotLinearizable) {
+		t.Errorf("Expected the lost writes to be caught, got %v", err)
+	}
+}
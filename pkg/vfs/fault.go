@@ -0,0 +1,522 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrInjected is returned by calls failed by a Fault that has no Err of its own
+var ErrInjected = errors.New("vfs: injected fault")
+
+// Op names a kind of call a Fault can fail
+type Op uint8
+
+const (
+	OpOpen Op = iota
+	OpRead
+	OpWrite
+	OpSync
+	OpTruncate
+	OpClose
+	OpStat
+	OpReadDir
+	OpMkdir
+	OpRemove
+	OpRename
+	OpSyncDir
+)
+
+// Fault makes calls of one kind fail
+type Fault struct {
+	Op Op
+
+	// Path restricts the fault to paths whose base name matches this
+	// filepath.Match pattern. Empty matches every path.
+	Path string
+
+	// After is the number of matching calls let through before the first failure
+	After int
+
+	// Times is the number of calls that fail, zero fails every one after After
+	Times int
+
+	// Err is returned by the failing calls, ErrInjected if nil.
+	// Use syscall.ENOSPC and the like to mimic specific failures.
+	Err error
+
+	// Short lets a failing write put the first half of its data in the file
+	// before it returns the error
+	Short bool
+
+	// seen counts the matching calls so far
+	seen int
+}
+
+// FaultFS wraps a filesystem to fail calls on demand and to simulate a
+// crash in which everything not yet synced is lost.
+//
+// To know what a crash loses it tracks, for every file written through it,
+// the size the file had when it was last synced and the bytes that were
+// overwritten below that size since. Files created since their directory
+// was last synced disappear in a crash. Removals and renames are taken as
+// durable right away.
+type FaultFS struct {
+	fs FS
+
+	mut sync.Mutex
+	faults []*Fault
+	files map[string]*fileState
+	created map[string]bool
+	open map[*faultFile]bool
+}
+
+// fileState is what a crash has to undo in one file
+type fileState struct {
+	// size is the size of the file at its last sync
+	size int64
+	// undo holds the synced bytes since overwritten, oldest first
+	undo []undoRecord
+}
+
+type undoRecord struct {
+	off int64
+	data []byte
+}
+
+// NewFault wraps fs. No call fails until a Fault is injected.
+func NewFault(fs FS) *FaultFS {
+	return &FaultFS{
+		fs: fs,
+		files: make(map[string]*fileState),
+		created: make(map[string]bool),
+		open: make(map[*faultFile]bool),
+	}
+}
+
+// Inject adds a fault. Faults are checked in the order they were added and
+// the first one matching a call decides whether it fails.
+func (f *FaultFS) Inject(fault Fault) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+// Reset removes every injected fault
+func (f *FaultFS) Reset() {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.faults = nil
+}
+
+// fail returns the fault that makes a call of op on name fail, if any
+func (f *FaultFS) fail(op Op, name string) *Fault {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	for _, fault := range f.faults {
+		if fault.Op != op {
+			continue
+		}
+		if fault.Path != "" {
+			if ok, _ := filepath.Match(fault.Path, filepath.Base(name)); !ok {
+				continue
+			}
+		}
+
+		fault.seen++
+		if fault.seen <= fault.After || (fault.Times > 0 && fault.seen > fault.After+fault.Times) {
+			return nil
+		}
+		return fault
+	}
+	return nil
+}
+
+func (fault *Fault) err(op, name string) error {
+	err := fault.Err
+	if err == nil {
+		err = ErrInjected
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Crash simulates a power cut: every file loses what was written to it
+// since it was last synced, files created since their directory was last
+// synced are removed, and every file open through f is closed. Injected
+// faults stay in place.
+func (f *FaultFS) Crash() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	for file := range f.open {
+		file.crashed.Store(true)
+		file.file.Close()
+	}
+	clear(f.open)
+
+	for name := range f.created {
+		if err := f.fs.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		delete(f.files, name)
+	}
+	clear(f.created)
+
+	for name, state := range f.files {
+		if err := state.restore(f.fs, name); err != nil {
+			return err
+		}
+	}
+	clear(f.files)
+	return nil
+}
+
+// restore puts the file at name back into its synced state
+func (s *fileState) restore(fsys FS, name string) error {
+	file, err := fsys.OpenFile(name, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for i := len(s.undo) - 1; i >= 0; i-- {
+		if _, err := file.WriteAt(s.undo[i].data, s.undo[i].off); err != nil {
+			return err
+		}
+	}
+	return file.Truncate(s.size)
+}
+
+// state returns the crash state of the file at name, starting one if the
+// file was synced as it is. Caller must hold f.mut.
+func (f *FaultFS) state(name string, file File) (*fileState, error) {
+	if s, ok := f.files[name]; ok {
+		return s, nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s := &fileState{size: info.Size()}
+	f.files[name] = s
+	return s, nil
+}
+
+// overwrite records the synced bytes of name in [off, off+n) before they
+// are overwritten. Caller must hold f.mut.
+func (f *FaultFS) overwrite(name string, file File, off, n int64) error {
+	s, err := f.state(name, file)
+	if err != nil {
+		return err
+	}
+	if off >= s.size || n <= 0 {
+		return nil
+	}
+
+	n = min(n, s.size-off)
+	r, err := f.fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	old := make([]byte, n)
+	if _, err := r.ReadAt(old, off); err != nil && err != io.EOF {
+		return err
+	}
+	s.undo = append(s.undo, undoRecord{off: off, data: old})
+	return nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	if fault := f.fail(OpOpen, name); fault != nil {
+		return nil, fault.err("open", name)
+	}
+
+	// Truncation goes through faultFile.Truncate so a crash can undo it
+	truncate := flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0
+	_, statErr := f.fs.Stat(name)
+	file, err := f.fs.OpenFile(name, flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	ff := &faultFile{fs: f, file: file, name: name, flag: flag}
+
+	f.mut.Lock()
+	f.open[ff] = true
+	if errors.Is(statErr, fs.ErrNotExist) {
+		f.created[name] = true
+		f.files[name] = &fileState{}
+	}
+	f.mut.Unlock()
+
+	if truncate {
+		if err := ff.Truncate(0); err != nil {
+			ff.Close()
+			return nil, err
+		}
+	}
+	return ff, nil
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if fault := f.fail(OpStat, name); fault != nil {
+		return nil, fault.err("stat", name)
+	}
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	if fault := f.fail(OpReadDir, name); fault != nil {
+		return nil, fault.err("readdir", name)
+	}
+	return f.fs.ReadDir(name)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if fault := f.fail(OpMkdir, path); fault != nil {
+		return fault.err("mkdir", path)
+	}
+	return f.fs.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	if fault := f.fail(OpRemove, name); fault != nil {
+		return fault.err("remove", name)
+	}
+	if err := f.fs.Remove(name); err != nil {
+		return err
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	delete(f.files, name)
+	delete(f.created, name)
+	return nil
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if fault := f.fail(OpRename, oldpath); fault != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fault.err("rename", oldpath)}
+	}
+	if err := f.fs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	delete(f.files, newpath)
+	delete(f.created, newpath)
+	if s, ok := f.files[oldpath]; ok {
+		f.files[newpath] = s
+		delete(f.files, oldpath)
+	}
+	if f.created[oldpath] {
+		f.created[newpath] = true
+		delete(f.created, oldpath)
+	}
+	return nil
+}
+
+func (f *FaultFS) SyncDir(dir string) error {
+	if fault := f.fail(OpSyncDir, dir); fault != nil {
+		return fault.err("sync", dir)
+	}
+	if err := f.fs.SyncDir(dir); err != nil {
+		return err
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	dir = filepath.Clean(dir)
+	for name := range f.created {
+		if filepath.Dir(name) == dir {
+			delete(f.created, name)
+		}
+	}
+	return nil
+}
+
+// faultFile is a file opened through a FaultFS
+type faultFile struct {
+	fs *FaultFS
+	file File
+	name string
+	flag int
+	// crashed is set once a crash closed the file under its user
+	crashed atomic.Bool
+}
+
+func (f *faultFile) checkCrashed(op string) error {
+	if f.crashed.Load() {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.checkCrashed("read"); err != nil {
+		return 0, err
+	}
+	if fault := f.fs.fail(OpRead, f.name); fault != nil {
+		return 0, fault.err("read", f.name)
+	}
+	return f.file.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.checkCrashed("read"); err != nil {
+		return 0, err
+	}
+	if fault := f.fs.fail(OpRead, f.name); fault != nil {
+		return 0, fault.err("read", f.name)
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.checkCrashed("write"); err != nil {
+		return 0, err
+	}
+
+	var off int64
+	if f.flag&os.O_APPEND != 0 {
+		info, err := f.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		off = info.Size()
+	} else {
+		var err error
+		if off, err = f.file.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+	return f.write(p, off, f.file.Write)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.checkCrashed("write"); err != nil {
+		return 0, err
+	}
+	return f.write(p, off, func(p []byte) (int, error) {
+		return f.file.WriteAt(p, off)
+	})
+}
+
+// write records what a crash has to undo and then hands p to write,
+// unless a fault cuts it short
+func (f *faultFile) write(p []byte, off int64, write func([]byte) (int, error)) (int, error) {
+	fault := f.fs.fail(OpWrite, f.name)
+	if fault != nil && !fault.Short {
+		return 0, fault.err("write", f.name)
+	}
+	if fault != nil {
+		p = p[:len(p)/2]
+	}
+
+	f.fs.mut.Lock()
+	err := f.fs.overwrite(f.name, f.file, off, int64(len(p)))
+	f.fs.mut.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := write(p)
+	if err == nil && fault != nil {
+		err = fault.err("write", f.name)
+	}
+	return n, err
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.checkCrashed("seek"); err != nil {
+		return 0, err
+	}
+	return f.file.Seek(offset, whence)
+}
+
+// Sync makes everything written to the file so far survive a crash, unless
+// a fault fails it, in which case none of it is known to be on disk
+func (f *faultFile) Sync() error {
+	if err := f.checkCrashed("sync"); err != nil {
+		return err
+	}
+	if fault := f.fs.fail(OpSync, f.name); fault != nil {
+		return fault.err("sync", f.name)
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+	if !f.fs.created[f.name] {
+		delete(f.fs.files, f.name)
+		return nil
+	}
+
+	// The data is durable but the file itself goes on a crash until its
+	// directory is synced, keep tracking it from its new size
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.fs.files[f.name] = &fileState{size: info.Size()}
+	return nil
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.checkCrashed("stat"); err != nil {
+		return nil, err
+	}
+	if fault := f.fs.fail(OpStat, f.name); fault != nil {
+		return nil, fault.err("stat", f.name)
+	}
+	return f.file.Stat()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.checkCrashed("truncate"); err != nil {
+		return err
+	}
+	if fault := f.fs.fail(OpTruncate, f.name); fault != nil {
+		return fault.err("truncate", f.name)
+	}
+
+	f.fs.mut.Lock()
+	err := f.fs.overwrite(f.name, f.file, size, 1<<62)
+	f.fs.mut.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.file.Truncate(size)
+}
+
+func (f *faultFile) Close() error {
+	if err := f.checkCrashed("close"); err != nil {
+		return err
+	}
+	if fault := f.fs.fail(OpClose, f.name); fault != nil {
+		return fault.err("close", f.name)
+	}
+
+	f.fs.mut.Lock()
+	delete(f.fs.open, f)
+	f.fs.mut.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,390 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is a filesystem held in memory. Everything written is durable as
+// soon as it is written, use NewFault on top of it to lose unsynced data.
+// It is safe for concurrent use.
+type MemFS struct {
+	mut sync.Mutex
+	// nodes maps cleaned slash separated paths to files and directories.
+	// The root always exists and is not in the map.
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	dir bool
+	data []byte
+	modTime time.Time
+}
+
+// NewMem returns an empty in-memory filesystem
+func NewMem() *MemFS {
+	return &MemFS{nodes: make(map[string]*memNode)}
+}
+
+// clean turns name into the key it has in m.nodes
+func clean(name string) string {
+	name = path.Clean(filepath.ToSlash(name))
+	if name == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
+// parentExists reports whether the directory holding name exists.
+// Caller must hold m.mut.
+func (m *MemFS) parentExists(name string) bool {
+	dir := path.Dir(name)
+	if dir == "." {
+		return true
+	}
+	n, ok := m.nodes[dir]
+	return ok && n.dir
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	key := clean(name)
+	n, ok := m.nodes[key]
+	switch {
+	case ok && n.dir:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok && !m.parentExists(key):
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		n = &memNode{modTime: time.Now()}
+		m.nodes[key] = n
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		n.data = nil
+	}
+	return &memFile{fs: m, node: n, name: name, flag: flag}, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	key := clean(name)
+	if key == "." {
+		return &memInfo{name: ".", node: &memNode{dir: true}}, nil
+	}
+	n, ok := m.nodes[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memInfo{name: path.Base(key), node: n, size: int64(len(n.data))}, nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	key := clean(name)
+	if n, ok := m.nodes[key]; key != "." && (!ok || !n.dir) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []os.DirEntry
+	for p, n := range m.nodes {
+		if p != "." && path.Dir(p) == key {
+			entries = append(entries, fs.FileInfoToDirEntry(&memInfo{name: path.Base(p), node: n, size: int64(len(n.data))}))
+		}
+	}
+	slices.SortFunc(entries, func(a, b os.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	key := clean(name)
+	for p := key; p != "."; p = path.Dir(p) {
+		if n, ok := m.nodes[p]; ok && !n.dir {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+	}
+	for p := key; p != "."; p = path.Dir(p) {
+		if _, ok := m.nodes[p]; !ok {
+			m.nodes[p] = &memNode{dir: true, modTime: time.Now()}
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	key := clean(name)
+	n, ok := m.nodes[key]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.dir {
+		for p := range m.nodes {
+			if path.Dir(p) == key {
+				return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+			}
+		}
+	}
+	delete(m.nodes, key)
+	return nil
+}
+
+// Rename moves a file, replacing whatever file is at newpath. Directories
+// cannot be renamed.
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	from, to := clean(oldpath), clean(newpath)
+	n, ok := m.nodes[from]
+	if !ok || !m.parentExists(to) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if target, ok := m.nodes[to]; n.dir || (ok && target.dir) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+
+	delete(m.nodes, from)
+	m.nodes[to] = n
+	return nil
+}
+
+// SyncDir only checks that dir exists, MemFS has nothing to flush
+func (m *MemFS) SyncDir(dir string) error {
+	info, err := m.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: "sync", Path: dir, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// memFile is an open MemFS file. Its node stays readable and writable after
+// the file was removed, like an open file on disk.
+type memFile struct {
+	fs *MemFS
+	node *memNode
+	name string
+	flag int
+	pos int64
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	readOnly := f.flag&(os.O_WRONLY|os.O_RDWR) == 0
+	writeOnly := f.flag&os.O_WRONLY != 0
+	if (write && readOnly) || (!write && writeOnly) {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	return f.readAt(p, off)
+}
+
+// readAt is ReadAt for callers already holding f.fs.mut
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.node.data))
+	}
+	f.writeAt(p, f.pos)
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.writeAt(p, off)
+	return len(p), nil
+}
+
+// writeAt copies p into the file at off, growing it as needed.
+// Caller must hold f.fs.mut.
+func (f *memFile) writeAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return &memInfo{name: path.Base(clean(f.name)), node: f.node, size: int64(len(f.node.data))}, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// memInfo describes a MemFS node. size is taken when the info is made.
+type memInfo struct {
+	name string
+	node *memNode
+	size int64
+}
+
+func (i *memInfo) Name() string {
+	return i.name
+}
+
+func (i *memInfo) Size() int64 {
+	return i.size
+}
+
+func (i *memInfo) Mode() os.FileMode {
+	if i.node.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *memInfo) ModTime() time.Time {
+	return i.node.modTime
+}
+
+func (i *memInfo) IsDir() bool {
+	return i.node.dir
+}
+
+func (i *memInfo) Sys() any {
+	return nil
+}
@@ -0,0 +1,104 @@
+// Package vfs abstracts the filesystem calls made by the WAL, so that tests
+// can run it against memory or inject failures.
+//
+// Only the WAL goes through it. MemStore keeps nothing else and so runs on
+// it entirely, but the LSM and B-tree engines keep their tables, manifest
+// and page file on the OS filesystem whatever FS their WAL is given. A crash
+// simulated with NewFault only takes their log back to its last sync, their
+// other files are left as they are.
+//
+// OS is the real filesystem. NewMem returns an in-memory one, and NewFault
+// wraps either to fail chosen calls and to simulate a power cut that loses
+// everything not yet synced.
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// File is an open file
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+
+	// Sync forces the file's data to stable storage
+	Sync() error
+
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// FS is the set of filesystem calls the WAL uses. Paths and flags mean what
+// they mean for the functions of the same name in package os.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+
+	// SyncDir makes the creation, removal and renaming of entries in dir durable
+	SyncDir(dir string) error
+}
+
+// Open opens name in fs for reading
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OS is the filesystem of the operating system
+var OS FS = osFS{}
+
+// Default returns fs, or OS if fs is nil
+func Default(fs FS) FS {
+	if fs == nil {
+		return OS
+	}
+	return fs
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// A nil *os.File must not end up in a non-nil File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,182 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// readFile returns the content of name in fsys
+func readFile(t *testing.T, fsys FS, name string) string {
+	t.Helper()
+
+	f, err := Open(fsys, name)
+	if err != nil {
+		t.Fatalf("Open %s failed: %v", name, err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read %s failed: %v", name, err)
+	}
+	return string(data)
+}
+
+// writeFile appends data to name in fsys, creating it if needed, and syncs it if sync is set
+func writeFile(t *testing.T, fsys FS, name, data string, sync bool) {
+	t.Helper()
+
+	f, err := fsys.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Open %s failed: %v", name, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatalf("Write %s failed: %v", name, err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			t.Fatalf("Sync %s failed: %v", name, err)
+		}
+	}
+}
+
+// Test that MemFS behaves like the OS filesystem for the calls the WAL makes
+func TestFS_Conformance(t *testing.T) {
+	for name, fsys := range map[string]FS{"OS": OS, "Mem": NewMem()} {
+		t.Run(name, func(t *testing.T) {
+			dir := "db"
+			if fsys == OS {
+				dir = filepath.Join(t.TempDir(), "db")
+			}
+
+			if _, err := fsys.OpenFile(filepath.Join(dir, "a"), os.O_CREATE|os.O_WRONLY, 0644); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected creating a file in a missing directory to fail, got %v", err)
+			}
+			if err := fsys.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+
+			a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+			writeFile(t, fsys, a, "hello ", false)
+			writeFile(t, fsys, a, "world", true)
+			if got := readFile(t, fsys, a); got != "hello world" {
+				t.Errorf("Got %q, want %q", got, "hello world")
+			}
+
+			f, err := fsys.OpenFile(a, os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			f.WriteAt([]byte("J"), 6)
+			f.Truncate(9)
+			if info, _ := f.Stat(); info.Size() != 9 {
+				t.Errorf("Expected size 9 after truncating, got %d", info.Size())
+			}
+			buf := make([]byte, 3)
+			if n, err := f.ReadAt(buf, 6); n != 3 || err != nil || string(buf) != "Jor" {
+				t.Errorf("ReadAt got %q (%d, %v)", buf[:n], n, err)
+			}
+			f.Close()
+
+			if err := fsys.Rename(a, b); err != nil {
+				t.Fatalf("Rename failed: %v", err)
+			}
+			if _, err := fsys.Stat(a); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected the old name to be gone, got %v", err)
+			}
+			writeFile(t, fsys, a, "new", true)
+
+			entries, err := fsys.ReadDir(dir)
+			if err != nil || len(entries) != 2 || entries[0].Name() != "a" || entries[1].Name() != "b" {
+				t.Errorf("ReadDir got %v (%v)", entries, err)
+			}
+			if err := fsys.SyncDir(dir); err != nil {
+				t.Errorf("SyncDir failed: %v", err)
+			}
+
+			if err := fsys.Remove(b); err != nil {
+				t.Fatalf("Remove failed: %v", err)
+			}
+			if _, err := Open(fsys, b); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected the removed file to be gone, got %v", err)
+			}
+		})
+	}
+}
+
+// Test that a crash keeps synced data and drops the rest, including overwrites and new files
+func TestFaultFS_Crash(t *testing.T) {
+	mem := NewMem()
+	mem.MkdirAll("db", 0755)
+	fsys := NewFault(mem)
+
+	writeFile(t, fsys, "db/log", "synced", true)
+	fsys.SyncDir("db")
+	writeFile(t, fsys, "db/log", " lost", false)
+
+	f, _ := fsys.OpenFile("db/page", os.O_CREATE|os.O_RDWR, 0644)
+	f.Write([]byte("aaaa"))
+	f.Sync()
+	fsys.SyncDir("db")
+	f.WriteAt([]byte("bb"), 1)
+
+	// Synced, but its directory never was
+	writeFile(t, fsys, "db/new", "data", true)
+
+	open, _ := fsys.OpenFile("db/log", os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err := fsys.Crash(); err != nil {
+		t.Fatalf("Crash failed: %v", err)
+	}
+
+	if got := readFile(t, fsys, "db/log"); got != "synced" {
+		t.Errorf("Got %q, want the synced part only", got)
+	}
+	if got := readFile(t, fsys, "db/page"); got != "aaaa" {
+		t.Errorf("Got %q, want the overwrite undone", got)
+	}
+	if _, err := fsys.Stat("db/new"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the file in the unsynced directory to be gone, got %v", err)
+	}
+	if _, err := open.Write([]byte("x")); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Expected files open at the crash to be closed, got %v", err)
+	}
+}
+
+// Test that injected faults fail the chosen calls and no others
+func TestFaultFS_Inject(t *testing.T) {
+	mem := NewMem()
+	fsys := NewFault(mem)
+
+	fsys.Inject(Fault{Op: OpSync, Path: "*.log", After: 1, Times: 1})
+	fsys.Inject(Fault{Op: OpWrite, Path: "full", Err: syscall.ENOSPC, Short: true})
+
+	f, _ := fsys.OpenFile("a.log", os.O_CREATE|os.O_WRONLY, 0644)
+	for i, want := range []error{nil, ErrInjected, nil} {
+		if err := f.Sync(); !errors.Is(err, want) {
+			t.Errorf("Sync %d: got %v, want %v", i, err, want)
+		}
+	}
+	f.Close()
+	writeFile(t, fsys, "other", "x", true)
+
+	full, _ := fsys.OpenFile("full", os.O_CREATE|os.O_WRONLY, 0644)
+	n, err := full.Write([]byte("abcdef"))
+	if n != 3 || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected a short write with ENOSPC, got %d (%v)", n, err)
+	}
+	full.Close()
+	if got := readFile(t, mem, "full"); got != "abc" {
+		t.Errorf("Got %q, want the first half", got)
+	}
+
+	fsys.Reset()
+	writeFile(t, fsys, "full", "ghi", true)
+}
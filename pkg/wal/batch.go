@@ -0,0 +1,95 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// batchOpHeaderSize = 1 (OP) + 4 (KLen) + 4 (VLen)
+const batchOpHeaderSize = 9
+
+var ErrInvalidBatch = errors.New("wal: malformed batch record")
+
+// NewBatchEntry packs entries into a single OpBatch entry. The batch is
+// written and checksummed as one record, so after a crash either all of
+// its operations are in the log or none of them are.
+//
+// Payload layout: 4 (Count) followed by Count x [1 (OP) + 4 (KLen) + 4 (VLen) + Key + Value]
+func NewBatchEntry(timestamp int64, entries []*LogEntry) *LogEntry {
+	size := 4
+	for _, e := range entries {
+		size += batchOpHeaderSize + len(e.Key) + len(e.Value)
+	}
+
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(entries)))
+
+	pos := 4
+	for _, e := range entries {
+		buf[pos] = uint8(e.Op)
+		binary.LittleEndian.PutUint32(buf[pos+1:pos+5], uint32(len(e.Key)))
+		binary.LittleEndian.PutUint32(buf[pos+5:pos+9], uint32(len(e.Value)))
+		pos += batchOpHeaderSize
+
+		pos += copy(buf[pos:], e.Key)
+		pos += copy(buf[pos:], e.Value)
+	}
+
+	return &LogEntry{
+		Timestamp: timestamp,
+		Op: OpBatch,
+		Value: buf,
+	}
+}
+
+// BatchEntries unpacks the operations of an OpBatch entry in the order they were added.
+// Every operation carries the LSN and timestamp of the batch record itself.
+func (e *LogEntry) BatchEntries() ([]*LogEntry, error) {
+	if e.Op != OpBatch {
+		return nil, fmt.Errorf("%w: entry has op %d", ErrInvalidBatch, e.Op)
+	}
+
+	data := e.Value
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: missing count", ErrInvalidBatch)
+	}
+
+	count := binary.LittleEndian.Uint32(data[0:4])
+	data = data[4:]
+
+	// Every operation needs at least its header, don't trust count beyond that
+	if uint64(count)*batchOpHeaderSize > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: count %d does not fit in %d bytes", ErrInvalidBatch, count, len(data))
+	}
+
+	entries := make([]*LogEntry, 0, count)
+	for i := range count {
+		if len(data) < batchOpHeaderSize {
+			return nil, fmt.Errorf("%w: operation %d is truncated", ErrInvalidBatch, i)
+		}
+
+		op := OpType(data[0])
+		kLen := uint64(binary.LittleEndian.Uint32(data[1:5]))
+		vLen := uint64(binary.LittleEndian.Uint32(data[5:9]))
+		data = data[batchOpHeaderSize:]
+
+		if kLen+vLen > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: operation %d is truncated", ErrInvalidBatch, i)
+		}
+
+		entries = append(entries, &LogEntry{
+			LSN: e.LSN,
+			Timestamp: e.Timestamp,
+			Op: op,
+			Key: data[:kLen:kLen],
+			Value: data[kLen : kLen+vLen : kLen+vLen],
+		})
+		data = data[kLen+vLen:]
+	}
+
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidBatch, len(data))
+	}
+	return entries, nil
+}
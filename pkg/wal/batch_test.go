@@ -0,0 +1,69 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// Tests that a batch survives being written to and read back from the log as one record
+func TestWAL_BatchRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	ops := []*LogEntry{
+		{Op: OpPut, Key: []byte("a"), Value: []byte("1")},
+		{Op: OpDelete, Key: []byte("b")},
+		{Op: OpPut, Key: []byte("c"), Value: []byte{}},
+	}
+
+	writer, _ := Open(dir, Options{})
+	lsn, err := writer.SyncWrite(ctx, NewBatchEntry(42, ops))
+	if err != nil {
+		t.Fatalf("SyncWrite failed: %v", err)
+	}
+	writer.Close()
+
+	reader, _ := NewReader(dir)
+	defer reader.Close()
+
+	record, err := reader.Next()
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	got, err := record.BatchEntries()
+	if err != nil {
+		t.Fatalf("BatchEntries failed: %v", err)
+	}
+	if len(got) != len(ops) {
+		t.Fatalf("Expected %d operations, got %d", len(ops), len(got))
+	}
+
+	for i, op := range got {
+		if op.Op != ops[i].Op || string(op.Key) != string(ops[i].Key) || string(op.Value) != string(ops[i].Value) {
+			t.Errorf("Operation %d: got %+v, want %+v", i, op, ops[i])
+		}
+		if op.LSN != lsn || op.Timestamp != 42 {
+			t.Errorf("Operation %d should inherit the batch LSN and timestamp", i)
+		}
+	}
+}
+
+// Tests that a malformed batch payload is rejected instead of being partially decoded
+func TestWAL_BatchMalformed(t *testing.T) {
+	record := NewBatchEntry(0, []*LogEntry{
+		{Op: OpPut, Key: []byte("key"), Value: []byte("value")},
+	})
+
+	for _, cut := range []int{2, 6, len(record.Value) - 1} {
+		broken := &LogEntry{Op: OpBatch, Value: record.Value[:cut]}
+		if _, err := broken.BatchEntries(); !errors.Is(err, ErrInvalidBatch) {
+			t.Errorf("Cut at %d: expected ErrInvalidBatch, got %v", cut, err)
+		}
+	}
+
+	if _, err := (&LogEntry{Op: OpPut}).BatchEntries(); !errors.Is(err, ErrInvalidBatch) {
+		t.Errorf("Expected ErrInvalidBatch for a non-batch entry, got %v", err)
+	}
+}
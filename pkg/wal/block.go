@@ -0,0 +1,351 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+// Log files from FormatFramed on are split into blocks of BlockSize bytes, the
+// first of which starts with the file header. Records are cut into chunks
+// that never cross a block boundary, each with a header of its own:
+//
+//	4 (CRC) + 2 (Length) + 1 (Type)
+//
+// The CRC covers the length, the type and the Length bytes of the record
+// that follow. A record that fits in the rest of its block is a single
+// chunkFull, a larger one is a chunkFirst, any number of chunkMiddle and a
+// chunkLast. When fewer than ChunkHeaderSize bytes are left in a block they
+// are zeroed and the next chunk starts in the next block. A record that
+// starts with exactly ChunkHeaderSize bytes left has an empty chunkFirst.
+//
+// Since every block starts on a chunk, a reader that hits a damaged chunk
+// loses at most the rest of its block and picks up again after it.
+const (
+	BlockSize = 32 * 1024 // 32KB
+
+	ChunkHeaderSize = 7
+)
+
+const (
+	chunkFull = 1
+	chunkFirst = 2
+	chunkMiddle = 3
+	chunkLast = 4
+)
+
+// blockLeft returns the number of bytes from offset to the end of its block
+func blockLeft(offset int64) int64 {
+	return BlockSize - offset%BlockSize
+}
+
+// skipTrailer moves offset past the zeroed end of a block too short for a chunk
+func skipTrailer(offset int64) int64 {
+	if left := blockLeft(offset); left < ChunkHeaderSize {
+		return offset + left
+	}
+	return offset
+}
+
+// appendChunks appends record to dst cut into chunks checksummed with sums,
+// for a file in which dst will start at offset
+func appendChunks(dst, record []byte, offset int64, sums checksummer) []byte {
+	for first := true; ; first = false {
+		if left := blockLeft(offset); left < ChunkHeaderSize {
+			dst = append(dst, make([]byte, left)...)
+			offset += left
+		}
+
+		n := min(len(record), int(blockLeft(offset)-ChunkHeaderSize))
+		last := n == len(record)
+		typ := byte(chunkMiddle)
+		switch {
+		case first && last:
+			typ = chunkFull
+		case first:
+			typ = chunkFirst
+		case last:
+			typ = chunkLast
+		}
+
+		var header [ChunkHeaderSize]byte
+		binary.LittleEndian.PutUint16(header[4:6], uint16(n))
+		header[6] = typ
+		binary.LittleEndian.PutUint32(header[0:4], chunkChecksum(header[:], record[:n], sums))
+
+		dst = append(dst, header[:]...)
+		dst = append(dst, record[:n]...)
+		offset += int64(ChunkHeaderSize + n)
+		record = record[n:]
+
+		if last {
+			return dst
+		}
+	}
+}
+
+// chunkChecksum is the checksum of a chunk, taken over everything after the CRC field
+func chunkChecksum(header, payload []byte, sums checksummer) uint32 {
+	return sums.sum(header[4:], payload)
+}
+
+// chunkLen returns the length of the payload of the chunk whose header is
+// at offset, once it is sure the payload stays inside the block
+func chunkLen(header []byte, offset int64) (int64, error) {
+	n := int64(binary.LittleEndian.Uint16(header[4:6]))
+	if n > blockLeft(offset)-ChunkHeaderSize {
+		return 0, fmt.Errorf("%w: chunk at offset %d runs past the end of its block", ErrCorruption, offset)
+	}
+	return n, nil
+}
+
+// checkChunk verifies the checksum of a complete chunk
+func checkChunk(header, payload []byte, offset int64, sums checksummer) error {
+	if chunkChecksum(header, payload, sums) != binary.LittleEndian.Uint32(header[0:4]) {
+		return fmt.Errorf("%w: chunk checksum mismatch at offset %d", ErrCorruption, offset)
+	}
+	return nil
+}
+
+// assemble puts a record back together from the chunks next returns. It
+// returns io.EOF if there are no more chunks, and io.ErrUnexpectedEOF if they
+// end in the middle of the record.
+func assemble(next func() (byte, []byte, error), limits Limits, sums checksummer) ([]byte, error) {
+	// A chunkFirst may be empty, so record being nil does not mean none was read
+	var record []byte
+	inRecord := false
+	for {
+		typ, payload, err := next()
+		if err == io.EOF && inRecord {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case typ < chunkFull || typ > chunkLast:
+			return nil, fmt.Errorf("%w: unknown chunk type %d", ErrCorruption, typ)
+		case !inRecord && (typ == chunkMiddle || typ == chunkLast):
+			return nil, fmt.Errorf("%w: chunk of type %d outside of a record", ErrCorruption, typ)
+		case inRecord && (typ == chunkFull || typ == chunkFirst):
+			return nil, fmt.Errorf("%w: record ends without its last chunk", ErrCorruption)
+		}
+
+		record = append(record, payload...)
+		if err := checkPartial(record, limits, sums); err != nil {
+			return nil, err
+		}
+		if typ == chunkFull || typ == chunkLast {
+			return record, nil
+		}
+		inRecord = true
+	}
+}
+
+// checkPartial stops a record being assembled from growing past what its
+// header promises, once enough of it is there to read the header
+func checkPartial(record []byte, limits Limits, sums checksummer) error {
+	if len(record) < HeaderSize || len(record) < headerLen(record) {
+		return nil
+	}
+	header := record[:headerLen(record)]
+	if err := checkHeader(header, sums); err != nil {
+		return err
+	}
+
+	_, _, _, kLen, vLen := DecodeHeader(header)
+	if err := limits.check(int64(kLen), int64(vLen)); err != nil {
+		return err
+	}
+	if int64(len(record)) > int64(len(header))+int64(kLen)+int64(vLen) {
+		return fmt.Errorf("%w: chunks run past the end of the record", ErrCorruption)
+	}
+	return nil
+}
+
+// decodeChunked decodes a record put back together by assemble, which has to hold it exactly
+func decodeChunked(record []byte, limits Limits, sums checksummer) (*LogEntry, error) {
+	entry, n, err := decode(record, limits, sums)
+	if err == io.ErrUnexpectedEOF || err == nil && n != len(record) {
+		return nil, fmt.Errorf("%w: record of %d bytes does not match its chunks", ErrCorruption, len(record))
+	}
+	return entry, err
+}
+
+// readFramed reads the record at the current position of a framed file
+func (r *Reader) readFramed() (*LogEntry, error) {
+	record, err := assemble(r.readChunk, r.limits, r.header.sums())
+	if err == io.EOF && len(r.pending) > 0 {
+		// Clean end of this segment, carry on with the next one
+		if err := r.advance(); err != nil {
+			return nil, err
+		}
+		return r.read()
+	}
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return nil, r.torn(err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w (record at offset %d)", err, r.start)
+	}
+
+	entry, err := decodeChunked(record, r.limits, r.header.sums())
+	if err != nil {
+		return nil, fmt.Errorf("%w (record at offset %d)", err, r.start)
+	}
+	return entry, nil
+}
+
+// readChunk reads the chunk at the current position of the file. Returns
+// io.EOF if the file ends right before it.
+func (r *Reader) readChunk() (byte, []byte, error) {
+	offset := r.CurrentOffset()
+	if trailer := skipTrailer(offset) - offset; trailer > 0 {
+		if _, err := io.ReadFull(r.file, make([]byte, trailer)); err != nil {
+			return 0, nil, err
+		}
+		offset += trailer
+	}
+
+	header := make([]byte, ChunkHeaderSize)
+	if _, err := io.ReadFull(r.file, header); err != nil {
+		return 0, nil, err
+	}
+	n, err := chunkLen(header, offset)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r.file, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	if err := checkChunk(header, payload, offset, r.header.sums()); err != nil {
+		return 0, nil, err
+	}
+	return header[6], payload, nil
+}
+
+// chunkAt parses the chunk at offset in a framed file whose bytes from base
+// on are data, and returns it along with the offset of the chunk after it
+func chunkAt(data []byte, base, offset int64, sums checksummer) (byte, []byte, int64, error) {
+	offset = skipTrailer(offset)
+	i := offset - base
+	if i >= int64(len(data)) {
+		return 0, nil, offset, io.EOF
+	}
+	if i+ChunkHeaderSize > int64(len(data)) {
+		return 0, nil, offset, io.ErrUnexpectedEOF
+	}
+
+	header := data[i : i+ChunkHeaderSize]
+	n, err := chunkLen(header, offset)
+	if err != nil {
+		return 0, nil, offset, err
+	}
+	end := i + ChunkHeaderSize + n
+	if end > int64(len(data)) {
+		return 0, nil, offset, io.ErrUnexpectedEOF
+	}
+
+	payload := data[i+ChunkHeaderSize : end]
+	if err := checkChunk(header, payload, offset, sums); err != nil {
+		return 0, nil, offset, err
+	}
+	return header[6], payload, base + end, nil
+}
+
+// blocks reads a framed file for resync a block at a time. Chunks never
+// cross a block boundary, so one block in memory is all that following them
+// takes. The first read error is kept in err.
+type blocks struct {
+	file vfs.File
+	sums checksummer
+	buf []byte
+	block []byte
+	base int64
+	err error
+}
+
+// newBlocks returns blocks reading file with checksums from sums
+func newBlocks(file vfs.File, sums checksummer) *blocks {
+	return &blocks{file: file, sums: sums, buf: make([]byte, BlockSize), base: -1}
+}
+
+// chunkAt is chunkAt for the chunk at offset of the file, which it reads the
+// block of first. The payload is only good until the next call.
+func (b *blocks) chunkAt(offset int64) (byte, []byte, int64, error) {
+	offset = skipTrailer(offset)
+	if base := offset - offset%BlockSize; base != b.base {
+		n, err := b.file.ReadAt(b.buf, base)
+		if err != nil && err != io.EOF {
+			b.err = err
+			return 0, nil, offset, err
+		}
+		b.block, b.base = b.buf[:n], base
+	}
+	return chunkAt(b.block, b.base, offset, b.sums)
+}
+
+// resyncFramed is resync for a framed file. It follows the chunks after
+// the damaged record. When one of them is damaged too it looks for the
+// next intact chunk in the rest of its block, and failing that carries on
+// at the start of the next block.
+func (r *Reader) resyncFramed() (int64, error) {
+	b := newBlocks(r.file, r.header.sums())
+	for offset := r.start; b.err == nil; {
+		offset = skipTrailer(offset)
+		typ, _, next, err := b.chunkAt(offset)
+		if err == io.EOF {
+			return -1, nil
+		}
+		if err != nil {
+			offset = r.nextChunk(b, offset+1)
+			continue
+		}
+
+		if offset > r.start && (typ == chunkFull || typ == chunkFirst) && r.validChunked(b, offset) {
+			return offset, nil
+		}
+		offset = next
+	}
+	return 0, b.err
+}
+
+// nextChunk returns the offset of the first intact chunk from offset to
+// the end of its block, or the start of the next block if there is none
+func (r *Reader) nextChunk(b *blocks, offset int64) int64 {
+	blockEnd := offset + blockLeft(offset)
+	for ; offset < blockEnd && b.err == nil; offset++ {
+		if _, _, _, err := b.chunkAt(offset); err == nil {
+			return offset
+		}
+	}
+	return blockEnd
+}
+
+// validChunked reports whether the chunks at offset hold a complete valid
+// record with an LSN above the last one read. It leaves b on another block
+// when the record spans several.
+func (r *Reader) validChunked(b *blocks, offset int64) bool {
+	record, err := assemble(func() (byte, []byte, error) {
+		typ, payload, next, err := b.chunkAt(offset)
+		offset = next
+		return typ, payload, err
+	}, r.limits, b.sums)
+	if err != nil {
+		return false
+	}
+
+	entry, err := decodeChunked(record, r.limits, b.sums)
+	return err == nil && entry.LSN > r.last
+}
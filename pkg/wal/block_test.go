@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+// Tests that records of every size survive being cut into chunks, including ones spanning several blocks
+func TestWAL_SpanningBlocks(t *testing.T) {
+	fs := vfs.NewMem()
+	ctx := context.Background()
+
+	var values [][]byte
+	writer, _ := NewWriterFS(fs, "log")
+	write := func(value []byte) {
+		t.Helper()
+		key := fmt.Appendf(nil, "key-%d", len(values))
+		if _, err := writer.Write(ctx, &LogEntry{Op: OpPut, Key: key, Value: value}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		values = append(values, value)
+	}
+
+	// Sizes chosen to end records at and just short of block boundaries
+	for i, size := range []int{0, 100, BlockSize, 3*BlockSize + 17, 1, BlockSize - 2*ChunkHeaderSize - 50, 5, 2 * BlockSize} {
+		write(bytes.Repeat([]byte{byte(i + 1)}, size))
+	}
+
+	// Records that end from 0 to just over ChunkHeaderSize bytes before the
+	// end of a block, each followed by one that starts in what is left. With
+	// exactly ChunkHeaderSize bytes left that one starts with an empty chunkFirst.
+	for tail := range int64(ChunkHeaderSize + 2) {
+		key := fmt.Appendf(nil, "key-%d", len(values))
+		empty, _ := (&LogEntry{Op: OpPut, Key: key}).encode(Limits{}, writer.header.sums(), compressor{})
+		left := blockLeft(skipTrailer(FileHeaderSize + writer.size))
+		size := left - tail - ChunkHeaderSize - int64(len(empty))
+		if size < 0 {
+			size += BlockSize - ChunkHeaderSize
+		}
+		write(bytes.Repeat([]byte{'t'}, int(size)))
+		if got := blockLeft(FileHeaderSize + writer.size); got != tail && !(tail == 0 && got == BlockSize) {
+			t.Fatalf("Record left %d bytes in its block, want %d", got, tail)
+		}
+		write([]byte("after"))
+	}
+	writer.Close()
+
+	reader, _ := NewReaderFS(fs, "log")
+	defer reader.Close()
+	for i, value := range values {
+		entry, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Entry %d: %v", i, err)
+		}
+		if string(entry.Key) != fmt.Sprintf("key-%d", i) || !bytes.Equal(entry.Value, value) {
+			t.Errorf("Entry %d came back as %q with %d bytes of value", i, entry.Key, len(entry.Value))
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+// Tests that garbage to the end of a block only costs the records it touches
+func TestWAL_DamagedBlock(t *testing.T) {
+	fs := vfs.NewMem()
+	ctx := context.Background()
+
+	writer, _ := NewWriterFS(fs, "log")
+	for i := range 200 {
+		writer.Write(ctx, &LogEntry{Op: OpPut, Key: fmt.Appendf(nil, "key-%03d", i), Value: bytes.Repeat([]byte{'v'}, 500)})
+	}
+	writer.Close()
+
+	// Where each record starts and ends before the damage
+	type span struct{ start, end int64 }
+	var spans []span
+	reader, _ := NewReaderFS(fs, "log")
+	for {
+		if _, err := reader.Next(); err != nil {
+			break
+		}
+		spans = append(spans, span{reader.RecordOffset(), reader.CurrentOffset()})
+	}
+	reader.Close()
+
+	from, to := int64(BlockSize/2), int64(BlockSize)
+	f, _ := fs.OpenFile("log", os.O_RDWR, 0644)
+	f.WriteAt(bytes.Repeat([]byte{0xFF}, int(to-from)), from)
+	f.Close()
+
+	var want []string
+	for i, s := range spans {
+		if s.end <= from || s.start >= to {
+			want = append(want, fmt.Sprintf("key-%03d", i))
+		}
+	}
+
+	reader, _ = OpenReader("log", Options{FS: fs, Recovery: RecoverSkipCorrupted})
+	defer reader.Close()
+	var got []string
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		got = append(got, string(entry.Key))
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Read %d entries, want %d: %v", len(got), len(want), got)
+	}
+	skipped := reader.Skipped()
+	if len(skipped) != 1 || skipped[0].Offset > from || skipped[0].Offset+skipped[0].Length < to || !errors.Is(skipped[0].Err, ErrCorruption) {
+		t.Errorf("Expected one skipped range over the damage, got %+v", skipped)
+	}
+}
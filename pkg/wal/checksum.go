@@ -0,0 +1,99 @@
+package wal
+
+import (
+	"hash/crc32"
+
+	"com.github/mune-0/anchor/pkg/internal/xxhash"
+)
+
+// Checksum names the algorithm the records of a log file are checksummed
+// with. It is recorded in the file header, so files written with different
+// algorithms can be read side by side. Every algorithm stores 32 bits, so
+// they all catch damage equally well and differ only in speed.
+type Checksum uint8
+
+const (
+	// ChecksumIEEE is CRC-32 with the IEEE polynomial, the only algorithm of
+	// log files before FormatMasked
+	ChecksumIEEE Checksum = 1
+
+	// ChecksumCRC32C is CRC-32 with the Castagnoli polynomial, which most
+	// CPUs compute in hardware
+	ChecksumCRC32C Checksum = 2
+
+	// ChecksumXXHash64 is XXH64 cut down to its low 32 bits. It is only
+	// there for speed on CPUs without CRC instructions, at 32 bits it lets
+	// damage through as often as CRC-32 does.
+	ChecksumXXHash64 Checksum = 3
+
+	// DefaultChecksum is used for new log files when Options.Checksum is unset
+	DefaultChecksum = ChecksumCRC32C
+)
+
+func (c Checksum) String() string {
+	switch c {
+	case ChecksumIEEE:
+		return "crc32-ieee"
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumXXHash64:
+		return "xxhash64"
+	default:
+		return "unknown"
+	}
+}
+
+// valid reports whether c is an algorithm this package knows
+func (c Checksum) valid() bool {
+	return c >= ChecksumIEEE && c <= ChecksumXXHash64
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// maskDelta is added to a rotated checksum by mask
+const maskDelta = 0xa282ead8
+
+// mask scrambles a checksum before it is stored. Taking the CRC of data that
+// holds its own CRC, say a log record stored as a value, gives results that
+// are far from random, which masking the stored CRC avoids.
+func mask(sum uint32) uint32 {
+	return (sum>>15 | sum<<17) + maskDelta
+}
+
+// checksummer computes the checksums stored in a log file, of records, of
+// their headers and of the chunks they are framed in
+type checksummer struct {
+	alg Checksum
+
+	// Whether stored checksums are masked, as they are from FormatMasked on
+	masked bool
+}
+
+// legacySums are the checksums of log files before FormatMasked
+var legacySums = checksummer{alg: ChecksumIEEE}
+
+// sum returns the checksum of parts one after the other, the way it is stored
+func (c checksummer) sum(parts ...[]byte) uint32 {
+	var s uint32
+	switch c.alg {
+	case ChecksumCRC32C:
+		for _, p := range parts {
+			s = crc32.Update(s, castagnoli, p)
+		}
+	case ChecksumXXHash64:
+		d := xxhash.New()
+		for _, p := range parts {
+			d.Write(p)
+		}
+		s = uint32(d.Sum64())
+	default:
+		for _, p := range parts {
+			s = crc32.Update(s, crc32.IEEETable, p)
+		}
+	}
+
+	if c.masked {
+		return mask(s)
+	}
+	return s
+}
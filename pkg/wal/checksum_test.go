@@ -0,0 +1,112 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+var allChecksums = []Checksum{ChecksumIEEE, ChecksumCRC32C, ChecksumXXHash64}
+
+// Tests the algorithms against published check values
+func TestChecksum_KnownValues(t *testing.T) {
+	tests := []struct {
+		alg Checksum
+		data string
+		want uint32
+	}{
+		{ChecksumIEEE, "123456789", 0xCBF43926},
+		{ChecksumCRC32C, "123456789", 0xE3069283},
+		{ChecksumXXHash64, "", 0x51D8E999},
+		{ChecksumXXHash64, "a", 0xA98C6E5B},
+		{ChecksumXXHash64, "abc", 0xAD770999},
+		{ChecksumXXHash64, "Nobody inspects the spammish repetition", 0x8A378BF1},
+	}
+
+	for _, tt := range tests {
+		if got := (checksummer{alg: tt.alg}).sum([]byte(tt.data)); got != tt.want {
+			t.Errorf("%s(%q) = %#x, want %#x", tt.alg, tt.data, got, tt.want)
+		}
+	}
+}
+
+// Tests that a checksum over several parts equals the one over them joined, however they are cut
+func TestChecksum_Parts(t *testing.T) {
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for _, alg := range allChecksums {
+		sums := checksummer{alg: alg, masked: true}
+		want := sums.sum(data)
+		for _, cut := range []int{0, 1, 31, 32, 33, 100, 199} {
+			for _, cut2 := range []int{cut, cut + 1, 200} {
+				if got := sums.sum(data[:cut], data[cut:cut2], data[cut2:]); got != want {
+					t.Errorf("%s: cut at %d and %d gave %#x, want %#x", alg, cut, cut2, got, want)
+				}
+			}
+		}
+	}
+}
+
+// Tests that a log written with each algorithm reads back and records it in its header
+func TestWAL_Checksums(t *testing.T) {
+	for _, alg := range allChecksums {
+		t.Run(alg.String(), func(t *testing.T) {
+			fs := vfs.NewMem()
+			ctx := context.Background()
+
+			writer, err := Open("wal", Options{FS: fs, Checksum: alg})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			for i := range 10 {
+				writer.Write(ctx, &LogEntry{Op: OpPut, Key: fmt.Appendf(nil, "key-%d", i), Value: bytes.Repeat([]byte{'v'}, i*1000)})
+			}
+			writer.Close()
+
+			segments, _ := SegmentsFS(fs, "wal")
+			if h, err := ReadFileHeader(fs, segments[0]); err != nil || h.Checksum != alg {
+				t.Errorf("Expected the header to name %s, got %+v (%v)", alg, h, err)
+			}
+
+			reader, _ := NewReaderFS(fs, "wal")
+			defer reader.Close()
+			for i := range 10 {
+				entry, err := reader.Next()
+				if err != nil || string(entry.Key) != fmt.Sprintf("key-%d", i) || len(entry.Value) != i*1000 {
+					t.Fatalf("Entry %d: got %+v (%v)", i, entry, err)
+				}
+			}
+			if _, err := reader.Next(); err != io.EOF {
+				t.Errorf("Expected io.EOF, got %v", err)
+			}
+		})
+	}
+
+	if _, err := Open(t.TempDir(), Options{Checksum: 42}); err == nil {
+		t.Error("Open should refuse an unknown checksum algorithm")
+	}
+}
+
+// Compares the throughput of the checksum algorithms over typical record sizes.
+// ChecksumXXHash64 hashes with XXH64 but stores 32 bits like the others.
+func BenchmarkChecksum(b *testing.B) {
+	for _, alg := range allChecksums {
+		for _, size := range []int{64, 4 * 1024, 64 * 1024} {
+			b.Run(fmt.Sprintf("%s/%d", alg, size), func(b *testing.B) {
+				sums := checksummer{alg: alg, masked: true}
+				data := make([]byte, size)
+				b.SetBytes(int64(size))
+				for b.Loop() {
+					sums.sum(data)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package wal
+
+import (
+	"context"
+	"slices"
+)
+
+// commitRequest is a SyncWrite call waiting in the group commit queue
+type commitRequest struct {
+	entry *LogEntry
+	lsn uint64
+	err error
+
+	// ready is closed once the request has been committed by a leader,
+	// or once it has been promoted to lead the next batch itself
+	ready chan struct{}
+	leader bool
+}
+
+// groupSyncWrite is SyncWrite when Options.GroupCommit is set.
+//
+// Callers enqueue their entries and one of them, the leader, appends the
+// whole queue and pays for a single flush and fsync on behalf of everyone.
+// While the leader is syncing, new callers pile up in the queue and become
+// the next batch, so under load the cost of one fsync is shared by many writers.
+func (w *Writer) groupSyncWrite(ctx context.Context, entry *LogEntry) (uint64, error) {
+	req := &commitRequest{entry: entry, ready: make(chan struct{})}
+
+	w.queueMut.Lock()
+	if w.leading {
+		w.queue = append(w.queue, req)
+		w.queueMut.Unlock()
+
+		select {
+		case <-req.ready:
+		case <-ctx.Done():
+			w.queueMut.Lock()
+			if i := slices.Index(w.queue, req); i >= 0 {
+				// Not picked up yet, so the entry never reaches the log
+				w.queue = slices.Delete(w.queue, i, i+1)
+				w.queueMut.Unlock()
+				return 0, ctx.Err()
+			}
+			w.queueMut.Unlock()
+
+			// A leader already took the entry, report how its commit went
+			<-req.ready
+		}
+
+		if !req.leader {
+			return req.lsn, req.err
+		}
+	} else {
+		w.leading = true
+		w.queueMut.Unlock()
+	}
+
+	// We are the leader: commit our own entry plus everything queued so far
+	w.queueMut.Lock()
+	batch := append([]*commitRequest{req}, w.queue...)
+	w.queue = nil
+	w.queueMut.Unlock()
+
+	w.commit(batch)
+
+	// Hand over to the first caller that queued up while we were syncing
+	w.queueMut.Lock()
+	if len(w.queue) > 0 {
+		next := w.queue[0]
+		w.queue = w.queue[1:]
+		next.leader = true
+		close(next.ready)
+	} else {
+		w.leading = false
+	}
+	w.queueMut.Unlock()
+
+	return req.lsn, req.err
+}
+
+// commit appends every entry in batch, then flushes and fsyncs once.
+// All followers in the batch are released with the same outcome.
+func (w *Writer) commit(batch []*commitRequest) {
+	w.mut.Lock()
+
+	err := w.syncErr
+	appended := 0
+	for _, req := range batch {
+		if err != nil {
+			break
+		}
+		if err = w.append(req.entry); err == nil {
+			appended++
+		}
+		req.lsn = req.entry.LSN
+	}
+
+	if err == nil {
+		err = w.sync()
+	}
+	if err != nil && appended > 0 && w.syncErr == nil {
+		// The entries appended before the failure cannot be taken back, their
+		// LSNs are used up and some bytes may have reached the file. Drop what
+		// is still buffered and fail every later write, so that no flush makes
+		// durable what the batch was told did not happen.
+		w.writer.Reset(w.file)
+		w.syncErr = err
+	}
+
+	w.mut.Unlock()
+
+	for i, req := range batch {
+		if err != nil {
+			req.lsn = 0
+		}
+		req.err = err
+
+		// The leader is batch[0] and is not waiting on anything
+		if i > 0 {
+			close(req.ready)
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package wal
 
 import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 	"context"
+
+	"com.github/mune-0/anchor/pkg/vfs"
 )
 
 // Tests that a LogEntry can be successfully be encoded, written to disk, and retrieved with all fields intact
@@ -24,7 +31,7 @@ func TestWAL_WriteRead(t *testing.T) {
 	ctx := context.Background()
 
 	// Using SyncWrite to ensure durability
-	if err := writer.SyncWrite(ctx, originalEntry); err != nil {
+	if _, err := writer.SyncWrite(ctx, originalEntry); err != nil {
 		t.Fatalf("Failed to write: %v", err)
 	}
 	writer.Close()
@@ -94,3 +101,139 @@ func TestWAL_PartialWrite(t *testing.T) {
 		t.Error("Reader should have failed to read a truncated entry")
 	}
 }
+
+// Tests that a torn header claiming a huge payload reads as a torn record instead of being allocated
+func TestWAL_GarbledLength(t *testing.T) {
+	tmpFile, _ := os.CreateTemp("", "wal_garbled_*.log")
+	defer os.Remove(tmpFile.Name())
+
+	// Only unframed records are read by the length in their header
+	h := newFileHeader(1, ChecksumIEEE)
+	h.Version = FormatHeader
+	tmpFile.Write(h.encode())
+	tmpFile.Close()
+
+	ctx := context.Background()
+
+	writer, _ := NewWriter(tmpFile.Name())
+	writer.SyncWrite(ctx, &LogEntry{Key: []byte("kept"), Value: []byte("value")})
+	writer.Close()
+
+	// A second header whose value length has all bits set, and no payload
+	header := make([]byte, HeaderSize)
+	for i := 25; i < HeaderSize; i++ {
+		header[i] = 0xFF
+	}
+	f, _ := os.OpenFile(tmpFile.Name(), os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write(header)
+	f.Close()
+
+	reader, _ := NewReader(tmpFile.Name())
+	defer reader.Close()
+
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("Expected the first entry, got %v", err)
+	}
+	if _, err := reader.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+// Tests that every entry gets a unique, increasing LSN that survives a restart
+func TestWAL_LSN(t *testing.T) {
+	tmpFile, _ := os.CreateTemp("", "wal_lsn_*.log")
+	defer os.Remove(tmpFile.Name())
+
+	ctx := context.Background()
+
+	writer, _ := NewWriter(tmpFile.Name())
+	for i := range 3 {
+		lsn, err := writer.Write(ctx, &LogEntry{Key: []byte("key"), Value: []byte("value")})
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if lsn != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, lsn)
+		}
+	}
+	writer.Close()
+
+	// A reopened writer continues numbering where the file ends
+	writer, _ = NewWriter(tmpFile.Name())
+	lsn, _ := writer.SyncWrite(ctx, &LogEntry{Key: []byte("key"), Value: []byte("value")})
+	if lsn != 4 {
+		t.Errorf("Expected LSN 4 after reopen, got %d", lsn)
+	}
+	writer.Close()
+
+	reader, _ := NewReader(tmpFile.Name())
+	defer reader.Close()
+
+	for i := range 4 {
+		entry, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if entry.LSN != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, entry.LSN)
+		}
+	}
+}
+
+// Tests that keys and values over the limits are refused when writing and when reading
+func TestWAL_RecordTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	writer, _ := Open(dir, Options{Limits: Limits{MaxKeySize: 8, MaxValueSize: 16}})
+	if _, err := writer.SyncWrite(ctx, &LogEntry{Key: []byte("much too long"), Value: []byte("v")}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Expected ErrRecordTooLarge for the key, got %v", err)
+	}
+	if _, err := writer.Write(ctx, &LogEntry{Key: []byte("k"), Value: make([]byte, 17)}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Expected ErrRecordTooLarge for the value, got %v", err)
+	}
+	if _, err := writer.SyncWrite(ctx, &LogEntry{Key: []byte("k"), Value: make([]byte, 16)}); err != nil {
+		t.Fatalf("SyncWrite at the limit failed: %v", err)
+	}
+	writer.Close()
+
+	// Nothing was written for the refused entries
+	reader, _ := OpenReader(dir, Options{Limits: Limits{MaxValueSize: 8}})
+	defer reader.Close()
+	if _, err := reader.Next(); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Expected the reader to refuse the 16 byte value, got %v", err)
+	}
+}
+
+// Tests that records written before headers had their own checksum can still be read
+func TestWAL_ReadUnflaggedHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.log")
+
+	// Same layout as Encode, without the header checksum
+	record := make([]byte, HeaderSize+len("key")+len("value"))
+	binary.LittleEndian.PutUint64(record[4:12], 1)
+	record[20] = uint8(OpPut)
+	binary.LittleEndian.PutUint32(record[21:25], 3)
+	binary.LittleEndian.PutUint32(record[25:29], 5)
+	copy(record[HeaderSize:], "keyvalue")
+	binary.LittleEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	os.WriteFile(path, record, 0644)
+
+	reader, _ := NewReader(path)
+	entry, err := reader.Next()
+	reader.Close()
+	if err != nil || string(entry.Key) != "key" || string(entry.Value) != "value" || entry.LSN != 1 {
+		t.Fatalf("Got %+v (%v), want the old record", entry, err)
+	}
+
+	// Appending continues the old log in the current format
+	writer, _ := NewWriter(path)
+	if lsn, _ := writer.SyncWrite(context.Background(), &LogEntry{Key: []byte("new")}); lsn != 2 {
+		t.Errorf("Expected LSN 2, got %d", lsn)
+	}
+	writer.Close()
+
+	if keys := readAllFS(t, vfs.OS, path); len(keys) != 2 || keys[1] != "new" {
+		t.Errorf("Got %v", keys)
+	}
+}
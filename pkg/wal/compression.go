@@ -0,0 +1,96 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+
+	"com.github/mune-0/anchor/pkg/compress"
+)
+
+// Compression names the codec the values of records are compressed with.
+// A compressed value starts with a byte naming its codec, so segments written
+// with different codecs can be read side by side.
+type Compression uint8
+
+const (
+	// CompressionNone stores values as they are
+	CompressionNone Compression = 0
+
+	// CompressionSnappy is the Snappy block format, fast with a modest ratio
+	CompressionSnappy Compression = 1
+
+	// CompressionZstd is zstd, slower than Snappy with a better ratio
+	CompressionZstd Compression = 2
+
+	// DefaultCompressMinSize is used when Options.CompressMinSize is unset
+	DefaultCompressMinSize = 256
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return "unknown"
+	}
+}
+
+// valid reports whether c is a codec this package knows
+func (c Compression) valid() bool {
+	return c <= CompressionZstd
+}
+
+// codec returns the implementation of c, which must be valid and not CompressionNone
+func (c Compression) codec() compress.Codec {
+	if c == CompressionSnappy {
+		return compress.Snappy
+	}
+	return compress.Zstd
+}
+
+// compressor decides which values of records are compressed and how
+type compressor struct {
+	alg Compression
+
+	// Values smaller than this are stored as they are
+	minSize int
+}
+
+// compress returns value compressed and led by the byte naming its codec,
+// or nil if it is too small to bother or does not get any smaller
+func (c compressor) compress(value []byte) []byte {
+	if c.alg == CompressionNone || len(value) < c.minSize {
+		return nil
+	}
+	packed := c.alg.codec().Encode([]byte{byte(c.alg)}, value)
+	if len(packed) >= len(value) {
+		return nil
+	}
+	return packed
+}
+
+// decompress reverses compress. A value that would decompress to more than
+// limits allow is refused with ErrRecordTooLarge before it is produced.
+func decompress(packed []byte, limits Limits) ([]byte, error) {
+	if len(packed) == 0 {
+		return nil, fmt.Errorf("%w: compressed value without a codec", ErrCorruption)
+	}
+	alg := Compression(packed[0])
+	if alg == CompressionNone || !alg.valid() {
+		return nil, fmt.Errorf("%w: unknown compression codec %d", ErrCorruption, packed[0])
+	}
+
+	_, maxValue := limits.max()
+	value, err := alg.codec().Decode(nil, packed[1:], int(maxValue))
+	if errors.Is(err, compress.ErrTooLarge) {
+		return nil, fmt.Errorf("%w: compressed value over %d bytes", ErrRecordTooLarge, maxValue)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s value does not decompress: %v", ErrCorruption, alg, err)
+	}
+	return value, nil
+}
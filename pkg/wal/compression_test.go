@@ -0,0 +1,136 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+var allCompressions = []Compression{CompressionSnappy, CompressionZstd}
+
+// jsonValue returns a JSON document of about n bytes, the kind of value compression is for
+func jsonValue(i, n int) []byte {
+	doc := []byte(`{"items":[`)
+	for j := 0; len(doc) < n; j++ {
+		doc = fmt.Appendf(doc, `{"id":%d,"owner":"user-%d","status":"active","tags":["wal","anchor"]},`, j, i)
+	}
+	return append(doc[:len(doc)-1], "]}"...)
+}
+
+// Tests that a log written with each codec reads back, and takes less space than without one
+func TestWAL_Compression(t *testing.T) {
+	random := make([]byte, 5000)
+	for i := range random {
+		random[i] = byte(rand.Uint32())
+	}
+	values := [][]byte{nil, []byte("small"), jsonValue(0, 200), jsonValue(1, 4000), random, jsonValue(2, 100*1024)}
+
+	written := func(alg Compression) (vfs.FS, int64) {
+		fs := vfs.NewMem()
+		writer, err := Open("wal", Options{FS: fs, Compression: alg})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		for i, value := range values {
+			writer.Write(context.Background(), &LogEntry{Op: OpPut, Key: fmt.Appendf(nil, "key-%d", i), Value: value})
+		}
+		writer.Close()
+
+		segments, _ := SegmentsFS(fs, "wal")
+		stat, _ := fs.Stat(segments[0])
+		return fs, stat.Size()
+	}
+
+	_, raw := written(CompressionNone)
+	for _, alg := range allCompressions {
+		t.Run(alg.String(), func(t *testing.T) {
+			fs, size := written(alg)
+			if size > raw/2 {
+				t.Errorf("Expected the log to shrink, %d bytes with %s against %d without", size, alg, raw)
+			}
+
+			reader, _ := NewReaderFS(fs, "wal")
+			defer reader.Close()
+			for i, value := range values {
+				entry, err := reader.Next()
+				if err != nil || string(entry.Key) != fmt.Sprintf("key-%d", i) || !bytes.Equal(entry.Value, value) {
+					t.Fatalf("Entry %d: got %q (%v)", i, entry.Key, err)
+				}
+			}
+			if _, err := reader.Next(); err != io.EOF {
+				t.Errorf("Expected io.EOF, got %v", err)
+			}
+		})
+	}
+
+	if _, err := Open(t.TempDir(), Options{Compression: 42}); err == nil {
+		t.Error("Open should refuse an unknown compression codec")
+	}
+}
+
+// Tests that values below the threshold, or that do not shrink, are stored as they are
+func TestWAL_CompressMinSize(t *testing.T) {
+	sums := newFileHeader(1, 0).sums()
+	comp := compressor{alg: CompressionSnappy, minSize: 500}
+	value := jsonValue(0, 600)
+
+	tests := []struct {
+		value []byte
+		compressed bool
+	}{
+		{value[:499], false},
+		{value[:500], true},
+		{value, true},
+		{bytes.Repeat([]byte{'x'}, 499), false},
+		{[]byte("{}"), false},
+	}
+
+	for _, tt := range tests {
+		entry := &LogEntry{LSN: 1, Op: OpPut, Key: []byte("key"), Value: tt.value}
+		data, err := entry.encode(Limits{}, sums, comp)
+		if err != nil {
+			t.Fatalf("encode failed: %v", err)
+		}
+		if got := data[20]&flagCompressed != 0; got != tt.compressed {
+			t.Errorf("Value of %d bytes: compressed %v, want %v", len(tt.value), got, tt.compressed)
+		}
+		if !bytes.Equal(entry.Value, tt.value) {
+			t.Errorf("encode changed the value of the entry")
+		}
+
+		got, _, err := decode(data, Limits{}, sums)
+		if err != nil || !bytes.Equal(got.Value, tt.value) {
+			t.Errorf("Value of %d bytes decoded to %d (%v)", len(tt.value), len(got.Value), err)
+		}
+	}
+
+	// Random data does not shrink, whatever its size
+	random := make([]byte, 1000)
+	for i := range random {
+		random[i] = byte(rand.Uint32())
+	}
+	data, _ := (&LogEntry{Op: OpPut, Value: random}).encode(Limits{}, sums, comp)
+	if data[20]&flagCompressed != 0 {
+		t.Error("Expected an incompressible value to be stored as it is")
+	}
+}
+
+// Tests that a compressed value that expands past the reader's limits is refused without being expanded
+func TestWAL_CompressedTooLarge(t *testing.T) {
+	fs := vfs.NewMem()
+	writer, _ := Open("wal", Options{FS: fs, Compression: CompressionZstd})
+	writer.Write(context.Background(), &LogEntry{Op: OpPut, Key: []byte("big"), Value: make([]byte, 1<<20)})
+	writer.Close()
+
+	reader, _ := OpenReader("wal", Options{FS: fs, Limits: Limits{MaxValueSize: 1 << 16}})
+	defer reader.Close()
+	if _, err := reader.Next(); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Expected ErrRecordTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+// readAllFS returns the keys of every entry in the log in dir on fs
+func readAllFS(t *testing.T, fs vfs.FS, dir string) []string {
+	t.Helper()
+
+	reader, err := NewReaderFS(fs, dir)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	defer reader.Close()
+
+	var keys []string
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return keys
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		keys = append(keys, string(entry.Key))
+	}
+}
+
+// Tests that a crash keeps every synced entry and loses the ones only written
+func TestWAL_CrashLosesUnsynced(t *testing.T) {
+	ctx := context.Background()
+	fs := vfs.NewFault(vfs.NewMem())
+
+	writer, err := Open("wal", Options{Sync: SyncNever, SegmentSize: 350, FS: fs})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	for i := range 10 {
+		if _, err := writer.SyncWrite(ctx, &LogEntry{Op: OpPut, Key: fmt.Appendf(nil, "synced-%d", i)}); err != nil {
+			t.Fatalf("SyncWrite failed: %v", err)
+		}
+	}
+	for i := range 3 {
+		writer.Write(ctx, &LogEntry{Op: OpPut, Key: fmt.Appendf(nil, "lost-%d", i)})
+	}
+	// Reaches the OS, but is never synced
+	writer.writer.Flush()
+
+	if err := fs.Crash(); err != nil {
+		t.Fatalf("Crash failed: %v", err)
+	}
+
+	keys := readAllFS(t, fs, "wal")
+	if len(keys) != 10 || keys[9] != "synced-9" {
+		t.Errorf("Expected exactly the synced entries, got %v", keys)
+	}
+
+	// The log carries on after the last entry that survived
+	writer, err = Open("wal", Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer writer.Close()
+	if lsn := writer.LastLSN(); lsn != 10 {
+		t.Errorf("Expected to continue after LSN 10, got %d", lsn)
+	}
+}
+
+// Tests that failing fsyncs and full disks surface as write errors
+func TestWAL_InjectedFaults(t *testing.T) {
+	ctx := context.Background()
+	fs := vfs.NewFault(vfs.NewMem())
+
+	writer, err := Open("wal", Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer writer.Close()
+
+	if _, err := writer.SyncWrite(ctx, &LogEntry{Op: OpPut, Key: []byte("a")}); err != nil {
+		t.Fatalf("SyncWrite failed: %v", err)
+	}
+
+	fs.Inject(vfs.Fault{Op: vfs.OpSync, Path: "*" + SegmentExt, Times: 1})
+	if _, err := writer.SyncWrite(ctx, &LogEntry{Op: OpPut, Key: []byte("b")}); !errors.Is(err, vfs.ErrInjected) {
+		t.Errorf("Expected the fsync failure, got %v", err)
+	}
+
+	// The kernel may have dropped the dirty pages, so the log stays failed
+	// even though the next fsync would succeed
+	if _, err := writer.SyncWrite(ctx, &LogEntry{Op: OpPut, Key: []byte("c")}); !errors.Is(err, vfs.ErrInjected) {
+		t.Errorf("Expected the fsync failure to stick, got %v", err)
+	}
+
+	full, err := Open("full", Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer full.Close()
+
+	fs.Inject(vfs.Fault{Op: vfs.OpWrite, Err: syscall.ENOSPC, Short: true})
+	if _, err := full.SyncWrite(ctx, &LogEntry{Op: OpPut, Key: []byte("d")}); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected ENOSPC, got %v", err)
+	}
+}
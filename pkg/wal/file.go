@@ -8,9 +8,11 @@ import (
 type WALWriter interface {
 	// Log entry is not flushed to the file immediately
 	// File is not always in sync
-	Write(ctx context.Context, entry *LogEntry) error
+	// Returns the LSN assigned to the entry
+	Write(ctx context.Context, entry *LogEntry) (uint64, error)
 
 	// Log entry directly to the file
 	// File is always in sync
-	SyncWrite(ctx context.Context, entry *LogEntry) error
+	// Returns the LSN assigned to the entry
+	SyncWrite(ctx context.Context, entry *LogEntry) (uint64, error)
 }
@@ -2,55 +2,278 @@ package wal
 
 import (
 	"encoding/binary"
-	"hash/crc32"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 )
 
 const (
-	// HeaderSize = 4 (CRC) + 8 (TS) + 1 (OP) + 4 (KLen) + 4 (VLen)
-	HeaderSize = 21
+	// HeaderSize = 4 (CRC) + 8 (LSN) + 8 (TS) + 1 (OP) + 4 (KLen) + 4 (VLen)
+	HeaderSize = 29
+
+	// HeaderChecksumSize is the size of the CRC of the header alone that
+	// follows it in records flagged with flagHeaderChecksum, which Encode
+	// always sets. It lets a reader trust the lengths before allocating.
+	HeaderChecksumSize = 4
+
+	// DefaultMaxKeySize is used when Limits.MaxKeySize is unset
+	DefaultMaxKeySize = 64 * 1024 // 64KB
+
+	// DefaultMaxValueSize is used when Limits.MaxValueSize is unset
+	DefaultMaxValueSize = 64 * 1024 * 1024 // 64MB
 )
 
+// The OP byte of a record holds the OpType in its low bits and flags in the high ones
+const (
+	opMask = 0x3F
+
+	flagHeaderChecksum = 0x80
+
+	// flagCompressed marks a record whose value is stored compressed, see
+	// compressor. VLen is then the length of the compressed value.
+	flagCompressed = 0x40
+)
+
+// ErrRecordTooLarge is returned for a key or value over the Limits of the log
+var ErrRecordTooLarge = errors.New("wal: record too large")
+
+// Limits bounds the size of the keys and values in a log. Writers refuse
+// larger entries and readers refuse larger records.
+type Limits struct {
+	// MaxKeySize is the largest key in bytes, DefaultMaxKeySize if unset
+	MaxKeySize int
+
+	// MaxValueSize is the largest value in bytes, DefaultMaxValueSize if unset.
+	// For an OpBatch entry this covers all of its operations together.
+	MaxValueSize int
+}
+
+// max returns the largest key and value l allows, with the defaults filled in
+func (l Limits) max() (maxKey, maxValue int64) {
+	maxKey, maxValue = int64(l.MaxKeySize), int64(l.MaxValueSize)
+	if maxKey <= 0 {
+		maxKey = DefaultMaxKeySize
+	}
+	if maxValue <= 0 {
+		maxValue = DefaultMaxValueSize
+	}
+	// The lengths are stored in 32 bits
+	return min(maxKey, math.MaxUint32), min(maxValue, math.MaxUint32)
+}
+
+// check returns ErrRecordTooLarge if a key of kLen or a value of vLen bytes is over l
+func (l Limits) check(kLen, vLen int64) error {
+	maxKey, maxValue := l.max()
+	if kLen > maxKey {
+		return fmt.Errorf("%w: key of %d bytes, at most %d allowed", ErrRecordTooLarge, kLen, maxKey)
+	}
+	if vLen > maxValue {
+		return fmt.Errorf("%w: value of %d bytes, at most %d allowed", ErrRecordTooLarge, vLen, maxValue)
+	}
+	return nil
+}
+
+// checkEntry is check for the key and value of e
+func (l Limits) checkEntry(e *LogEntry) error {
+	return l.check(int64(len(e.Key)), int64(len(e.Value)))
+}
+
 type OpType uint8
 
 const (
 	OpPut OpType = 0
 	OpDelete OpType = 1
+	// OpBatch carries several puts and deletes in one record, see NewBatchEntry
+	OpBatch OpType = 2
+	// OpCheckpoint carries state an engine saved at a checkpoint. The value
+	// is up to the engine, the record only has to be replayed by it.
+	OpCheckpoint OpType = 3
 )
 
 // LogEntry represents a single record in the WAL
 type LogEntry struct {
 	Checksum uint32
+	// LSN is the log sequence number assigned by the Writer when the entry is appended.
+	// LSNs start at 1 and increase by one for every record in the log.
+	LSN uint64
 	Timestamp int64
 	Op OpType
 	Key []byte
 	Value []byte
 }
 
-// Encode serializes the entry into a byte slice
-func (e *LogEntry) Encode() []byte {
-	buf := make([]byte, HeaderSize+len(e.Key) + len(e.Value))
+// Encode serializes the entry into a byte slice, checksummed with
+// ChecksumIEEE the way records are stored in log files before
+// FormatMasked. Returns ErrRecordTooLarge if the key or value is over limits.
+func (e *LogEntry) Encode(limits Limits) ([]byte, error) {
+	return e.encode(limits, legacySums, compressor{})
+}
+
+// encode is Encode with the checksums of sums, compressing the value if comp
+// picks it. Limits apply to the value before compression.
+func (e *LogEntry) encode(limits Limits, sums checksummer, comp compressor) ([]byte, error) {
+	if err := limits.checkEntry(e); err != nil {
+		return nil, err
+	}
+
+	value, flags := e.Value, uint8(flagHeaderChecksum)
+	if packed := comp.compress(e.Value); packed != nil {
+		value, flags = packed, flags|flagCompressed
+	}
+
+	size := HeaderSize + HeaderChecksumSize
+	buf := make([]byte, size+len(e.Key) + len(value))
 
 	// Leave space for Checksum at buf[0:4]
-	binary.LittleEndian.PutUint64(buf[4:12], uint64(e.Timestamp))
-	buf[12] = uint8(e.Op)
-	binary.LittleEndian.PutUint32(buf[13:17], uint32(len(e.Key)))
-	binary.LittleEndian.PutUint32(buf[17:21], uint32(len(e.Value)))
+	binary.LittleEndian.PutUint64(buf[4:12], e.LSN)
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(e.Timestamp))
+	buf[20] = uint8(e.Op) | flags
+	binary.LittleEndian.PutUint32(buf[21:25], uint32(len(e.Key)))
+	binary.LittleEndian.PutUint32(buf[25:29], uint32(len(value)))
+	binary.LittleEndian.PutUint32(buf[HeaderSize:size], sums.sum(buf[4:HeaderSize]))
 
-	copy(buf[HeaderSize:], e.Key)
-	copy(buf[HeaderSize+len(e.Key):], e.Value)
+	copy(buf[size:], e.Key)
+	copy(buf[size+len(e.Key):], value)
 
 	// Calculate checksum of everything except the checksum field itself
-	e.Checksum = crc32.ChecksumIEEE(buf[4:])
+	e.Checksum = sums.sum(buf[4:])
 	binary.LittleEndian.PutUint32(buf[0:4], e.Checksum)
 
-	return buf
+	return buf, nil
 }
 
-// DecodeHeader parses the fixed-size portion to help manage memory allocation
-func DecodeHeader(data []byte) (timestamp int64, op OpType, kLen, vLen uint32) {
+// DecodeHeader parses the fixed-size portion to help manage memory allocation.
+// The lengths are only safe to use once checkHeader has accepted the header.
+func DecodeHeader(data []byte) (lsn uint64, timestamp int64, op OpType, kLen, vLen uint32) {
+	lsn = binary.LittleEndian.Uint64(data[4:12])
+	timestamp = int64(binary.LittleEndian.Uint64(data[12:20]))
+	op = OpType(data[20] & opMask)
+	kLen = binary.LittleEndian.Uint32(data[21:25])
+	vLen = binary.LittleEndian.Uint32(data[25:29])
+	return
+}
+
+// Records of FormatBaseline files, from before entries had an LSN, have a
+// shorter header:
+//
+//	4 (CRC) + 8 (TS) + 1 (OP) + 4 (KLen) + 4 (VLen)
+//
+// The CRC is ChecksumIEEE over everything after it, like in later records.
+const baselineHeaderSize = 21
+
+// decodeBaselineHeader is DecodeHeader for a record of a FormatBaseline file
+func decodeBaselineHeader(data []byte) (timestamp int64, op OpType, kLen, vLen uint32) {
 	timestamp = int64(binary.LittleEndian.Uint64(data[4:12]))
 	op = OpType(data[12])
 	kLen = binary.LittleEndian.Uint32(data[13:17])
 	vLen = binary.LittleEndian.Uint32(data[17:21])
 	return
 }
+
+// decodeBaseline is decode for a record of a FormatBaseline file. The entry
+// has no LSN, that is up to whoever numbers the records of the file.
+func decodeBaseline(data []byte, limits Limits) (*LogEntry, int, error) {
+	if len(data) < baselineHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	header := data[:baselineHeaderSize]
+	ts, op, kLen, vLen := decodeBaselineHeader(header)
+	end := int64(len(header)) + int64(kLen) + int64(vLen)
+	if end > int64(len(data)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if err := limits.check(int64(kLen), int64(vLen)); err != nil {
+		return nil, 0, err
+	}
+
+	payload := data[len(header):end]
+	crc := binary.LittleEndian.Uint32(data[0:4])
+	if recordChecksum(header, payload, legacySums) != crc {
+		return nil, 0, ErrCorruption
+	}
+
+	return &LogEntry{
+		Checksum: crc,
+		Timestamp: ts,
+		Op: op,
+		Key: payload[:kLen:kLen],
+		Value: payload[kLen:],
+	}, int(end), nil
+}
+
+// headerLen returns the size of the header of a record from the first
+// HeaderSize bytes of it
+func headerLen(data []byte) int {
+	if data[20]&flagHeaderChecksum != 0 {
+		return HeaderSize + HeaderChecksumSize
+	}
+	return HeaderSize
+}
+
+// checkHeader verifies the checksum of a complete record header, if it has
+// one. Records written before headers were checksummed have none, their
+// lengths are only confirmed by the checksum of the whole record.
+func checkHeader(header []byte, sums checksummer) error {
+	if len(header) == HeaderSize {
+		return nil
+	}
+
+	want := binary.LittleEndian.Uint32(header[HeaderSize:])
+	if sums.sum(header[4:HeaderSize]) != want {
+		return fmt.Errorf("%w: header checksum mismatch", ErrCorruption)
+	}
+	if flags := header[20] &^ opMask; flags&^(flagHeaderChecksum|flagCompressed) != 0 {
+		return fmt.Errorf("%w: unknown record flags %#x", ErrCorruption, flags)
+	}
+	return nil
+}
+
+// recordChecksum is the checksum of a record, taken over everything after the CRC field
+func recordChecksum(header, payload []byte, sums checksummer) uint32 {
+	return sums.sum(header[4:], payload) // Header minus CRC, then Key + Value
+}
+
+// decode parses the record at the start of data and returns it with its
+// size. Returns io.ErrUnexpectedEOF if data ends before the record does.
+func decode(data []byte, limits Limits, sums checksummer) (*LogEntry, int, error) {
+	if len(data) < HeaderSize || len(data) < headerLen(data) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	header := data[:headerLen(data)]
+	if err := checkHeader(header, sums); err != nil {
+		return nil, 0, err
+	}
+
+	lsn, ts, op, kLen, vLen := DecodeHeader(header)
+	end := int64(len(header)) + int64(kLen) + int64(vLen)
+	if end > int64(len(data)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if err := limits.check(int64(kLen), int64(vLen)); err != nil {
+		return nil, 0, err
+	}
+
+	payload := data[len(header):end]
+	crc := binary.LittleEndian.Uint32(data[0:4])
+	if recordChecksum(header, payload, sums) != crc {
+		return nil, 0, ErrCorruption
+	}
+
+	value := payload[kLen:]
+	if header[20]&flagCompressed != 0 {
+		var err error
+		if value, err = decompress(value, limits); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return &LogEntry{
+		Checksum: crc,
+		LSN: lsn,
+		Timestamp: ts,
+		Op: op,
+		Key: payload[:kLen:kLen],
+		Value: value,
+	}, int(end), nil
+}
@@ -0,0 +1,184 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+// fuzzLimits keeps the fuzzers from spending their time on huge allocations
+var fuzzLimits = Limits{MaxKeySize: 1024, MaxValueSize: 64 * 1024}
+
+// fuzzSums picks the checksums of a log file from a fuzzed byte
+func fuzzSums(b uint8) checksummer {
+	return checksummer{alg: Checksum(b%3 + 1), masked: b&4 != 0}
+}
+
+// fuzzCompressor picks how values are compressed from the higher bits of the same byte
+func fuzzCompressor(b uint8) compressor {
+	return compressor{alg: Compression((b >> 3) % 3), minSize: int(b >> 5)}
+}
+
+// Fuzzes that every entry decodes back to itself and that changing any byte of it is caught
+func FuzzRecord(f *testing.F) {
+	f.Add(uint64(1), int64(0), uint8(OpPut), []byte("key"), []byte("value"), uint(0), uint8(1), uint8(0))
+	f.Add(uint64(7), int64(-1), uint8(OpDelete), []byte("key"), []byte(nil), uint(20), uint8(0x80), uint8(5))
+	f.Add(uint64(1<<40), int64(1<<62), uint8(OpBatch), []byte(nil), bytes.Repeat([]byte{0}, 300), uint(27), uint8(0xFF), uint8(6))
+	f.Add(uint64(2), int64(0), uint8(OpPut), []byte("key"), bytes.Repeat([]byte("snappy"), 50), uint(40), uint8(1), uint8(1<<3))
+	f.Add(uint64(3), int64(0), uint8(OpPut), []byte("key"), bytes.Repeat([]byte("zstd"), 80), uint(100), uint8(0x10), uint8(2<<3|5))
+
+	f.Fuzz(func(t *testing.T, lsn uint64, ts int64, op uint8, key, value []byte, pos uint, flip uint8, alg uint8) {
+		sums := fuzzSums(alg)
+		entry := &LogEntry{LSN: lsn, Timestamp: ts, Op: OpType(op % 4), Key: key, Value: value}
+		data, err := entry.encode(fuzzLimits, sums, fuzzCompressor(alg))
+		if err != nil {
+			if fuzzLimits.checkEntry(entry) == nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			return
+		}
+
+		got, n, err := decode(data, fuzzLimits, sums)
+		if err != nil {
+			t.Fatalf("decode failed: %v", err)
+		}
+		if n != len(data) || got.LSN != lsn || got.Timestamp != ts || got.Op != entry.Op ||
+			!bytes.Equal(got.Key, key) || !bytes.Equal(got.Value, value) || got.Checksum != entry.Checksum {
+			t.Fatalf("Got %+v (%d bytes), want %+v (%d bytes)", got, n, entry, len(data))
+		}
+
+		if flip == 0 {
+			return
+		}
+		data[pos%uint(len(data))] ^= flip
+		if got, _, err := decode(data, fuzzLimits, sums); err == nil {
+			t.Fatalf("Flipping %#x at %d went unnoticed, decoded %+v", flip, pos%uint(len(data)), got)
+		}
+	})
+}
+
+// Fuzzes that arbitrary bytes never crash the decoder, and that whatever it
+// accepts is a record Encode would have written
+func FuzzDecode(f *testing.F) {
+	for _, e := range []*LogEntry{
+		{LSN: 1, Op: OpPut, Key: []byte("key"), Value: []byte("value")},
+		{LSN: 2, Op: OpDelete, Key: []byte("key")},
+		NewBatchEntry(3, []*LogEntry{{Op: OpPut, Key: []byte("a"), Value: []byte("1")}, {Op: OpDelete, Key: []byte("b")}}),
+	} {
+		data, _ := e.Encode(Limits{})
+		f.Add(data)
+	}
+	f.Add(make([]byte, HeaderSize))
+	f.Add(bytes.Repeat([]byte{0xFF}, HeaderSize+HeaderChecksumSize))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entry, n, err := decode(data, fuzzLimits, legacySums)
+		if err != nil {
+			return
+		}
+		if n > len(data) || len(entry.Key) > fuzzLimits.MaxKeySize || len(entry.Value) > fuzzLimits.MaxValueSize {
+			t.Fatalf("Accepted %+v from %d bytes", entry, n)
+		}
+
+		// Only records with a header checksum are written today, and Encode never compresses
+		if headerLen(data) == HeaderSize || data[20]&flagCompressed != 0 {
+			return
+		}
+		again, err := entry.Encode(fuzzLimits)
+		if err != nil || !bytes.Equal(again, data[:n]) {
+			t.Fatalf("Re-encoding gave %x (%v), decoded from %x", again, err, data[:n])
+		}
+	})
+}
+
+// Fuzzes that records of any size, starting anywhere in a block, come back
+// whole from their chunks. They are cut up by appendChunks and put back
+// together by assemble, then written by a Writer and read by a Reader.
+func FuzzChunks(f *testing.F) {
+	sizes := func(n ...int) []byte {
+		var b []byte
+		for _, size := range n {
+			b = binary.LittleEndian.AppendUint16(b, uint16(size))
+		}
+		return b
+	}
+	overhead := HeaderSize + HeaderChecksumSize + 1
+	f.Add(uint16(0), sizes(0, 100, 5000), uint8(1))
+	f.Add(uint16(100), sizes(BlockSize, 2*BlockSize-1, 0), uint8(2))
+	// Records that end 0 and ChunkHeaderSize bytes before the end of the first block
+	f.Add(uint16(0), sizes(BlockSize-FileHeaderSize-ChunkHeaderSize-overhead, 10), uint8(3))
+	f.Add(uint16(0), sizes(BlockSize-FileHeaderSize-2*ChunkHeaderSize-overhead, 10, 10), uint8(4))
+
+	f.Fuzz(func(t *testing.T, start uint16, sizes []byte, alg uint8) {
+		var entries []*LogEntry
+		for i := 0; i+2 <= len(sizes) && len(entries) < 16; i += 2 {
+			size := binary.LittleEndian.Uint16(sizes[i:])
+			value := bytes.Repeat([]byte{byte(len(entries))}, int(size))
+			entries = append(entries, &LogEntry{LSN: uint64(len(entries) + 1), Op: OpPut, Key: []byte("k"), Value: value})
+		}
+
+		sums := fuzzSums(alg)
+		base := int64(FileHeaderSize) + int64(start)
+		var data []byte
+		var records [][]byte
+		for _, entry := range entries {
+			record, err := entry.encode(Limits{}, sums, compressor{})
+			if err != nil {
+				t.Fatalf("encode failed: %v", err)
+			}
+			records = append(records, record)
+			data = appendChunks(data, record, base+int64(len(data)), sums)
+		}
+
+		offset := base
+		next := func() (byte, []byte, error) {
+			typ, payload, after, err := chunkAt(data, base, offset, sums)
+			offset = after
+			return typ, payload, err
+		}
+		for i, want := range records {
+			got, err := assemble(next, Limits{}, sums)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("Record %d of %d bytes at offset %d: got %d bytes (%v)", i, len(want), base, len(got), err)
+			}
+		}
+		if _, err := assemble(next, Limits{}, sums); err != io.EOF {
+			t.Fatalf("Expected io.EOF after the last record, got %v", err)
+		}
+
+		// The same through a log file, after a record that moves the rest along if start is set
+		fs := vfs.NewMem()
+		writer, err := Open("wal", Options{FS: fs, Checksum: Checksum(alg%3 + 1)})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		if start > 0 {
+			entries = append([]*LogEntry{{Op: OpPut, Value: make([]byte, start)}}, entries...)
+		}
+		for _, entry := range entries {
+			if _, err := writer.Write(context.Background(), entry); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		writer.Close()
+
+		reader, _ := NewReaderFS(fs, "wal")
+		defer reader.Close()
+		for i, want := range entries {
+			got, err := reader.Next()
+			if err != nil {
+				t.Fatalf("Entry %d of %d bytes: %v", i, len(want.Value), err)
+			}
+			if !bytes.Equal(got.Value, want.Value) {
+				t.Fatalf("Entry %d of %d bytes came back with %d", i, len(want.Value), len(got.Value))
+			}
+		}
+		if _, err := reader.Next(); err != io.EOF {
+			t.Fatalf("Expected io.EOF, got %v", err)
+		}
+	})
+}
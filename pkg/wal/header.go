@@ -0,0 +1,255 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+// Every log file written by this package starts with a header:
+//
+//	8 (Magic) + 2 (Version) + 1 (Checksum) + 1 (Reserved) + 8 (Created) + 8 (FirstLSN) + 4 (CRC)
+//
+// The CRC covers the bytes before it. Records follow right after.
+const FileHeaderSize = 32
+
+const (
+	// FormatBaseline is the version of log files written before records had
+	// an LSN, which have no header either. Their records are numbered as
+	// they are read, on from the record before.
+	FormatBaseline = 0
+
+	// FormatLegacy is the version of log files written once records had an
+	// LSN but before files had a header. They hold records from the first
+	// byte on.
+	FormatLegacy = 1
+
+	// FormatHeader is the version of log files that start with a header.
+	// Their records follow each other back to back.
+	FormatHeader = 2
+
+	// FormatFramed is FormatHeader with records framed into blocks (see
+	// BlockSize). Checksums are stored as they are.
+	FormatFramed = 3
+
+	// FormatMasked is FormatFramed with masked checksums, in whichever
+	// algorithm the header names
+	FormatMasked = 4
+
+	// FormatCompressed is FormatMasked with records whose values may be
+	// compressed (see Options.Compression)
+	FormatCompressed = 5
+
+	// FormatVersion is the version of the log files this package writes
+	FormatVersion = FormatCompressed
+)
+
+// fileMagic starts every log file that has a header
+var fileMagic = []byte("ANCHRWAL")
+
+// ErrUnsupportedFormat is returned for a log file written in a format this
+// package cannot read, normally by a newer version of it
+var ErrUnsupportedFormat = errors.New("wal: unsupported log format")
+
+// FileHeader describes a log file
+type FileHeader struct {
+	// Version is the format the file is written in. Files without a header
+	// are reported as FormatBaseline or FormatLegacy, going by their first
+	// record, and have no other fields set.
+	Version uint16
+
+	// Checksum is the algorithm the records are checksummed with. Before
+	// FormatMasked it is always ChecksumIEEE.
+	Checksum Checksum
+
+	// Created is when the file was started
+	Created time.Time
+
+	// FirstLSN is the LSN the first record in the file has, or will have
+	FirstLSN uint64
+}
+
+// size returns the number of bytes the header takes up at the start of its file
+func (h FileHeader) size() int64 {
+	if h.Version <= FormatLegacy {
+		return 0
+	}
+	return FileHeaderSize
+}
+
+// recordHeaderSize returns the size of the fixed part of the header of the
+// records in the file, before any header checksum
+func (h FileHeader) recordHeaderSize() int {
+	if h.Version == FormatBaseline {
+		return baselineHeaderSize
+	}
+	return HeaderSize
+}
+
+// framed reports whether the records of the file are framed into blocks
+func (h FileHeader) framed() bool {
+	return h.Version >= FormatFramed
+}
+
+// compressed reports whether the records of the file may hold compressed values
+func (h FileHeader) compressed() bool {
+	return h.Version >= FormatCompressed
+}
+
+// sums returns how the checksums in the file are computed
+func (h FileHeader) sums() checksummer {
+	if h.Version < FormatMasked {
+		return legacySums
+	}
+	return checksummer{alg: h.Checksum, masked: true}
+}
+
+// encode serializes the header into FileHeaderSize bytes
+func (h FileHeader) encode() []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf[0:8], fileMagic)
+	binary.LittleEndian.PutUint16(buf[8:10], h.Version)
+	buf[10] = uint8(h.Checksum)
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(h.Created.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[20:28], h.FirstLSN)
+	binary.LittleEndian.PutUint32(buf[28:32], crc32.ChecksumIEEE(buf[:28]))
+	return buf
+}
+
+// newFileHeader returns the header for a new file whose first record is
+// first, checksummed with alg or DefaultChecksum if it is unset
+func newFileHeader(first uint64, alg Checksum) FileHeader {
+	if alg == 0 {
+		alg = DefaultChecksum
+	}
+	return FileHeader{
+		Version: FormatVersion,
+		Checksum: alg,
+		Created: time.Now(),
+		FirstLSN: first,
+	}
+}
+
+// readFileHeader reads the header at the start of r. A file that does not
+// start with the magic has no header and r is left at its start, otherwise
+// r is left right after the header. An empty file has no header yet and
+// returns io.EOF. A header cut short returns io.ErrUnexpectedEOF.
+func readFileHeader(r io.ReadSeeker, path string) (FileHeader, error) {
+	buf := make([]byte, FileHeaderSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF {
+		return FileHeader{}, io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return FileHeader{}, err
+	}
+
+	if m := min(n, len(fileMagic)); !bytes.Equal(buf[:m], fileMagic[:m]) {
+		version, err := headerlessVersion(r)
+		return FileHeader{Version: version}, err
+	}
+	if n < FileHeaderSize {
+		return FileHeader{}, io.ErrUnexpectedEOF
+	}
+
+	if crc32.ChecksumIEEE(buf[:28]) != binary.LittleEndian.Uint32(buf[28:32]) {
+		return FileHeader{}, fmt.Errorf("%w: file header checksum mismatch in %s", ErrCorruption, path)
+	}
+
+	h := FileHeader{
+		Version: binary.LittleEndian.Uint16(buf[8:10]),
+		Checksum: Checksum(buf[10]),
+		Created: time.Unix(0, int64(binary.LittleEndian.Uint64(buf[12:20]))),
+		FirstLSN: binary.LittleEndian.Uint64(buf[20:28]),
+	}
+	if h.Version < FormatHeader || h.Version > FormatVersion {
+		return h, fmt.Errorf("%w: %s has format version %d, only %d to %d can be read",
+			ErrUnsupportedFormat, path, h.Version, FormatHeader, FormatVersion)
+	}
+	if !h.Checksum.valid() || h.Version < FormatMasked && h.Checksum != ChecksumIEEE {
+		return h, fmt.Errorf("%w: %s uses unknown checksum algorithm %d", ErrUnsupportedFormat, path, h.Checksum)
+	}
+	return h, nil
+}
+
+// headerlessVersion tells a FormatBaseline file from a FormatLegacy one by
+// whether its first record is intact in the baseline layout, and leaves r at
+// the start of the file. A file whose first record is damaged either way is
+// taken to be FormatLegacy.
+func headerlessVersion(r io.ReadSeeker) (uint16, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	version := uint16(FormatLegacy)
+	header := make([]byte, baselineHeaderSize)
+	if size >= baselineHeaderSize {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return 0, err
+		}
+		_, _, kLen, vLen := decodeBaselineHeader(header)
+		if n := int64(kLen) + int64(vLen); baselineHeaderSize+n <= size {
+			payload := make([]byte, n)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return 0, err
+			}
+			if recordChecksum(header, payload, legacySums) == binary.LittleEndian.Uint32(header[0:4]) {
+				version = FormatBaseline
+			}
+		}
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	return version, err
+}
+
+// ReadFileHeader returns the header of the log file at path on fs
+func ReadFileHeader(fs vfs.FS, path string) (FileHeader, error) {
+	f, err := vfs.Open(fs, path)
+	if err != nil {
+		return FileHeader{}, err
+	}
+	defer f.Close()
+
+	h, err := readFileHeader(f, path)
+	if err == io.EOF {
+		return h, fmt.Errorf("%w: %s is empty", io.ErrUnexpectedEOF, path)
+	}
+	return h, err
+}
+
+// prepareFile gets the file f at path ready for appending. An empty file
+// gets a header for records starting at first and checksummed with alg,
+// synced before anything can follow it. Returns the header of the file and
+// the number of bytes of records already in it.
+func prepareFile(fs vfs.FS, f vfs.File, path string, first uint64, alg Checksum) (FileHeader, int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return FileHeader{}, 0, err
+	}
+
+	if stat.Size() == 0 {
+		h := newFileHeader(first, alg)
+		if _, err := f.Write(h.encode()); err != nil {
+			return h, 0, err
+		}
+		return h, 0, f.Sync()
+	}
+
+	// Records are appended in the format of the file, whatever its version
+	h, err := ReadFileHeader(fs, path)
+	if err != nil {
+		return h, 0, err
+	}
+	return h, stat.Size() - h.size(), nil
+}
@@ -0,0 +1,306 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+// Tests that every segment starts with a header naming its format and first LSN
+func TestWAL_FileHeader(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	start := time.Now()
+
+	writer, _ := Open(dir, Options{SegmentSize: 256})
+	for i := range 20 {
+		writer.Write(ctx, &LogEntry{Op: OpPut, Key: fmt.Appendf(nil, "key-%02d", i)})
+	}
+	writer.Close()
+
+	segments, _ := listSegments(vfs.OS, dir)
+	if len(segments) < 2 {
+		t.Fatalf("Expected several segments, got %d", len(segments))
+	}
+	for _, s := range segments {
+		h, err := ReadFileHeader(vfs.OS, s.path)
+		if err != nil {
+			t.Fatalf("ReadFileHeader failed: %v", err)
+		}
+		if h.Version != FormatVersion || h.Checksum != DefaultChecksum || h.FirstLSN != s.base || h.Created.Before(start.Add(-time.Second)) {
+			t.Errorf("Unexpected header for %s: %+v", s.path, h)
+		}
+	}
+
+	if keys := readAllFS(t, vfs.OS, dir); len(keys) != 20 {
+		t.Errorf("Expected 20 entries after the headers, got %d", len(keys))
+	}
+}
+
+// Tests that a log written by a newer format version is refused instead of misread
+func TestWAL_UnsupportedVersion(t *testing.T) {
+	dir := t.TempDir()
+
+	h := newFileHeader(1, 0)
+	h.Version = FormatVersion + 1
+	os.WriteFile(filepath.Join(dir, segmentName(1)), h.encode(), 0644)
+
+	reader, _ := NewReader(dir)
+	defer reader.Close()
+	if _, err := reader.Next(); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat from the reader, got %v", err)
+	}
+
+	if _, err := Open(dir, Options{}); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat from the writer, got %v", err)
+	}
+
+	// Versions before FormatHeader never had a header, so one that claims
+	// such a version is refused with the range that can be read
+	h.Version = FormatLegacy
+	path := filepath.Join(dir, segmentName(1))
+	os.WriteFile(path, h.encode(), 0644)
+	want := fmt.Sprintf("only %d to %d can be read", FormatHeader, FormatVersion)
+	if _, err := ReadFileHeader(vfs.OS, path); !errors.Is(err, ErrUnsupportedFormat) || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected ErrUnsupportedFormat saying %q, got %v", want, err)
+	}
+}
+
+// Tests that segments written in older formats are read and appended to as they are
+func TestWAL_ReadOlderFormats(t *testing.T) {
+	for _, version := range []uint16{FormatLegacy, FormatHeader, FormatFramed, FormatMasked} {
+		t.Run(fmt.Sprint(version), func(t *testing.T) {
+			dir := t.TempDir()
+			ctx := context.Background()
+
+			var old []byte
+			h := FileHeader{Version: FormatLegacy}
+			if version != FormatLegacy {
+				h = newFileHeader(1, ChecksumIEEE)
+				h.Version = version
+				old = h.encode()
+			}
+			for i := range 3 {
+				data, _ := (&LogEntry{LSN: uint64(i + 1), Op: OpPut, Key: fmt.Appendf(nil, "old-%d", i)}).encode(Limits{}, h.sums(), compressor{})
+				if h.framed() {
+					data = appendChunks(nil, data, int64(len(old)), h.sums())
+				}
+				old = append(old, data...)
+			}
+			path := filepath.Join(dir, segmentName(1))
+			os.WriteFile(path, old, 0644)
+
+			// Values appended to the old segment stay uncompressed, which its
+			// version promises. The second one fills it and goes to a new
+			// segment in the current format instead.
+			value := bytes.Repeat([]byte("compressible "), 100)
+			writer, err := Open(dir, Options{Compression: CompressionSnappy, SegmentSize: 2000})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			writer.Write(ctx, &LogEntry{Op: OpPut, Key: []byte("appended"), Value: value})
+			writer.Write(ctx, &LogEntry{Op: OpPut, Key: []byte("rotated"), Value: value})
+			writer.Close()
+
+			if h, err := ReadFileHeader(vfs.OS, path); err != nil || h.Version != version {
+				t.Errorf("Expected the old segment to keep version %d, got %+v (%v)", version, h, err)
+			}
+			if data, _ := os.ReadFile(path); !bytes.Contains(data, value) {
+				t.Error("Expected the value appended to the old segment to be stored as it is")
+			}
+			segments, _ := Segments(dir)
+			if h, err := ReadFileHeader(vfs.OS, segments[len(segments)-1]); err != nil || h.Version != FormatVersion {
+				t.Errorf("Expected the new segment to have version %d, got %+v (%v)", FormatVersion, h, err)
+			}
+
+			keys := readAllFS(t, vfs.OS, dir)
+			want := []string{"old-0", "old-1", "old-2", "appended", "rotated"}
+			if fmt.Sprint(keys) != fmt.Sprint(want) {
+				t.Errorf("Got %v, want %v", keys, want)
+			}
+		})
+	}
+}
+
+// encodeBaseline encodes e the way records were written before they had an LSN
+func encodeBaseline(e *LogEntry) []byte {
+	buf := make([]byte, baselineHeaderSize+len(e.Key)+len(e.Value))
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(e.Timestamp))
+	buf[12] = uint8(e.Op)
+	binary.LittleEndian.PutUint32(buf[13:17], uint32(len(e.Key)))
+	binary.LittleEndian.PutUint32(buf[17:21], uint32(len(e.Value)))
+	copy(buf[baselineHeaderSize:], e.Key)
+	copy(buf[baselineHeaderSize+len(e.Key):], e.Value)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// Tests that records from before LSNs are read and numbered in order, and
+// that new records never end up in the same file as them
+func TestWAL_ReadBaseline(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	var old []byte
+	for i := range 3 {
+		old = append(old, encodeBaseline(&LogEntry{Timestamp: int64(i), Op: OpPut, Key: fmt.Appendf(nil, "old-%d", i), Value: []byte("v")})...)
+	}
+	old = append(old, encodeBaseline(&LogEntry{Op: OpDelete, Key: []byte("old-1")})...)
+	path := filepath.Join(dir, segmentName(0))
+	os.WriteFile(path, old, 0644)
+
+	if h, err := ReadFileHeader(vfs.OS, path); err != nil || h.Version != FormatBaseline {
+		t.Fatalf("Expected FormatBaseline, got %+v (%v)", h, err)
+	}
+
+	reader, _ := NewReader(path)
+	for i := range 4 {
+		entry, err := reader.Next()
+		if err != nil || entry.LSN != uint64(i+1) {
+			t.Fatalf("Entry %d: got %+v (%v)", i, entry, err)
+		}
+		if i == 3 && (entry.Op != OpDelete || string(entry.Key) != "old-1") {
+			t.Errorf("Expected the delete of old-1, got %+v", entry)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	reader.Close()
+
+	if _, err := NewWriter(path); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat appending to the file, got %v", err)
+	}
+
+	// A segmented log carries on in a new segment numbered after the old records
+	writer, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	lsn, _ := writer.Write(ctx, &LogEntry{Op: OpPut, Key: []byte("new")})
+	writer.Close()
+	if data, _ := os.ReadFile(path); lsn != 5 || !bytes.Equal(data, old) {
+		t.Errorf("Expected LSN 5 in a new segment, got %d", lsn)
+	}
+
+	reader, _ = NewReader(dir)
+	defer reader.Close()
+	for i, want := range []string{"old-0", "old-1", "old-2", "old-1", "new"} {
+		entry, err := reader.Next()
+		if err != nil || string(entry.Key) != want || entry.LSN != uint64(i+1) {
+			t.Fatalf("Entry %d: got %+v (%v), want %s", i, entry, err, want)
+		}
+	}
+}
+
+// Tests that log files written by earlier releases, before files had a
+// header, read back and can be carried on. The files in testdata were
+// written by NewWriter of those releases: baseline.wal before records had
+// an LSN, legacy.wal once they did and legacy-header-checksum.wal once
+// record headers were checksummed too.
+func TestWAL_PreHeaderFixtures(t *testing.T) {
+	want := []LogEntry{
+		{LSN: 1, Timestamp: 1, Op: OpPut, Key: []byte("alpha"), Value: []byte("1")},
+		{LSN: 2, Timestamp: 2, Op: OpPut, Key: []byte("beta"), Value: bytes.Repeat([]byte("b"), 1000)},
+		{LSN: 3, Timestamp: 3, Op: OpDelete, Key: []byte("alpha")},
+		{LSN: 4, Timestamp: 4, Op: OpPut, Key: []byte("gamma"), Value: []byte("3")},
+	}
+
+	for _, tt := range []struct {
+		name string
+		version uint16
+	}{
+		{"baseline.wal", FormatBaseline},
+		{"legacy.wal", FormatLegacy},
+		{"legacy-header-checksum.wal", FormatLegacy},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			path := filepath.Join(dir, segmentName(1))
+			os.WriteFile(path, data, 0644)
+
+			if h, err := ReadFileHeader(vfs.OS, path); err != nil || h.Version != tt.version {
+				t.Fatalf("Expected version %d, got %+v (%v)", tt.version, h, err)
+			}
+
+			writer, err := Open(dir, Options{})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if lsn, err := writer.Write(context.Background(), &LogEntry{Timestamp: 5, Op: OpPut, Key: []byte("new")}); err != nil || lsn != 5 {
+				t.Fatalf("Expected the next entry to get LSN 5, got %d (%v)", lsn, err)
+			}
+			writer.Close()
+
+			reader, _ := NewReader(dir)
+			defer reader.Close()
+			for _, w := range append(want, LogEntry{LSN: 5, Timestamp: 5, Op: OpPut, Key: []byte("new")}) {
+				got, err := reader.Next()
+				if err != nil {
+					t.Fatalf("Entry %d: %v", w.LSN, err)
+				}
+				if got.LSN != w.LSN || got.Timestamp != w.Timestamp || got.Op != w.Op || !bytes.Equal(got.Key, w.Key) || !bytes.Equal(got.Value, w.Value) {
+					t.Errorf("Got %+v, want %+v", got, w)
+				}
+			}
+			if _, err := reader.Next(); err != io.EOF {
+				t.Errorf("Expected io.EOF, got %v", err)
+			}
+		})
+	}
+}
+
+// Tests that a segment whose header was cut short by a crash reads as a torn tail
+func TestWAL_TornFileHeader(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	writer, _ := Open(dir, Options{})
+	writer.SyncWrite(ctx, &LogEntry{Op: OpPut, Key: []byte("kept")})
+	writer.Rotate()
+	writer.Close()
+
+	segments, _ := Segments(dir)
+	newest := segments[len(segments)-1]
+	os.Truncate(newest, 10)
+
+	reader, _ := NewReader(dir)
+	if entry, err := reader.Next(); err != nil || string(entry.Key) != "kept" {
+		t.Fatalf("Expected the entry before the torn segment, got %v", err)
+	}
+	if _, err := reader.Next(); err != io.ErrUnexpectedEOF || reader.CurrentFile() != newest || reader.RecordOffset() != 0 {
+		t.Errorf("Expected a torn tail at the start of %s, got %v at %s:%d", newest, err, reader.CurrentFile(), reader.RecordOffset())
+	}
+	reader.Close()
+
+	// Once recovery cuts the torn header off, the writer starts the segment over
+	os.Truncate(newest, 0)
+	writer, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	writer.SyncWrite(ctx, &LogEntry{Op: OpPut, Key: []byte("after")})
+	writer.Close()
+
+	if h, err := ReadFileHeader(vfs.OS, newest); err != nil || h.FirstLSN != 2 {
+		t.Errorf("Expected a fresh header starting at LSN 2, got %+v (%v)", h, err)
+	}
+	if keys := readAllFS(t, vfs.OS, dir); len(keys) != 2 || keys[1] != "after" {
+		t.Errorf("Got %v", keys)
+	}
+}
@@ -0,0 +1,131 @@
+package wal
+
+import (
+	"time"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+const (
+	// DefaultSegmentSize is the size at which a segment is rotated when Options.SegmentSize is unset
+	DefaultSegmentSize = 64 * 1024 * 1024 // 64MB
+
+	// DefaultSyncEveryN is used by SyncEveryN when Options.SyncEveryN is unset
+	DefaultSyncEveryN = 100
+
+	// DefaultSyncInterval is used by SyncInterval when Options.SyncInterval is unset
+	DefaultSyncInterval = 100 * time.Millisecond
+)
+
+// SyncPolicy decides when entries appended with Write are forced to disk.
+// SyncWrite always forces its entry to disk regardless of the policy.
+type SyncPolicy uint8
+
+const (
+	// SyncAlways fsyncs after every entry, nothing acknowledged is ever lost
+	SyncAlways SyncPolicy = iota
+
+	// SyncEveryN fsyncs once every Options.SyncEveryN entries,
+	// a crash loses at most the last N-1 acknowledged entries
+	SyncEveryN
+
+	// SyncInterval fsyncs from a background goroutine every Options.SyncInterval,
+	// a crash loses at most one interval worth of entries
+	SyncInterval
+
+	// SyncNever leaves it to the OS, entries reach disk when the buffer fills,
+	// a segment is rotated or the writer is closed
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncEveryN:
+		return "every-n"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	default:
+		return "unknown"
+	}
+}
+
+// RecoveryMode decides what reading a log back does with damaged records.
+// A torn final record, the normal result of a crash in the middle of a
+// write, is dropped in every mode.
+type RecoveryMode uint8
+
+const (
+	// RecoverStrict fails on the first damaged record
+	RecoverStrict RecoveryMode = iota
+
+	// RecoverTruncateTail also drops a corrupt record at the end of the log,
+	// as long as no valid record follows it. Damage anywhere else still fails.
+	RecoverTruncateTail
+
+	// RecoverSkipCorrupted passes over damaged bytes anywhere in the log and
+	// carries on at the next valid record. The records in the skipped ranges
+	// are lost, see Reader.Skipped.
+	RecoverSkipCorrupted
+)
+
+func (m RecoveryMode) String() string {
+	switch m {
+	case RecoverStrict:
+		return "strict"
+	case RecoverTruncateTail:
+		return "truncate-tail"
+	case RecoverSkipCorrupted:
+		return "skip-corrupted"
+	default:
+		return "unknown"
+	}
+}
+
+// Options configures a segmented WAL opened with Open
+type Options struct {
+	// SegmentSize is the size in bytes after which the active segment is
+	// closed and a new one is started. A single record larger than this
+	// still gets written, it just ends up alone in its segment.
+	SegmentSize int64
+
+	// GroupCommit lets concurrent SyncWrite callers share a single fsync.
+	// Each call still only returns once its own entry is on disk.
+	GroupCommit bool
+
+	// Sync is the durability policy applied to Write. The zero value is SyncAlways.
+	Sync SyncPolicy
+
+	// SyncEveryN is the number of entries between fsyncs for SyncEveryN
+	SyncEveryN int
+
+	// SyncInterval is the time between background fsyncs for SyncInterval
+	SyncInterval time.Duration
+
+	// FS is the filesystem the log is kept on, vfs.OS if nil
+	FS vfs.FS
+
+	// Limits bounds the keys and values Write accepts, and the records a
+	// Reader opened with OpenReader reads back
+	Limits Limits
+
+	// Recovery is what a Reader opened with OpenReader does with damaged
+	// records. The zero value is RecoverStrict.
+	Recovery RecoveryMode
+
+	// Checksum is the algorithm new segments are checksummed with,
+	// DefaultChecksum if unset. Segments already on disk keep their own.
+	Checksum Checksum
+
+	// Compression is the codec values are compressed with. The zero value
+	// is CompressionNone. Values are only stored compressed when that makes
+	// them smaller, and never in segments written before FormatCompressed.
+	Compression Compression
+
+	// CompressMinSize is the smallest value in bytes that gets compressed,
+	// DefaultCompressMinSize if unset
+	CompressMinSize int
+}
@@ -4,68 +4,518 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
-	"os"
+
+	"com.github/mune-0/anchor/pkg/vfs"
 )
 
 var ErrCorruption = errors.New("wal: data corruption detected (checksum mismatch)")
 
 type Reader struct {
-	file *os.File
+	fs vfs.FS
+	file vfs.File
+
+	// Segment files still to be read after file, oldest first
+	pending []segment
+	path string
+
+	// Size of path when last checked, see fits
+	size int64
+
+	// Whether the file header of path has been read, see readHeader, and
+	// what it says about the format of the records
+	headerRead bool
+	header FileHeader
+
+	// Offset in path at which the record last handled by Next starts
+	start int64
+
+	// Entry read ahead by Seek, returned by the next call to Next
+	peeked *LogEntry
+
+	// Largest records Next accepts
+	limits Limits
+
+	// What Next does with damaged records, and the ranges it skipped
+	mode RecoveryMode
+	skipped []Damage
+
+	// LSN of the last entry read, a resynced record has to come after it
+	last uint64
 }
 
+// Damage is a range of a log file that Next passed over because it held no
+// valid record
+type Damage struct {
+	Path string
+	Offset int64
+	Length int64
+
+	// Err is what was wrong with the first record in the range
+	Err error
+}
+
+// NewReader opens a log for reading. path is either a single log file or a
+// directory of segments written by Open, in which case the segments are read
+// back to back in order as if they were one file.
 func NewReader(path string) (*Reader, error) {
-	f, err := os.Open(path)
+	return NewReaderFS(vfs.OS, path)
+}
+
+// NewReaderFS is NewReader on the filesystem fs
+func NewReaderFS(fs vfs.FS, path string) (*Reader, error) {
+	stat, err := fs.Stat(path)
 	if err != nil {
 		return nil, err
 	}
-	return &Reader{file: f}, nil
+
+	segments := []segment{{path: path}}
+	if stat.IsDir() {
+		if segments, err = listSegments(fs, path); err != nil {
+			return nil, err
+		}
+		if len(segments) == 0 {
+			return &Reader{fs: fs}, nil
+		}
+	}
+
+	r := &Reader{fs: fs, pending: segments[1:]}
+	if err := r.open(segments[0].path); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OpenReader opens the segmented log in dir for reading. opts.FS,
+// opts.Limits and opts.Recovery apply, the rest only matter to writers.
+func OpenReader(dir string, opts Options) (*Reader, error) {
+	r, err := NewReaderFS(vfs.Default(opts.FS), dir)
+	if err != nil {
+		return nil, err
+	}
+	r.limits = opts.Limits
+	r.mode = opts.Recovery
+	return r, nil
+}
+
+// open switches the reader over to the file at path
+func (r *Reader) open(path string) error {
+	f, err := vfs.Open(r.fs, path)
+	if err != nil {
+		return err
+	}
+	r.file = f
+	r.path = path
+	r.size = 0
+	r.headerRead = false
+	r.header = FileHeader{}
+	return nil
 }
 
 // Next reads the next entry from the log. Returns io.EOF at end of file.
+// A torn final record returns io.ErrUnexpectedEOF, and RecordOffset tells
+// where it starts. What happens on a damaged record depends on the
+// RecoveryMode the reader was opened with, by default it is ErrCorruption.
 func (r *Reader) Next() (*LogEntry, error) {
+	if r.peeked != nil {
+		entry := r.peeked
+		r.peeked = nil
+		return entry, nil
+	}
+
+	for {
+		entry, err := r.read()
+		if err == nil {
+			r.last = entry.LSN
+			return entry, nil
+		}
+		if err != io.ErrUnexpectedEOF && !errors.Is(err, ErrCorruption) {
+			return nil, err
+		}
+		if err := r.salvage(err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// read reads the record at the current position
+func (r *Reader) read() (*LogEntry, error) {
+	if r.file == nil {
+		return nil, io.EOF
+	}
+	if !r.headerRead {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+	r.start = r.CurrentOffset()
+	if r.header.framed() {
+		return r.readFramed()
+	}
+
 	// 1. Read the Fixed Header
-	headerBuf := make([]byte, HeaderSize)
+	headerBuf := make([]byte, r.header.recordHeaderSize(), HeaderSize+HeaderChecksumSize)
 	if _, err := io.ReadFull(r.file, headerBuf); err != nil {
+		if err == io.EOF && len(r.pending) > 0 {
+			// Clean end of this segment, carry on with the next one
+			if err := r.advance(); err != nil {
+				return nil, err
+			}
+			return r.read()
+		}
+		if err == io.ErrUnexpectedEOF && len(r.pending) > 0 {
+			// Only the newest segment can have a torn tail, sealed ones were synced
+			return nil, fmt.Errorf("%w: truncated record in sealed segment %s", ErrCorruption, r.path)
+		}
 		return nil, err // Returns io.EOF or io.ErrUnexpectedEOF
 	}
+	if r.header.Version == FormatBaseline {
+		return r.readBaseline(headerBuf)
+	}
 
-	// 2. Parse Header
+	// 2. Check and Parse Header, before its lengths are used for anything
+	if n := headerLen(headerBuf); n > HeaderSize {
+		headerBuf = headerBuf[:n]
+		if _, err := io.ReadFull(r.file, headerBuf[HeaderSize:]); err != nil {
+			return nil, r.torn(err)
+		}
+	}
+	if err := checkHeader(headerBuf, r.header.sums()); err != nil {
+		return nil, fmt.Errorf("%w at offset %d", err, r.start)
+	}
 	expectedCRC := binary.LittleEndian.Uint32(headerBuf[0:4])
-	ts, op, kLen, vLen := DecodeHeader(headerBuf)
-	
+	lsn, ts, op, kLen, vLen := DecodeHeader(headerBuf)
+
 	// 3. Read Variable Data (Key + Value)
-	payloadSize := int(kLen + vLen)
+	payloadSize := int64(kLen) + int64(vLen)
+	if err := r.fits(payloadSize); err != nil {
+		return nil, r.torn(err)
+	}
+	if err := r.limits.check(int64(kLen), int64(vLen)); err != nil {
+		return nil, fmt.Errorf("%w at offset %d", err, r.start)
+	}
 	payloadBuf := make([]byte, payloadSize)
 	if _, err := io.ReadFull(r.file, payloadBuf); err != nil {
-		return nil, err
+		return nil, r.torn(err)
 	}
 
 	// 4. Verify Integrity
-	// Checksum was calculated on everything AFTER the CRC field
-	h := crc32.NewIEEE()
-	h.Write(headerBuf[4:]) // Header minus CRC
-	h.Write(payloadBuf) // Key + Value
-
-	if h.Sum32() != expectedCRC {
+	if recordChecksum(headerBuf, payloadBuf, r.header.sums()) != expectedCRC {
 		return nil, fmt.Errorf("%w: at offset %d", ErrCorruption, r.CurrentOffset())
 	}
 
+	// 5. Decompress the Value
+	value := payloadBuf[kLen:]
+	if headerBuf[20]&flagCompressed != 0 {
+		var err error
+		if value, err = decompress(value, r.limits); err != nil {
+			return nil, fmt.Errorf("%w at offset %d", err, r.start)
+		}
+	}
+
 	return &LogEntry {
 		Checksum: expectedCRC,
+		LSN: lsn,
+		Timestamp: ts,
+		Op: op,
+		Key: payloadBuf[:kLen:kLen],
+		Value: value,
+	}, nil
+}
+
+// readBaseline reads the rest of the record of a FormatBaseline file whose
+// header is headerBuf. It gets the LSN after the last entry read.
+func (r *Reader) readBaseline(headerBuf []byte) (*LogEntry, error) {
+	expectedCRC := binary.LittleEndian.Uint32(headerBuf[0:4])
+	ts, op, kLen, vLen := decodeBaselineHeader(headerBuf)
+
+	payloadSize := int64(kLen) + int64(vLen)
+	if err := r.fits(payloadSize); err != nil {
+		return nil, r.torn(err)
+	}
+	if err := r.limits.check(int64(kLen), int64(vLen)); err != nil {
+		return nil, fmt.Errorf("%w at offset %d", err, r.start)
+	}
+	payloadBuf := make([]byte, payloadSize)
+	if _, err := io.ReadFull(r.file, payloadBuf); err != nil {
+		return nil, r.torn(err)
+	}
+
+	if recordChecksum(headerBuf, payloadBuf, legacySums) != expectedCRC {
+		return nil, fmt.Errorf("%w: at offset %d", ErrCorruption, r.CurrentOffset())
+	}
+
+	return &LogEntry{
+		Checksum: expectedCRC,
+		LSN: r.last + 1,
 		Timestamp: ts,
 		Op: op,
-		Key: payloadBuf[:kLen],
+		Key: payloadBuf[:kLen:kLen],
 		Value: payloadBuf[kLen:],
 	}, nil
 }
 
+// readHeader reads the file header of the current file and leaves the file
+// at its first record
+func (r *Reader) readHeader() error {
+	r.headerRead = true
+	r.start = 0
+
+	h, err := readFileHeader(r.file, r.path)
+	r.header = h
+	switch {
+	case err == io.EOF:
+		// Empty, reading the first record finds the end of the file. The
+		// header is read again next time, in case the file has grown.
+		r.headerRead = false
+		return nil
+	case err == io.ErrUnexpectedEOF:
+		// A crash while the segment was being started
+		return r.torn(err)
+	}
+	return err
+}
+
+// fits returns io.ErrUnexpectedEOF if fewer than n bytes are left in the
+// current file. A torn or garbled header can claim gigabytes of payload,
+// which must not be allocated just to find out the file ends first.
+func (r *Reader) fits(n int64) error {
+	offset := r.CurrentOffset()
+	if offset+n <= r.size {
+		return nil
+	}
+
+	// The file may have grown since it was last looked at
+	stat, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	r.size = stat.Size()
+	if offset+n > r.size {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// torn turns a failure to read the payload of a record into the error Next returns
+func (r *Reader) torn(err error) error {
+	// A header without its payload is a torn record, not a clean end of log
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == io.ErrUnexpectedEOF && len(r.pending) > 0 {
+		return fmt.Errorf("%w: truncated record in sealed segment %s", ErrCorruption, r.path)
+	}
+	return err
+}
+
+// salvage decides what Next does after cause, the failure to read the
+// record at r.start. It returns nil if Next can carry on with the next
+// valid record, having noted the bytes passed over in r.skipped.
+func (r *Reader) salvage(cause error) error {
+	next, err := r.resync()
+	if err != nil {
+		return err
+	}
+
+	if next < 0 && len(r.pending) == 0 {
+		// Nothing valid follows, the damage is the tail of the log
+		if cause == io.ErrUnexpectedEOF || r.mode != RecoverStrict {
+			return io.ErrUnexpectedEOF
+		}
+		return cause
+	}
+
+	if cause == io.ErrUnexpectedEOF {
+		// Cut short by a length running past the end of the file, which was
+		// garbled since a valid record comes after it
+		cause = fmt.Errorf("%w: record at offset %d in %s overruns the file", ErrCorruption, r.start, r.path)
+	}
+	if r.mode != RecoverSkipCorrupted {
+		return cause
+	}
+
+	if next < 0 {
+		// Nothing valid in the rest of this segment, carry on with the next one
+		if next, err = r.file.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	} else if _, err := r.file.Seek(next, io.SeekStart); err != nil {
+		return err
+	}
+	r.skipped = append(r.skipped, Damage{Path: r.path, Offset: r.start, Length: next - r.start, Err: cause})
+	return nil
+}
+
+// resyncWindow is how much of a file resync reads at a time. Looking past
+// damage must not cost memory in proportion to the rest of the segment.
+const resyncWindow = 2 * BlockSize
+
+// resync returns the offset of the first valid record after r.start in the
+// current file, or -1 if there is none. Only records newer than the last one
+// read count, so a log entry stored inside a value cannot be mistaken for one.
+func (r *Reader) resync() (int64, error) {
+	stat, err := r.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if r.header.framed() {
+		// Chunks are followed from the damaged record on
+		return r.resyncFramed()
+	}
+
+	// Windows overlap by a record header, so that one cut off at the end
+	// of a window is looked at in the next
+	size := stat.Size()
+	stride := int64(resyncWindow - HeaderSize - HeaderChecksumSize)
+	window := make([]byte, resyncWindow)
+	for base := r.start + 1; base < size; base += stride {
+		n, err := r.file.ReadAt(window, base)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := int64(0); i < stride && i < int64(n); i++ {
+			length, ok := r.recordSize(window[i:n])
+			if !ok || base+i+length > size {
+				continue
+			}
+
+			record := window[i:n]
+			if i+length > int64(n) {
+				// Only a record whose header holds up is read in full
+				record = make([]byte, length)
+				if _, err := r.file.ReadAt(record, base+i); err != nil && err != io.EOF {
+					return 0, err
+				}
+			}
+			if r.validRecord(record[:length], r.last) {
+				return base + i, nil
+			}
+		}
+	}
+	return -1, nil
+}
+
+// recordSize returns the size of the record whose header starts data, if
+// that header holds up on its own: its checksum if it has one, the limits
+// and, in files that have them, an LSN above the last one read
+func (r *Reader) recordSize(data []byte) (int64, bool) {
+	if r.header.Version == FormatBaseline {
+		if len(data) < baselineHeaderSize {
+			return 0, false
+		}
+		_, _, kLen, vLen := decodeBaselineHeader(data)
+		return baselineHeaderSize + int64(kLen) + int64(vLen), r.allows(kLen, vLen)
+	}
+
+	if len(data) < HeaderSize || len(data) < headerLen(data) {
+		return 0, false
+	}
+	header := data[:headerLen(data)]
+	if checkHeader(header, r.header.sums()) != nil {
+		return 0, false
+	}
+	lsn, _, _, kLen, vLen := DecodeHeader(header)
+	if lsn <= r.last || !r.allows(kLen, vLen) {
+		return 0, false
+	}
+	return int64(len(header)) + int64(kLen) + int64(vLen), true
+}
+
+// allows is Limits.check without building an error for every offset tried
+func (r *Reader) allows(kLen, vLen uint32) bool {
+	maxKey, maxValue := r.limits.max()
+	return int64(kLen) <= maxKey && int64(vLen) <= maxValue
+}
+
+// validRecord reports whether data starts with a complete record with
+// matching checksums and an LSN above after
+func (r *Reader) validRecord(data []byte, after uint64) bool {
+	if r.header.Version == FormatBaseline {
+		// Baseline records have no LSN to go by
+		_, _, err := decodeBaseline(data, r.limits)
+		return err == nil
+	}
+	entry, _, err := decode(data, r.limits, r.header.sums())
+	return err == nil && entry.LSN > after
+}
+
+// Skipped returns the damaged ranges Next has passed over, in the order it
+// came across them. Only a reader in RecoverSkipCorrupted mode skips any.
+func (r *Reader) Skipped() []Damage {
+	return r.skipped
+}
+
+// advance closes the current segment and opens the next pending one
+func (r *Reader) advance() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	next := r.pending[0]
+	r.pending = r.pending[1:]
+	return r.open(next.path)
+}
+
+// Seek skips forward so that the next call to Next returns the first entry
+// with an LSN greater than or equal to lsn. On a segmented log, segments that
+// end before lsn are skipped without being read. Seeking past the end of the
+// log is not an error, Next simply returns io.EOF.
+// Seek only moves forward, it cannot return to entries already read.
+func (r *Reader) Seek(lsn uint64) error {
+	if r.peeked != nil {
+		if r.peeked.LSN >= lsn {
+			return nil
+		}
+		r.peeked = nil
+	}
+
+	// Every record in the current segment is below the base of the next one
+	for len(r.pending) > 0 && r.pending[0].base <= lsn {
+		if err := r.advance(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.LSN >= lsn {
+			r.peeked = entry
+			return nil
+		}
+	}
+}
+
+// CurrentOffset returns the read position within the current file
 func (r *Reader) CurrentOffset() int64 {
+	if r.file == nil {
+		return 0
+	}
 	offset, _ := r.file.Seek(0, io.SeekCurrent)
 	return offset
 }
 
+// RecordOffset returns the offset in CurrentFile of the record last returned
+// or rejected by Next. After a torn or corrupt record this is where the
+// damage begins.
+func (r *Reader) RecordOffset() int64 {
+	return r.start
+}
+
+// CurrentFile returns the path of the file being read, which for a segmented
+// log is the segment that CurrentOffset refers to
+func (r *Reader) CurrentFile() string {
+	return r.path
+}
+
 func (r *Reader) Close() error {
+	if r.file == nil {
+		return nil
+	}
 	return r.file.Close()
 }
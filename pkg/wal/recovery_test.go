@@ -0,0 +1,162 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+// Tests what each recovery mode makes of damage in the middle and at the end of the log
+func TestWAL_RecoveryModes(t *testing.T) {
+	// Offset of the key in a record, which fits in a single chunk
+	const headerSize = ChunkHeaderSize + HeaderSize + HeaderChecksumSize
+	const recordSize = headerSize + len("key-00") + len("value")
+
+	tests := []struct {
+		name string
+		// segment to damage, -1 for the newest one
+		segment int
+		// offset of the damaged byte after the file header, from the end of the segment if negative
+		offset int
+		// entries read and final error for RecoverStrict, RecoverTruncateTail and RecoverSkipCorrupted
+		entries [3]int
+		errs [3]error
+	}{
+		{
+			name: "sealed segment",
+			segment: 0,
+			offset: 2*recordSize + headerSize,
+			entries: [3]int{2, 2, 19},
+			errs: [3]error{ErrCorruption, ErrCorruption, io.EOF},
+		},
+		{
+			name: "middle of newest segment",
+			segment: -1,
+			offset: headerSize,
+			entries: [3]int{18, 18, 19},
+			errs: [3]error{ErrCorruption, ErrCorruption, io.EOF},
+		},
+		{
+			// Caught before the length is used, as it runs past the end of the block
+			name: "garbled chunk length",
+			segment: -1,
+			offset: 5,
+			entries: [3]int{18, 18, 19},
+			errs: [3]error{ErrCorruption, ErrCorruption, io.EOF},
+		},
+		{
+			name: "tail",
+			segment: -1,
+			offset: -1,
+			entries: [3]int{19, 19, 19},
+			errs: [3]error{ErrCorruption, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF},
+		},
+	}
+
+	for _, tt := range tests {
+		for i, mode := range []RecoveryMode{RecoverStrict, RecoverTruncateTail, RecoverSkipCorrupted} {
+			t.Run(fmt.Sprintf("%s/%s", tt.name, mode), func(t *testing.T) {
+				fs := vfs.NewMem()
+				writer, err := Open("wal", Options{SegmentSize: int64(6 * recordSize), FS: fs})
+				if err != nil {
+					t.Fatalf("Open failed: %v", err)
+				}
+				for i := range 20 {
+					writer.Write(context.Background(), &LogEntry{Op: OpPut, Key: fmt.Appendf(nil, "key-%02d", i), Value: []byte("value")})
+				}
+				writer.Close()
+
+				segments, _ := SegmentsFS(fs, "wal")
+				path := segments[(tt.segment+len(segments))%len(segments)]
+				f, _ := fs.OpenFile(path, os.O_RDWR, 0644)
+				info, _ := f.Stat()
+				offset := int64(tt.offset) + FileHeaderSize
+				if tt.offset < 0 {
+					offset = int64(tt.offset) + info.Size()
+				}
+				f.WriteAt([]byte{0xFF}, offset)
+				f.Close()
+
+				reader, err := OpenReader("wal", Options{FS: fs, Recovery: mode})
+				if err != nil {
+					t.Fatalf("OpenReader failed: %v", err)
+				}
+				defer reader.Close()
+
+				entries := 0
+				for {
+					_, err = reader.Next()
+					if err != nil {
+						break
+					}
+					entries++
+				}
+
+				if entries != tt.entries[i] || !errors.Is(err, tt.errs[i]) {
+					t.Errorf("Read %d entries ending in %v, want %d ending in %v", entries, err, tt.entries[i], tt.errs[i])
+				}
+
+				skipped := reader.Skipped()
+				if mode != RecoverSkipCorrupted || tt.offset < 0 {
+					if len(skipped) != 0 {
+						t.Errorf("Expected nothing skipped, got %+v", skipped)
+					}
+					return
+				}
+				if len(skipped) != 1 || skipped[0].Path != path || skipped[0].Length != int64(recordSize) || !errors.Is(skipped[0].Err, ErrCorruption) {
+					t.Errorf("Expected the damaged record to be skipped, got %+v", skipped)
+				}
+			})
+		}
+	}
+}
+
+// Tests that resync finds the record after a damaged one wherever it falls
+// relative to the windows the file is read in
+func TestWAL_ResyncWindows(t *testing.T) {
+	h := newFileHeader(1, ChecksumIEEE)
+	h.Version = FormatHeader
+	encode := func(lsn uint64, value []byte) []byte {
+		data, _ := (&LogEntry{LSN: lsn, Op: OpPut, Key: fmt.Appendf(nil, "key-%d", lsn), Value: value}).encode(Limits{}, h.sums(), compressor{})
+		return data
+	}
+
+	// The scan starts a byte into the damaged record, so the next one starts
+	// size-1 bytes into it: in the overlap of the first two windows or just past
+	stride := resyncWindow - HeaderSize - HeaderChecksumSize
+	overhead := len(encode(2, nil))
+	for size := stride - 40; size <= stride+5; size++ {
+		damaged := encode(2, bytes.Repeat([]byte{'v'}, size-overhead))
+		damaged[0] ^= 0xFF
+		data := append(h.encode(), encode(1, nil)...)
+		data = append(data, damaged...)
+		data = append(data, encode(3, []byte("after"))...)
+
+		path := filepath.Join(t.TempDir(), "log")
+		os.WriteFile(path, data, 0644)
+		reader, err := OpenReader(path, Options{Recovery: RecoverSkipCorrupted})
+		if err != nil {
+			t.Fatalf("OpenReader failed: %v", err)
+		}
+		var keys []string
+		for {
+			entry, err := reader.Next()
+			if err != nil {
+				break
+			}
+			keys = append(keys, string(entry.Key))
+		}
+		reader.Close()
+
+		if fmt.Sprint(keys) != "[key-1 key-3]" {
+			t.Errorf("Damaged record of %d bytes: got %v", size, keys)
+		}
+	}
+}
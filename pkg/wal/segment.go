@@ -0,0 +1,117 @@
+package wal
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+// SegmentExt is the file extension used for WAL segments
+const SegmentExt = ".wal"
+
+// segment is a single numbered file in a WAL directory
+type segment struct {
+	// base is the LSN of the first record stored in the segment.
+	// Records are numbered from 1 in the order they are appended to the log.
+	base uint64
+	path string
+}
+
+// segmentName returns the file name for a segment starting at base.
+// Names are zero-padded so that lexical order matches numeric order.
+func segmentName(base uint64) string {
+	return fmt.Sprintf("%020d%s", base, SegmentExt)
+}
+
+// listSegments returns all segments in dir ordered from oldest to newest
+func listSegments(fs vfs.FS, dir string) ([]segment, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, SegmentExt) {
+			continue
+		}
+
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, SegmentExt), 10, 64)
+		if err != nil {
+			continue // Not one of ours
+		}
+		segments = append(segments, segment{base: base, path: filepath.Join(dir, name)})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].base < segments[j].base
+	})
+	return segments, nil
+}
+
+// ImportFile makes the log file at path, written by NewWriter, the first
+// segment of the log in dir, so that a log from before it was split into
+// segments can be carried on with Open. The file is moved, not copied. dir
+// must not hold any segments yet, since there is no telling how the records
+// of the file would be numbered against theirs.
+func ImportFile(fs vfs.FS, path, dir string) error {
+	segments, err := listSegments(fs, dir)
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		return fmt.Errorf("wal: cannot import %s, %s already holds segments from %s on", path, dir, segments[0].path)
+	}
+
+	// Records of a file without an LSN are numbered from 1, like a new log
+	if err := fs.Rename(path, filepath.Join(dir, segmentName(1))); err != nil {
+		return err
+	}
+	return fs.SyncDir(dir)
+}
+
+// Segments returns the paths of all segments in dir ordered from oldest to newest
+func Segments(dir string) ([]string, error) {
+	return SegmentsFS(vfs.OS, dir)
+}
+
+// SegmentsFS is Segments on the filesystem fs
+func SegmentsFS(fs vfs.FS, dir string) ([]string, error) {
+	segments, err := listSegments(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(segments))
+	for i, s := range segments {
+		paths[i] = s.path
+	}
+	return paths, nil
+}
+
+// lastLSN returns the LSN of the last complete record in a log file, or 0 if it has none
+func lastLSN(fs vfs.FS, path string) (uint64, error) {
+	r, err := NewReaderFS(fs, path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	// Records past a damaged one still hold their LSNs, which must not be handed out again
+	r.mode = RecoverSkipCorrupted
+
+	var lsn uint64
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			// Anything past the last good record is left for recovery to deal with
+			return lsn, nil
+		}
+		lsn = entry.LSN
+	}
+}
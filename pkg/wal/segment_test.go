@@ -0,0 +1,210 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"com.github/mune-0/anchor/pkg/vfs"
+)
+
+// Tests that a segmented writer rotates once a segment is full and the reader walks all of them in order
+func TestWAL_SegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	writer, err := Open(dir, Options{SegmentSize: 256})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	for i := range 50 {
+		entry := &LogEntry{Op: OpPut, Key: []byte(fmt.Sprintf("key-%02d", i)), Value: []byte("value")}
+		if _, err := writer.Write(ctx, entry); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	writer.Close()
+
+	segments, _ := Segments(dir)
+	if len(segments) < 2 {
+		t.Fatalf("Expected several segments, got %d", len(segments))
+	}
+
+	reader, err := NewReader(dir)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	defer reader.Close()
+
+	for i := range 50 {
+		entry, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Entry %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("key-%02d", i); string(entry.Key) != want {
+			t.Fatalf("Entry %d: got key %s, want %s", i, entry.Key, want)
+		}
+	}
+
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF after last segment, got %v", err)
+	}
+}
+
+// Tests that reopening a segmented log keeps appending where it left off
+func TestWAL_SegmentReopen(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	writer, _ := Open(dir, Options{SegmentSize: 128})
+	for range 10 {
+		writer.Write(ctx, &LogEntry{Key: []byte("before"), Value: []byte("restart")})
+	}
+	writer.Close()
+
+	writer, _ = Open(dir, Options{SegmentSize: 128})
+	for range 10 {
+		writer.Write(ctx, &LogEntry{Key: []byte("after"), Value: []byte("restart")})
+	}
+	writer.Close()
+
+	// Segment names must keep increasing across restarts
+	segments, _ := listSegments(vfs.OS, dir)
+	for i := 1; i < len(segments); i++ {
+		if segments[i].base <= segments[i-1].base {
+			t.Fatalf("Segment %s does not follow %s", segments[i].path, segments[i-1].path)
+		}
+	}
+
+	reader, _ := NewReader(dir)
+	defer reader.Close()
+
+	count := 0
+	for {
+		if _, err := reader.Next(); err != nil {
+			break
+		}
+		count++
+	}
+	if count != 20 {
+		t.Errorf("Expected 20 entries, got %d", count)
+	}
+}
+
+// Tests that checkpointed segments can be removed without touching newer records
+func TestWAL_RemoveBefore(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	writer, _ := Open(dir, Options{SegmentSize: 128})
+	defer writer.Close()
+
+	for i := range 30 {
+		writer.Write(ctx, &LogEntry{Key: []byte(fmt.Sprintf("key-%02d", i)), Value: []byte("value")})
+	}
+	writer.Sync()
+
+	before, _ := listSegments(vfs.OS, dir)
+	if len(before) < 3 {
+		t.Fatalf("Expected at least 3 segments, got %d", len(before))
+	}
+
+	// Everything below the third segment's first record is checkpointed
+	removed, err := writer.RemoveBefore(before[2].base)
+	if err != nil {
+		t.Fatalf("RemoveBefore failed: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("Expected 2 segments removed, got %d", removed)
+	}
+
+	after, _ := listSegments(vfs.OS, dir)
+	if len(after) != len(before)-2 || after[0].base != before[2].base {
+		t.Errorf("Unexpected segments left behind: %v", after)
+	}
+
+	// The active segment survives even if everything is checkpointed
+	writer.RemoveBefore(^uint64(0))
+	if left, _ := listSegments(vfs.OS, dir); len(left) != 1 {
+		t.Errorf("Expected only the active segment to remain, got %d", len(left))
+	}
+}
+
+// Tests that a reader can resume from an arbitrary LSN across segments
+func TestWAL_SeekLSN(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	writer, _ := Open(dir, Options{SegmentSize: 128})
+	for i := range 40 {
+		writer.Write(ctx, &LogEntry{Key: []byte(fmt.Sprintf("key-%02d", i)), Value: []byte("value")})
+	}
+	writer.Close()
+
+	for _, lsn := range []uint64{1, 17, 33, 40} {
+		reader, _ := NewReader(dir)
+
+		if err := reader.Seek(lsn); err != nil {
+			t.Fatalf("Seek(%d) failed: %v", lsn, err)
+		}
+
+		entry, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Next after Seek(%d) failed: %v", lsn, err)
+		}
+		if entry.LSN != lsn {
+			t.Errorf("Seek(%d) landed on LSN %d", lsn, entry.LSN)
+		}
+		if want := fmt.Sprintf("key-%02d", lsn-1); string(entry.Key) != want {
+			t.Errorf("Seek(%d) returned key %s, want %s", lsn, entry.Key, want)
+		}
+		reader.Close()
+	}
+
+	// Seeking past the end is allowed and just yields EOF
+	reader, _ := NewReader(dir)
+	defer reader.Close()
+
+	if err := reader.Seek(100); err != nil {
+		t.Fatalf("Seek past end failed: %v", err)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+// Tests that Rotate starts a new segment on demand and skips empty ones
+func TestWAL_Rotate(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	writer, _ := Open(dir, Options{})
+	defer writer.Close()
+
+	for i := range 3 {
+		writer.Write(ctx, &LogEntry{Key: []byte(fmt.Sprintf("key-%d", i)), Value: []byte("value")})
+	}
+
+	base, err := writer.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if base != 4 {
+		t.Errorf("Expected new segment to start at LSN 4, got %d", base)
+	}
+
+	// Nothing was written since, so there is nothing to seal
+	if again, _ := writer.Rotate(); again != base {
+		t.Errorf("Expected empty segment to be kept at %d, got %d", base, again)
+	}
+	if segments, _ := listSegments(vfs.OS, dir); len(segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(segments))
+	}
+
+	writer.Write(ctx, &LogEntry{Key: []byte("key-3"), Value: []byte("value")})
+	if removed, _ := writer.RemoveBefore(base); removed != 1 {
+		t.Errorf("Expected the sealed segment to be removed, got %d", removed)
+	}
+}
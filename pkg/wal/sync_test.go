@@ -0,0 +1,121 @@
+package wal
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// readCount returns how many complete entries can currently be read back from dir
+func readCount(dir string) int {
+	reader, err := NewReader(dir)
+	if err != nil {
+		return 0
+	}
+	defer reader.Close()
+
+	n := 0
+	for {
+		if _, err := reader.Next(); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+// Tests that each sync policy makes buffered writes visible on disk when it promises to
+func TestWAL_SyncPolicies(t *testing.T) {
+	ctx := context.Background()
+	entry := func() *LogEntry {
+		return &LogEntry{Key: []byte("key"), Value: []byte("value")}
+	}
+
+	t.Run("Always", func(t *testing.T) {
+		dir := t.TempDir()
+		writer, _ := Open(dir, Options{Sync: SyncAlways})
+		defer writer.Close()
+
+		writer.Write(ctx, entry())
+		if n := readCount(dir); n != 1 {
+			t.Errorf("Expected entry on disk right after Write, got %d", n)
+		}
+	})
+
+	t.Run("EveryN", func(t *testing.T) {
+		dir := t.TempDir()
+		writer, _ := Open(dir, Options{Sync: SyncEveryN, SyncEveryN: 3})
+		defer writer.Close()
+
+		writer.Write(ctx, entry())
+		writer.Write(ctx, entry())
+		if n := readCount(dir); n != 0 {
+			t.Errorf("Expected nothing on disk before the 3rd write, got %d", n)
+		}
+
+		writer.Write(ctx, entry())
+		if n := readCount(dir); n != 3 {
+			t.Errorf("Expected 3 entries on disk after the 3rd write, got %d", n)
+		}
+	})
+
+	t.Run("Interval", func(t *testing.T) {
+		dir := t.TempDir()
+		writer, _ := Open(dir, Options{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond})
+		defer writer.Close()
+
+		writer.Write(ctx, entry())
+
+		deadline := time.Now().Add(2 * time.Second)
+		for readCount(dir) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("Background flusher never synced the entry")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+
+	t.Run("Never", func(t *testing.T) {
+		dir := t.TempDir()
+		writer, _ := Open(dir, Options{Sync: SyncNever})
+
+		writer.Write(ctx, entry())
+		if n := readCount(dir); n != 0 {
+			t.Errorf("Expected entry to stay buffered, got %d on disk", n)
+		}
+
+		// SyncWrite ignores the policy
+		writer.SyncWrite(ctx, entry())
+		if n := readCount(dir); n != 2 {
+			t.Errorf("Expected SyncWrite to flush everything, got %d on disk", n)
+		}
+
+		writer.Write(ctx, entry())
+		writer.Close()
+		if n := readCount(dir); n != 3 {
+			t.Errorf("Expected Close to flush everything, got %d on disk", n)
+		}
+	})
+}
+
+// Tests that Close stops the background flusher and flushes what is left
+func TestWAL_IntervalClose(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// Long enough that only Close can be responsible for the data reaching disk
+	writer, _ := Open(dir, Options{Sync: SyncInterval, SyncInterval: time.Hour})
+	writer.Write(ctx, &LogEntry{Key: []byte("key"), Value: []byte("value")})
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if n := readCount(dir); n != 1 {
+		t.Errorf("Expected 1 entry after Close, got %d", n)
+	}
+
+	segments, _ := Segments(dir)
+	if info, _ := os.Stat(segments[0]); info.Size() == 0 {
+		t.Error("Segment is still empty after Close")
+	}
+}
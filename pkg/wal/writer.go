@@ -2,35 +2,226 @@ package wal
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
 	"context"
+	"time"
+
+	"com.github/mune-0/anchor/pkg/vfs"
 )
 
 type Writer struct {
-	file *os.File
+	fs vfs.FS
+	file vfs.File
 	writer *bufio.Writer
 	mut sync.RWMutex
+
+	// Only used by segmented writers (see Open)
+	dir string
+	opts Options
+	segments []segment
+	size int64 // bytes of records in the active segment, not counting its header
+	header FileHeader // of the active file, which decides how records are written to it
+	nextLSN uint64 // LSN of the next record
+
+	// Entries written since the last fsync
+	unsynced int
+
+	// Background flusher for SyncInterval, stopped by Close
+	stop chan struct{}
+	flusherDone chan struct{}
+
+	// Group commit state (see commit.go)
+	queueMut sync.Mutex
+	queue []*commitRequest
+	leading bool
+
+	// syncErr is the first fsync failure, or the failure of a group commit
+	// that had already appended part of its batch. Once set, every later
+	// write fails, because the kernel may have dropped the dirty pages it was
+	// holding or the file may end in records reported as failed.
+	syncErr error
 }
 
+// NewWriter opens a single log file for appending. Write only buffers entries,
+// use SyncWrite or Sync to force them to disk.
 func NewWriter(path string) (*Writer, error) {
+	return NewWriterFS(vfs.OS, path)
+}
+
+// NewWriterFS is NewWriter on the filesystem fs
+func NewWriterFS(fs vfs.FS, path string) (*Writer, error) {
 	// Open for appending, create if missing
-	f, err := os.OpenFile(path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	f, err := fs.OpenFile(path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Continue numbering after the last record already in the file
+	last, err := lastLSN(fs, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	h, size, err := prepareFile(fs, f, path, last+1, DefaultChecksum)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
+	if h.Version == FormatBaseline {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s holds records without an LSN, it can only be read", ErrUnsupportedFormat, path)
+	}
 
 	return &Writer {
+		fs: fs,
 		file: f,
 		writer: bufio.NewWriterSize(f, 64*1024), // 64KB buffer
+		opts: Options{Sync: SyncNever},
+		size: size,
+		header: h,
+		nextLSN: last + 1,
 	}, nil
 }
 
-// Write appends an entry to the buffer
-func (w *Writer) Write(ctx context.Context, entry *LogEntry) error {
+// Open opens a segmented WAL in dir, creating the directory if needed.
+// Appends go to the newest segment until it grows past opts.SegmentSize,
+// at which point a new numbered segment is started.
+// When Write forces entries to disk is decided by opts.Sync.
+func Open(dir string, opts Options) (*Writer, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.SyncEveryN <= 0 {
+		opts.SyncEveryN = DefaultSyncEveryN
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+
+	if opts.CompressMinSize <= 0 {
+		opts.CompressMinSize = DefaultCompressMinSize
+	}
+
+	if opts.Checksum != 0 && !opts.Checksum.valid() {
+		return nil, fmt.Errorf("%w: unknown checksum algorithm %d", ErrUnsupportedFormat, opts.Checksum)
+	}
+	if !opts.Compression.valid() {
+		return nil, fmt.Errorf("%w: unknown compression codec %d", ErrUnsupportedFormat, opts.Compression)
+	}
+
+	fs := vfs.Default(opts.FS)
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		fs: fs,
+		dir: dir,
+		opts: opts,
+		segments: segments,
+		nextLSN: 1,
+	}
+
+	if len(segments) == 0 {
+		if err := w.openSegment(w.nextLSN); err != nil {
+			return nil, err
+		}
+		w.startFlusher()
+		return w, nil
+	}
+
+	// Continue numbering after the last record in the newest segment
+	last := segments[len(segments)-1]
+	lsn, err := lastLSN(fs, last.path)
+	if err != nil {
+		return nil, err
+	}
+	w.nextLSN = last.base
+	if lsn != 0 {
+		w.nextLSN = lsn + 1
+	}
+
+	f, err := fs.OpenFile(last.path, os.O_APPEND | os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// A crash can leave the newest segment without its header
+	h, size, err := prepareFile(fs, f, last.path, w.nextLSN, opts.Checksum)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if h.Version == FormatBaseline {
+		// Records with an LSN cannot follow ones without, they go to a new segment
+		f.Close()
+		if err := w.openSegment(w.nextLSN); err != nil {
+			return nil, err
+		}
+		w.startFlusher()
+		return w, nil
+	}
+
+	w.file = f
+	w.writer = bufio.NewWriterSize(f, 64*1024)
+	w.size = size
+	w.header = h
+	w.startFlusher()
+	return w, nil
+}
+
+// startFlusher launches the background fsync loop if the sync policy needs one
+func (w *Writer) startFlusher() {
+	if w.opts.Sync != SyncInterval {
+		return
+	}
+
+	w.stop = make(chan struct{})
+	w.flusherDone = make(chan struct{})
+	go w.flushLoop()
+}
+
+// flushLoop syncs the log every SyncInterval until Close is called
+func (w *Writer) flushLoop() {
+	defer close(w.flusherDone)
+
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mut.Lock()
+			if w.unsynced > 0 {
+				// Failures are kept in w.syncErr and reported by the next write
+				w.sync()
+			}
+			w.mut.Unlock()
+		}
+	}
+}
+
+// Write appends an entry and returns its LSN. Whether the entry is on disk
+// when Write returns depends on the sync policy the writer was opened with.
+// An entry over the writer's Limits is refused with ErrRecordTooLarge.
+func (w *Writer) Write(ctx context.Context, entry *LogEntry) (uint64, error) {
 	// Check context before acquiring lock
 	if err := ctx.Err(); err != nil {
-		return  err
+		return 0, err
+	}
+	if err := w.opts.Limits.checkEntry(entry); err != nil {
+		return 0, err
 	}
 
 	w.mut.Lock()
@@ -38,18 +229,46 @@ func (w *Writer) Write(ctx context.Context, entry *LogEntry) error {
 
 	// Check context after acquiring lock
 	if err := ctx.Err(); err != nil {
-		return err
+		return 0, err
 	}
 
-	data := entry.Encode()
-	_, err := w.writer.Write(data)
-	return err
+	if w.syncErr != nil {
+		return 0, w.syncErr
+	}
+
+	if err := w.append(entry); err != nil {
+		return 0, err
+	}
+
+	w.unsynced++
+	switch w.opts.Sync {
+	case SyncAlways:
+		if err := w.sync(); err != nil {
+			return 0, err
+		}
+	case SyncEveryN:
+		if w.unsynced >= w.opts.SyncEveryN {
+			if err := w.sync(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return entry.LSN, nil
 }
 
-func (w *Writer) SyncWrite(ctx context.Context, entry *LogEntry) error {
+// SyncWrite appends an entry and waits until it is on disk. Returns the entry's LSN.
+func (w *Writer) SyncWrite(ctx context.Context, entry *LogEntry) (uint64, error) {
 	// Checking context before acquiring lock
 	if err := ctx.Err(); err != nil {
-		return err
+		return 0, err
+	}
+	// An entry that cannot be written must not fail a whole group commit
+	if err := w.opts.Limits.checkEntry(entry); err != nil {
+		return 0, err
+	}
+
+	if w.opts.GroupCommit {
+		return w.groupSyncWrite(ctx, entry)
 	}
 
 	w.mut.Lock()
@@ -57,35 +276,209 @@ func (w *Writer) SyncWrite(ctx context.Context, entry *LogEntry) error {
 
 	// Checking context after acquiring lock
 	if err := ctx.Err(); err != nil {
-		return err
+		return 0, err
 	}
 
-	data := entry.Encode()
+	if w.syncErr != nil {
+		return 0, w.syncErr
+	}
 
 	// Write to the OS buffer
-	if _, err := w.writer.Write(data); err != nil {
+	if err := w.append(entry); err != nil {
+		return 0, err
+	}
+
+	if err := w.sync(); err != nil {
+		return 0, err
+	}
+	return entry.LSN, nil
+}
+
+// append stamps the entry with the next LSN and writes it, rotating to a new
+// segment first if the active one is full. Caller must hold w.mut.
+func (w *Writer) append(entry *LogEntry) error {
+	entry.LSN = w.nextLSN
+	data, err := w.encode(entry)
+	if err != nil {
 		return err
 	}
 
-	// 1. Flush bufio to the OS
-	if err := w.writer.Flush(); err != nil {
+	if w.dir != "" && w.size > 0 && w.size+int64(len(data)) > w.opts.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+		// The new segment may checksum and compress records differently
+		if data, err = w.encode(entry); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.writer.Write(data)
+	w.size += int64(n)
+	if err != nil {
 		return err
 	}
 
-	// 2. Fsync forces the disk controller to commit to physical media
-	// This is the "Durability" in ACID.
-	return w.file.Sync()
+	w.nextLSN++
+	return nil
+}
+
+// encode returns entry the way it is written at the end of the active file
+func (w *Writer) encode(entry *LogEntry) ([]byte, error) {
+	record, err := entry.encode(w.opts.Limits, w.header.sums(), w.compressor())
+	if err != nil {
+		return nil, err
+	}
+	if !w.header.framed() {
+		return record, nil
+	}
+	return appendChunks(nil, record, FileHeaderSize+w.size, w.header.sums()), nil
+}
+
+// compressor returns how values are compressed in the active file. Files
+// from before compression keep all of theirs as they are, so that the
+// version in their header still describes them.
+func (w *Writer) compressor() compressor {
+	if !w.header.compressed() {
+		return compressor{}
+	}
+	return compressor{alg: w.opts.Compression, minSize: w.opts.CompressMinSize}
+}
+
+// LastLSN returns the LSN of the most recently appended entry, or 0 if the log is empty
+func (w *Writer) LastLSN() uint64 {
+	w.mut.RLock()
+	defer w.mut.RUnlock()
+	return w.nextLSN - 1
+}
+
+// Rotate seals the active segment and starts a new one, so that everything
+// appended so far can later be dropped with RemoveBefore. Returns the LSN the
+// new segment starts at. An empty active segment is kept as it is.
+func (w *Writer) Rotate() (uint64, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.dir == "" {
+		return 0, errors.New("wal: cannot rotate a single-file log")
+	}
+
+	if w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	return w.nextLSN, nil
+}
+
+// rotate seals the active segment and starts a new one. Caller must hold w.mut.
+func (w *Writer) rotate() error {
+	// The old segment must be durable before anything lands in the next one,
+	// otherwise a crash could leave a hole in the middle of the log
+	if err := w.sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.openSegment(w.nextLSN)
+}
+
+// openSegment creates a new empty segment starting at base and makes it active
+func (w *Writer) openSegment(base uint64) error {
+	path := filepath.Join(w.dir, segmentName(base))
+
+	f, err := w.fs.OpenFile(path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	h, _, err := prepareFile(w.fs, f, path, base, w.opts.Checksum)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.fs.SyncDir(w.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.writer = bufio.NewWriterSize(f, 64*1024)
+	w.size = 0
+	w.header = h
+	w.segments = append(w.segments, segment{base: base, path: path})
+	return nil
+}
+
+// RemoveBefore deletes every sealed segment whose records all have an LSN
+// below lsn. It is meant to be called once everything up to lsn has
+// been checkpointed elsewhere. The active segment is never removed.
+// Returns the number of segments deleted.
+func (w *Writer) RemoveBefore(lsn uint64) (int, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.dir == "" {
+		return 0, nil
+	}
+
+	removed := 0
+	// A segment only holds records below the base of the segment after it
+	for len(w.segments) > 1 && w.segments[1].base <= lsn {
+		if err := w.fs.Remove(w.segments[0].path); err != nil {
+			return removed, err
+		}
+		w.segments = w.segments[1:]
+		removed++
+	}
+
+	if removed > 0 {
+		return removed, w.fs.SyncDir(w.dir)
+	}
+	return 0, nil
 }
 
 // Sync flushes the buffer to the OS and forces a disk write
 func (w *Writer) Sync() error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	return w.sync()
+}
+
+// sync is Sync for callers already holding w.mut
+func (w *Writer) sync() error {
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+
+	// 1. Flush bufio to the OS
 	if err := w.writer.Flush(); err != nil {
 		return err
 	}
-	return w.file.Sync()
+
+	// 2. Fsync forces the disk controller to commit to physical media
+	// This is the "Durability" in ACID.
+	if err := w.file.Sync(); err != nil {
+		w.syncErr = err
+		return err
+	}
+
+	w.unsynced = 0
+	return nil
 }
 
+// Close stops the background flusher, syncs whatever is still buffered and closes the file
 func (w *Writer) Close() error {
-	w.Sync()
+	if w.stop != nil {
+		close(w.stop)
+		<-w.flusherDone
+		w.stop = nil
+	}
+
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	w.sync()
 	return w.file.Close()
 }